@@ -2,11 +2,13 @@ package bot
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"strings"
+	"path/filepath"
 	"time"
 
 	n "github.com/dyng/nosdaily/nostr"
+	"github.com/dyng/nosdaily/relay"
 	"github.com/dyng/nosdaily/service"
 	"github.com/dyng/nosdaily/types"
 	"github.com/ethereum/go-ethereum/log"
@@ -24,45 +26,68 @@ const (
 )
 
 type BotApplication struct {
-	Bot    *Bot
-	config *types.Config
-	Worker *Worker
+	Bot      *Bot
+	Client   *n.Client
+	config   *types.Config
+	Worker   *Worker
+	commands *Router
 }
 
 type Bot struct {
 	client  n.IClient
 	service service.IService
 	config  *types.Config
-	SK      string
+	signer  n.Signer
 	pub     string
+	// the newest private messages handled, nil to receive them from now on
+	cursor *n.MessageCursor
 }
 
-func NewBotApplication(config *types.Config, service *service.Service) *BotApplication {
+func NewBotApplication(config *types.Config, service *service.Service, pool *relay.Pool) *BotApplication {
 	ctx := context.Background()
 
-	client, err := n.NewClient(ctx, config.Bot.Relays, config.Bot.ListenTo)
+	queue, err := n.NewPublishQueue(config.Bot.Publish, filepath.Join(config.Objects.Root, "outbox"))
 	if err != nil {
 		panic(err)
 	}
 
-	bot, err := NewBot(ctx, client, service, config)
+	client, err := n.NewClient(ctx, config.Bot.Relays, config.Bot.ListenTo, pool, config.Bot.PublishQuorum, queue, config.Bot.Publish.RateLimit)
 	if err != nil {
 		panic(err)
 	}
 
-	worker, err := NewWorker(ctx, client, service, config)
+	signer, err := newSigner(ctx, config.Bot, pool)
 	if err != nil {
 		panic(err)
 	}
 
-	return &BotApplication{
+	bot, err := NewBot(ctx, client, service, config, signer)
+	if err != nil {
+		panic(err)
+	}
+	bot.cursor, err = n.OpenMessageCursor(filepath.Join(config.Objects.Root, "messages.json"))
+	if err != nil {
+		panic(err)
+	}
+
+	worker, err := NewWorker(ctx, client, service, config, signer)
+	if err != nil {
+		panic(err)
+	}
+
+	ba := &BotApplication{
 		Bot:    bot,
+		Client: client,
 		config: config,
 		Worker: worker,
 	}
+	ba.commands = ba.newRouter()
+	return ba
 }
 
 func (ba *BotApplication) Run(ctx context.Context) error {
+	go ba.Client.RetryQueued(ctx)
+
 	c, err := ba.Bot.Listen(ctx)
 	if err != nil {
 		logger.Crit("cannot listen to subscribe messages", "err", err)
@@ -77,6 +102,17 @@ func (ba *BotApplication) Run(ctx context.Context) error {
 		logger.Info("running cron job")
 		ba.Worker.Run(ctx)
 	})
+	if digest := ba.config.Bot.Digest; digest.Main {
+		logger.Info("register main digest cron job", "schedule", digest.Schedule)
+		_, err := cr.AddFunc(digest.Schedule, func() {
+			if err := ba.Worker.DigestMain(ctx); err != nil {
+				logger.Error("failed to publish digest of main channel", "err", err)
+			}
+		})
+		if err != nil {
+			logger.Crit("invalid digest schedule", "schedule", digest.Schedule, "err", err)
+		}
+	}
 	cr.Start()
 
 	logger.Info("start listening to subscribe messages...")
@@ -87,61 +123,208 @@ func (ba *BotApplication) Run(ctx context.Context) error {
 	go func(c <-chan nostr.Event) {
 		for ev := range c {
 			logger.Info("received mentioning event", "event", ev.Content)
-			if strings.Contains(ev.Content, "#subscribe") {
-				logger.Info("preparing channel", "pubkey", ev.PubKey)
-				channelSK, new, err := ba.Bot.GetOrCreateSubscription(ctx, ev.PubKey)
-				if err != nil {
-					logger.Warn("failed to create channel", "pubkey", ev.PubKey, "err", err)
-					continue
-				}
-
-				if new {
-					err := ba.Bot.SendWelcomeMessage(ctx, channelSK, ev.PubKey)
-					if err != nil {
-						logger.Error("failed to send welcome message", "pubkey", ev.PubKey, "err", err)
-					} else {
-						logger.Info("sent welcome message to new subscriber", "pubkey", ev.PubKey)
-					}
-				} else {
-					restored, err := ba.Bot.RestoreSubscription(ctx, ev.PubKey)
-					if err != nil {
-						logger.Warn("failed to restore subscription", "pubkey", ev.PubKey, "err", err)
-					}
-
-					if restored {
-						logger.Info("sending welcome message to returning subscriber", "pubkey", ev.PubKey)
-						err := ba.Bot.SendWelcomeMessage(ctx, channelSK, ev.PubKey)
-						if err != nil {
-							logger.Warn("failed to send welcome message returning subscriber", "pubkey", ev.PubKey, "err", err)
-						}
-					} else {
-						logger.Info("skip welcome message for existing subscriber", "pubkey", ev.PubKey)
-					}
-				}
-
-				// prepare initial content for first subscription
-				err = ba.Worker.Push(ctx, ev.PubKey, channelSK, PushInterval, PushSize, false)
-				if err != nil {
-					logger.Error("failed to prepare initial content", "pubkey", ev.PubKey, "err", err)
-				}
-			} else if strings.Contains(ev.Content, "#unsubscribe") {
-				logger.Warn("unsubscribing", "pubkey", ev.PubKey)
-				ba.Bot.TerminateSubscription(ctx, ev.PubKey)
-			}
+			ba.handleMention(ctx, ev)
 		}
 
 		done <- struct{}{}
 	}(c)
 
+	go func(messages <-chan n.DirectMessage) {
+		for msg := range messages {
+			logger.Info("received private message", "sender", msg.Sender, "format", msg.Format, "id", msg.ID)
+			ba.handleMessage(ctx, msg)
+			ba.Bot.MessageHandled(msg)
+		}
+	}(ba.Bot.ListenMessages(ctx))
+
 	<-done
 	cr.Stop()
 	logger.Info("bot exiting...")
 	return nil
 }
 
-func NewBot(ctx context.Context, client n.IClient, service service.IService, config *types.Config) (*Bot, error) {
-	sk := config.Bot.SK
-	pub, err := nostr.GetPublicKey(sk)
+// newRouter registers the commands subscribers can send to the bot.
+func (ba *BotApplication) newRouter() *Router {
+	r := NewRouter()
+	r.Handle("subscribe", "get your own curated feed", ba.subscribe)
+	r.Handle("unsubscribe", "stop your feed", ba.unsubscribe)
+	r.Handle("status", "show your subscription and channel", ba.status)
+	r.Handle("prefs", "show how your feed is delivered", ba.preferences)
+	r.Handle("set", "change how your feed is delivered, e.g. #set interval daily", ba.setPreference)
+	r.Handle("help", "list the commands", func(ctx context.Context, cmd Command) (string, error) {
+		return r.Help(), nil
+	})
+	return r
+}
+
+// handleMention runs the command of a note mentioning the bot and replies
+// to it in the thread of the note.
+func (ba *BotApplication) handleMention(ctx context.Context, ev nostr.Event) {
+	if ev.PubKey == ba.Bot.Pubkey() {
+		return
+	}
+
+	cmd, ok := ParseCommand(ev.Content, ev.Tags)
+	if !ok {
+		// a command not in front is ambiguous, tell how to send it
+		if ba.commands.Mentioned(ev.Content) {
+			ba.reply(ctx, ev, "Not sure what you mean, put the command first, e.g. \"#subscribe\".\n\n"+ba.commands.Help())
+		}
+		return
+	}
+	cmd.Sender = ev.PubKey
+
+	if reply := ba.runCommand(ctx, cmd); reply != "" {
+		ba.reply(ctx, ev, reply)
+	}
+}
+
+// handleMessage runs the command of a private message to the bot and
+// answers it privately.
+func (ba *BotApplication) handleMessage(ctx context.Context, msg n.DirectMessage) {
+	if msg.Sender == ba.Bot.Pubkey() {
+		return
+	}
+
+	cmd, ok := ParseCommand(msg.Content, nil)
+	if !ok {
+		// all private messages are meant for the bot
+		ba.replyMessage(ctx, msg, "Hi! Send me a command, e.g. \"#subscribe\".\n\n"+ba.commands.Help())
+		return
+	}
+	cmd.Sender = msg.Sender
+	cmd.Private = true
+
+	if reply := ba.runCommand(ctx, cmd); reply != "" {
+		ba.replyMessage(ctx, msg, reply)
+	}
+}
+
+func (ba *BotApplication) runCommand(ctx context.Context, cmd Command) string {
+	logger.Info("running command", "command", cmd.Name, "pubkey", cmd.Sender, "private", cmd.Private)
+	reply, err := ba.commands.Dispatch(ctx, cmd)
+	if err != nil {
+		logger.Error("failed to run command", "command", cmd.Name, "pubkey", cmd.Sender, "err", err)
+		return fmt.Sprintf("Sorry, #%s failed, please try again later.", cmd.Name)
+	}
+	return reply
+}
+
+func (ba *BotApplication) reply(ctx context.Context, ev nostr.Event, msg string) {
+	if err := ba.Bot.Reply(ctx, ev, msg); err != nil {
+		logger.Error("failed to reply", "event", ev.ID, "err", err)
+	}
+}
+
+func (ba *BotApplication) replyMessage(ctx context.Context, msg n.DirectMessage, reply string) {
+	if err := ba.Bot.ReplyMessage(ctx, msg, reply); err != nil {
+		logger.Error("failed to reply to private message", "sender", msg.Sender, "err", err)
+	}
+}
+
+func (ba *BotApplication) subscribe(ctx context.Context, cmd Command) (string, error) {
+	logger.Info("preparing channel", "pubkey", cmd.Sender)
+	channel, new, err := ba.Bot.GetOrCreateSubscription(ctx, cmd.Sender)
+	if err != nil {
+		return "", fmt.Errorf("failed to create channel: %w", err)
+	}
+	channelPub, err := channel.PublicKey(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	// a subscriber asking privately is welcomed privately too
+	reply := ""
+	welcome := func() error {
+		if cmd.Private {
+			reply = ba.Bot.WelcomeText(channelPub)
+			return nil
+		}
+		return ba.Bot.SendWelcomeMessage(ctx, channelPub, cmd.Sender)
+	}
+
+	if new {
+		err := welcome()
+		if err != nil {
+			logger.Error("failed to send welcome message", "pubkey", cmd.Sender, "err", err)
+		} else {
+			logger.Info("sent welcome message to new subscriber", "pubkey", cmd.Sender)
+		}
+	} else {
+		restored, err := ba.Bot.RestoreSubscription(ctx, cmd.Sender)
+		if err != nil {
+			logger.Warn("failed to restore subscription", "pubkey", cmd.Sender, "err", err)
+		}
+
+		if restored {
+			logger.Info("sending welcome message to returning subscriber", "pubkey", cmd.Sender)
+			err := welcome()
+			if err != nil {
+				logger.Warn("failed to send welcome message returning subscriber", "pubkey", cmd.Sender, "err", err)
+			}
+		} else {
+			logger.Info("skip welcome message for existing subscriber", "pubkey", cmd.Sender)
+			npub, _ := nip19.EncodePublicKey(channelPub)
+			reply = fmt.Sprintf("You are subscribed already, your feed is at nostr:%s", npub)
+		}
+	}
+
+	// prepare initial content for first subscription
+	err = ba.Worker.Push(ctx, cmd.Sender, channel, PushInterval, PushSize, false)
+	if err != nil {
+		logger.Error("failed to prepare initial content", "pubkey", cmd.Sender, "err", err)
+	}
+	return reply, nil
+}
+
+func (ba *BotApplication) unsubscribe(ctx context.Context, cmd Command) (string, error) {
+	logger.Warn("unsubscribing", "pubkey", cmd.Sender)
+	if err := ba.Bot.TerminateSubscription(ctx, cmd.Sender); err != nil {
+		return "", err
+	}
+	return "You are unsubscribed. Send #subscribe to come back any time.", nil
+}
+
+func (ba *BotApplication) status(ctx context.Context, cmd Command) (string, error) {
+	return ba.Bot.Status(cmd.Sender), nil
+}
+
+func (ba *BotApplication) preferences(ctx context.Context, cmd Command) (string, error) {
+	subscriber := ba.Bot.service.GetSubscriber(cmd.Sender)
+	if subscriber == nil {
+		return notSubscribedReply, nil
+	}
+	return describePreferences(subscriber.Preferences), nil
+}
+
+func (ba *BotApplication) setPreference(ctx context.Context, cmd Command) (string, error) {
+	if len(cmd.Args) == 0 {
+		return "Tell me what to change: " + setUsage, nil
+	}
+
+	prefs, err := ba.Bot.SetPreference(cmd.Sender, cmd.Args[0], cmd.Args[1:])
+	switch {
+	case errors.Is(err, ErrNotSubscribed):
+		return notSubscribedReply, nil
+	case errors.Is(err, service.ErrInvalidPreferences):
+		return fmt.Sprintf("Sorry, %s.", err), nil
+	case err != nil:
+		return "", err
+	}
+	return "Done. " + describePreferences(prefs), nil
+}
+
+// newSigner returns the signer of the main bot, a bunker if one is
+// configured, otherwise the secret key.
+func newSigner(ctx context.Context, config types.BotConfig, pool *relay.Pool) (n.Signer, error) {
+	if config.Bunker.URI != "" {
+		return n.NewBunkerSigner(ctx, config.Bunker.URI, config.Bunker.SK, pool)
+	}
+	return n.NewLocalSigner(config.SK)
+}
+
+func NewBot(ctx context.Context, client n.IClient, service service.IService, config *types.Config, signer n.Signer) (*Bot, error) {
+	pub, err := signer.PublicKey(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -149,18 +332,23 @@ func NewBot(ctx context.Context, client n.IClient, service service.IService, con
 	return &Bot{
 		client:  client,
 		config:  config,
-		SK:      sk,
+		signer:  signer,
 		pub:     pub,
 		service: service,
 	}, nil
 }
 
+// Pubkey returns the public key of the main bot.
+func (b *Bot) Pubkey() string {
+	return b.pub
+}
+
 func (b *Bot) Listen(ctx context.Context) (<-chan nostr.Event, error) {
 	// set user metadata
 	logger.Info("Create account metadata", "pubkey", b.pub)
 	metadata := b.config.Bot.Metadata
 	relays := b.recommendedRelayList(*b.config)
-	err := b.client.Metadata(ctx, b.SK, metadata.Name, metadata.About, metadata.Picture, metadata.Nip05, relays)
+	err := b.client.Metadata(ctx, b.signer, metadata.Name, metadata.About, metadata.Picture, metadata.Nip05, relays)
 	if err != nil {
 		logger.Error("failed to set account metadata", "err", err)
 	}
@@ -180,68 +368,252 @@ func (b *Bot) Listen(ctx context.Context) (<-chan nostr.Event, error) {
 	return b.client.Subscribe(ctx, filters), nil
 }
 
-func (b *Bot) GetOrCreateSubscription(ctx context.Context, subscriberPub string) (string, bool, error) {
+// ListenMessages receives the private messages sent to the bot since the
+// newest one handled.
+func (b *Bot) ListenMessages(ctx context.Context) <-chan n.DirectMessage {
+	logger.Info("Listen to private messages", "pubkey", b.pub)
+	return b.client.Messages(ctx, b.signer, b.cursor)
+}
+
+// MessageHandled records that a private message has been handled, so that
+// it is not received again after a restart.
+func (b *Bot) MessageHandled(msg n.DirectMessage) {
+	if b.cursor == nil {
+		return
+	}
+	if err := b.cursor.Done(msg); err != nil {
+		logger.Error("failed to save message cursor", "id", msg.ID, "err", err)
+	}
+}
+
+// Reply replies to a note in its thread, hinting at the relays the note was
+// received from.
+func (b *Bot) Reply(ctx context.Context, ev nostr.Event, msg string) error {
+	return b.client.Reply(ctx, b.signer, ev, b.client.ReceivedOn(ev.ID), msg)
+}
+
+// ReplyMessage answers a private message privately.
+func (b *Bot) ReplyMessage(ctx context.Context, msg n.DirectMessage, reply string) error {
+	return b.client.ReplyMessage(ctx, b.signer, msg, reply)
+}
+
+// SetPreference changes one delivery preference of a subscriber and returns
+// the preferences in effect.
+func (b *Bot) SetPreference(subscriberPub, key string, args []string) (types.Preferences, error) {
+	subscriber := b.service.GetSubscriber(subscriberPub)
+	if subscriber == nil || subscriber.UnsubscribedAt != nil {
+		return types.Preferences{}, ErrNotSubscribed
+	}
+
+	prefs := subscriber.Preferences
+	if err := setPreference(&prefs, key, args); err != nil {
+		return types.Preferences{}, err
+	}
+	if err := b.service.UpdatePreferences(subscriberPub, prefs); err != nil {
+		return types.Preferences{}, err
+	}
+	return prefs, nil
+}
+
+// Status describes the subscription of subscriberPub.
+func (b *Bot) Status(subscriberPub string) string {
+	subscriber := b.service.GetSubscriber(subscriberPub)
+	if subscriber == nil {
+		return notSubscribedReply
+	}
+	if subscriber.UnsubscribedAt != nil {
+		return fmt.Sprintf("You unsubscribed on %s. Send #subscribe to come back.", subscriber.UnsubscribedAt.Format("2006-01-02"))
+	}
+
+	status := "You are subscribed"
+	if subscriber.SubscribedAt != nil {
+		status += " since " + subscriber.SubscribedAt.Format("2006-01-02")
+	}
+	channel, err := channelSigner(b.service, subscriberPub, subscriber.ChannelSecret)
+	if err != nil {
+		logger.Error("failed to open channel secret", "pubkey", subscriberPub, "err", err)
+		return status + ", but your channel is unavailable right now."
+	}
+	channelPub, _ := channel.PublicKey(context.Background())
+	npub, _ := nip19.EncodePublicKey(channelPub)
+	return fmt.Sprintf("%s. Your feed is at nostr:%s", status, npub)
+}
+
+// GetOrCreateSubscription returns the channel of a subscriber, creating the
+// subscriber first if it is new.
+func (b *Bot) GetOrCreateSubscription(ctx context.Context, subscriberPub string) (n.Signer, bool, error) {
 	subscriber := b.service.GetSubscriber(subscriberPub)
 	if subscriber != nil {
 		logger.Info("found existing subscriber", "pubkey", subscriberPub)
-		return subscriber.ChannelSecret, false, nil
+		channel, err := channelSigner(b.service, subscriberPub, subscriber.ChannelSecret)
+		if err != nil {
+			return nil, false, err
+		}
+		return channel, false, nil
 	}
 
 	logger.Info("creating new subscriber", "pubkey", subscriberPub)
-	channelSK, err := b.createSubscription(ctx, subscriberPub)
+	channel, err := b.createSubscription(ctx, subscriberPub)
 	if err != nil {
-		return "", false, err
+		return nil, false, err
 	}
 
-	return channelSK, true, nil
+	return channel, true, nil
 }
 
-func (b *Bot) createSubscription(ctx context.Context, subscriberPub string) (string, error) {
-	metadata := b.config.Bot.Metadata
+func (b *Bot) createSubscription(ctx context.Context, subscriberPub string) (n.Signer, error) {
 	channelSK := nostr.GeneratePrivateKey()
+	channel, err := n.NewLocalSigner(channelSK)
+	if err != nil {
+		return nil, err
+	}
 
 	// save secret key to db
-	err := b.service.CreateSubscriber(subscriberPub, channelSK, time.Now())
+	err = b.service.CreateSubscriber(subscriberPub, channelSK, time.Now())
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	// send set_metadata event
+	err = b.publishChannelMetadata(ctx, channel, subscriberPub)
+	if err != nil {
+		// the subscriber is saved already, so the channel is usable even if
+		// its profile did not reach enough relays
+		logger.Error("failed to publish channel metadata", "pubkey", subscriberPub, "err", err)
+	}
+
+	return channel, nil
+}
+
+func (b *Bot) TerminateSubscription(ctx context.Context, subscriberPub string) error {
+	return b.service.DeleteSubscriber(subscriberPub, time.Now())
+}
+
+func (b *Bot) RestoreSubscription(ctx context.Context, subscriberPub string) (bool, error) {
+	return b.service.RestoreSubscriber(subscriberPub, time.Now())
+}
+
+func (b *Bot) publishChannelMetadata(ctx context.Context, channel n.Signer, subscriberPub string) error {
+	metadata := b.config.Bot.Metadata
 	npub, _ := nip19.EncodePublicKey(subscriberPub)
 	mainNpub, _ := nip19.EncodePublicKey(b.pub)
 	relays := b.recommendedRelayList(*b.config)
-	err = b.client.Metadata(ctx, channelSK,
+	return b.client.Metadata(ctx, channel,
 		metadata.ChannelName,
 		fmt.Sprintf(metadata.ChannelAbout, npub, mainNpub),
 		metadata.ChannelPicture, "", relays)
+}
+
+// RotateChannel replaces the channel of a subscriber with a new one, e.g.
+// because its secret leaked or relays flagged it as spam. The profile of the
+// old channel is changed to point to the new one and the subscriber is told
+// to follow it. It returns the public key of the new channel.
+func (b *Bot) RotateChannel(ctx context.Context, subscriberPub string) (string, error) {
+	channelSK := nostr.GeneratePrivateKey()
+	channel, err := n.NewLocalSigner(channelSK)
+	if err != nil {
+		return "", err
+	}
+	channelPub, _ := channel.PublicKey(ctx)
+
+	oldSecret, err := b.service.RotateChannelSecret(subscriberPub, channelSK, time.Now())
 	if err != nil {
 		return "", err
 	}
+	logger.Info("rotated channel", "pubkey", subscriberPub, "channel", channelPub)
+
+	// the new channel is in place, failing to announce it is not fatal
+	if err := b.publishChannelMetadata(ctx, channel, subscriberPub); err != nil {
+		logger.Error("failed to publish channel metadata", "pubkey", subscriberPub, "err", err)
+	}
 
-	return channelSK, nil
+	if old, err := channelSigner(b.service, subscriberPub, oldSecret); err == nil {
+		if err := b.retireChannel(ctx, old, channelPub); err != nil {
+			logger.Error("failed to retire channel", "pubkey", subscriberPub, "err", err)
+		}
+	} else {
+		logger.Warn("cannot retire channel of unknown secret", "pubkey", subscriberPub, "err", err)
+	}
+
+	msg := "#[0], your nossence curator has moved to #[1], follow it to keep getting your feed."
+	if err := b.client.Mention(ctx, b.signer, msg, []string{subscriberPub, channelPub}); err != nil {
+		logger.Error("failed to tell subscriber about new channel", "pubkey", subscriberPub, "err", err)
+	}
+
+	return channelPub, nil
 }
 
-func (b *Bot) TerminateSubscription(ctx context.Context, subscriberPub string) error {
-	return b.service.DeleteSubscriber(subscriberPub, time.Now())
+// retireChannel marks the profile of a replaced channel as moved to the
+// channel of channelPub.
+func (b *Bot) retireChannel(ctx context.Context, old n.Signer, channelPub string) error {
+	metadata := b.config.Bot.Metadata
+	channelNpub, _ := nip19.EncodePublicKey(channelPub)
+	relays := b.recommendedRelayList(*b.config)
+	return b.client.Metadata(ctx, old,
+		metadata.ChannelName+" (moved)",
+		fmt.Sprintf("This channel is no longer updated, it has moved to nostr:%s", channelNpub),
+		metadata.ChannelPicture, "", relays)
 }
 
-func (b *Bot) RestoreSubscription(ctx context.Context, subscriberPub string) (bool, error) {
-	return b.service.RestoreSubscriber(subscriberPub, time.Now())
+// ChannelRotations is the outcome of rotating the channels of all
+// subscribers.
+type ChannelRotations struct {
+	Rotated int      `json:"rotated"`
+	Failed  []string `json:"failed"`
 }
 
-func (b *Bot) SendWelcomeMessage(ctx context.Context, channelSK, receiverPub string) error {
-	channelPub, err := nostr.GetPublicKey(channelSK)
-	if err != nil {
-		return err
+// RotateChannels rotates the channels of all active subscribers.
+func (b *Bot) RotateChannels(ctx context.Context) (*ChannelRotations, error) {
+	rotations := &ChannelRotations{Failed: []string{}}
+	limit := 100
+	for skip := 0; ; skip += limit {
+		subscribers, err := b.service.ListSubscribers(ctx, limit, skip)
+		if err != nil {
+			return rotations, err
+		}
+
+		for _, subscriber := range subscribers {
+			if subscriber.UnsubscribedAt != nil {
+				continue
+			}
+			if _, err := b.RotateChannel(ctx, subscriber.Pubkey); err != nil {
+				logger.Error("failed to rotate channel", "pubkey", subscriber.Pubkey, "err", err)
+				rotations.Failed = append(rotations.Failed, subscriber.Pubkey)
+				continue
+			}
+			rotations.Rotated++
+		}
+
+		if len(subscribers) < limit {
+			return rotations, nil
+		}
 	}
+}
 
+func (b *Bot) SendWelcomeMessage(ctx context.Context, channelPub, receiverPub string) error {
 	msg := "Hello, #[0]! Your nossence curator is ready, follow: #[1] to fetch your own feed."
-	return b.client.Mention(ctx, b.SK, msg, []string{
+	return b.client.Mention(ctx, b.signer, msg, []string{
 		receiverPub,
 		channelPub,
 	})
 }
 
+// WelcomeText is the welcome message sent privately to a subscriber.
+func (b *Bot) WelcomeText(channelPub string) string {
+	npub, _ := nip19.EncodePublicKey(channelPub)
+	return fmt.Sprintf("Hello! Your nossence curator is ready, follow nostr:%s to fetch your own feed.", npub)
+}
+
+// channelSigner returns the signer of a channel from its secret as stored,
+// decrypting it.
+func channelSigner(service service.IService, subscriberPub, stored string) (*n.LocalSigner, error) {
+	channelSK, err := service.OpenChannelSecret(subscriberPub, stored)
+	if err != nil {
+		return nil, err
+	}
+	return n.NewLocalSigner(channelSK)
+}
+
 func (b *Bot) recommendedRelayList(config types.Config) []types.RelayInfo {
 	relays := []types.RelayInfo{}
 
@@ -2,16 +2,20 @@ package bot
 
 import (
 	"context"
+	"errors"
 	"testing"
+	"time"
 
 	n "github.com/dyng/nosdaily/nostr"
 	"github.com/dyng/nosdaily/service"
 	"github.com/dyng/nosdaily/types"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 )
 
 var botSK = nostr.GeneratePrivateKey()
+var botSigner, _ = n.NewLocalSigner(botSK)
 var subscriberSK = nostr.GeneratePrivateKey()
 var relays = []string{"ws://localhost:8090"}
 var config = &types.Config{
@@ -32,7 +36,7 @@ func TestNewBot(t *testing.T) {
 	mockClient := new(n.MockClient)
 	mockService := new(service.MockService)
 
-	bot, err := NewBot(context.Background(), mockClient, mockService, config)
+	bot, err := NewBot(context.Background(), mockClient, mockService, config, botSigner)
 	assert.NoError(t, err)
 	assert.NotNil(t, bot)
 }
@@ -42,7 +46,27 @@ func TestListen(t *testing.T) {
 	mockClient := new(n.MockClient)
 	mockService := new(service.MockService)
 
-	bot, err := NewBot(context.Background(), mockClient, mockService, config)
+	botPub, err := nostr.GetPublicKey(botSK)
+	assert.NoError(t, err)
+	subscriberPub, err := nostr.GetPublicKey(subscriberSK)
+	assert.NoError(t, err)
+	ev := nostr.Event{
+		Content:   "#[0] #subscribe",
+		CreatedAt: time.Now(),
+		Kind:      1,
+		PubKey:    subscriberPub,
+		Tags: nostr.Tags{
+			nostr.Tag{"p", botPub, "", "mention"},
+		},
+	}
+	assert.NoError(t, ev.Sign(subscriberSK))
+
+	events := make(chan nostr.Event, 1)
+	events <- ev
+	mockClient.On("Metadata", mock.Anything, botSigner, config.Bot.Metadata.Name, config.Bot.Metadata.About, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockClient.On("Subscribe", mock.Anything, mock.Anything).Return((<-chan nostr.Event)(events))
+
+	bot, err := NewBot(context.Background(), mockClient, mockService, config, botSigner)
 	assert.NoError(t, err)
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -51,27 +75,13 @@ func TestListen(t *testing.T) {
 	c, err := bot.Listen(ctx)
 	assert.NoError(t, err)
 
-	// botPub, err := nostr.GetPublicKey(botSK)
-	// assert.NoError(t, err)
-	// subscriberPub, err := nostr.GetPublicKey(subscriberSK)
-	// assert.NoError(t, err)
-	// ev := nostr.Event{
-	// 	Content:   "#[0] #subscribe",
-	// 	CreatedAt: time.Now(),
-	// 	Kind:      1,
-	// 	PubKey:    subscriberPub,
-	// 	Tags: nostr.Tags{
-	// 		nostr.Tag{"p", botPub, "", "mention"},
-	// 	},
-	// }
-	// ev.Sign(subscriberSK)
-
-	// err = mockClient.Publish(context.Background(), ev)
-	// assert.NoError(t, err)
-
 	msg := <-c
-	assert.NotNil(t, msg)
-	t.Logf("msg: %v", msg)
+	assert.Equal(t, ev.ID, msg.ID)
+
+	// only notes mentioning the bot are asked for
+	filters := mockClient.Calls[1].Arguments.Get(1).([]nostr.Filter)
+	assert.Equal(t, []int{1}, filters[0].Kinds)
+	assert.Equal(t, []string{botPub}, filters[0].Tags["p"])
 }
 
 // bot should create a channel and store it with a reference to subscriber
@@ -79,21 +89,39 @@ func TestGetOrCreateSubscription(t *testing.T) {
 	mockClient := new(n.MockClient)
 	mockService := new(service.MockService)
 
-	bot, err := NewBot(context.Background(), mockClient, mockService, config)
+	subscriberPub, err := nostr.GetPublicKey(subscriberSK)
 	assert.NoError(t, err)
 
-	subscriberPub, err := nostr.GetPublicKey(subscriberSK)
+	mockService.On("GetSubscriber", subscriberPub).Return((*types.Subscriber)(nil)).Once()
+	mockService.On("CreateSubscriber", subscriberPub, mock.AnythingOfType("string"), mock.AnythingOfType("time.Time")).Return(nil)
+	mockClient.On("Metadata", mock.Anything, mock.Anything, config.Bot.Metadata.ChannelName, mock.Anything, mock.Anything, "", mock.Anything).Return(nil)
+
+	bot, err := NewBot(context.Background(), mockClient, mockService, config, botSigner)
 	assert.NoError(t, err)
 
-	channelSK, created, err := bot.GetOrCreateSubscription(context.Background(), subscriberPub)
+	channel, created, err := bot.GetOrCreateSubscription(context.Background(), subscriberPub)
 	assert.NoError(t, err)
 	assert.True(t, created)
-	assert.NotNil(t, channelSK)
+	channelSK := mockService.Calls[1].Arguments.String(1)
+	expected, _ := n.NewLocalSigner(channelSK)
+	assert.Equal(t, expected, channel)
+
+	// the channel's profile is published with the channel's key
+	mockClient.AssertCalled(t, "Metadata", mock.Anything, channel, config.Bot.Metadata.ChannelName, mock.Anything, mock.Anything, "", mock.Anything)
 
-	channelSK, created, err = bot.GetOrCreateSubscription(context.Background(), subscriberPub)
+	// an existing channel is signed for with its decrypted secret
+	mockService.On("GetSubscriber", subscriberPub).Return(&types.Subscriber{Pubkey: subscriberPub, ChannelSecret: "sealed"})
+	mockService.On("OpenChannelSecret", subscriberPub, "sealed").Return(channelSK, nil).Once()
+	existing, created, err := bot.GetOrCreateSubscription(context.Background(), subscriberPub)
 	assert.NoError(t, err)
 	assert.False(t, created)
-	assert.NotNil(t, channelSK)
+	assert.Equal(t, channel, existing)
+	mockService.AssertNumberOfCalls(t, "CreateSubscriber", 1)
+
+	// a secret that cannot be decrypted is an error
+	mockService.On("OpenChannelSecret", subscriberPub, "sealed").Return("", errors.New("wrong master key"))
+	_, _, err = bot.GetOrCreateSubscription(context.Background(), subscriberPub)
+	assert.Error(t, err)
 }
 
 // bot should send a welcome message to subscriber mentioning the channel
@@ -101,20 +129,51 @@ func TestSendWelcomeMessage(t *testing.T) {
 	mockClient := new(n.MockClient)
 	mockService := new(service.MockService)
 
-	channelSK := nostr.GeneratePrivateKey()
+	channelPub, err := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	assert.NoError(t, err)
 	subscriberPub, err := nostr.GetPublicKey(subscriberSK)
 	assert.NoError(t, err)
 
-	bot, err := NewBot(context.Background(), mockClient, mockService, config)
+	mockClient.On("Mention", mock.Anything, botSigner, mock.AnythingOfType("string"), mock.Anything).Return(nil)
+
+	bot, err := NewBot(context.Background(), mockClient, mockService, config, botSigner)
+	assert.NoError(t, err)
+
+	assert.NoError(t, bot.SendWelcomeMessage(context.Background(), channelPub, subscriberPub))
+
+	// the message mentions the subscriber first, then the channel
+	mockClient.AssertCalled(t, "Mention", mock.Anything, botSigner, mock.Anything, []string{subscriberPub, channelPub})
+	msg := mockClient.Calls[0].Arguments.String(2)
+	assert.Contains(t, msg, "#[0]")
+	assert.Contains(t, msg, "#[1]")
+}
+
+// bot should replace the channel, retire the old one and tell the subscriber
+func TestRotateChannel(t *testing.T) {
+	mockClient := new(n.MockClient)
+	mockService := new(service.MockService)
+
+	subscriberPub, err := nostr.GetPublicKey(subscriberSK)
+	assert.NoError(t, err)
+	oldSK := nostr.GeneratePrivateKey()
+	oldChannel, _ := n.NewLocalSigner(oldSK)
+
+	mockService.On("RotateChannelSecret", subscriberPub, mock.AnythingOfType("string"), mock.AnythingOfType("time.Time")).Return("sealed", nil)
+	mockService.On("OpenChannelSecret", subscriberPub, "sealed").Return(oldSK, nil)
+	mockClient.On("Metadata", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockClient.On("Mention", mock.Anything, botSigner, mock.Anything, mock.Anything).Return(nil)
+
+	bot, err := NewBot(context.Background(), mockClient, mockService, config, botSigner)
+	assert.NoError(t, err)
+
+	channelPub, err := bot.RotateChannel(context.Background(), subscriberPub)
 	assert.NoError(t, err)
 
-	// c := client.Subscribe(context.Background(), []nostr.Filter{
-	// 	{Kinds: []int{4}, Tags: nostr.TagMap{"p": []string{subscriberPub}}},
-	// })
-	bot.SendWelcomeMessage(context.Background(), channelSK, subscriberPub)
+	// the new secret is stored and belongs to the new channel
+	newSK := mockService.Calls[0].Arguments.String(1)
+	newPub, _ := nostr.GetPublicKey(newSK)
+	assert.Equal(t, newPub, channelPub)
 
-	// ev := <-c
-	// t.Logf("event: %v", ev)
-	// assert.NotNil(t, ev)
-	// TODO: should check welcome message mentions the right person
+	mockClient.AssertCalled(t, "Metadata", mock.Anything, oldChannel, config.Bot.Metadata.ChannelName+" (moved)", mock.Anything, mock.Anything, "", mock.Anything)
+	mockClient.AssertCalled(t, "Mention", mock.Anything, botSigner, mock.Anything, []string{subscriberPub, channelPub})
 }
@@ -0,0 +1,127 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Command is a hashtag command sent to the bot, e.g. "#subscribe".
+type Command struct {
+	// Name is the hashtag of the command in lower case, without '#'.
+	Name string
+	// Args are the words following the command.
+	Args []string
+	// Sender is the public key of who sent the command.
+	Sender string
+	// Private is set for commands sent in a private message, they are
+	// answered privately.
+	Private bool
+}
+
+// CommandHandler runs a command and returns the reply to it, nothing is
+// replied if it is empty.
+type CommandHandler func(ctx context.Context, cmd Command) (string, error)
+
+type route struct {
+	name    string
+	usage   string
+	handler CommandHandler
+}
+
+// Router dispatches commands to the handlers registered for them.
+type Router struct {
+	routes []route
+}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Handle registers handler for the command name, usage is how the command is
+// described by #help.
+func (r *Router) Handle(name, usage string, handler CommandHandler) {
+	r.routes = append(r.routes, route{name: strings.ToLower(name), usage: usage, handler: handler})
+}
+
+func (r *Router) lookup(name string) *route {
+	for i := range r.routes {
+		if r.routes[i].name == name {
+			return &r.routes[i]
+		}
+	}
+	return nil
+}
+
+// Dispatch runs cmd and returns the reply to it. Unknown commands are
+// answered with the list of commands.
+func (r *Router) Dispatch(ctx context.Context, cmd Command) (string, error) {
+	route := r.lookup(cmd.Name)
+	if route == nil {
+		return fmt.Sprintf("Sorry, I don't know #%s.\n\n%s", cmd.Name, r.Help()), nil
+	}
+	return route.handler(ctx, cmd)
+}
+
+// Help lists the registered commands.
+func (r *Router) Help() string {
+	var sb strings.Builder
+	sb.WriteString("Commands I understand:")
+	for _, route := range r.routes {
+		sb.WriteString(fmt.Sprintf("\n#%s - %s", route.name, route.usage))
+	}
+	return sb.String()
+}
+
+// Mentioned tells whether content refers to a registered command anywhere,
+// e.g. a note that has a command but not in front.
+func (r *Router) Mentioned(content string) bool {
+	for _, word := range strings.Fields(strings.ToLower(content)) {
+		word = strings.TrimRight(word, ".,!?:;")
+		if strings.HasPrefix(word, "#") && r.lookup(word[1:]) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// mentionPattern matches the ways a note refers to a profile: NIP-08 #[i]
+// references, NIP-27 nostr: links and plain @names.
+var mentionPattern = regexp.MustCompile(`^(#\[\d+\]|(nostr:)?(npub|nprofile)1[0-9a-z]+|@\S+)[,:]?$`)
+
+// ParseCommand reads the command of a note. The command must be the first
+// word after the mentions, so that a note merely talking about a command
+// ("don't #subscribe") is not taken for it. When the note carries t tags the
+// command must be one of them too. ok is false if the note has no command.
+func ParseCommand(content string, tags nostr.Tags) (cmd Command, ok bool) {
+	words := strings.Fields(content)
+	for len(words) > 0 && mentionPattern.MatchString(words[0]) {
+		words = words[1:]
+	}
+	if len(words) == 0 || !strings.HasPrefix(words[0], "#") {
+		return Command{}, false
+	}
+
+	name := strings.ToLower(strings.TrimRight(words[0][1:], ".,!?:;"))
+	if name == "" || strings.HasPrefix(name, "[") {
+		return Command{}, false
+	}
+
+	if hashtags := tags.GetAll([]string{"t", ""}); len(hashtags) > 0 {
+		tagged := false
+		for _, tag := range hashtags {
+			if strings.ToLower(tag.Value()) == name {
+				tagged = true
+				break
+			}
+		}
+		if !tagged {
+			return Command{}, false
+		}
+	}
+
+	return Command{Name: name, Args: words[1:]}, true
+}
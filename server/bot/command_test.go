@@ -0,0 +1,138 @@
+package bot
+
+import (
+	"context"
+	"testing"
+
+	n "github.com/dyng/nosdaily/nostr"
+	"github.com/dyng/nosdaily/service"
+	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParseCommand(t *testing.T) {
+	cmd, ok := ParseCommand("#[0] #subscribe", nil)
+	assert.True(t, ok)
+	assert.Equal(t, "subscribe", cmd.Name)
+	assert.Empty(t, cmd.Args)
+
+	cmd, ok = ParseCommand("nostr:npub1sg6plzptd64u62a878hep2kev88swjh3tw00gjsfl8f237lmu63q0uf63m, #Status now please", nil)
+	assert.True(t, ok)
+	assert.Equal(t, "status", cmd.Name)
+	assert.Equal(t, []string{"now", "please"}, cmd.Args)
+
+	// a command talked about is not a command
+	_, ok = ParseCommand("#[0] don't #subscribe", nil)
+	assert.False(t, ok)
+	_, ok = ParseCommand("#[0] #[1]", nil)
+	assert.False(t, ok)
+
+	// with t tags the command must be one of them
+	tags := nostr.Tags{nostr.Tag{"t", "subscribe"}}
+	_, ok = ParseCommand("#[0] #subscribe", tags)
+	assert.True(t, ok)
+	_, ok = ParseCommand("#[0] #unsubscribe", tags)
+	assert.False(t, ok)
+}
+
+func TestRouter(t *testing.T) {
+	r := NewRouter()
+	r.Handle("echo", "repeat after me", func(ctx context.Context, cmd Command) (string, error) {
+		return cmd.Sender + ": " + cmd.Args[0], nil
+	})
+
+	reply, err := r.Dispatch(context.Background(), Command{Name: "echo", Args: []string{"hi"}, Sender: "alice"})
+	assert.NoError(t, err)
+	assert.Equal(t, "alice: hi", reply)
+
+	// unknown commands get the help
+	reply, err = r.Dispatch(context.Background(), Command{Name: "nope"})
+	assert.NoError(t, err)
+	assert.Contains(t, reply, "#nope")
+	assert.Contains(t, reply, "#echo - repeat after me")
+
+	assert.True(t, r.Mentioned("please #echo this"))
+	assert.False(t, r.Mentioned("#nope"))
+}
+
+// private messages are answered privately
+func TestHandleMessage(t *testing.T) {
+	mockClient := new(n.MockClient)
+	mockService := new(service.MockService)
+
+	bot, err := NewBot(context.Background(), mockClient, mockService, config, botSigner)
+	assert.NoError(t, err)
+	ba := &BotApplication{Bot: bot}
+	ba.commands = ba.newRouter()
+
+	subscriberPub, _ := nostr.GetPublicKey(subscriberSK)
+	mockService.On("GetSubscriber", subscriberPub).Return((*types.Subscriber)(nil))
+	mockClient.On("ReplyMessage", mock.Anything, botSigner, mock.Anything, mock.Anything).Return(nil)
+
+	msg := n.DirectMessage{Sender: subscriberPub, Content: "#status", Format: n.MessageNip17}
+	ba.handleMessage(context.Background(), msg)
+	mockClient.AssertCalled(t, "ReplyMessage", mock.Anything, botSigner, msg, bot.Status(subscriberPub))
+
+	// anything else gets the help
+	msg = n.DirectMessage{Sender: subscriberPub, Content: "hello?", Format: n.MessageNip04}
+	ba.handleMessage(context.Background(), msg)
+	assert.Contains(t, mockClient.Calls[len(mockClient.Calls)-1].Arguments.String(3), "#subscribe")
+	mockClient.AssertNotCalled(t, "Reply", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestSetPreference(t *testing.T) {
+	prefs := service.DefaultPreferences
+
+	assert.NoError(t, setPreference(&prefs, "interval", []string{"daily"}))
+	assert.Equal(t, 24, prefs.IntervalHours)
+	assert.NoError(t, setPreference(&prefs, "interval", []string{"6h"}))
+	assert.Equal(t, 6, prefs.IntervalHours)
+	assert.NoError(t, setPreference(&prefs, "Size", []string{"8"}))
+	assert.Equal(t, 8, prefs.Size)
+	assert.NoError(t, setPreference(&prefs, "format", []string{"Repost"}))
+	assert.Equal(t, service.FormatRepost, prefs.Format)
+	assert.NoError(t, setPreference(&prefs, "quiet", []string{"22-7"}))
+	assert.Equal(t, 22, prefs.QuietFrom)
+	assert.Equal(t, 7, prefs.QuietTo)
+	assert.NoError(t, setPreference(&prefs, "timezone", []string{"America/New_York"}))
+	assert.Equal(t, "America/New_York", prefs.Timezone)
+	assert.NoError(t, setPreference(&prefs, "interval", []string{"weekly"}))
+	assert.Equal(t, 168, prefs.IntervalHours)
+	assert.NoError(t, setPreference(&prefs, "format", []string{"digest"}))
+	assert.Equal(t, service.FormatDigest, prefs.Format)
+	assert.NoError(t, setPreference(&prefs, "quiet", []string{"off"}))
+	assert.Equal(t, prefs.QuietFrom, prefs.QuietTo)
+
+	assert.Error(t, setPreference(&prefs, "interval", []string{"often"}))
+	assert.Error(t, setPreference(&prefs, "quiet", []string{"late"}))
+	assert.Error(t, setPreference(&prefs, "timezone", []string{"Nowhere"}))
+	assert.Error(t, setPreference(&prefs, "colour", []string{"blue"}))
+	assert.Error(t, setPreference(&prefs, "size", nil))
+}
+
+// preferences are changed by command and validated by the service
+func TestSetPreferenceCommand(t *testing.T) {
+	mockClient := new(n.MockClient)
+	mockService := new(service.MockService)
+
+	bot, err := NewBot(context.Background(), mockClient, mockService, config, botSigner)
+	assert.NoError(t, err)
+	ba := &BotApplication{Bot: bot}
+	ba.commands = ba.newRouter()
+
+	subscriberPub, _ := nostr.GetPublicKey(subscriberSK)
+	mockService.On("GetSubscriber", subscriberPub).Return(&types.Subscriber{Pubkey: subscriberPub, Preferences: service.DefaultPreferences})
+	mockService.On("UpdatePreferences", subscriberPub, mock.Anything).Return(nil)
+
+	reply, err := ba.commands.Dispatch(context.Background(), Command{Name: "set", Args: []string{"interval", "daily"}, Sender: subscriberPub})
+	assert.NoError(t, err)
+	assert.Contains(t, reply, "once a day")
+	prefs := mockService.Calls[1].Arguments.Get(1).(types.Preferences)
+	assert.Equal(t, 24, prefs.IntervalHours)
+
+	reply, err = ba.commands.Dispatch(context.Background(), Command{Name: "set", Args: []string{"size", "many"}, Sender: subscriberPub})
+	assert.NoError(t, err)
+	assert.Contains(t, reply, "Sorry")
+}
@@ -0,0 +1,94 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	n "github.com/dyng/nosdaily/nostr"
+	"github.com/dyng/nosdaily/types"
+)
+
+// DigestMain publishes the digest of the main channel.
+func (w *Worker) DigestMain(ctx context.Context) error {
+	logger.Info("publishing digest of main channel")
+	config := w.config.Bot.Digest
+	period, err := types.ParseTimeOffset(config.Period)
+	if err != nil {
+		return err
+	}
+	return w.Digest(ctx, "", w.main, period, config.Size)
+}
+
+// Digest publishes the top posts of timeRange for a subscriber as one
+// digest from the channel.
+func (w *Worker) Digest(ctx context.Context, subscriberPub string, channel n.Signer, timeRange time.Duration, limit int) error {
+	end := time.Now()
+	start := end.Add(-timeRange)
+	channelPub, err := channel.PublicKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	feed := w.feed(subscriberPub, channelPub, start, end, limit)
+	if len(feed) == 0 {
+		logger.Warn("got empty feed for digest", "subscriberPub", subscriberPub)
+		return nil
+	}
+
+	ids := make([]string, 0, len(feed))
+	authors := make([]string, 0, len(feed))
+	for _, entry := range feed {
+		ids = append(ids, entry.Id)
+		authors = append(authors, entry.Pubkey)
+	}
+	engagement, err := w.service.GetEngagement(ids)
+	if err != nil {
+		logger.Warn("failed to count engagement", "subscriberPub", subscriberPub, "err", err)
+	}
+	names := w.client.Profiles(ctx, authors)
+
+	items := make([]n.DigestItem, 0, len(feed))
+	for _, entry := range feed {
+		items = append(items, n.DigestItem{
+			Entry:      entry,
+			Author:     names[entry.Pubkey],
+			Engagement: engagement[entry.Id],
+		})
+	}
+
+	// an article replaces the one of the same identifier, i.e. of the
+	// same hour
+	identifier := "nossence-digest-" + end.UTC().Format("2006-01-02-15")
+	err = w.client.Digest(ctx, channel, w.digestKind(), identifier, digestTitle(len(items), timeRange, end), items)
+	if err != nil {
+		return err
+	}
+
+	w.markDelivered(subscriberPub, channelPub, ids, end)
+	logger.Info("published digest", "subscriberPub", subscriberPub, "channelPub", channelPub, "eventIds", ids)
+	return nil
+}
+
+// digestKind returns the kind of digests, articles unless notes are
+// configured.
+func (w *Worker) digestKind() int {
+	if w.config != nil && w.config.Bot.Digest.Kind == 1 {
+		return 1
+	}
+	return n.KindArticle
+}
+
+func digestTitle(size int, timeRange time.Duration, end time.Time) string {
+	day := end.UTC().Format("Jan 2, 2006")
+	switch {
+	case timeRange >= 7*24*time.Hour:
+		return fmt.Sprintf("nossence digest: top %d notes of the week to %s", size, day)
+	case timeRange >= 24*time.Hour:
+		return fmt.Sprintf("nossence digest: top %d notes of %s", size, day)
+	case timeRange > time.Hour:
+		return fmt.Sprintf("nossence digest: top %d notes of the last %d hours", size, int(timeRange.Hours()))
+	default:
+		return fmt.Sprintf("nossence digest: top %d notes of the last hour", size)
+	}
+}
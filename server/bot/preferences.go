@@ -0,0 +1,98 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dyng/nosdaily/service"
+	"github.com/dyng/nosdaily/types"
+)
+
+const setUsage = "#set interval hourly|6h|daily|weekly, #set size 1-20, #set format quote|repost|digest, #set quiet 22-7|off, #set timezone Europe/Berlin"
+
+const notSubscribedReply = "You are not subscribed. Send #subscribe to get your own curated feed."
+
+// ErrNotSubscribed is returned for changes to the subscription of somebody
+// without one.
+var ErrNotSubscribed = errors.New("not subscribed")
+
+// describePreferences tells a subscriber the preferences in effect.
+func describePreferences(prefs types.Preferences) string {
+	interval := "every hour"
+	switch prefs.IntervalHours {
+	case 1:
+	case 24:
+		interval = "once a day"
+	case 168:
+		interval = "once a week"
+	default:
+		interval = fmt.Sprintf("every %d hours", prefs.IntervalHours)
+	}
+
+	s := fmt.Sprintf("You get %d notes %s as %ss", prefs.Size, interval, prefs.Format)
+	if prefs.Format == service.FormatDigest {
+		s = fmt.Sprintf("You get a digest of the top %d notes %s", prefs.Size, interval)
+	}
+	if prefs.QuietFrom != prefs.QuietTo {
+		s += fmt.Sprintf(", nothing from %d:00 to %d:00 %s", prefs.QuietFrom, prefs.QuietTo, prefs.Timezone)
+	}
+	return s + ".\nChange with " + setUsage
+}
+
+// setPreference changes the preference named key to the value in args.
+func setPreference(prefs *types.Preferences, key string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: %s needs a value", service.ErrInvalidPreferences, key)
+	}
+	value := strings.ToLower(args[0])
+
+	switch strings.ToLower(key) {
+	case "interval":
+		switch value {
+		case "hourly":
+			prefs.IntervalHours = 1
+		case "daily":
+			prefs.IntervalHours = 24
+		case "weekly":
+			prefs.IntervalHours = 168
+		default:
+			hours, err := strconv.Atoi(strings.TrimSuffix(value, "h"))
+			if err != nil {
+				return fmt.Errorf("%w: interval must be hourly, daily, weekly or a number of hours", service.ErrInvalidPreferences)
+			}
+			prefs.IntervalHours = hours
+		}
+	case "size":
+		size, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%w: size must be a number", service.ErrInvalidPreferences)
+		}
+		prefs.Size = size
+	case "format":
+		prefs.Format = value
+	case "quiet":
+		if value == "off" {
+			prefs.QuietFrom, prefs.QuietTo = 0, 0
+			return nil
+		}
+		from, to, ok := strings.Cut(value, "-")
+		fromHour, err1 := strconv.Atoi(from)
+		toHour, err2 := strconv.Atoi(to)
+		if !ok || err1 != nil || err2 != nil {
+			return fmt.Errorf("%w: quiet hours must be like 22-7", service.ErrInvalidPreferences)
+		}
+		prefs.QuietFrom, prefs.QuietTo = fromHour, toHour
+	case "timezone":
+		// time zone names are case sensitive
+		if _, err := time.LoadLocation(args[0]); err != nil {
+			return fmt.Errorf("%w: unknown timezone %s", service.ErrInvalidPreferences, args[0])
+		}
+		prefs.Timezone = args[0]
+	default:
+		return fmt.Errorf("%w: unknown preference %s", service.ErrInvalidPreferences, key)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package bot
+
+import (
+	"time"
+
+	"github.com/dyng/nosdaily/types"
+)
+
+// pushSlack lets a push run a bit early, the cron job starts every hour but
+// the pushes of one run take a while.
+const pushSlack = 10 * time.Minute
+
+// pushDue tells whether the feed is to be pushed to a subscriber at now,
+// i.e. the interval of the subscriber passed since the last push and it is
+// not the quiet hours of the subscriber.
+func pushDue(subscriber types.Subscriber, now time.Time) bool {
+	prefs := subscriber.Preferences
+	if quiet(prefs, now) {
+		return false
+	}
+	if subscriber.LastPushedAt == nil {
+		return true
+	}
+	interval := time.Duration(prefs.IntervalHours) * time.Hour
+	return now.Sub(*subscriber.LastPushedAt) >= interval-pushSlack
+}
+
+// quiet tells whether now falls into the quiet hours of prefs.
+func quiet(prefs types.Preferences, now time.Time) bool {
+	if prefs.QuietFrom == prefs.QuietTo {
+		return false
+	}
+	loc, err := time.LoadLocation(prefs.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	hour := now.In(loc).Hour()
+	if prefs.QuietFrom < prefs.QuietTo {
+		return hour >= prefs.QuietFrom && hour < prefs.QuietTo
+	}
+	// quiet over midnight, e.g. from 22 to 7
+	return hour >= prefs.QuietFrom || hour < prefs.QuietTo
+}
+
+// pushRange returns how far back the feed pushed at now reaches: the
+// interval of the subscriber, or the time since the last push if that was
+// longer ago, e.g. because of quiet hours, up to a day or the interval if
+// longer.
+func pushRange(subscriber types.Subscriber, now time.Time) time.Duration {
+	interval := time.Duration(subscriber.Preferences.IntervalHours) * time.Hour
+	timeRange := interval
+	if subscriber.LastPushedAt != nil {
+		if since := now.Sub(*subscriber.LastPushedAt); since > timeRange {
+			timeRange = since
+		}
+	}
+	limit := 24 * time.Hour
+	if interval > limit {
+		limit = interval
+	}
+	if timeRange > limit {
+		timeRange = limit
+	}
+	return timeRange
+}
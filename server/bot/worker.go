@@ -2,6 +2,7 @@ package bot
 
 import (
 	"context"
+	"fmt"
 	"runtime"
 	"sync"
 	"time"
@@ -9,25 +10,35 @@ import (
 	n "github.com/dyng/nosdaily/nostr"
 	"github.com/dyng/nosdaily/service"
 	"github.com/dyng/nosdaily/types"
-	"github.com/nbd-wtf/go-nostr"
 )
 
 type Worker struct {
-	config  *types.Config
-	client  n.IClient
-	service service.IService
+	config    *types.Config
+	client    n.IClient
+	service   service.IService
+	main      n.Signer
+	redeliver time.Duration
 }
 
 var (
 	QuoteComment = "Here are the Top %d events curated for You"
 )
 
-func NewWorker(ctx context.Context, client n.IClient, service service.IService, config *types.Config) (*Worker, error) {
-	return &Worker{
+func NewWorker(ctx context.Context, client n.IClient, service service.IService, config *types.Config, main n.Signer) (*Worker, error) {
+	w := &Worker{
 		config:  config,
 		client:  client,
 		service: service,
-	}, nil
+		main:    main,
+	}
+	if config != nil && config.Bot.Redeliver != "" {
+		redeliver, err := types.ParseTimeOffset(config.Bot.Redeliver)
+		if err != nil {
+			return nil, err
+		}
+		w.redeliver = redeliver
+	}
+	return w, nil
 }
 
 func (w *Worker) Run(ctx context.Context) error {
@@ -36,9 +47,12 @@ func (w *Worker) Run(ctx context.Context) error {
 	hasNext := true
 	var err error
 
-	err = w.UpdateMain(ctx)
-	if err != nil {
-		logger.Error("error occurs in main update", "err", err)
+	// the main channel publishes digests on a schedule of its own instead
+	if w.config == nil || !w.config.Bot.Digest.Main {
+		err = w.UpdateMain(ctx)
+		if err != nil {
+			logger.Error("error occurs in main update", "err", err)
+		}
 	}
 
 	for hasNext {
@@ -55,8 +69,7 @@ func (w *Worker) Run(ctx context.Context) error {
 
 func (w *Worker) UpdateMain(ctx context.Context) error {
 	logger.Info("updating main channel")
-	mainSK := w.config.Bot.SK
-	return w.Push(ctx, "", mainSK, PushInterval, PushSize, true)
+	return w.Push(ctx, "", w.main, PushInterval, PushSize, true)
 }
 
 func (w *Worker) Batch(ctx context.Context, limit, skip int) (hasNext bool, err error) {
@@ -87,43 +100,112 @@ func (w *Worker) Batch(ctx context.Context, limit, skip int) (hasNext bool, err
 	return len(subscribers) >= limit, nil
 }
 
-func (w *Worker) Push(ctx context.Context, subscriberPub, channelSK string, timeRange time.Duration, limit int, useRepost bool) error {
+// ChannelSigner returns the signer of the channel of a subscriber.
+func (w *Worker) ChannelSigner(subscriber *types.Subscriber) (n.Signer, error) {
+	return channelSigner(w.service, subscriber.Pubkey, subscriber.ChannelSecret)
+}
+
+func (w *Worker) Push(ctx context.Context, subscriberPub string, channel n.Signer, timeRange time.Duration, limit int, useRepost bool) error {
 	start := time.Now().Add(-1 * timeRange)
 	end := time.Now()
 	logger.Debug("start to repost feed", "userPub", subscriberPub, "start", start, "end", end, "limit", limit)
-	feed := w.service.GetFeed(subscriberPub, start, end, limit)
+	channelPub, err := channel.PublicKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	feed := w.feed(subscriberPub, channelPub, start, end, limit)
 	if len(feed) == 0 {
 		logger.Warn("got empty feed", "subscriberPub", subscriberPub)
 		return nil
 	}
 	logger.Debug("got feed", "subscriberPub", subscriberPub, "size", len(feed))
 
-	channelPub, _ := nostr.GetPublicKey(channelSK)
 	var eventIds []string
 	for _, post := range feed {
 		eventIds = append(eventIds, post.Id)
 	}
 
-	if useRepost {
-		for _, post := range feed {
-			err := w.client.Repost(ctx, channelSK, post.Id, post.Pubkey, post.Raw)
-			if err != nil {
-				logger.Warn("failed to repost event", "channelPub", channelPub, "id", post.Id, "err", err)
-			}
+	failed := 0
+	published := make([]string, 0, len(feed))
+	for _, post := range feed {
+		if useRepost {
+			err = w.client.Repost(ctx, channel, post)
+		} else {
+			err = w.client.Quote(ctx, channel, "", []types.FeedEntry{post})
 		}
-	} else {
-		for _, post := range feed {
-			err := w.client.Quote(ctx, channelSK, "", []string{post.Id})
-			if err != nil {
-				logger.Warn("failed to quote event", "channelPub", channelPub, "eventIds", eventIds, "err", err)
-			}
+		if err != nil {
+			logger.Warn("failed to publish event", "channelPub", channelPub, "id", post.Id, "useRepost", useRepost, "err", err)
+			failed++
+			continue
 		}
+		published = append(published, post.Id)
+	}
+
+	w.markDelivered(subscriberPub, channelPub, published, end)
+
+	if failed == len(feed) {
+		return fmt.Errorf("failed to publish any of %d events of the feed", len(feed))
+	}
+	if failed > 0 {
+		logger.Warn("feed partially published", "subscriberPub", subscriberPub, "channelPub", channelPub, "failed", failed, "total", len(feed))
 	}
 
 	logger.Info("reposted feed", "subscriberPub", subscriberPub, "channelPub", channelPub, "eventIds", eventIds, "useRepost", useRepost)
 	return nil
 }
 
+// feed returns the top posts from start to end not delivered to the channel
+// yet.
+func (w *Worker) feed(subscriberPub, channelPub string, start, end time.Time, limit int) []types.FeedEntry {
+	delivered := w.delivered(subscriberPub, channelPub, end)
+	// ask for as many more as may have been delivered already
+	feed := w.service.GetFeed(subscriberPub, start, end, limit+len(delivered))
+	return undelivered(feed, delivered, limit)
+}
+
+func (w *Worker) markDelivered(subscriberPub, channelPub string, ids []string, at time.Time) {
+	if w.redeliver <= 0 || len(ids) == 0 {
+		return
+	}
+	if err := w.service.MarkDelivered(subscriberPub, channelPub, ids, at); err != nil {
+		logger.Warn("failed to record delivered events", "subscriberPub", subscriberPub, "channelPub", channelPub, "err", err)
+	}
+}
+
+// delivered returns the events delivered to the channel or the subscriber
+// within the redelivery period before now.
+func (w *Worker) delivered(subscriberPub, channelPub string, now time.Time) map[string]bool {
+	delivered := map[string]bool{}
+	if w.redeliver <= 0 {
+		return delivered
+	}
+
+	ids, err := w.service.GetDelivered(subscriberPub, channelPub, now.Add(-w.redeliver))
+	if err != nil {
+		logger.Warn("failed to get delivered events", "subscriberPub", subscriberPub, "channelPub", channelPub, "err", err)
+		return delivered
+	}
+	for _, id := range ids {
+		delivered[id] = true
+	}
+	return delivered
+}
+
+// undelivered returns up to limit entries of feed not delivered yet.
+func undelivered(feed []types.FeedEntry, delivered map[string]bool, limit int) []types.FeedEntry {
+	result := make([]types.FeedEntry, 0, limit)
+	for _, entry := range feed {
+		if len(result) == limit {
+			break
+		}
+		if !delivered[entry.Id] {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
 func (w *Worker) pusher(id int, ctx context.Context, subscribers <-chan *types.Subscriber, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for subscriber := range subscribers {
@@ -132,11 +214,30 @@ func (w *Worker) pusher(id int, ctx context.Context, subscribers <-chan *types.S
 			logger.Info("skipping non subscriber", "pubkey", subscriber.Pubkey)
 			continue
 		}
-		err := w.Push(ctx, subscriber.Pubkey, subscriber.ChannelSecret, PushInterval, PushSize, false)
+		now := time.Now()
+		if !pushDue(*subscriber, now) {
+			logger.Debug("skipping subscriber not due", "pubkey", subscriber.Pubkey)
+			continue
+		}
+		channel, err := w.ChannelSigner(subscriber)
 		if err != nil {
-			logger.Warn("failed to run worker for subscriber", "pubkey", subscriber.Pubkey, "err", err)
+			logger.Error("failed to open channel secret", "pubkey", subscriber.Pubkey, "err", err)
+			continue
+		}
+		prefs := subscriber.Preferences
+		if prefs.Format == service.FormatDigest {
+			err = w.Digest(ctx, subscriber.Pubkey, channel, pushRange(*subscriber, now), prefs.Size)
 		} else {
-			logger.Info("worker finished for subscriber", "pubkey", subscriber.Pubkey)
+			useRepost := prefs.Format == service.FormatRepost
+			err = w.Push(ctx, subscriber.Pubkey, channel, pushRange(*subscriber, now), prefs.Size, useRepost)
+		}
+		if err != nil {
+			logger.Warn("failed to run worker for subscriber", "pubkey", subscriber.Pubkey, "err", err)
+			continue
+		}
+		logger.Info("worker finished for subscriber", "pubkey", subscriber.Pubkey)
+		if err := w.service.MarkPushed(subscriber.Pubkey, now); err != nil {
+			logger.Warn("failed to record push", "pubkey", subscriber.Pubkey, "err", err)
 		}
 	}
 }
@@ -5,30 +5,118 @@ import (
 	"testing"
 	"time"
 
-	"github.com/dyng/nosdaily/nostr"
+	n "github.com/dyng/nosdaily/nostr"
 	"github.com/dyng/nosdaily/service"
 	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
 
 func TestWorkerRun(t *testing.T) {
-	mockClient := new(nostr.MockClient)
-	mockClient.On("Repost", context.Background(), "channel_secret", "event_id", "author_pub", "raw_event").Return(nil)
+	mockClient := new(n.MockClient)
+	entry := types.FeedEntry{
+		Id:     "event_id",
+		Kind:   1,
+		Pubkey: "author_pub",
+		Raw:    "raw_event",
+	}
+	channelSK := nostr.GeneratePrivateKey()
+	channel, _ := n.NewLocalSigner(channelSK)
+	mockClient.On("Repost", mock.Anything, channel, entry).Return(nil)
 
 	mockService := new(service.MockService)
-	mockService.On("GetFeed").Return([]types.FeedEntry{
-		{
-			Id:     "event_id",
-			Pubkey: "author_pub",
-			Raw:    "raw_event",
-		},
-	})
-
-	worker, err := NewWorker(context.Background(), mockClient, mockService, nil)
+	mockService.On("GetFeed", "subscriber_pub", mock.AnythingOfType("time.Time"), mock.AnythingOfType("time.Time"), 10).Return([]types.FeedEntry{entry})
+
+	worker, err := NewWorker(context.Background(), mockClient, mockService, nil, nil)
 	assert.NoError(t, err)
 
-	worker.Push(context.Background(), "subscriber_pub", "channel_secret", time.Hour, 10, false)
+	assert.NoError(t, worker.Push(context.Background(), "subscriber_pub", channel, time.Hour, 10, true))
 	mockService.AssertCalled(t, "GetFeed", "subscriber_pub", mock.AnythingOfType("time.Time"), mock.AnythingOfType("time.Time"), 10)
-	mockClient.AssertCalled(t, "Repost", context.Background(), "channel_secret", "event_id", "author_pub", "raw_event")
+	mockClient.AssertCalled(t, "Repost", mock.Anything, channel, entry)
+}
+
+func TestPushDue(t *testing.T) {
+	now := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+	lastPush := now.Add(-55 * time.Minute)
+	subscriber := types.Subscriber{Preferences: service.DefaultPreferences}
+
+	// never pushed
+	assert.True(t, pushDue(subscriber, now))
+
+	// an hourly push started a bit late last time is still due
+	subscriber.LastPushedAt = &lastPush
+	assert.True(t, pushDue(subscriber, now))
+
+	subscriber.Preferences.IntervalHours = 6
+	assert.False(t, pushDue(subscriber, now))
+	lastPush = now.Add(-6 * time.Hour)
+	assert.True(t, pushDue(subscriber, now))
+	assert.Equal(t, 6*time.Hour, pushRange(subscriber, now))
+
+	// quiet from 22 to 7 in Tokyo, 12:00 UTC is 21:00 there
+	subscriber.Preferences.QuietFrom, subscriber.Preferences.QuietTo, subscriber.Preferences.Timezone = 22, 7, "Asia/Tokyo"
+	assert.True(t, pushDue(subscriber, now))
+	assert.False(t, pushDue(subscriber, now.Add(time.Hour)))
+	assert.False(t, pushDue(subscriber, now.Add(9*time.Hour)))
+	assert.True(t, pushDue(subscriber, now.Add(10*time.Hour)))
+
+	// the first push after the quiet hours covers them
+	assert.Equal(t, 16*time.Hour, pushRange(subscriber, now.Add(10*time.Hour)))
+	assert.Equal(t, 24*time.Hour, pushRange(subscriber, now.Add(48*time.Hour)))
+
+	// a weekly push covers the week
+	subscriber.Preferences.IntervalHours = 168
+	assert.Equal(t, 168*time.Hour, pushRange(subscriber, now.Add(30*24*time.Hour)))
+}
+
+// events delivered before are not delivered again
+func TestPushSkipsDelivered(t *testing.T) {
+	mockClient := new(n.MockClient)
+	mockService := new(service.MockService)
+	channelSK := nostr.GeneratePrivateKey()
+	channel, _ := n.NewLocalSigner(channelSK)
+	channelPub, _ := nostr.GetPublicKey(channelSK)
+
+	feed := []types.FeedEntry{{Id: "a", Kind: 1}, {Id: "b", Kind: 1}, {Id: "c", Kind: 1}}
+	mockService.On("GetDelivered", "subscriber_pub", channelPub, mock.AnythingOfType("time.Time")).Return([]string{"a"}, nil)
+	mockService.On("GetFeed", "subscriber_pub", mock.Anything, mock.Anything, 3).Return(feed)
+	mockService.On("MarkDelivered", "subscriber_pub", channelPub, mock.Anything, mock.Anything).Return(nil)
+	mockClient.On("Quote", mock.Anything, mock.Anything, "", mock.Anything).Return(nil)
+
+	redeliverConfig := *config
+	redeliverConfig.Bot.Redeliver = "7d"
+	worker, err := NewWorker(context.Background(), mockClient, mockService, &redeliverConfig, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 7*24*time.Hour, worker.redeliver)
+
+	assert.NoError(t, worker.Push(context.Background(), "subscriber_pub", channel, time.Hour, 2, false))
+	mockClient.AssertNumberOfCalls(t, "Quote", 2)
+	mockClient.AssertNotCalled(t, "Quote", mock.Anything, mock.Anything, "", []types.FeedEntry{feed[0]})
+	mockService.AssertCalled(t, "MarkDelivered", "subscriber_pub", channelPub, []string{"b", "c"}, mock.Anything)
+}
+
+// a digest lists the feed with author names and engagement in one event
+func TestDigest(t *testing.T) {
+	mockClient := new(n.MockClient)
+	mockService := new(service.MockService)
+	channelSK := nostr.GeneratePrivateKey()
+	channel, _ := n.NewLocalSigner(channelSK)
+
+	feed := []types.FeedEntry{{Id: "a", Kind: 1, Pubkey: "alice"}, {Id: "b", Kind: 1, Pubkey: "bob"}}
+	mockService.On("GetFeed", "subscriber_pub", mock.Anything, mock.Anything, 10).Return(feed)
+	mockService.On("GetEngagement", []string{"a", "b"}).Return(map[string]types.Engagement{"a": {Likes: 3}}, nil)
+	mockClient.On("Profiles", mock.Anything, []string{"alice", "bob"}).Return(map[string]string{"alice": "Alice"})
+	mockClient.On("Digest", mock.Anything, channel, n.KindArticle, mock.AnythingOfType("string"), "nossence digest: top 2 notes of the week to "+time.Now().UTC().Format("Jan 2, 2006"), mock.Anything).Return(nil)
+
+	worker, err := NewWorker(context.Background(), mockClient, mockService, config, nil)
+	assert.NoError(t, err)
+
+	assert.NoError(t, worker.Digest(context.Background(), "subscriber_pub", channel, 7*24*time.Hour, 10))
+	items := mockClient.Calls[1].Arguments.Get(5).([]n.DigestItem)
+	assert.Equal(t, []n.DigestItem{
+		{Entry: feed[0], Author: "Alice", Engagement: types.Engagement{Likes: 3}},
+		{Entry: feed[1]},
+	}, items)
+	mockClient.AssertNotCalled(t, "Quote", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
 }
@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+
+	"github.com/dyng/nosdaily/nostr"
+	"github.com/dyng/nosdaily/service"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// requireAdmin rejects requests without the configured admin token. Admin
+// endpoints are closed altogether if no token is configured.
+func (app *Application) requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := app.config.Admin.Token
+		if token == "" {
+			w.WriteHeader(http.StatusForbidden)
+			doResponse(w, false, "admin token is not configured")
+			return
+		}
+
+		given := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(given), []byte("Bearer "+token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			doResponse(w, false, "unauthorized")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (app *Application) handleRelays(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		doResponse(w, true, app.crawler.ListRelays())
+	case http.MethodPost:
+		url := r.URL.Query().Get("url")
+		doRelayResponse(w, app.crawler.AddRelay(url), "added "+url)
+	case http.MethodDelete:
+		url := r.URL.Query().Get("url")
+		doRelayResponse(w, app.crawler.RemoveRelay(url), "removed "+url)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		doResponse(w, false, "method not allowed")
+	}
+}
+
+func (app *Application) handlePauseRelay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		doResponse(w, false, "method not allowed")
+		return
+	}
+
+	url := r.URL.Query().Get("url")
+	doRelayResponse(w, app.crawler.PauseRelay(url), "paused "+url)
+}
+
+func (app *Application) handleResumeRelay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		doResponse(w, false, "method not allowed")
+		return
+	}
+
+	url := r.URL.Query().Get("url")
+	doRelayResponse(w, app.crawler.ResumeRelay(url), "resumed "+url)
+}
+
+func (app *Application) handleRelayHealth(w http.ResponseWriter, r *http.Request) {
+	doResponse(w, true, app.pool.Health().Stats())
+}
+
+func (app *Application) handleIngestStats(w http.ResponseWriter, r *http.Request) {
+	doResponse(w, true, app.crawler.IngestStats())
+}
+
+func (app *Application) handleOutbox(w http.ResponseWriter, r *http.Request) {
+	doResponse(w, true, app.bot.Client.Queued())
+}
+
+// handleRotateChannel replaces the channel of the subscriber given by
+// pubkey, or the channels of all subscribers if all is set.
+func (app *Application) handleRotateChannel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		doResponse(w, false, "method not allowed")
+		return
+	}
+
+	if r.URL.Query().Get("all") == "true" {
+		rotations, err := app.bot.Bot.RotateChannels(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			doResponse(w, false, err.Error())
+			return
+		}
+		doResponse(w, true, rotations)
+		return
+	}
+
+	pubkey := r.URL.Query().Get("pubkey")
+	if pubkey == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		doResponse(w, false, "pubkey or all is required")
+		return
+	}
+
+	channelPub, err := app.bot.Bot.RotateChannel(r.Context(), pubkey)
+	switch {
+	case errors.Is(err, service.ErrSubscriberNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		doResponse(w, false, err.Error())
+	case err != nil:
+		w.WriteHeader(http.StatusInternalServerError)
+		doResponse(w, false, err.Error())
+	default:
+		npub, _ := nip19.EncodePublicKey(channelPub)
+		doResponse(w, true, "rotated channel of "+pubkey+" to "+npub)
+	}
+}
+
+func (app *Application) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		doResponse(w, false, "method not allowed")
+		return
+	}
+
+	if err := app.reloadConfig(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		doResponse(w, false, err.Error())
+		return
+	}
+	doResponse(w, true, "reloaded")
+}
+
+func doRelayResponse(w http.ResponseWriter, err error, msg string) {
+	switch {
+	case err == nil:
+		doResponse(w, true, msg)
+	case errors.Is(err, nostr.ErrRelayNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		doResponse(w, false, err.Error())
+	case errors.Is(err, nostr.ErrRelayExists):
+		w.WriteHeader(http.StatusConflict)
+		doResponse(w, false, err.Error())
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		doResponse(w, false, err.Error())
+	}
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		doResponse(w, true, "ok")
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		status int
+	}{
+		{"no token configured", "", "", http.StatusForbidden},
+		{"no token configured with header", "", "Bearer ", http.StatusForbidden},
+		{"missing header", "secret", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer nope", http.StatusUnauthorized},
+		{"right token", "secret", "Bearer secret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &Application{config: &types.Config{Admin: types.AdminConfig{Token: tt.token}}}
+			req := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			app.requireAdmin(ok)(rec, req)
+			assert.Equal(t, tt.status, rec.Code)
+		})
+	}
+}
@@ -8,12 +8,15 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/dyng/nosdaily/bot"
 	"github.com/dyng/nosdaily/database"
 	"github.com/dyng/nosdaily/nostr"
+	"github.com/dyng/nosdaily/relay"
 	"github.com/dyng/nosdaily/service"
 	"github.com/dyng/nosdaily/types"
 	"github.com/ethereum/go-ethereum/log"
@@ -26,6 +29,7 @@ type Application struct {
 	neo4j   *database.Neo4jDb
 	service *service.Service
 	crawler *nostr.Crawler
+	pool    *relay.Pool
 	bot     *bot.BotApplication
 	nserver *nostr.NameServer
 }
@@ -49,14 +53,19 @@ func NewApplication() *Application {
 	// inject dependencies
 	neo4j := database.NewNeo4jDb(config)
 	service := service.NewService(config, neo4j)
-	crawler := nostr.NewCrawler(config, service)
-	bot := bot.NewBotApplication(config, service)
-	nserver := nostr.NewNameServer(config, neo4j)
+	pool := relay.NewPool(relay.NewHealth(config.Relay.Health), config.Relay.Auth)
+	crawler, err := nostr.NewCrawler(config, service, pool)
+	if err != nil {
+		log.Crit("Failed to create crawler", "err", err)
+	}
+	bot := bot.NewBotApplication(config, service, pool)
+	nserver := nostr.NewNameServer(config, neo4j, bot.Bot.Pubkey())
 	return &Application{
 		config:  config,
 		neo4j:   neo4j,
 		service: service,
 		crawler: crawler,
+		pool:    pool,
 		bot:     bot,
 		nserver: nserver,
 	}
@@ -73,6 +82,7 @@ func (app *Application) Run() {
 
 	// start crawler
 	app.crawler.Run()
+	go app.reloadOnSignal()
 
 	// start bot app
 	go func() {
@@ -86,12 +96,22 @@ func (app *Application) Run() {
 func (app *Application) listenAndServe() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/v1/recommendations/trends", app.handleRecommendationsTrends)
+	mux.HandleFunc("/api/v1/events", app.handleEvent)
+	mux.HandleFunc("/api/v1/preferences", app.handlePreferences)
 	mux.HandleFunc("/feed", app.handleFeed)
 	mux.HandleFunc("/push", app.handlePush)
 	mux.HandleFunc("/batch", app.handleBatch)
 	mux.HandleFunc("/run", app.handleRun)
 	mux.HandleFunc("/subscribe", app.handleSubscribe)
 	mux.HandleFunc("/.well-known/nostr.json", app.nserver.Serve)
+	mux.HandleFunc("/admin/relays", app.requireAdmin(app.handleRelays))
+	mux.HandleFunc("/admin/relays/pause", app.requireAdmin(app.handlePauseRelay))
+	mux.HandleFunc("/admin/relays/resume", app.requireAdmin(app.handleResumeRelay))
+	mux.HandleFunc("/admin/relays/health", app.requireAdmin(app.handleRelayHealth))
+	mux.HandleFunc("/admin/ingest", app.requireAdmin(app.handleIngestStats))
+	mux.HandleFunc("/admin/outbox", app.requireAdmin(app.handleOutbox))
+	mux.HandleFunc("/admin/channels/rotate", app.requireAdmin(app.handleRotateChannel))
+	mux.HandleFunc("/admin/reload", app.requireAdmin(app.handleReload))
 
 	log.Info("Server started")
 	err := http.ListenAndServe(":8080", mux)
@@ -151,6 +171,80 @@ func (app *Application) handleRecommendationsTrends(w http.ResponseWriter, r *ht
 	doApiResponse(w, true, feed)
 }
 
+func (app *Application) handleEvent(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+
+	event, err := app.service.GetEvent(id)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		doApiResponse(w, false, err.Error())
+		return
+	}
+	if event == nil {
+		w.WriteHeader(http.StatusNotFound)
+		doApiResponse(w, false, "event not found")
+		return
+	}
+	doApiResponse(w, true, event)
+}
+
+// handlePreferences reads the delivery preferences of the subscriber who
+// signed the NIP-98 authorization of the request, or changes those given in
+// the body of a PUT.
+func (app *Application) handlePreferences(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		doApiResponse(w, false, "method not allowed")
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		doApiResponse(w, false, err.Error())
+		return
+	}
+	pubkey, err := nostr.VerifyHTTPAuth(r.Header.Get("Authorization"), r.Method, r.URL.RequestURI(), body, time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		doApiResponse(w, false, err.Error())
+		return
+	}
+
+	subscriber := app.service.GetSubscriber(pubkey)
+	if subscriber == nil {
+		w.WriteHeader(http.StatusNotFound)
+		doApiResponse(w, false, "subscriber not found")
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		doApiResponse(w, true, subscriber.Preferences)
+		return
+	}
+
+	prefs := subscriber.Preferences
+	if err := json.Unmarshal(body, &prefs); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		doApiResponse(w, false, "body must be a JSON object of preferences")
+		return
+	}
+	err = app.service.UpdatePreferences(pubkey, prefs)
+	switch {
+	case errors.Is(err, service.ErrInvalidPreferences):
+		w.WriteHeader(http.StatusBadRequest)
+		doApiResponse(w, false, err.Error())
+	case errors.Is(err, service.ErrSubscriberNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		doApiResponse(w, false, err.Error())
+	case err != nil:
+		w.WriteHeader(http.StatusInternalServerError)
+		doApiResponse(w, false, err.Error())
+	default:
+		doApiResponse(w, true, prefs)
+	}
+}
+
 func (app *Application) handleFeed(w http.ResponseWriter, r *http.Request) {
 	userPub := r.URL.Query().Get("pubkey")
 
@@ -182,9 +276,18 @@ func (app *Application) handlePush(w http.ResponseWriter, r *http.Request) {
 	subscriber := app.service.GetSubscriber(subscriberPub)
 	if subscriber == nil {
 		doResponse(w, false, "subscriber not found")
+		return
 	}
 
-	app.bot.Worker.Push(r.Context(), subscriberPub, subscriber.ChannelSecret, time.Hour, 10, useRepost)
+	channel, err := app.bot.Worker.ChannelSigner(subscriber)
+	if err != nil {
+		doResponse(w, false, err.Error())
+		return
+	}
+	if err := app.bot.Worker.Push(r.Context(), subscriberPub, channel, time.Hour, 10, useRepost); err != nil {
+		doResponse(w, false, err.Error())
+		return
+	}
 	doResponse(w, true, "pushed")
 }
 
@@ -193,13 +296,16 @@ func (app *Application) handleSubscribe(w http.ResponseWriter, r *http.Request)
 	ctx := context.Background()
 	ba := app.bot
 
-	channelSK, new, err := ba.Bot.GetOrCreateSubscription(ctx, subscriberPub)
+	channel, new, err := ba.Bot.GetOrCreateSubscription(ctx, subscriberPub)
 	if err != nil {
 		log.Warn("failed to create channel", "pubkey", subscriberPub, "err", err)
+		doResponse(w, false, err.Error())
+		return
 	}
 
 	if new {
-		err := ba.Bot.SendWelcomeMessage(ctx, channelSK, subscriberPub)
+		channelPub, _ := channel.PublicKey(ctx)
+		err := ba.Bot.SendWelcomeMessage(ctx, channelPub, subscriberPub)
 		if err != nil {
 			log.Error("failed to send welcome message", "pubkey", subscriberPub, "err", err)
 		} else {
@@ -208,7 +314,7 @@ func (app *Application) handleSubscribe(w http.ResponseWriter, r *http.Request)
 	}
 
 	// prepare initial content for first subscription
-	err = ba.Worker.Push(ctx, subscriberPub, channelSK, bot.PushInterval, bot.PushSize, false)
+	err = ba.Worker.Push(ctx, subscriberPub, channel, bot.PushInterval, bot.PushSize, false)
 	if err != nil {
 		log.Error("failed to prepare initial content", "pubkey", subscriberPub, "err", err)
 	}
@@ -244,17 +350,49 @@ func doApiResponse(w http.ResponseWriter, success bool, body any) {
 }
 
 func loadConfig() *types.Config {
+	config, err := readConfig()
+	if err != nil {
+		fmt.Printf("Failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+	return config
+}
+
+func readConfig() (*types.Config, error) {
 	config := &types.Config{}
 	files := uconfig.Files{
 		{"config.json", json.Unmarshal},
 	}
 	_, err := uconfig.Classic(&config, files)
 	if err != nil {
-		fmt.Printf("Failed to load config: %v\n", err)
-		os.Exit(1)
+		return nil, err
 	}
 	setDefaultValue(config)
-	return config
+	return config, nil
+}
+
+// reloadConfig reads the configuration again and applies the parts that can
+// change at runtime, i.e. the crawl profiles.
+func (app *Application) reloadConfig() error {
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	app.crawler.SetProfiles(config.Crawler.Profiles)
+	return nil
+}
+
+// reloadOnSignal reloads the configuration whenever SIGHUP is received.
+func (app *Application) reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		log.Info("Reloading configuration")
+		if err := app.reloadConfig(); err != nil {
+			log.Error("Failed to reload configuration", "err", err)
+		}
+	}
 }
 
 // set some default values that cannot be parsed by struct tags
@@ -263,6 +401,10 @@ func setDefaultValue(config *types.Config) {
 		config.Bot.Metadata.About = "A recommender engine for nostr. Follow this account and post '@nossence #subscribe' to get your own feed!"
 	}
 
+	if config.Relay.Auth.SK == "" {
+		config.Relay.Auth.SK = config.Bot.SK
+	}
+
 	if config.Bot.Metadata.ChannelAbout == "" {
 		config.Bot.Metadata.ChannelAbout = "nossence curated content for %s powered by %s"
 	}
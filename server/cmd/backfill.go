@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/dyng/nosdaily/database"
+	"github.com/dyng/nosdaily/nostr"
+	"github.com/dyng/nosdaily/relay"
+	"github.com/dyng/nosdaily/service"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+func runBackfill(args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	days := fs.Int("days", 7, "number of days to backfill, ignored if -since is set")
+	sinceParam := fs.String("since", "", "start of the range, as a date (2006-01-02) or RFC3339 time")
+	untilParam := fs.String("until", "", "end of the range, as a date (2006-01-02) or RFC3339 time, defaults to now")
+	relaysParam := fs.String("relays", "", "comma separated relay urls, defaults to the crawler relays")
+	restart := fs.Bool("restart", false, "ignore saved progress and start over")
+	fs.Parse(args)
+
+	until := time.Now()
+	if *untilParam != "" {
+		t, err := parseDate(*untilParam)
+		if err != nil {
+			return err
+		}
+		until = t
+	}
+
+	since := until.AddDate(0, 0, -*days)
+	if *sinceParam != "" {
+		t, err := parseDate(*sinceParam)
+		if err != nil {
+			return err
+		}
+		since = t
+	}
+
+	if !since.Before(until) {
+		return fmt.Errorf("since (%v) must be before until (%v)", since, until)
+	}
+
+	config := loadConfig()
+	initLogger(config)
+
+	relays := config.Crawler.Relays
+	if *relaysParam != "" {
+		relays = strings.Split(*relaysParam, ",")
+	}
+
+	neo4j := database.NewNeo4jDb(config)
+	if err := neo4j.Connect(); err != nil {
+		return err
+	}
+	defer neo4j.Close()
+
+	service := service.NewService(config, neo4j)
+	if err := service.Init(); err != nil {
+		return err
+	}
+
+	// stop gracefully on interrupt, progress is saved per window
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	log.Info("Starting backfill", "relays", relays, "since", since, "until", until)
+	pool := relay.NewPool(relay.NewHealth(config.Relay.Health), config.Relay.Auth)
+	nostr.NewBackfiller(config, service, pool).Run(ctx, relays, since, until, *restart)
+	return nil
+}
+
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
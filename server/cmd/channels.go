@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dyng/nosdaily/bot"
+	"github.com/dyng/nosdaily/nostr"
+)
+
+const channelsUsage = "usage: channels rotate <pubkey|npub> | rotate -all"
+
+// runChannels manages the channels of the subscribers through the admin api.
+func runChannels(args []string) error {
+	if len(args) < 2 || args[0] != "rotate" {
+		return errors.New(channelsUsage)
+	}
+
+	if args[1] == "-all" {
+		// every channel is announced on the relays, this takes a while
+		data, err := adminRequest(http.MethodPost, "/admin/channels/rotate?all=true", time.Hour)
+		if err != nil {
+			return err
+		}
+		var rotations bot.ChannelRotations
+		if err := json.Unmarshal(data, &rotations); err != nil {
+			return err
+		}
+		fmt.Printf("rotated %d channels\n", rotations.Rotated)
+		if len(rotations.Failed) > 0 {
+			return fmt.Errorf("failed to rotate channels of %s", strings.Join(rotations.Failed, ", "))
+		}
+		return nil
+	}
+
+	pubkey := args[1]
+	if strings.HasPrefix(pubkey, "npub") {
+		var err error
+		if pubkey, err = nostr.DecodeNpub(pubkey); err != nil {
+			return err
+		}
+	}
+
+	data, err := adminRequest(http.MethodPost, "/admin/channels/rotate?pubkey="+url.QueryEscape(pubkey), time.Minute)
+	if err != nil {
+		return err
+	}
+	var msg string
+	json.Unmarshal(data, &msg)
+	fmt.Println(msg)
+	return nil
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"backfill": {
+		usage: "fetch historical events from crawler relays",
+		run:   runBackfill,
+	},
+	"channels": {
+		usage: "rotate the channel keys of subscribers",
+		run:   runChannels,
+	},
+	"relays": {
+		usage: "list, add, remove, pause or resume relays of the running crawler",
+		run:   runRelays,
+	},
+}
+
+// Execute runs a one-off command instead of the server and exits on failure.
+func Execute(name string, args []string) {
+	c, ok := commands[name]
+	if !ok {
+		fmt.Printf("Unknown command: %s\n\nAvailable commands:\n", name)
+		names := make([]string, 0, len(commands))
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			fmt.Printf("  %-10s %s\n", n, commands[n].usage)
+		}
+		os.Exit(2)
+	}
+
+	if err := c.run(args); err != nil {
+		fmt.Printf("Command %s failed: %v\n", name, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dyng/nosdaily/nostr"
+)
+
+const relaysUsage = "usage: relays list | add <url> | remove <url> | pause <url> | resume <url>"
+
+// runRelays manages the relays of a running crawler through the admin api.
+func runRelays(args []string) error {
+	if len(args) == 0 {
+		return errors.New(relaysUsage)
+	}
+
+	action := args[0]
+	var method, path string
+	switch action {
+	case "list":
+		method, path = http.MethodGet, "/admin/relays"
+	case "add":
+		method, path = http.MethodPost, "/admin/relays"
+	case "remove":
+		method, path = http.MethodDelete, "/admin/relays"
+	case "pause", "resume":
+		method, path = http.MethodPost, "/admin/relays/"+action
+	default:
+		return errors.New(relaysUsage)
+	}
+
+	if action != "list" {
+		if len(args) < 2 {
+			return errors.New(relaysUsage)
+		}
+		path += "?url=" + url.QueryEscape(args[1])
+	}
+
+	data, err := adminRequest(method, path, 10*time.Second)
+	if err != nil {
+		return err
+	}
+
+	if action != "list" {
+		var msg string
+		json.Unmarshal(data, &msg)
+		fmt.Println(msg)
+		return nil
+	}
+
+	var relays []nostr.RelayStatus
+	if err := json.Unmarshal(data, &relays); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "URL\tSOURCE\tSTATE\tCONNECTED AT\tCHECKPOINT\tERROR")
+	for _, r := range relays {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.URL, r.Source, r.State, formatTime(r.ConnectedAt), formatTime(r.Checkpoint), r.Error)
+	}
+	return tw.Flush()
+}
+
+// adminRequest calls the admin api of the running server and returns the
+// data of a successful response.
+func adminRequest(method, path string, timeout time.Duration) (json.RawMessage, error) {
+	config := loadConfig()
+	req, err := http.NewRequest(method, strings.TrimSuffix(config.Admin.Endpoint, "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if config.Admin.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+config.Admin.Token)
+	}
+
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Success bool            `json:"success"`
+		Data    json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("unexpected response (%s): %w", resp.Status, err)
+	}
+
+	if !body.Success {
+		var msg string
+		json.Unmarshal(body.Data, &msg)
+		return nil, fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+	return body.Data, nil
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"os"
+	"strings"
+
 	"github.com/dyng/nosdaily/cmd"
 )
 
 func main() {
+	// run a one-off command if given, e.g. `main backfill -days 7`
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		cmd.Execute(os.Args[1], os.Args[2:])
+		return
+	}
+
 	app := cmd.NewApplication()
 	app.Run()
 }
@@ -0,0 +1,267 @@
+package nostr
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dyng/nosdaily/relay"
+	"github.com/dyng/nosdaily/service"
+	"github.com/dyng/nosdaily/types"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	minBackfillWindow = time.Minute
+	maxBackfillWindow = 24 * time.Hour
+)
+
+type backfillStore interface {
+	eventStore
+	GetBackfillCursor(url string) (*time.Time, error)
+	SaveBackfillCursor(url string, cursor time.Time) error
+}
+
+// Backfiller fetches historical events from relays by walking a time range
+// in since/until windows, paging through each window with limit.
+type Backfiller struct {
+	config  *types.Config
+	service backfillStore
+	pool    *relay.Pool
+}
+
+func NewBackfiller(config *types.Config, service *service.Service, pool *relay.Pool) *Backfiller {
+	return &Backfiller{
+		config:  config,
+		service: service,
+		pool:    pool,
+	}
+}
+
+// Run backfills all relays concurrently and returns when all of them are done.
+// Unless restart is set, each relay resumes from its saved cursor if it falls
+// into the requested range.
+func (b *Backfiller) Run(ctx context.Context, urls []string, since, until time.Time, restart bool) {
+	var wg sync.WaitGroup
+	for _, url := range urls {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			err := b.backfillRelay(ctx, url, since, until, restart)
+			if err != nil {
+				log.Error("Backfill aborted", "url", url, "err", err)
+			} else {
+				log.Info("Backfill finished", "url", url)
+			}
+		}(url)
+	}
+	wg.Wait()
+}
+
+func (b *Backfiller) backfillRelay(ctx context.Context, url string, since, until time.Time, restart bool) error {
+	start := since
+	if !restart {
+		cursor, err := b.service.GetBackfillCursor(url)
+		if err != nil {
+			return err
+		}
+		if cursor != nil && cursor.After(since) && cursor.Before(until) {
+			log.Info("Resuming backfill from cursor", "url", url, "cursor", cursor)
+			start = *cursor
+		}
+	}
+
+	conn := b.pool.Acquire(url)
+	defer b.pool.Release(url)
+
+	window := timeOffset(b.config.Crawler.Backfill.Window)
+	if window < minBackfillWindow {
+		window = minBackfillWindow
+	}
+	pageSize := b.config.Crawler.Backfill.PageSize
+
+	log.Info("Starting backfill", "url", url, "since", start, "until", until)
+	for start.Before(until) {
+		end := start.Add(window)
+		if end.After(until) {
+			end = until
+		}
+
+		// the connection may have dropped in the middle of the window, in
+		// which case the result is incomplete and the window is fetched again
+		// once the pool has reconnected
+		count, truncated, err := b.fetchWindow(ctx, conn, start, end)
+		if errors.Is(err, relay.ErrNotConnected) || errors.Is(err, relay.ErrTimeout) {
+			log.Warn("Connection lost during backfill, retrying window", "url", url, "err", err)
+			if err := b.throttle(ctx); err != nil {
+				return err
+			}
+			if err := b.waitConnected(ctx, conn); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		log.Info("Backfilled window", "url", url, "since", start, "until", end, "events", count, "window", window)
+		err = b.service.SaveBackfillCursor(url, end)
+		if err != nil {
+			log.Error("Failed to save backfill cursor", "url", url, "err", err)
+		}
+
+		// shrink the window when the relay truncates the results, and grow
+		// it again when it comes back mostly empty
+		if truncated && window > minBackfillWindow {
+			window /= 2
+		} else if count < pageSize/4 && window < maxBackfillWindow {
+			window *= 2
+		}
+
+		start = end
+	}
+
+	return nil
+}
+
+// fetchWindow stores all events between since and until. Relays supporting
+// negentropy only send the events that are not stored yet, others are paged
+// through: relays return the newest events first, so when a page is full the
+// next page ends at the oldest event of the previous one.
+func (b *Backfiller) fetchWindow(ctx context.Context, conn *relay.Relay, since, until time.Time) (count int, truncated bool, err error) {
+	if b.config.Crawler.Negentropy {
+		filter := nostr.Filter{
+			Kinds: crawlKinds,
+			Since: &since,
+			Until: &until,
+		}
+		count, err := reconcile(ctx, conn, b.service, filter)
+		if !errors.Is(err, relay.ErrNegentropyUnsupported) {
+			if err == nil {
+				err = b.throttle(ctx)
+			}
+			return count, false, err
+		}
+		log.Debug("Falling back to paging", "url", conn.URL, "err", err)
+	}
+
+	pageSize := b.config.Crawler.Backfill.PageSize
+	pageUntil := until
+
+	for {
+		filter := nostr.Filter{
+			Kinds: crawlKinds,
+			Since: &since,
+			Until: &pageUntil,
+			Limit: pageSize,
+		}
+		log.Debug("Querying relay", "url", conn.URL, "filter", filter)
+		events, err := conn.QuerySync(ctx, filter)
+		if err != nil {
+			return count, truncated, err
+		}
+
+		oldest := pageUntil
+		for _, ev := range events {
+			err := b.service.StoreEvent(ev)
+			if err != nil {
+				log.Error("Failed to store event", "event", ev, "err", err)
+			}
+			if ev.CreatedAt.Before(oldest) {
+				oldest = ev.CreatedAt
+			}
+		}
+		count += len(events)
+
+		if err := b.throttle(ctx); err != nil {
+			return count, truncated, err
+		}
+
+		if pageSize == 0 || len(events) < pageSize {
+			return count, truncated, nil
+		}
+
+		// a full page of events sharing the same second would otherwise
+		// be requested over and over again, that second is fetched on its
+		// own before moving on to the previous one
+		truncated = true
+		if !oldest.Before(pageUntil) {
+			n, err := b.fetchSecond(ctx, conn, pageUntil)
+			count += n
+			if err != nil {
+				return count, truncated, err
+			}
+			oldest = pageUntil.Add(-time.Second)
+		}
+		if oldest.Before(since) {
+			return count, truncated, nil
+		}
+		pageUntil = oldest
+	}
+}
+
+// fetchSecond stores all events of one second with more events than fit in
+// a page. Negentropy is tried even if it is disabled for whole windows, as
+// it is the only way to tell which of them are missing. Relays without it
+// are asked for each kind on its own, a kind that still fills a page is
+// logged as incomplete.
+func (b *Backfiller) fetchSecond(ctx context.Context, conn *relay.Relay, second time.Time) (int, error) {
+	filter := nostr.Filter{
+		Kinds: crawlKinds,
+		Since: &second,
+		Until: &second,
+	}
+	count, err := reconcile(ctx, conn, b.service, filter)
+	if !errors.Is(err, relay.ErrNegentropyUnsupported) {
+		return count, err
+	}
+
+	pageSize := b.config.Crawler.Backfill.PageSize
+	for _, kind := range crawlKinds {
+		filter := nostr.Filter{
+			Kinds: []int{kind},
+			Since: &second,
+			Until: &second,
+			Limit: pageSize,
+		}
+		events, err := conn.QuerySync(ctx, filter)
+		if err != nil {
+			return count, err
+		}
+		for _, ev := range events {
+			if err := b.service.StoreEvent(ev); err != nil {
+				log.Error("Failed to store event", "event", ev, "err", err)
+			}
+		}
+		count += len(events)
+		if len(events) >= pageSize {
+			log.Warn("More events in one second than fit in a page, some may be missing", "url", conn.URL, "second", second, "kind", kind)
+		}
+	}
+	return count, nil
+}
+
+// waitConnected waits until the pool has reconnected to a relay, giving up
+// when ctx is done.
+func (b *Backfiller) waitConnected(ctx context.Context, conn *relay.Relay) error {
+	for {
+		if err := conn.WaitConnected(ctx); err == nil {
+			return nil
+		}
+		if err := b.throttle(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *Backfiller) throttle(ctx context.Context) error {
+	select {
+	case <-time.After(timeOffset(b.config.Crawler.Backfill.Throttle)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
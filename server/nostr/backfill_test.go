@@ -0,0 +1,143 @@
+package nostr
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dyng/nosdaily/relay"
+	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryBackfillStore struct {
+	memoryEventStore
+	cursors []time.Time
+}
+
+func (m *memoryBackfillStore) GetBackfillCursor(url string) (*time.Time, error) {
+	if len(m.cursors) == 0 {
+		return nil, nil
+	}
+	return &m.cursors[len(m.cursors)-1], nil
+}
+
+func (m *memoryBackfillStore) SaveBackfillCursor(url string, cursor time.Time) error {
+	m.cursors = append(m.cursors, cursor)
+	return nil
+}
+
+func TestBackfillWindows(t *testing.T) {
+	mock := relay.NewMockRelay()
+	defer mock.Close()
+
+	sk := nostr.GeneratePrivateKey()
+	pub, _ := nostr.GetPublicKey(sk)
+	since := time.Now().Add(-24 * time.Hour).Truncate(time.Hour)
+	until := since.Add(3 * time.Hour)
+
+	// the first window has more events than fit in a page, the rest of the
+	// range has a single event
+	var want []string
+	for _, offset := range []time.Duration{5, 10, 20, 30, 40, 50, 100} {
+		ev := &nostr.Event{
+			PubKey:    pub,
+			CreatedAt: since.Add(offset * time.Minute),
+			Kind:      1,
+			Content:   "hello",
+		}
+		assert.NoError(t, ev.Sign(sk))
+		mock.AddEvent(ev)
+		want = append(want, ev.ID)
+	}
+
+	config := &types.Config{}
+	config.Crawler.Backfill = types.BackfillConfig{Window: "1h", PageSize: 4, Throttle: "0s"}
+	store := &memoryBackfillStore{memoryEventStore: memoryEventStore{events: map[string]*nostr.Event{}}}
+	pool := relay.NewPool(relay.NewHealth(types.HealthConfig{}), types.AuthConfig{})
+	b := &Backfiller{config: config, service: store, pool: pool}
+
+	err := b.backfillRelay(context.Background(), mock.URL, since, until, true)
+	assert.NoError(t, err)
+
+	// the full first window is paged through with until, and the window is
+	// halved after it; windows coming back nearly empty double it again
+	var got []string
+	for id := range store.events {
+		got = append(got, id)
+	}
+	assert.ElementsMatch(t, want, got)
+	assert.Equal(t, []time.Time{
+		since.Add(time.Hour),
+		since.Add(90 * time.Minute),
+		since.Add(150 * time.Minute),
+		until,
+	}, store.cursors)
+}
+
+func TestBackfillResume(t *testing.T) {
+	mock := relay.NewMockRelay()
+	defer mock.Close()
+
+	since := time.Now().Add(-24 * time.Hour).Truncate(time.Hour)
+	until := since.Add(2 * time.Hour)
+
+	config := &types.Config{}
+	config.Crawler.Backfill = types.BackfillConfig{Window: "1h", PageSize: 4, Throttle: "0s"}
+	store := &memoryBackfillStore{
+		memoryEventStore: memoryEventStore{events: map[string]*nostr.Event{}},
+		cursors:          []time.Time{since.Add(90 * time.Minute)},
+	}
+	pool := relay.NewPool(relay.NewHealth(types.HealthConfig{}), types.AuthConfig{})
+	b := &Backfiller{config: config, service: store, pool: pool}
+
+	err := b.backfillRelay(context.Background(), mock.URL, since, until, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Time{since.Add(90 * time.Minute), until}, store.cursors)
+}
+
+// a second with more events than fit in a page is fetched completely
+func TestBackfillCrowdedSecond(t *testing.T) {
+	mock := relay.NewMockRelay()
+	defer mock.Close()
+
+	sk := nostr.GeneratePrivateKey()
+	pub, _ := nostr.GetPublicKey(sk)
+	since := time.Now().Add(-24 * time.Hour).Truncate(time.Hour)
+	until := since.Add(time.Hour)
+
+	var want []string
+	for i := 0; i < 10; i++ {
+		ev := &nostr.Event{
+			PubKey:    pub,
+			CreatedAt: since.Add(30 * time.Minute),
+			Kind:      1,
+			Content:   fmt.Sprintf("hello %d", i),
+		}
+		assert.NoError(t, ev.Sign(sk))
+		mock.AddEvent(ev)
+		want = append(want, ev.ID)
+	}
+	earlier := &nostr.Event{PubKey: pub, CreatedAt: since.Add(10 * time.Minute), Kind: 1, Content: "earlier"}
+	assert.NoError(t, earlier.Sign(sk))
+	mock.AddEvent(earlier)
+	want = append(want, earlier.ID)
+
+	config := &types.Config{}
+	config.Crawler.Backfill = types.BackfillConfig{Window: "1h", PageSize: 4, Throttle: "0s"}
+	store := &memoryBackfillStore{memoryEventStore: memoryEventStore{events: map[string]*nostr.Event{}}}
+	pool := relay.NewPool(relay.NewHealth(types.HealthConfig{}), types.AuthConfig{})
+	b := &Backfiller{config: config, service: store, pool: pool}
+
+	err := b.backfillRelay(context.Background(), mock.URL, since, until, true)
+	assert.NoError(t, err)
+
+	var got []string
+	for id := range store.events {
+		got = append(got, id)
+	}
+	assert.ElementsMatch(t, want, got)
+	assert.Equal(t, []time.Time{until}, store.cursors)
+}
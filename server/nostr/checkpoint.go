@@ -0,0 +1,108 @@
+package nostr
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+type checkpointStore interface {
+	GetRelayCheckpoint(url string) (*time.Time, error)
+	SaveRelayCheckpoint(url string, checkpoint time.Time) error
+}
+
+// checkpointer keeps track of the newest created_at seen on each relay and
+// periodically persists it, so that subscriptions can be resumed from where
+// they stopped after a reconnect or a restart.
+type checkpointer struct {
+	store  checkpointStore
+	mu     sync.Mutex
+	latest map[string]time.Time
+	dirty  map[string]bool
+}
+
+func newCheckpointer(store checkpointStore) *checkpointer {
+	return &checkpointer{
+		store:  store,
+		latest: make(map[string]time.Time),
+		dirty:  make(map[string]bool),
+	}
+}
+
+// Observe records an event seen on a relay. Events from the future are
+// ignored, otherwise a single skewed clock would move the checkpoint past
+// events we have not received yet.
+func (cp *checkpointer) Observe(url string, createdAt time.Time) {
+	if createdAt.After(time.Now()) {
+		return
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if createdAt.After(cp.latest[url]) {
+		cp.latest[url] = createdAt
+		cp.dirty[url] = true
+	}
+}
+
+// Get returns the checkpoint of a relay, loading it from the store if it is
+// not known in memory yet.
+func (cp *checkpointer) Get(url string) (time.Time, bool) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if t, ok := cp.latest[url]; ok {
+		return t, true
+	}
+
+	t, err := cp.store.GetRelayCheckpoint(url)
+	if err != nil {
+		log.Error("Failed to load relay checkpoint", "url", url, "err", err)
+		return time.Time{}, false
+	}
+	if t == nil {
+		return time.Time{}, false
+	}
+
+	cp.latest[url] = *t
+	return *t, true
+}
+
+// Flush persists all checkpoints that changed since the last flush.
+func (cp *checkpointer) Flush() {
+	cp.mu.Lock()
+	pending := make(map[string]time.Time, len(cp.dirty))
+	for url := range cp.dirty {
+		pending[url] = cp.latest[url]
+	}
+	cp.dirty = make(map[string]bool)
+	cp.mu.Unlock()
+
+	for url, t := range pending {
+		err := cp.store.SaveRelayCheckpoint(url, t)
+		if err != nil {
+			log.Error("Failed to save relay checkpoint", "url", url, "err", err)
+
+			// retry on next flush
+			cp.mu.Lock()
+			cp.dirty[url] = true
+			cp.mu.Unlock()
+		}
+	}
+}
+
+// Run flushes checkpoints every interval, it never returns.
+func (cp *checkpointer) Run(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cp.Flush()
+	}
+}
@@ -0,0 +1,70 @@
+package nostr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryCheckpointStore struct {
+	checkpoints map[string]time.Time
+	saves       int
+}
+
+func (m *memoryCheckpointStore) GetRelayCheckpoint(url string) (*time.Time, error) {
+	if t, ok := m.checkpoints[url]; ok {
+		return &t, nil
+	}
+	return nil, nil
+}
+
+func (m *memoryCheckpointStore) SaveRelayCheckpoint(url string, checkpoint time.Time) error {
+	m.checkpoints[url] = checkpoint
+	m.saves++
+	return nil
+}
+
+func TestCheckpointObserve(t *testing.T) {
+	store := &memoryCheckpointStore{checkpoints: map[string]time.Time{}}
+	cp := newCheckpointer(store)
+	url := "wss://relay.example.com"
+
+	_, ok := cp.Get(url)
+	assert.False(t, ok)
+
+	newest := time.Now().Add(-time.Minute).Truncate(time.Second)
+	cp.Observe(url, newest.Add(-time.Hour))
+	cp.Observe(url, newest)
+	cp.Observe(url, newest.Add(-time.Minute))
+	// events from the future must not move the checkpoint
+	cp.Observe(url, time.Now().Add(time.Hour))
+
+	got, ok := cp.Get(url)
+	assert.True(t, ok)
+	assert.Equal(t, newest, got)
+
+	cp.Flush()
+	assert.Equal(t, newest, store.checkpoints[url])
+	assert.Equal(t, 1, store.saves)
+
+	// nothing changed, nothing to save
+	cp.Flush()
+	assert.Equal(t, 1, store.saves)
+}
+
+func TestCheckpointLoad(t *testing.T) {
+	url := "wss://relay.example.com"
+	saved := time.Unix(1686000000, 0)
+	store := &memoryCheckpointStore{checkpoints: map[string]time.Time{url: saved}}
+	cp := newCheckpointer(store)
+
+	got, ok := cp.Get(url)
+	assert.True(t, ok)
+	assert.Equal(t, saved, got)
+
+	// older events do not move the checkpoint back
+	cp.Observe(url, saved.Add(-time.Hour))
+	cp.Flush()
+	assert.Equal(t, 0, store.saves)
+}
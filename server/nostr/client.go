@@ -3,30 +3,118 @@ package nostr
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/dyng/nosdaily/relay"
 	"github.com/dyng/nosdaily/types"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/nbd-wtf/go-nostr"
-	"github.com/nbd-wtf/go-nostr/nip04"
 	"github.com/nbd-wtf/go-nostr/nip19"
+	"golang.org/x/exp/slices"
 )
 
 var logger = log.New("module", "nostr")
 
 type Client struct {
-	Relays   map[string]*nostr.Relay
-	ListenTo map[string]*nostr.Relay
+	Relays   map[string]*relay.Relay
+	ListenTo map[string]*relay.Relay
+	pool     *relay.Pool
+	quorum   int
+	queue    *PublishQueue
+	limiter  *rateLimiter
+	received *receivedEvents
+}
+
+const (
+	PublishAccepted = "accepted"
+	PublishRejected = "rejected"
+	PublishTimeout  = "timeout"
+	PublishFailed   = "failed"
+
+	// the relay asked us to slow down, the event is to be published again
+	PublishRateLimited = "rate-limited"
+	// the relay does not accept events from us
+	PublishBlocked = "blocked"
+)
+
+// how often a rate limited event is published again before giving up
+const rateLimitRetries = 3
+
+// how many events received from subscriptions are remembered the relays of
+const receivedHistorySize = 10000
+
+// PublishResult is the outcome of publishing an event to one relay. Message
+// is the reason given by the relay or the error that occurred.
+type PublishResult struct {
+	URL     string `json:"url"`
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+type PublishResults []PublishResult
+
+// Accepted returns the number of relays that accepted the event.
+func (rs PublishResults) Accepted() int {
+	return rs.count(PublishAccepted)
+}
+
+func (rs PublishResults) count(status string) int {
+	n := 0
+	for _, r := range rs {
+		if r.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// Failed returns the results of the relays that did not accept the event.
+func (rs PublishResults) Failed() PublishResults {
+	var failed PublishResults
+	for _, r := range rs {
+		if r.Status != PublishAccepted {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// QuorumError is returned by Publish if fewer relays than the quorum
+// accepted an event.
+type QuorumError struct {
+	ID      string
+	Quorum  int
+	Results PublishResults
+}
+
+func (e *QuorumError) Error() string {
+	reasons := make([]string, 0, len(e.Results))
+	for _, r := range e.Results.Failed() {
+		reasons = append(reasons, fmt.Sprintf("%s %s: %s", r.URL, r.Status, r.Message))
+	}
+	return fmt.Sprintf("event %s accepted by %d of %d relays, %d required (%s)",
+		e.ID, e.Results.Accepted(), len(e.Results), e.Quorum, strings.Join(reasons, "; "))
 }
 
 type IClient interface {
 	Subscribe(ctx context.Context, filters []nostr.Filter) <-chan nostr.Event
-	Repost(ctx context.Context, sk, id, author, raw string) error
-	Quote(ctx context.Context, sk string, comment string, id []string) error
-	Mention(ctx context.Context, sk, msg string, mentions []string) error
-	Metadata(ctx context.Context, sk, name, about, picture, nip05 string, relays []types.RelayInfo) error
+	Repost(ctx context.Context, signer Signer, entry types.FeedEntry) error
+	Quote(ctx context.Context, signer Signer, comment string, entries []types.FeedEntry) error
+	Mention(ctx context.Context, signer Signer, msg string, mentions []string) error
+	Reply(ctx context.Context, signer Signer, parent nostr.Event, seenOn []types.SeenOn, msg string) error
+	ReceivedOn(id string) []types.SeenOn
+	Digest(ctx context.Context, signer Signer, kind int, identifier, title string, items []DigestItem) error
+	Profiles(ctx context.Context, pubkeys []string) map[string]string
+	Metadata(ctx context.Context, signer Signer, name, about, picture, nip05 string, relays []types.RelayInfo) error
+	SendMessage(ctx context.Context, signer Signer, receiverPub, msg string) error
+	ReplyMessage(ctx context.Context, signer Signer, msg DirectMessage, reply string) error
+	Messages(ctx context.Context, signer Signer, cursor *MessageCursor) <-chan DirectMessage
 }
 
 func DecodeNsec(nsec string) (string, error) {
@@ -63,149 +151,321 @@ func DecodeNpub(npub string) (string, error) {
 	return "", fmt.Errorf("invalid npub value: %v", val)
 }
 
-func NewClient(ctx context.Context, uris []string, listenTo []string) (*Client, error) {
+// NewClient creates a client publishing to uris and listening to listenTo,
+// or uris if empty. Publishing fails unless at least quorum relays accept an
+// event, a quorum larger than the number of relays means all of them. If
+// queue is not nil, published events are retried on the relays that did not
+// accept them. Publishing to each relay is limited by limits.
+func NewClient(ctx context.Context, uris []string, listenTo []string, pool *relay.Pool, quorum int, queue *PublishQueue, limits types.RateLimitConfig) (*Client, error) {
 	if len(listenTo) == 0 {
 		listenTo = uris
 	}
 
+	c := &Client{
+		Relays:   map[string]*relay.Relay{},
+		ListenTo: map[string]*relay.Relay{},
+		pool:     pool,
+		quorum:   quorum,
+		queue:    queue,
+		limiter:  newRateLimiter(limits),
+		received: newReceivedEvents(receivedHistorySize),
+	}
+
+	// connections are shared with other users of the pool, which connects
+	// and reconnects them in the background
 	logger.Info("using relays", "uris", strings.Join(uris, ","))
-	rs := map[string]*nostr.Relay{}
 	for _, uri := range uris {
-		r, err := nostr.RelayConnect(ctx, uri)
-		if err != nil {
-			logger.Warn("failed to connect to relay, skipping...", "uri", uri, "err", err)
-			continue
-		}
-		rs[uri] = r
+		c.Relays[uri] = pool.Acquire(uri)
 	}
 
 	logger.Info("listening to relays", "uris", strings.Join(listenTo, ","))
-	listenRs := map[string]*nostr.Relay{}
 	for _, uri := range listenTo {
-		r, err := nostr.RelayConnect(ctx, uri)
-		if err != nil {
-			logger.Warn("failed to connect to relay, skipping...", "uri", uri, "err", err)
-			continue
-		}
-		listenRs[uri] = r
+		c.ListenTo[uri] = pool.Acquire(uri)
 	}
 
-	return &Client{
-		Relays:   rs,
-		ListenTo: listenRs,
-	}, nil
+	return c, nil
+}
+
+// Close releases the relays of the client.
+func (c *Client) Close() {
+	for uri := range c.Relays {
+		c.pool.Release(uri)
+	}
+	for uri := range c.ListenTo {
+		c.pool.Release(uri)
+	}
 }
 
 func (c *Client) Subscribe(ctx context.Context, filters []nostr.Filter) <-chan nostr.Event {
 	ch := make(chan nostr.Event)
 	for uri, r := range c.ListenTo {
 		logger.Info("subscribing to relay", "uri", uri)
-		sub := r.Subscribe(ctx, filters)
-
-		// FIXME: fragile, need to refactor
-		go func(uri string, relay *nostr.Relay, subscription *nostr.Subscription) {
-			for {
-				select {
-				case ev := <-subscription.Events:
-					if ev == nil {
-						logger.Debug("received nil event, channel may closed", "uri", uri)
-					} else {
-						ch <- *ev
-					}
-				case notice := <-relay.Notices:
-					logger.Warn("relay notice", "uri", uri, "notice", notice)
-				case <-relay.ConnectionContext.Done():
-					err := relay.ConnectionError
-					logger.Error("relay connection error, try to reconnect", "uri", uri, "err", err)
-
-					// try to reconnect for at most 5 times
-					reconnected := c.reconnect(relay, 5)
-					if !reconnected {
-						logger.Error("failed to reconnect to relay, closing channel", "uri", uri)
-						return
-					}
-
-					subscription = relay.Subscribe(ctx, filters)
-					logger.Info("reconnected to relay", "uri", uri)
-				}
-			}
-		}(uri, r, sub)
+		subscription := r.Subscribe(ctx, filters)
+		go c.consume(ctx, subscription, ch)
 	}
 
 	return ch
 }
 
-// Publish a signed event to all relays
-func (c *Client) Publish(ctx context.Context, ev nostr.Event) error {
+// consume forwards events of a subscription until ctx is done or the relay
+// closes the subscription.
+func (c *Client) consume(ctx context.Context, subscription *relay.Subscription, ch chan<- nostr.Event) {
+	for {
+		select {
+		case ev, ok := <-subscription.Events:
+			if !ok {
+				return
+			}
+			c.received.Add(ev.ID, subscription.Relay.URL)
+			select {
+			case ch <- *ev:
+			case <-ctx.Done():
+				return
+			}
+		case reason := <-subscription.ClosedReason:
+			logger.Error("subscription closed by relay", "uri", subscription.Relay.URL, "reason", reason)
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ReceivedOn returns the relays a recently received event of Subscribe came
+// from, in the order it came from them.
+func (c *Client) ReceivedOn(id string) []types.SeenOn {
+	return c.received.Get(id)
+}
+
+// receivedEvents remembers the relays recently received events came from in
+// two generations, like seenEvents.
+type receivedEvents struct {
+	mu       sync.Mutex
+	size     int
+	current  map[string][]types.SeenOn
+	previous map[string][]types.SeenOn
+}
+
+func newReceivedEvents(size int) *receivedEvents {
+	return &receivedEvents{
+		size:     size,
+		current:  make(map[string][]types.SeenOn),
+		previous: make(map[string][]types.SeenOn),
+	}
+}
+
+// Add records that the event of id was received from url. A nil
+// receivedEvents records nothing.
+func (r *receivedEvents) Add(id, url string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	seenOn, ok := r.current[id]
+	if !ok {
+		seenOn = r.previous[id]
+	}
+	for _, seen := range seenOn {
+		if seen.URL == url {
+			return
+		}
+	}
+	r.current[id] = append(seenOn, types.SeenOn{URL: url, FirstSeenAt: time.Now()})
+	if len(r.current) >= r.size {
+		r.previous = r.current
+		r.current = make(map[string][]types.SeenOn)
+	}
+}
+
+// Get returns the relays the event of id was received from.
+func (r *receivedEvents) Get(id string) []types.SeenOn {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if seenOn, ok := r.current[id]; ok {
+		return append([]types.SeenOn(nil), seenOn...)
+	}
+	return append([]types.SeenOn(nil), r.previous[id]...)
+}
+
+// Publish a signed event to all relays at once and report how each of them
+// responded. A *QuorumError is returned along with the results if fewer
+// relays than the quorum accepted the event. With a queue, the event is
+// persisted first and retried later on the relays that did not accept it,
+// even if the quorum has been met. Relays that rate limited the event are
+// then counted towards the quorum, as the event is only rescheduled.
+func (c *Client) Publish(ctx context.Context, ev nostr.Event) (PublishResults, error) {
+	if c.queue != nil && len(c.Relays) > 0 {
+		urls := make([]string, 0, len(c.Relays))
+		for uri := range c.Relays {
+			urls = append(urls, uri)
+		}
+		if err := c.queue.Add(ev, urls); err != nil {
+			logger.Error("failed to queue event, publishing without retries", "id", ev.ID, "err", err)
+		}
+	}
+
+	ch := make(chan PublishResult, len(c.Relays))
 	for uri, r := range c.Relays {
-		status, err := r.Publish(ctx, ev)
-		if err != nil {
-			logger.Debug("failed to publish event to relay, try to reconnect and resend", "uri", uri, "id", ev.ID, "err", err)
-			c.reconnect(r, 1)
-			status, err = r.Publish(ctx, ev)
+		go func(uri string, r *relay.Relay) {
+			ch <- c.publish(ctx, uri, r, ev)
+		}(uri, r)
+	}
+
+	results := make(PublishResults, 0, len(c.Relays))
+	for range c.Relays {
+		results = append(results, <-ch)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].URL < results[j].URL
+	})
+	if c.queue != nil {
+		c.queue.Record(ev.ID, results)
+	}
+
+	quorum := c.quorum
+	if quorum <= 0 {
+		quorum = 1
+	}
+	if quorum > len(results) {
+		quorum = len(results)
+	}
+
+	accepted := results.Accepted()
+	if c.queue != nil {
+		if rescheduled := results.count(PublishRateLimited); rescheduled > 0 {
+			logger.Info("event rescheduled on rate limited relays", "id", ev.ID, "relays", rescheduled)
+			accepted += rescheduled
 		}
-		switch status {
-		case nostr.PublishStatusSucceeded:
-			logger.Debug("published event to relay", "uri", uri, "id", ev.ID)
-		case nostr.PublishStatusFailed:
-			logger.Error("failed to publish event to relay, skip", "uri", uri, "id", ev.ID, "err", err)
-		case nostr.PublishStatusSent:
-			logger.Warn("event may or may not published to relay", "uri", uri, "id", ev.ID, "err", err)
+	}
+	if accepted < quorum || accepted == 0 {
+		return results, &QuorumError{ID: ev.ID, Quorum: quorum, Results: results}
+	}
+	if accepted < len(results) {
+		logger.Warn("event not accepted by all relays", "id", ev.ID, "accepted", accepted, "relays", len(results), "failed", results.Failed())
+	}
+	return results, nil
+}
+
+// RetryQueued publishes queued events again until ctx is done, it returns
+// right away if the client has no queue.
+func (c *Client) RetryQueued(ctx context.Context) {
+	if c.queue == nil {
+		return
+	}
+	c.queue.Run(ctx, func(ctx context.Context, uri string, ev nostr.Event) PublishResult {
+		r, ok := c.Relays[uri]
+		if !ok {
+			return PublishResult{URL: uri, Status: PublishDropped, Message: "relay is not used anymore"}
 		}
+		return c.publish(ctx, uri, r, ev)
+	})
+}
+
+// Queued returns the events waiting to be accepted by all relays.
+func (c *Client) Queued() PublishQueueStats {
+	if c.queue == nil {
+		return PublishQueueStats{Pending: []QueuedEvent{}}
 	}
-	return nil
+	return c.queue.Stats()
 }
 
-func (c *Client) reconnect(relay *nostr.Relay, retries int) bool {
-	for i := 0; i < retries; i++ {
-		err := relay.Connect(context.Background())
-		if err != nil {
-			logger.Debug("failed to reconnect to relay, retrying...", "uri", relay.URL, "err", err)
-			time.Sleep(30 * time.Second)
-			continue
+// publish sends an event to one relay within its rate limit. A relay that
+// answers "rate-limited:" is paused and asked again a few times before
+// giving up for now, a relay that answers "blocked:" is not asked again.
+func (c *Client) publish(ctx context.Context, uri string, r *relay.Relay, ev nostr.Event) PublishResult {
+	var result PublishResult
+	for attempt := 0; attempt < rateLimitRetries; attempt++ {
+		if err := c.limiter.Wait(ctx, uri); err != nil {
+			return PublishResult{URL: uri, Status: PublishRateLimited, Message: "rate limit: " + err.Error()}
 		}
-		return true
+
+		result = c.publishOnce(ctx, uri, r, ev)
+		if result.Status != PublishRateLimited {
+			return result
+		}
+		logger.Warn("relay rate limited event, slowing down", "uri", uri, "id", ev.ID, "reason", result.Message)
+		c.limiter.Pause(uri)
 	}
-	return false
+	return result
+}
+
+func (c *Client) publishOnce(ctx context.Context, uri string, r *relay.Relay, ev nostr.Event) PublishResult {
+	result := PublishResult{URL: uri}
+	ok, msg, err := r.Publish(ctx, ev)
+	switch {
+	case errors.Is(err, relay.ErrTimeout):
+		logger.Error("relay did not respond to event in time", "uri", uri, "id", ev.ID)
+		result.Status = PublishTimeout
+		result.Message = err.Error()
+	case err != nil:
+		logger.Error("failed to publish event to relay", "uri", uri, "id", ev.ID, "err", err)
+		result.Status = PublishFailed
+		result.Message = err.Error()
+	case !ok && strings.HasPrefix(msg, "rate-limited:"):
+		result.Status = PublishRateLimited
+		result.Message = msg
+	case !ok && strings.HasPrefix(msg, "blocked:"):
+		logger.Warn("relay blocked event", "uri", uri, "id", ev.ID, "reason", msg)
+		result.Status = PublishBlocked
+		result.Message = msg
+	case !ok:
+		logger.Error("relay rejected event", "uri", uri, "id", ev.ID, "reason", msg)
+		result.Status = PublishRejected
+		result.Message = msg
+	default:
+		logger.Debug("published event to relay", "uri", uri, "id", ev.ID)
+		result.Status = PublishAccepted
+	}
+	return result
 }
 
 // Repost an event
-func (c *Client) Repost(ctx context.Context, sk, eventID, authorPub, raw string) error {
-	note, _ := nip19.EncodeNote(eventID)
-	logger.Debug("reposting event", "event_id", eventID, "note", note, "author_pub", authorPub, "raw", raw)
-	pub, err := nostr.GetPublicKey(sk)
+func (c *Client) Repost(ctx context.Context, signer Signer, entry types.FeedEntry) error {
+	note, _ := nip19.EncodeNote(entry.Id)
+	logger.Debug("reposting event", "event_id", entry.Id, "note", note, "author_pub", entry.Pubkey, "kind", entry.Kind)
+	pub, err := signer.PublicKey(ctx)
 	if err != nil {
 		return err
 	}
 
-	// There's ongoing disucssion about how to create a repost event:
-	// https://github.com/nostr-protocol/nips/issues/173
-	// And there's potential NIP-10 will be extended to support repost:
-	// https://github.com/nostr-protocol/nips/pull/310
-	//
-	// For now aligning with iris.to implementation:
-	// https://github.com/irislib/iris-messenger/blob/0c6181c4dfe3ef0dc96607bc00222b63a473321a/src/js/components/events/Note.js#L76-L83
+	// NIP-18: notes are reposted with kind 6, any other kind with a generic
+	// repost of kind 16 telling the kind of the original in a k tag
+	kind := 6
+	tags := nostr.Tags{
+		nostr.Tag{"e", entry.Id, c.relayHint(entry)},
+		nostr.Tag{"p", entry.Pubkey},
+	}
+	if entry.Kind != 1 {
+		kind = 16
+		tags = append(tags, nostr.Tag{"k", strconv.Itoa(entry.Kind)})
+	}
+
 	ev := nostr.Event{
 		PubKey: pub,
-		Kind:   6,
-		Tags: nostr.Tags{
-			nostr.Tag{"e", eventID, "", "mention"},
-		},
+		Kind:   kind,
+		Tags:   tags,
 		// To align with repost requirement on Damus, there's needs
 		// to set the raw origin event in content field
-		Content:   raw,
+		Content:   entry.Raw,
 		CreatedAt: time.Now(),
 	}
 
-	err = ev.Sign(sk)
+	err = signer.Sign(ctx, &ev)
 	if err != nil {
 		return err
 	}
 
-	return c.Publish(ctx, ev)
+	_, err = c.Publish(ctx, ev)
+	return err
 }
 
-func (c *Client) Quote(ctx context.Context, sk string, comment string, eventIDs []string) error {
+func (c *Client) Quote(ctx context.Context, signer Signer, comment string, entries []types.FeedEntry) error {
 	var sb strings.Builder
 	var tags nostr.Tags
 
@@ -213,17 +473,25 @@ func (c *Client) Quote(ctx context.Context, sk string, comment string, eventIDs
 	sb.WriteString(comment)
 
 	// write events
-	for _, eventID := range eventIDs {
-		note, err := nip19.EncodeNote(eventID)
-		logger.Debug("quoting event", "event_id", eventID, "note", note)
+	var authors []string
+	for _, entry := range entries {
+		hint := c.relayHint(entry)
+		nevent, err := nip19.EncodeEvent(entry.Id, []string{hint}, entry.Pubkey)
+		logger.Debug("quoting event", "event_id", entry.Id, "nevent", nevent)
 		if err != nil {
 			return err
 		}
-		sb.WriteString("\n" + "nostr:" + note)
-		tags = append(tags, nostr.Tag{"q", eventID})
+		sb.WriteString("\n" + "nostr:" + nevent)
+		tags = append(tags, nostr.Tag{"q", entry.Id, hint, entry.Pubkey})
+		if !slices.Contains(authors, entry.Pubkey) {
+			authors = append(authors, entry.Pubkey)
+		}
+	}
+	for _, author := range authors {
+		tags = append(tags, nostr.Tag{"p", author})
 	}
 
-	pub, err := nostr.GetPublicKey(sk)
+	pub, err := signer.PublicKey(ctx)
 	if err != nil {
 		return err
 	}
@@ -236,20 +504,44 @@ func (c *Client) Quote(ctx context.Context, sk string, comment string, eventIDs
 		CreatedAt: time.Now(),
 	}
 
-	err = ev.Sign(sk)
+	err = signer.Sign(ctx, &ev)
 	if err != nil {
 		return err
 	}
 
-	return c.Publish(ctx, ev)
+	_, err = c.Publish(ctx, ev)
+	return err
 }
 
-func (c *Client) Mention(ctx context.Context, sk, msg string, mentions []string) error {
-	senderPub, err := nostr.GetPublicKey(sk)
-	if err != nil {
-		return err
+// relayHint returns a relay to find an event on. Of the relays the event was
+// seen on, one we publish to is preferred, then the one it was seen on
+// first. For an event of unknown provenance it is one of the relays we
+// publish to.
+func (c *Client) relayHint(entry types.FeedEntry) string {
+	urls := make([]string, 0, len(c.Relays))
+	for url := range c.Relays {
+		urls = append(urls, url)
 	}
 
+	normalized := normalizeURLs(urls)
+	for _, seen := range entry.SeenOn {
+		if slices.Contains(normalized, nostr.NormalizeURL(seen.URL)) {
+			return seen.URL
+		}
+	}
+	if len(entry.SeenOn) > 0 {
+		return entry.SeenOn[0].URL
+	}
+
+	if len(urls) == 0 {
+		return ""
+	}
+	sort.Strings(urls)
+	return urls[0]
+}
+
+func (c *Client) Mention(ctx context.Context, signer Signer, msg string, mentions []string) error {
+	senderPub, err := signer.PublicKey(ctx)
 	if err != nil {
 		return err
 	}
@@ -269,16 +561,87 @@ func (c *Client) Mention(ctx context.Context, sk, msg string, mentions []string)
 		Content:   msg,
 	}
 
-	err = ev.Sign(sk)
+	err = signer.Sign(ctx, &ev)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Publish(ctx, ev)
+	return err
+}
+
+// Reply replies to parent in its thread as per NIP-10. The reply mentions
+// the author of parent and everybody parent mentions. seenOn are the relays
+// parent was seen on, the one to hint at is picked from them.
+func (c *Client) Reply(ctx context.Context, signer Signer, parent nostr.Event, seenOn []types.SeenOn, msg string) error {
+	senderPub, err := signer.PublicKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	ev := nostr.Event{
+		PubKey:    senderPub,
+		CreatedAt: time.Now(),
+		Kind:      1,
+		Tags:      replyTags(parent, senderPub, c.relayHint(types.FeedEntry{Id: parent.ID, SeenOn: seenOn}), c.relayHint(types.FeedEntry{})),
+		Content:   msg,
+	}
+
+	err = signer.Sign(ctx, &ev)
 	if err != nil {
 		return err
 	}
 
-	return c.Publish(ctx, ev)
+	_, err = c.Publish(ctx, ev)
+	return err
 }
 
-func (c *Client) Metadata(ctx context.Context, sk, name, about, picture, nip05 string, relays []types.RelayInfo) error {
-	senderPub, err := nostr.GetPublicKey(sk)
+// replyTags returns the e and p tags of a reply to parent by senderPub.
+// parentHint is a relay parent is on, the root of the thread is hinted at
+// as parent does, or with fallbackHint.
+func replyTags(parent nostr.Event, senderPub, parentHint, fallbackHint string) nostr.Tags {
+	// the root of the thread is marked as such, or is the first e tag of a
+	// note using the deprecated positional scheme
+	var root nostr.Tag
+	for _, tag := range parent.Tags {
+		if len(tag) >= 4 && tag[0] == "e" && tag[3] == "root" {
+			root = tag
+			break
+		}
+	}
+	if root == nil {
+		if tag := parent.Tags.GetFirst([]string{"e", ""}); tag != nil && len(*tag) >= 2 && len(*tag) < 4 {
+			root = *tag
+		}
+	}
+
+	tags := nostr.Tags{}
+	if root == nil || root[1] == parent.ID {
+		tags = append(tags, nostr.Tag{"e", parent.ID, parentHint, "root"})
+	} else {
+		rootHint := fallbackHint
+		if len(root) >= 3 && root[2] != "" {
+			rootHint = root[2]
+		}
+		tags = append(tags, nostr.Tag{"e", root[1], rootHint, "root"}, nostr.Tag{"e", parent.ID, parentHint, "reply"})
+	}
+
+	pubs := []string{parent.PubKey}
+	for _, tag := range parent.Tags {
+		if len(tag) >= 2 && tag[0] == "p" && !slices.Contains(pubs, tag[1]) {
+			pubs = append(pubs, tag[1])
+		}
+	}
+	for _, pub := range pubs {
+		if pub != senderPub {
+			tags = append(tags, nostr.Tag{"p", pub})
+		}
+	}
+	return tags
+}
+
+func (c *Client) Metadata(ctx context.Context, signer Signer, name, about, picture, nip05 string, relays []types.RelayInfo) error {
+	senderPub, err := signer.PublicKey(ctx)
 	if err != nil {
 		return err
 	}
@@ -306,12 +669,12 @@ func (c *Client) Metadata(ctx context.Context, sk, name, about, picture, nip05 s
 		Content:   string(contentJson),
 	}
 
-	err = ev.Sign(sk)
+	err = signer.Sign(ctx, &ev)
 	if err != nil {
 		return err
 	}
 
-	err = c.Publish(ctx, ev)
+	_, err = c.Publish(ctx, ev)
 	if err != nil {
 		return err
 	}
@@ -336,47 +699,49 @@ func (c *Client) Metadata(ctx context.Context, sk, name, about, picture, nip05 s
 		Tags:      tags,
 	}
 
-	err = ev.Sign(sk)
+	err = signer.Sign(ctx, &ev)
 	if err != nil {
 		return err
 	}
 
-	return c.Publish(ctx, ev)
+	_, err = c.Publish(ctx, ev)
+	return err
 }
 
-// Sends a NIP-04 message
-func (c *Client) SendMessage(ctx context.Context, sk, receiverPub, msg string) error {
-	senderPub, err := nostr.GetPublicKey(sk)
+// SendMessage sends a NIP-17 private message, i.e. a chat message sealed by
+// the sender and gift wrapped with a throwaway key, so that relays learn
+// neither the sender nor the content. It is sent to the inbox relays of the
+// receiver, or to our relays if it has none or none of them accepted it.
+func (c *Client) SendMessage(ctx context.Context, signer Signer, receiverPub, msg string) error {
+	wrap, err := giftWrap(ctx, signer, receiverPub, msg, time.Now())
 	if err != nil {
 		return err
 	}
 
-	sharedKey, err := nip04.ComputeSharedSecret(receiverPub, sk)
-	if err != nil {
-		return fmt.Errorf("invalid receiver public key: %s", receiverPub)
+	if inbox := c.inboxRelays(ctx, receiverPub); len(inbox) > 0 {
+		err := c.publishInbox(ctx, inbox, wrap)
+		if err == nil {
+			return nil
+		}
+		logger.Warn("failed to send message to inbox relays", "receiver", receiverPub, "err", err)
 	}
 
-	content, err := nip04.Encrypt(msg, sharedKey)
-	if err != nil {
-		return err
-	}
+	_, err = c.Publish(ctx, wrap)
+	return err
+}
 
-	ev := nostr.Event{
-		PubKey:    senderPub,
-		CreatedAt: time.Now(),
-		Kind:      4, // 4 indicates encrypted direct message
-		Tags: nostr.Tags{
-			nostr.Tag{
-				"p", receiverPub, // tag the receiver
-			},
-		},
-		Content: content,
+// ReplyMessage answers a private message in the format it was sent in, as
+// somebody writing NIP-04 messages may not be able to read NIP-17 ones.
+func (c *Client) ReplyMessage(ctx context.Context, signer Signer, msg DirectMessage, reply string) error {
+	if msg.Format != MessageNip04 {
+		return c.SendMessage(ctx, signer, msg.Sender, reply)
 	}
 
-	err = ev.Sign(sk)
+	ev, err := encryptedDM(ctx, signer, msg.Sender, reply, time.Now())
 	if err != nil {
 		return err
 	}
 
-	return c.Publish(ctx, ev)
+	_, err = c.Publish(ctx, ev)
+	return err
 }
@@ -7,6 +7,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/dyng/nosdaily/relay"
+	"github.com/dyng/nosdaily/types"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/nbd-wtf/go-nostr/nip19"
 	"github.com/stretchr/testify/assert"
@@ -15,11 +17,19 @@ import (
 var relays = []string{"wss://relay.damus.io"}
 
 func getIdentity() (sk, pub string) {
-	sk = nostr.GeneratePrivateKey()
+	sk = padSecretKey(nostr.GeneratePrivateKey())
 	pub, _ = nostr.GetPublicKey(sk)
 	return
 }
 
+func signerOf(sk string) Signer {
+	signer, err := NewLocalSigner(sk)
+	if err != nil {
+		panic(err)
+	}
+	return signer
+}
+
 func getReceiverPub() string {
 	receiverPub := os.Getenv("NOSTR_TEST_RECEIVER_PUB")
 	pub, err := DecodeNpub(receiverPub)
@@ -31,12 +41,12 @@ func getReceiverPub() string {
 }
 
 func TestNewClient(t *testing.T) {
-	_, err := NewClient(context.Background(), relays, nil)
+	_, err := NewClient(context.Background(), relays, nil, relay.NewPool(relay.NewHealth(types.HealthConfig{}), types.AuthConfig{}), 1, nil, types.RateLimitConfig{})
 	assert.NoError(t, err)
 }
 
 func TestSubscribe(t *testing.T) {
-	client, err := NewClient(context.Background(), relays, nil)
+	client, err := NewClient(context.Background(), relays, relays, relay.NewPool(relay.NewHealth(types.HealthConfig{}), types.AuthConfig{}), 1, nil, types.RateLimitConfig{})
 	assert.NoError(t, err)
 
 	until := time.Now()
@@ -46,18 +56,21 @@ func TestSubscribe(t *testing.T) {
 		Limit: 10,
 	}}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	c := client.Subscribe(ctx, filters)
-
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
+	c := client.Subscribe(ctx, filters)
 
-	ev := <-c
-	t.Logf("event: %v", ev)
-	assert.NotNil(t, ev)
+	select {
+	case ev := <-c:
+		t.Logf("event: %v", ev)
+		assert.NotNil(t, ev)
+	case <-ctx.Done():
+		t.Fatal("no event received from relays")
+	}
 }
 
 func TestPublish(t *testing.T) {
-	client, err := NewClient(context.Background(), relays, nil)
+	client, err := NewClient(context.Background(), relays, nil, relay.NewPool(relay.NewHealth(types.HealthConfig{}), types.AuthConfig{}), 1, nil, types.RateLimitConfig{})
 	assert.NoError(t, err)
 
 	sk, pub := getIdentity()
@@ -71,23 +84,34 @@ func TestPublish(t *testing.T) {
 	err = ev.Sign(sk)
 	assert.NoError(t, err)
 
-	err = client.Publish(context.Background(), ev)
+	_, err = client.Publish(context.Background(), ev)
 	assert.NoError(t, err)
 }
 
 func TestSendMessage(t *testing.T) {
-	client, err := NewClient(context.Background(), relays, nil)
+	client, err := NewClient(context.Background(), relays, nil, relay.NewPool(relay.NewHealth(types.HealthConfig{}), types.AuthConfig{}), 1, nil, types.RateLimitConfig{})
 	assert.NoError(t, err)
 
+	receiverPub := getReceiverPub()
+	if receiverPub == "" {
+		t.Skip("NOSTR_TEST_RECEIVER_PUB is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for uri, r := range client.Relays {
+		if err := r.WaitConnected(ctx); err != nil {
+			t.Skipf("relay %s is not available: %v", uri, err)
+		}
+	}
+
 	sk, _ := getIdentity()
 	msg := "foo"
-	receiverPub := getReceiverPub()
-	err = client.SendMessage(context.Background(), sk, receiverPub, msg)
+	err = client.SendMessage(context.Background(), signerOf(sk), receiverPub, msg)
 	assert.NoError(t, err)
 }
 
 func TestRepost(t *testing.T) {
-	client, err := NewClient(context.Background(), relays, nil)
+	client, err := NewClient(context.Background(), relays, nil, relay.NewPool(relay.NewHealth(types.HealthConfig{}), types.AuthConfig{}), 1, nil, types.RateLimitConfig{})
 	assert.NoError(t, err)
 
 	sk, _ := getIdentity()
@@ -98,6 +122,189 @@ func TestRepost(t *testing.T) {
 	eventID := "c8436ce1b543ae7c9cabe2da4666cf566410c36d48886d732d2e19165130c652"
 	authorPub := "aba7339fe76595d4ad5bff333f1ba1e9198907588a49df4519a3ade60cc1f998"
 	raw := "{\"pubkey\":\"aba7339fe76595d4ad5bff333f1ba1e9198907588a49df4519a3ade60cc1f998\",\"content\":\"坚持，但不要执念。\\n\\npersevere, but don't obsess.\",\"id\":\"c8436ce1b543ae7c9cabe2da4666cf566410c36d48886d732d2e19165130c652\",\"created_at\":1677890182,\"sig\":\"4db2f023ddce2c9386325770f13a80e0470f20fd4df5535bd536c501377c29e0e80e47f88b5a0077ea9782d20746ce9ee48afeeb9043cdc6266ffdd492485433\",\"kind\":1,\"tags\":[]}"
-	err = client.Repost(context.Background(), sk, eventID, authorPub, raw)
+	err = client.Repost(context.Background(), signerOf(sk), types.FeedEntry{Id: eventID, Kind: 1, Pubkey: authorPub, Raw: raw})
 	assert.Error(t, err)
 }
+
+func TestRepostTags(t *testing.T) {
+	mock := relay.NewMockRelay()
+	defer mock.Close()
+
+	client, err := NewClient(context.Background(), []string{mock.URL}, nil, relay.NewPool(relay.NewHealth(types.HealthConfig{}), types.AuthConfig{}), 1, nil, types.RateLimitConfig{})
+	assert.NoError(t, err)
+	defer client.Close()
+
+	sk, _ := getIdentity()
+	_, authorPub := getIdentity()
+	note := types.FeedEntry{Id: "c8436ce1b543ae7c9cabe2da4666cf566410c36d48886d732d2e19165130c652", Kind: 1, Pubkey: authorPub, Raw: "{}", SeenOn: []types.SeenOn{{URL: "wss://seen.on"}}}
+	assert.NoError(t, client.Repost(context.Background(), signerOf(sk), note))
+
+	article := types.FeedEntry{Id: "d8436ce1b543ae7c9cabe2da4666cf566410c36d48886d732d2e19165130c652", Kind: 30023, Pubkey: authorPub, Raw: "{}"}
+	assert.NoError(t, client.Repost(context.Background(), signerOf(sk), article))
+
+	events := mock.Events()
+	assert.Len(t, events, 2)
+	byKind := map[int]*nostr.Event{}
+	for _, ev := range events {
+		byKind[ev.Kind] = ev
+	}
+
+	repost := byKind[6]
+	if assert.NotNil(t, repost) {
+		assert.Equal(t, nostr.Tag{"e", note.Id, "wss://seen.on"}, *repost.Tags.GetFirst([]string{"e"}))
+		assert.Equal(t, nostr.Tag{"p", authorPub}, *repost.Tags.GetFirst([]string{"p"}))
+		assert.Nil(t, repost.Tags.GetFirst([]string{"k"}))
+	}
+
+	generic := byKind[16]
+	if assert.NotNil(t, generic) {
+		// without a known relay the hint falls back to a relay we publish to
+		assert.Equal(t, nostr.Tag{"e", article.Id, mock.URL}, *generic.Tags.GetFirst([]string{"e"}))
+		assert.Equal(t, nostr.Tag{"k", "30023"}, *generic.Tags.GetFirst([]string{"k"}))
+	}
+}
+
+func TestQuoteTags(t *testing.T) {
+	mock := relay.NewMockRelay()
+	defer mock.Close()
+
+	client, err := NewClient(context.Background(), []string{mock.URL}, nil, relay.NewPool(relay.NewHealth(types.HealthConfig{}), types.AuthConfig{}), 1, nil, types.RateLimitConfig{})
+	assert.NoError(t, err)
+	defer client.Close()
+
+	sk, _ := getIdentity()
+	_, authorPub := getIdentity()
+	entry := types.FeedEntry{Id: "c8436ce1b543ae7c9cabe2da4666cf566410c36d48886d732d2e19165130c652", Kind: 1, Pubkey: authorPub, SeenOn: []types.SeenOn{{URL: "wss://seen.on"}}}
+	assert.NoError(t, client.Quote(context.Background(), signerOf(sk), "look", []types.FeedEntry{entry}))
+
+	events := mock.Events()
+	if assert.Len(t, events, 1) {
+		ev := events[0]
+		assert.Equal(t, nostr.Tag{"q", entry.Id, "wss://seen.on", authorPub}, *ev.Tags.GetFirst([]string{"q"}))
+		assert.Equal(t, nostr.Tag{"p", authorPub}, *ev.Tags.GetFirst([]string{"p"}))
+
+		nevent, _ := nip19.EncodeEvent(entry.Id, []string{"wss://seen.on"}, authorPub)
+		assert.Equal(t, "look\nnostr:"+nevent, ev.Content)
+	}
+}
+
+func TestPublishQuorum(t *testing.T) {
+	open := relay.NewMockRelay()
+	defer open.Close()
+	restricted := relay.NewMockRelay()
+	restricted.RequireAuth = true
+	defer restricted.Close()
+
+	pool := relay.NewPool(relay.NewHealth(types.HealthConfig{}), types.AuthConfig{})
+	uris := []string{open.URL, restricted.URL}
+
+	sk, pub := getIdentity()
+	ev := nostr.Event{
+		PubKey:    pub,
+		CreatedAt: time.Now(),
+		Kind:      1,
+		Content:   "Hello World!",
+	}
+	assert.NoError(t, ev.Sign(sk))
+
+	client, err := NewClient(context.Background(), uris, nil, pool, 1, nil, types.RateLimitConfig{})
+	assert.NoError(t, err)
+	defer client.Close()
+
+	results, err := client.Publish(context.Background(), ev)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, results.Accepted())
+	failed := results.Failed()
+	assert.Len(t, failed, 1)
+	assert.Equal(t, restricted.URL, failed[0].URL)
+	assert.Equal(t, PublishRejected, failed[0].Status)
+
+	client, err = NewClient(context.Background(), uris, nil, pool, 2, nil, types.RateLimitConfig{})
+	assert.NoError(t, err)
+	defer client.Close()
+
+	results, err = client.Publish(context.Background(), ev)
+	var quorumErr *QuorumError
+	assert.ErrorAs(t, err, &quorumErr)
+	assert.Equal(t, 2, quorumErr.Quorum)
+	assert.Len(t, results, 2)
+}
+
+func TestRelayHint(t *testing.T) {
+	client := &Client{Relays: map[string]*relay.Relay{
+		"wss://b.example.com":  nil,
+		"wss://a.example.com/": nil,
+	}}
+
+	// unknown provenance falls back to a relay we publish to
+	assert.Equal(t, "wss://a.example.com/", client.relayHint(types.FeedEntry{}))
+
+	seenOn := []types.SeenOn{
+		{URL: "wss://first.example.com", FirstSeenAt: time.Unix(100, 0)},
+		{URL: "wss://b.example.com", FirstSeenAt: time.Unix(200, 0)},
+	}
+	assert.Equal(t, "wss://b.example.com", client.relayHint(types.FeedEntry{SeenOn: seenOn}))
+	assert.Equal(t, "wss://first.example.com", client.relayHint(types.FeedEntry{SeenOn: seenOn[:1]}))
+}
+
+func TestReplyTags(t *testing.T) {
+	_, botPub := getIdentity()
+	_, alicePub := getIdentity()
+	_, bobPub := getIdentity()
+
+	// a reply to a top level note has it as root
+	note := nostr.Event{ID: "note", PubKey: alicePub, Tags: nostr.Tags{nostr.Tag{"p", botPub}}}
+	tags := replyTags(note, botPub, "wss://parent", "wss://fallback")
+	assert.Equal(t, nostr.Tags{
+		nostr.Tag{"e", "note", "wss://parent", "root"},
+		nostr.Tag{"p", alicePub},
+	}, tags)
+
+	// a reply to a reply keeps the root of the thread
+	reply := nostr.Event{ID: "reply", PubKey: alicePub, Tags: nostr.Tags{
+		nostr.Tag{"e", "note", "", "root"},
+		nostr.Tag{"p", bobPub},
+		nostr.Tag{"p", botPub},
+	}}
+	tags = replyTags(reply, botPub, "wss://parent", "wss://fallback")
+	assert.Equal(t, nostr.Tags{
+		nostr.Tag{"e", "note", "wss://fallback", "root"},
+		nostr.Tag{"e", "reply", "wss://parent", "reply"},
+		nostr.Tag{"p", alicePub},
+		nostr.Tag{"p", bobPub},
+	}, tags)
+
+	// the root is hinted at as the parent does
+	reply.Tags[0] = nostr.Tag{"e", "note", "wss://root", "root"}
+	tags = replyTags(reply, botPub, "wss://parent", "wss://fallback")
+	assert.Equal(t, nostr.Tag{"e", "note", "wss://root", "root"}, tags[0])
+
+	// positional e tags are understood too
+	reply.Tags = nostr.Tags{nostr.Tag{"e", "note"}}
+	tags = replyTags(reply, botPub, "", "")
+	assert.Equal(t, "note", tags[0][1])
+	assert.Equal(t, "reply", tags[1][1])
+}
+
+// the relays events were received from are remembered in order, once each
+func TestReceivedEvents(t *testing.T) {
+	received := newReceivedEvents(2)
+	received.Add("a", "wss://one")
+	received.Add("a", "wss://two")
+	received.Add("a", "wss://one")
+	seenOn := received.Get("a")
+	assert.Len(t, seenOn, 2)
+	assert.Equal(t, "wss://one", seenOn[0].URL)
+	assert.Equal(t, "wss://two", seenOn[1].URL)
+
+	// older events are forgotten after two generations
+	received.Add("b", "wss://one")
+	received.Add("c", "wss://one")
+	received.Add("d", "wss://one")
+	assert.Empty(t, received.Get("a"))
+	assert.Len(t, received.Get("c"), 1)
+
+	var none *receivedEvents
+	none.Add("a", "wss://one")
+	assert.Empty(t, none.Get("a"))
+}
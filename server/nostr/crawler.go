@@ -2,165 +2,649 @@ package nostr
 
 import (
 	"context"
-	"strconv"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/dyng/nosdaily/relay"
 	"github.com/dyng/nosdaily/service"
 	"github.com/dyng/nosdaily/types"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+// kinds of events the crawler is interested in
+var crawlKinds = []int{1, 3, 6, 7, 9735, 10002}
+
+const (
+	RelayConnecting   = "connecting"
+	RelayConnected    = "connected"
+	RelayReconnecting = "reconnecting"
+	RelayPaused       = "paused"
+	RelayFailed       = "failed"
+)
+
+var (
+	ErrRelayExists   = errors.New("relay is already crawled")
+	ErrRelayNotFound = errors.New("relay is not crawled")
 )
 
 type Crawler struct {
 	config      *types.Config
 	service     *service.Service
-	connections map[string]*relayConnection
+	mu          sync.Mutex
+	relays      map[string]*crawledRelay
+	profiles    []types.CrawlProfile
+	pool        *relay.Pool
+	checkpoints *checkpointer
+	ingest      *ingestQueue
+	discovery   *discovery
+	outbox      *outbox
+	provenance  *provenance
+
+	// profiles planned by the outbox, guarded by mu
+	outboxProfiles []types.CrawlProfile
 }
 
-func NewCrawler(config *types.Config, service *service.Service) *Crawler {
+// crawledRelay is an entry of the relay registry, all fields are guarded by
+// Crawler.mu. The connection itself is managed by the pool, a paused relay
+// has no connection and no cancel func.
+type crawledRelay struct {
+	url      string
+	source   string
+	profiles []types.CrawlProfile
+	conn     *relay.Relay
+	err      error
+	cancel   context.CancelFunc
+}
+
+type RelayStatus struct {
+	URL         string     `json:"url"`
+	Source      string     `json:"source"`
+	State       string     `json:"state"`
+	Profiles    []string   `json:"profiles"`
+	Error       string     `json:"error,omitempty"`
+	ConnectedAt *time.Time `json:"connected_at,omitempty"`
+	Checkpoint  *time.Time `json:"checkpoint,omitempty"`
+}
+
+func NewCrawler(config *types.Config, service *service.Service, pool *relay.Pool) (*Crawler, error) {
+	ingest, err := newIngestQueue(config.Crawler.Ingest, filepath.Join(config.Objects.Root, "spill"), service.StoreEvent)
+	if err != nil {
+		return nil, err
+	}
+
+	discovery := newDiscovery(config.Crawler.Discovery, config.Crawler.Relays)
 	return &Crawler{
 		config:      config,
 		service:     service,
-		connections: make(map[string]*relayConnection),
-	}
+		relays:      make(map[string]*crawledRelay),
+		profiles:    config.Crawler.Profiles,
+		pool:        pool,
+		checkpoints: newCheckpointer(service),
+		discovery:   discovery,
+		outbox:      newOutbox(config.Crawler.Outbox, service.GetOutbox, discovery.acceptable),
+		ingest:      ingest,
+		provenance:  newProvenance(service),
+	}, nil
 }
 
 func (c *Crawler) Run() {
 	log.Info("Starting crawler")
+	go c.checkpoints.Run(timeOffset(c.config.Crawler.CheckpointInterval))
+	go c.ingest.Run()
+	go c.provenance.Run()
+	if c.config.Crawler.Discovery.Enabled {
+		log.Info("Relay discovery enabled", "max_relays", c.config.Crawler.Discovery.MaxRelays)
+		go c.discovery.Run(
+			func(url string) error { return c.addRelay(url, "discovery") },
+			c.RemoveRelay,
+		)
+	}
 	for _, url := range c.config.Crawler.Relays {
-		c.AddRelay(url)
+		c.addRelay(url, "config")
+	}
+	c.SetProfiles(c.profiles)
+	if c.config.Crawler.Outbox.Enabled {
+		log.Info("Crawling follows of subscribers", "max_relays", c.config.Crawler.Outbox.MaxRelays)
+		go c.outbox.Run(c.crawledRelays, c.SetOutbox)
 	}
 }
 
-func (c *Crawler) AddRelay(url string) {
-	go func() {
-		log.Info("Adding a relay server", "url", url)
+// SetProfiles replaces the crawl profiles. Relays listed by new profiles are
+// added, relays only listed by removed profiles are dropped, and relays
+// whose profiles changed are resubscribed.
+func (c *Crawler) SetProfiles(profiles []types.CrawlProfile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-		since := time.Now().Add(parseTimeOffset(c.config.Crawler.Since))
-		limit := c.config.Crawler.Limit
-		conn, err := c.subscribe(url, since, limit)
-		if err != nil {
-			log.Error("Failed to subscribe to relay", "url", url, "err", err)
-			return
+	log.Info("Setting crawl profiles", "profiles", profileNames(profiles))
+	c.profiles = profiles
+	c.applyProfiles()
+}
+
+// SetOutbox replaces the profiles planned by the outbox. Relays are added
+// and dropped like for SetProfiles, relays crawled only for the outbox are
+// crawled with the outbox profiles only.
+func (c *Crawler) SetOutbox(profiles []types.CrawlProfile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.outboxProfiles = profiles
+	c.applyProfiles()
+}
+
+// crawledRelays returns the relays crawled for other reasons than the
+// outbox.
+func (c *Crawler) crawledRelays() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var urls []string
+	for url, r := range c.relays {
+		if r.source != outboxProfile {
+			urls = append(urls, url)
 		}
+	}
+	return urls
+}
 
-		for {
-			select {
-			case err := <-conn.error:
-				log.Info("Close & reconnect to relay", "url", url)
-				err = conn.Close()
-				if err != nil {
-					log.Error("Failed to close connection", "url", url, "err", err)
-				}
+// applyProfiles adds and drops the relays listed by the profiles and the
+// outbox, and resubscribes relays whose profiles changed. It must be called
+// with c.mu held.
+func (c *Crawler) applyProfiles() {
+	listed := profileRelays(c.profiles)
+	outbox := profileRelays(c.outboxProfiles)
 
-				// wait for a while
-				waitPeriod := 30 * time.Second
-				time.Sleep(waitPeriod)
+	for url, r := range c.relays {
+		if r.source != "profile" && r.source != outboxProfile {
+			continue
+		}
+		switch {
+		case slices.Contains(listed, url):
+			r.source = "profile"
+		case slices.Contains(outbox, url):
+			r.source = outboxProfile
+		default:
+			log.Info("Removing a relay server", "url", url)
+			c.stop(r)
+			delete(c.relays, url)
+		}
+	}
 
-				// reconnect
-				conn, err = c.subscribe(url, time.Now().Add(-waitPeriod), 1000)
-				if err != nil {
-					log.Error("Failed to subscribe to relay", "url", url, "err", err)
-					return
-				}
-				log.Info("Reconnected to relay", "url", url)
+	c.addListed(listed, "profile")
+	c.addListed(outbox, outboxProfile)
+
+	for _, r := range c.relays {
+		applied := c.relayProfiles(r)
+		if reflect.DeepEqual(applied, r.profiles) {
+			continue
+		}
+		log.Info("Crawl profiles of relay changed", "url", r.url, "profiles", profileNames(applied))
+		r.profiles = applied
+		if r.cancel != nil {
+			c.start(r)
+		}
+	}
+}
+
+// addListed starts crawling the listed relays that are not crawled yet, it
+// must be called with c.mu held.
+func (c *Crawler) addListed(urls []string, source string) {
+	for _, url := range urls {
+		if _, ok := c.relays[url]; !ok && url != "" {
+			log.Info("Adding a relay server", "url", url, "source", source)
+			r := &crawledRelay{
+				url:    url,
+				source: source,
 			}
+			c.relays[url] = r
+			c.start(r)
 		}
-	}()
+	}
+}
+
+// relayProfiles returns the profiles a relay is crawled with: the configured
+// profiles that apply to it and the outbox profiles listing it. Relays
+// crawled only for the outbox do not get the configured profiles, relays
+// crawled without restriction already deliver what the outbox asks for.
+func (c *Crawler) relayProfiles(r *crawledRelay) []types.CrawlProfile {
+	var applied []types.CrawlProfile
+	if r.source != outboxProfile {
+		applied = profilesFor(c.profiles, c.config.Crawler, r.url)
+		for _, p := range applied {
+			if len(p.Kinds) == 0 && len(p.Authors) == 0 && len(p.Hashtags) == 0 {
+				return applied
+			}
+		}
+	}
+	return append(applied, listedProfiles(c.outboxProfiles, r.url)...)
+}
+
+// ListRelays returns the status of all crawled relays, sorted by url.
+func (c *Crawler) ListRelays() []RelayStatus {
+	c.mu.Lock()
+	statuses := make([]RelayStatus, 0, len(c.relays))
+	for _, r := range c.relays {
+		status := RelayStatus{
+			URL:      r.url,
+			Source:   r.source,
+			State:    c.state(r),
+			Profiles: profileNames(r.profiles),
+		}
+		if r.conn != nil {
+			status.ConnectedAt = r.conn.ConnectedAt()
+		}
+		if r.err != nil {
+			status.Error = r.err.Error()
+		}
+		statuses = append(statuses, status)
+	}
+	c.mu.Unlock()
+
+	for i := range statuses {
+		if checkpoint, ok := c.checkpoints.Get(statuses[i].URL); ok {
+			statuses[i].Checkpoint = &checkpoint
+		}
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].URL < statuses[j].URL
+	})
+	return statuses
+}
+
+// state derives the state of a relay from its connection in the pool and
+// its health, must be called with c.mu held.
+func (c *Crawler) state(r *crawledRelay) string {
+	if r.conn == nil {
+		return RelayPaused
+	}
+	if c.pool.Health().State(r.url) == relay.StateOpen {
+		return RelayFailed
+	}
+
+	switch r.conn.State() {
+	case relay.StateConnected:
+		return RelayConnected
+	case relay.StateReconnecting:
+		return RelayReconnecting
+	default:
+		return RelayConnecting
+	}
+}
+
+// IngestStats reports the depth of the queue between relays and storage.
+func (c *Crawler) IngestStats() IngestStats {
+	return c.ingest.Stats()
+}
+
+// AddRelay starts crawling a relay.
+func (c *Crawler) AddRelay(url string) error {
+	return c.addRelay(url, "admin")
+}
+
+func (c *Crawler) addRelay(url, source string) error {
+	url = nostr.NormalizeURL(url)
+	if url == "" {
+		return errors.New("invalid relay url")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.relays[url]; ok {
+		return ErrRelayExists
+	}
+
+	log.Info("Adding a relay server", "url", url, "source", source)
+	r := &crawledRelay{
+		url:    url,
+		source: source,
+	}
+	c.relays[url] = r
+	c.start(r)
+	return nil
+}
+
+// RemoveRelay stops crawling a relay and releases its connection.
+func (c *Crawler) RemoveRelay(url string) error {
+	url = nostr.NormalizeURL(url)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, ok := c.relays[url]
+	if !ok {
+		return ErrRelayNotFound
+	}
+
+	log.Info("Removing a relay server", "url", url)
+	c.stop(r)
+	delete(c.relays, url)
+	return nil
+}
+
+// PauseRelay releases the connection to a relay but keeps it registered, so
+// that it can be resumed from its checkpoint later.
+func (c *Crawler) PauseRelay(url string) error {
+	url = nostr.NormalizeURL(url)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, ok := c.relays[url]
+	if !ok {
+		return ErrRelayNotFound
+	}
+
+	log.Info("Pausing a relay server", "url", url)
+	c.stop(r)
+	r.err = nil
+	return nil
+}
+
+// ResumeRelay restarts crawling a paused relay, or reconnects a failed relay
+// right away instead of waiting for its next probe.
+func (c *Crawler) ResumeRelay(url string) error {
+	url = nostr.NormalizeURL(url)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, ok := c.relays[url]
+	if !ok {
+		return ErrRelayNotFound
+	}
+
+	state := c.state(r)
+	if state != RelayPaused && state != RelayFailed {
+		return nil
+	}
+
+	log.Info("Resuming a relay server", "url", url)
+	if state == RelayFailed {
+		c.pool.Health().Reset(url)
+		r.conn.Retry()
+		return nil
+	}
+	c.start(r)
+	return nil
 }
 
-func (c *Crawler) subscribe(url string, since time.Time, limit int) (*relayConnection, error) {
+// start acquires a connection to the relay unless it has one and runs its
+// crawl loop, replacing the current one. It must be called with c.mu held.
+func (c *Crawler) start(r *crawledRelay) {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	if r.conn == nil {
+		r.conn = c.pool.Acquire(r.url)
+	}
+	if r.profiles == nil {
+		r.profiles = c.relayProfiles(r)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.err = nil
+	go c.crawl(ctx, r.conn, r.profiles)
+}
 
-	relay, err := nostr.RelayConnect(ctx, url)
-	if err != nil {
-		cancel()
-		return nil, err
+// stop terminates the crawl loop of a relay and releases its connection,
+// must be called with c.mu held.
+func (c *Crawler) stop(r *crawledRelay) {
+	if r.cancel != nil {
+		r.cancel()
+		r.cancel = nil
 	}
+	if r.conn != nil {
+		c.pool.Release(r.url)
+		r.conn = nil
+	}
+}
 
-	var filter nostr.Filter
-	if limit != 0 {
-		filter = nostr.Filter{
-			Kinds: []int{1, 3, 6, 7, 9735},
-			Since: &since,
-			Limit: limit,
+// fail records the reason a relay refused the subscription, unless the
+// crawl loop has been stopped in the meantime.
+func (c *Crawler) fail(ctx context.Context, url string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ctx.Err() != nil {
+		return
+	}
+	if r, ok := c.relays[url]; ok {
+		r.err = err
+	}
+}
+
+// crawl subscribes to a relay with the filters of its profiles and stores
+// the events it sends. Reconnects and resubscribes are handled by the pool,
+// only a subscription that has been closed by the relay is renewed here.
+// Relays supporting negentropy are caught up with first and then only asked
+// for new events, so that events already stored are not downloaded again.
+func (c *Crawler) crawl(ctx context.Context, conn *relay.Relay, profiles []types.CrawlProfile) {
+	url := conn.URL
+
+	for {
+		filters := c.filters(url, profiles)
+
+		var sub *relay.Subscription
+		if until, ok := c.catchUp(ctx, conn, filters); ok {
+			live := make(nostr.Filters, len(filters))
+			for i, f := range filters {
+				f.Since = &until
+				f.Limit = 0
+				live[i] = f
+			}
+			log.Debug("Subscribing to new events of relay", "url", url, "filters", live)
+			sub = conn.SubscribeLive(ctx, live)
+		} else {
+			log.Debug("Subscribing to relay", "url", url, "filters", filters)
+			sub = conn.Subscribe(ctx, filters)
 		}
-	} else {
-		filter = nostr.Filter{
-			Kinds: []int{1, 3, 6, 7, 9735},
-			Since: &since,
+
+		reason, closed := c.consume(ctx, sub, profiles)
+		sub.Close()
+		if !closed {
+			return
 		}
-	}
-	log.Debug("Subscribing to relay", "url", url, "filter", filter)
-	sub := relay.Subscribe(ctx, []nostr.Filter{filter})
 
-	conn := relayConnection{
-		relay:  relay,
-		cancel: cancel,
-		error:  make(chan error),
+		err := fmt.Errorf("subscription closed: %s", reason)
+		log.Error("Relay closed subscription", "url", url, "reason", reason)
+		c.fail(ctx, url, err)
+
+		wait := c.pool.Health().Backoff(url)
+		log.Info("Waiting to resubscribe to relay", "url", url, "wait", wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
 	}
-	c.connections[url] = &conn
+}
+
+// consume stores the events of a subscription until ctx is done, or the
+// relay closes the subscription in which case the reason is returned. Live
+// subscriptions are caught up with after every reconnect.
+func (c *Crawler) consume(ctx context.Context, sub *relay.Subscription, profiles []types.CrawlProfile) (string, bool) {
+	url := sub.Relay.URL
+	store := &crawlStore{ctx: ctx, crawler: c, url: url, checkpoint: true}
 
+	// catching up runs in the background, since the connection is shared
+	// and events have to be consumed in the meantime; it ends with the
+	// subscription, which is made anew if the relay closes it
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pending := make(chan nostr.Filters, 1)
 	go func() {
 		for {
 			select {
-			case ev := <-sub.Events:
-				if ev == nil {
-					log.Debug("Channel is closed", "url", url)
-					return
-				}
-				log.Debug("Received event", "id", ev.ID, "kind", ev.Kind, "author", ev.PubKey, "created_at", ev.CreatedAt)
-				err := c.service.StoreEvent(ev)
-				if err != nil {
-					log.Error("Failed to store event", "event", ev, "err", err)
-				}
-			case notice := <-relay.Notices:
-				log.Warn("Received relay notice", "notice", notice)
-			case <-relay.ConnectionContext.Done():
-				err := relay.ConnectionError
-				log.Error("Connection error", "url", url, "err", err)
-				conn.error <- err
-			case <-ctx.Done():
-				log.Debug("Stop consuming events", "url", url)
+			case filters := <-pending:
+				c.recover(subCtx, sub.Relay, filters)
+			case <-subCtx.Done():
 				return
 			}
 		}
 	}()
 
-	return &conn, nil
+	disconnected := sub.Disconnected()
+	for {
+		select {
+		case ev, ok := <-sub.Events:
+			if !ok {
+				log.Debug("Stop consuming events", "url", url)
+				return "", false
+			}
+			log.Debug("Received event", "id", ev.ID, "kind", ev.Kind, "author", ev.PubKey, "created_at", ev.CreatedAt)
+			err := store.StoreEvent(ev)
+			if err != nil {
+				log.Error("Failed to store event", "event", ev, "err", err)
+			}
+		case <-disconnected:
+			disconnected = sub.Disconnected()
+			// the checkpoint is taken now, before events of the new
+			// connection move it past the gap; if a catch-up is pending
+			// already it starts even earlier
+			if sub.Live() {
+				select {
+				case pending <- c.filters(url, profiles):
+				default:
+				}
+			}
+		case reason := <-sub.ClosedReason:
+			return reason, true
+		case <-ctx.Done():
+			log.Debug("Stop consuming events", "url", url)
+			return "", false
+		}
+	}
+}
+
+// catchUp stores the events matching filters that have not been stored yet
+// by negentropy reconciliation. It returns the time up to which the relay
+// has been caught up with, or false if negentropy is disabled or the relay
+// does not support it.
+func (c *Crawler) catchUp(ctx context.Context, conn *relay.Relay, filters nostr.Filters) (time.Time, bool) {
+	if !c.config.Crawler.Negentropy {
+		return time.Time{}, false
+	}
+
+	until := time.Now()
+	store := &crawlStore{ctx: ctx, crawler: c, url: conn.URL}
+	total := 0
+	for _, filter := range filters {
+		filter.Until = &until
+		filter.Limit = 0
+		count, err := reconcile(ctx, conn, store, filter)
+		if err != nil {
+			if !errors.Is(err, relay.ErrNegentropyUnsupported) {
+				log.Warn("Failed to reconcile events with relay", "url", conn.URL, "err", err)
+			}
+			return until, false
+		}
+		total += count
+	}
+
+	log.Info("Caught up with relay", "url", conn.URL, "events", total)
+	c.checkpoints.Observe(conn.URL, until)
+	return until, true
+}
+
+// recover catches up with a relay after its connection has been lost. If
+// reconciliation fails the missed events are queried with a plain REQ
+// instead.
+func (c *Crawler) recover(ctx context.Context, conn *relay.Relay, filters nostr.Filters) {
+	for conn.WaitConnected(ctx) != nil {
+		select {
+		case <-time.After(c.pool.Health().Backoff(conn.URL)):
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	if _, ok := c.catchUp(ctx, conn, filters); ok {
+		return
+	}
+
+	until := time.Now()
+	store := &crawlStore{ctx: ctx, crawler: c, url: conn.URL, checkpoint: true}
+	for _, filter := range filters {
+		filter.Until = &until
+		events, err := conn.QuerySync(ctx, filter)
+		if err != nil {
+			log.Warn("Failed to query missed events from relay", "url", conn.URL, "err", err)
+		}
+
+		for _, ev := range events {
+			err := store.StoreEvent(ev)
+			if err != nil {
+				log.Error("Failed to store event", "event", ev, "err", err)
+			}
+		}
+	}
 }
 
-type relayConnection struct {
-	relay  *nostr.Relay
-	cancel context.CancelFunc
-	error  chan error
+// filters builds the filters of a relay's profiles, resuming from the relay's
+// checkpoint minus a safety margin if it has one.
+func (c *Crawler) filters(url string, profiles []types.CrawlProfile) nostr.Filters {
+	var since *time.Time
+	if checkpoint, ok := c.checkpoints.Get(url); ok {
+		t := checkpoint.Add(timeOffset(c.config.Crawler.ResumeOffset))
+		log.Debug("Resuming from checkpoint", "url", url, "checkpoint", checkpoint, "since", t)
+		since = &t
+	}
+
+	filters := make(nostr.Filters, len(profiles))
+	for i, p := range profiles {
+		filters[i] = profileFilter(p, c.config.Crawler, since)
+	}
+	return filters
 }
 
-func (rc *relayConnection) Close() error {
-	rc.cancel() // 'cancel' is used to close the subscription
-	return rc.relay.Close()
+// crawlStore queues the events received from a relay for storage, keeping
+// track of the relays the events refer to and were seen on. Events
+// reconciled with the relay arrive in no particular order and must not move
+// the checkpoint, as it would skip the rest of them if reconciliation fails.
+type crawlStore struct {
+	ctx        context.Context
+	crawler    *Crawler
+	url        string
+	checkpoint bool
 }
 
-func parseTimeOffset(offset string) time.Duration {
-	// split offset into number and unit
-	num, unit := offset[:len(offset)-1], offset[len(offset)-1:]
-	n, err := strconv.Atoi(num)
-	if err != nil {
-		log.Error("Failed to parse time offset", "offset", offset, "err", err)
-		return 0
+func (s *crawlStore) GetEventRefs(kinds []int, authors []string, since, until time.Time) ([]types.EventRef, error) {
+	return s.crawler.service.GetEventRefs(kinds, authors, since, until)
+}
+
+func (s *crawlStore) StoreEvent(ev *nostr.Event) error {
+	var stored func()
+	if s.checkpoint {
+		// the checkpoint only moves past events that have been stored
+		stored = func() { s.crawler.checkpoints.Observe(s.url, ev.CreatedAt) }
 	}
+	s.crawler.ingest.Enqueue(s.ctx, ev, stored)
+	s.crawler.discovery.Observe(s.url, ev)
+	s.crawler.outbox.Observe(ev)
+	s.crawler.provenance.Observe(s.url, ev)
+	return nil
+}
 
-	switch unit {
-	case "s":
-		return time.Duration(n) * time.Second
-	case "m":
-		return time.Duration(n) * time.Minute
-	case "h":
-		return time.Duration(n) * time.Hour
-	case "d":
-		return time.Duration(n) * time.Hour * 24
-	default:
-		log.Error("Unknown time unit", "unit", unit)
+// timeOffset parses an offset from the configuration, it is zero if the
+// offset is not set or invalid.
+func timeOffset(offset string) time.Duration {
+	if offset == "" {
+		return 0
+	}
+	d, err := types.ParseTimeOffset(offset)
+	if err != nil {
+		log.Error("Failed to parse time offset", "offset", offset, "err", err)
 		return 0
 	}
+	return d
 }
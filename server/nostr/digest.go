@@ -0,0 +1,221 @@
+package nostr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	KindArticle = 30023
+
+	// how long to wait for relays to send profiles
+	profilesTimeout = 5 * time.Second
+	// runes of a post quoted in a digest
+	excerptLength = 140
+)
+
+// DigestItem is a post listed in a digest along with the name of its author,
+// empty if unknown, and the reactions to it.
+type DigestItem struct {
+	Entry      types.FeedEntry
+	Author     string
+	Engagement types.Engagement
+}
+
+// Profiles returns the names of authors according to their metadata on the
+// relays listened to. Authors without a name are left out.
+func (c *Client) Profiles(ctx context.Context, pubkeys []string) map[string]string {
+	names := make(map[string]string)
+	if len(pubkeys) == 0 {
+		return names
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, profilesTimeout)
+	defer cancel()
+
+	filter := nostr.Filter{Kinds: []int{0}, Authors: pubkeys}
+	latest := make(map[string]time.Time)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for uri := range c.ListenTo {
+		wg.Add(1)
+		go func(uri string) {
+			defer wg.Done()
+			conn := c.pool.Acquire(uri)
+			defer c.pool.Release(uri)
+
+			events, err := conn.QuerySync(ctx, filter)
+			if err != nil {
+				logger.Debug("failed to query profiles", "uri", uri, "err", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, ev := range events {
+				if ev.Kind != 0 || !slices.Contains(pubkeys, ev.PubKey) {
+					continue
+				}
+				name := profileName(ev.Content)
+				if name != "" && ev.CreatedAt.After(latest[ev.PubKey]) {
+					latest[ev.PubKey] = ev.CreatedAt
+					names[ev.PubKey] = name
+				}
+			}
+		}(uri)
+	}
+	wg.Wait()
+
+	return names
+}
+
+// profileName reads the name from the content of a metadata event.
+func profileName(content string) string {
+	var metadata struct {
+		DisplayName string `json:"display_name"`
+		Name        string `json:"name"`
+	}
+	if err := json.Unmarshal([]byte(content), &metadata); err != nil {
+		return ""
+	}
+	if name := strings.TrimSpace(metadata.DisplayName); name != "" {
+		return name
+	}
+	return strings.TrimSpace(metadata.Name)
+}
+
+// Digest publishes items as one event, a long-form article of kind 30023 or
+// a note of kind 1. An article replaces the earlier one of the same
+// identifier.
+func (c *Client) Digest(ctx context.Context, signer Signer, kind int, identifier, title string, items []DigestItem) error {
+	pub, err := signer.PublicKey(ctx)
+	if err != nil {
+		return err
+	}
+
+	var sb strings.Builder
+	var tags nostr.Tags
+	if kind == KindArticle {
+		tags = append(tags,
+			nostr.Tag{"d", identifier},
+			nostr.Tag{"title", title},
+			nostr.Tag{"published_at", strconv.FormatInt(time.Now().Unix(), 10)},
+		)
+	} else {
+		sb.WriteString(title + "\n")
+	}
+
+	var authors []string
+	for i, item := range items {
+		entry := item.Entry
+		hint := c.relayHint(entry)
+		nevent, err := nip19.EncodeEvent(entry.Id, []string{hint}, entry.Pubkey)
+		if err != nil {
+			return err
+		}
+
+		author := item.Author
+		if author == "" {
+			npub, _ := nip19.EncodePublicKey(entry.Pubkey)
+			author = "nostr:" + npub
+		}
+		stats := engagementLine(item.Engagement)
+		quoted := excerpt(entry.Raw)
+
+		if kind == KindArticle {
+			sb.WriteString(fmt.Sprintf("%d. **%s**", i+1, author))
+			if stats != "" {
+				sb.WriteString(" · " + stats)
+			}
+			sb.WriteString("\n\n")
+			if quoted != "" {
+				sb.WriteString("> " + quoted + "\n\n")
+			}
+			sb.WriteString("nostr:" + nevent + "\n\n")
+		} else {
+			sb.WriteString(fmt.Sprintf("\n%d. %s", i+1, author))
+			if quoted != "" {
+				sb.WriteString(": " + quoted)
+			}
+			if stats != "" {
+				sb.WriteString("\n" + stats)
+			}
+			sb.WriteString("\nnostr:" + nevent + "\n")
+		}
+
+		tags = append(tags, nostr.Tag{"q", entry.Id, hint, entry.Pubkey})
+		if !slices.Contains(authors, entry.Pubkey) {
+			authors = append(authors, entry.Pubkey)
+		}
+	}
+	for _, author := range authors {
+		tags = append(tags, nostr.Tag{"p", author})
+	}
+
+	ev := nostr.Event{
+		PubKey:    pub,
+		Kind:      kind,
+		Tags:      tags,
+		Content:   strings.TrimSpace(sb.String()),
+		CreatedAt: time.Now(),
+	}
+
+	err = signer.Sign(ctx, &ev)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Publish(ctx, ev)
+	return err
+}
+
+// engagementLine describes the reactions to a post, e.g. "3 replies, 12
+// likes, 2100 sats zapped".
+func engagementLine(e types.Engagement) string {
+	var parts []string
+	count := func(n int, one, many string) {
+		switch {
+		case n == 1:
+			parts = append(parts, "1 "+one)
+		case n > 1:
+			parts = append(parts, strconv.Itoa(n)+" "+many)
+		}
+	}
+	count(e.Replies, "reply", "replies")
+	count(e.Likes, "like", "likes")
+	count(e.Reposts, "repost", "reposts")
+	if e.ZapSats > 0 {
+		parts = append(parts, strconv.FormatInt(e.ZapSats, 10)+" sats zapped")
+	} else {
+		count(e.Zaps, "zap", "zaps")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// excerpt returns the beginning of the content of a raw event on one line.
+func excerpt(raw string) string {
+	var ev nostr.Event
+	if err := json.Unmarshal([]byte(raw), &ev); err != nil {
+		return ""
+	}
+
+	text := strings.Join(strings.Fields(ev.Content), " ")
+	runes := []rune(text)
+	if len(runes) <= excerptLength {
+		return text
+	}
+	cut := string(runes[:excerptLength])
+	// do not break a word or a link
+	if i := strings.LastIndex(cut, " "); i > excerptLength/2 {
+		cut = cut[:i]
+	}
+	return cut + "…"
+}
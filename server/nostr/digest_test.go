@@ -0,0 +1,92 @@
+package nostr
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dyng/nosdaily/relay"
+	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func digestEntry(t *testing.T, content string) types.FeedEntry {
+	sk, pub := getIdentity()
+	ev := nostr.Event{PubKey: pub, CreatedAt: time.Now(), Kind: 1, Tags: nostr.Tags{}, Content: content}
+	assert.NoError(t, ev.Sign(sk))
+	raw, _ := json.Marshal(ev)
+	return types.FeedEntry{Id: ev.ID, Kind: 1, Pubkey: pub, Raw: string(raw)}
+}
+
+func TestDigest(t *testing.T) {
+	mock := relay.NewMockRelay()
+	defer mock.Close()
+
+	client, err := NewClient(context.Background(), []string{mock.URL}, nil, relay.NewPool(relay.NewHealth(types.HealthConfig{}), types.AuthConfig{}), 1, nil, types.RateLimitConfig{})
+	assert.NoError(t, err)
+	defer client.Close()
+
+	sk, _ := getIdentity()
+	items := []DigestItem{
+		{Entry: digestEntry(t, "gm\n\nnostr"), Author: "alice", Engagement: types.Engagement{Replies: 1, Likes: 12, ZapSats: 2100, Zaps: 2}},
+		{Entry: digestEntry(t, strings.Repeat("long words ", 30))},
+	}
+
+	assert.NoError(t, client.Digest(context.Background(), signerOf(sk), KindArticle, "digest-1", "top 2", items))
+	assert.NoError(t, client.Digest(context.Background(), signerOf(sk), 1, "digest-1", "top 2", items))
+
+	byKind := map[int]*nostr.Event{}
+	for _, ev := range mock.Events() {
+		byKind[ev.Kind] = ev
+	}
+
+	article := byKind[KindArticle]
+	if assert.NotNil(t, article) {
+		assert.Equal(t, "digest-1", article.Tags.GetFirst([]string{"d"}).Value())
+		assert.Equal(t, "top 2", article.Tags.GetFirst([]string{"title"}).Value())
+		assert.Contains(t, article.Content, "1. **alice** · 1 reply, 12 likes, 2100 sats zapped\n\n> gm nostr\n\nnostr:nevent1")
+		// unknown authors are mentioned, long posts cut short
+		assert.Contains(t, article.Content, "2. **nostr:npub1")
+		assert.Contains(t, article.Content, "long words long…")
+		assert.Len(t, article.Tags.GetAll([]string{"q", ""}), 2)
+		assert.Len(t, article.Tags.GetAll([]string{"p", ""}), 2)
+	}
+
+	note := byKind[1]
+	if assert.NotNil(t, note) {
+		assert.True(t, strings.HasPrefix(note.Content, "top 2\n\n1. alice: gm nostr\n1 reply, 12 likes, 2100 sats zapped\nnostr:nevent1"))
+		assert.Nil(t, note.Tags.GetFirst([]string{"d"}))
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	mock := relay.NewMockRelay()
+	defer mock.Close()
+
+	aliceSK, alicePub := getIdentity()
+	bobSK, bobPub := getIdentity()
+	_, carolPub := getIdentity()
+	for _, profile := range []struct {
+		sk      string
+		content string
+		at      time.Time
+	}{
+		{aliceSK, `{"name":"alice"}`, time.Now().Add(-time.Hour)},
+		{aliceSK, `{"name":"alice","display_name":"Alice"}`, time.Now()},
+		{bobSK, `{"name":"bob"}`, time.Now()},
+	} {
+		ev := nostr.Event{CreatedAt: profile.at, Kind: 0, Tags: nostr.Tags{}, Content: profile.content}
+		assert.NoError(t, signerOf(profile.sk).Sign(context.Background(), &ev))
+		mock.AddEvent(&ev)
+	}
+
+	client, err := NewClient(context.Background(), []string{mock.URL}, nil, relay.NewPool(relay.NewHealth(types.HealthConfig{}), types.AuthConfig{}), 1, nil, types.RateLimitConfig{})
+	assert.NoError(t, err)
+	defer client.Close()
+
+	names := client.Profiles(context.Background(), []string{alicePub, bobPub, carolPub})
+	assert.Equal(t, map[string]string{alicePub: "Alice", bobPub: "bob"}, names)
+}
@@ -0,0 +1,295 @@
+package nostr
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// number of event ids remembered per generation to detect duplicates
+	seenGenerationSize = 100000
+
+	// how long an evicted relay is not considered again
+	retireCooldown = 24 * time.Hour
+)
+
+// discovery learns candidate relays from the events flowing through the
+// crawler, i.e. NIP-65 relay lists, "r" tags and relay hints in "e"/"p" tags,
+// and decides which of them should be crawled based on how many events they
+// contribute that no other relay delivered first.
+type discovery struct {
+	config     types.DiscoveryConfig
+	pinned     []string
+	mu         sync.Mutex
+	candidates map[string]*relayCandidate
+	seen       *seenEvents
+}
+
+type relayCandidate struct {
+	url         string
+	mentions    int
+	unique      int
+	duplicates  int
+	activeSince *time.Time
+	retiredAt   *time.Time
+}
+
+func newDiscovery(config types.DiscoveryConfig, pinned []string) *discovery {
+	normalized := make([]string, 0, len(pinned))
+	for _, p := range pinned {
+		normalized = append(normalized, nostr.NormalizeURL(p))
+	}
+
+	return &discovery{
+		config:     config,
+		pinned:     normalized,
+		candidates: make(map[string]*relayCandidate),
+		seen:       newSeenEvents(seenGenerationSize),
+	}
+}
+
+// Observe accounts an event received from relay url and learns the relays
+// it refers to.
+func (d *discovery) Observe(url string, ev *nostr.Event) {
+	first := d.seen.Add(ev.ID)
+	hints := relayHints(ev)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	source := d.candidate(nostr.NormalizeURL(url))
+	if first {
+		source.unique++
+	} else {
+		source.duplicates++
+	}
+
+	for _, hint := range hints {
+		if d.acceptable(hint) {
+			d.candidate(hint).mentions++
+		}
+	}
+}
+
+// Rebalance evicts discovered relays that contributed too few unique events
+// during their last interval, and fills the free slots with the most
+// mentioned candidates. It returns the relays to start and to stop crawling.
+func (d *discovery) Rebalance(now time.Time) (add []string, remove []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	interval := timeOffset(d.config.Interval)
+	active := 0
+	for _, c := range d.candidates {
+		if c.activeSince == nil || slices.Contains(d.pinned, c.url) {
+			continue
+		}
+
+		if (now.Sub(*c.activeSince) >= interval && c.unique < d.config.MinUnique) || !d.acceptable(c.url) {
+			t := now
+			c.activeSince = nil
+			c.retiredAt = &t
+			remove = append(remove, c.url)
+			continue
+		}
+		active++
+	}
+
+	slots := d.config.MaxRelays - len(d.pinned) - active
+	if slots > 0 {
+		var pending []*relayCandidate
+		for _, c := range d.candidates {
+			if c.activeSince != nil || slices.Contains(d.pinned, c.url) || !d.acceptable(c.url) {
+				continue
+			}
+			if c.retiredAt != nil && now.Sub(*c.retiredAt) < retireCooldown {
+				continue
+			}
+			pending = append(pending, c)
+		}
+
+		sort.Slice(pending, func(i, j int) bool {
+			if pending[i].mentions != pending[j].mentions {
+				return pending[i].mentions > pending[j].mentions
+			}
+			return pending[i].url < pending[j].url
+		})
+
+		for i := 0; i < slots && i < len(pending); i++ {
+			t := now
+			pending[i].activeSince = &t
+			pending[i].retiredAt = nil
+			add = append(add, pending[i].url)
+		}
+	}
+
+	// scores reflect the contribution of the last interval only
+	for _, c := range d.candidates {
+		c.unique = 0
+		c.duplicates = 0
+	}
+
+	return add, remove
+}
+
+// Run periodically rebalances the crawled relays, it never returns.
+func (d *discovery) Run(addRelay func(url string) error, removeRelay func(url string) error) {
+	interval := timeOffset(d.config.Interval)
+	if interval <= 0 {
+		interval = 30 * time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		add, remove := d.Rebalance(now)
+		for _, url := range remove {
+			log.Info("Dropping discovered relay", "url", url)
+			if err := removeRelay(url); err != nil {
+				log.Warn("Failed to drop discovered relay", "url", url, "err", err)
+			}
+		}
+		for _, url := range add {
+			log.Info("Crawling discovered relay", "url", url)
+			if err := addRelay(url); err != nil {
+				log.Warn("Failed to crawl discovered relay", "url", url, "err", err)
+			}
+		}
+	}
+}
+
+func (d *discovery) candidate(url string) *relayCandidate {
+	c, ok := d.candidates[url]
+	if !ok {
+		c = &relayCandidate{url: url}
+		d.candidates[url] = c
+	}
+	return c
+}
+
+// acceptable checks a relay against the allow and deny lists. Entries match
+// either the full relay url or its host name.
+func (d *discovery) acceptable(relayURL string) bool {
+	if matchRelay(d.config.Deny, relayURL) {
+		return false
+	}
+	if len(d.config.Allow) > 0 && !matchRelay(d.config.Allow, relayURL) {
+		return false
+	}
+	return true
+}
+
+func matchRelay(list []string, relayURL string) bool {
+	u, err := url.Parse(relayURL)
+	if err != nil {
+		return false
+	}
+
+	for _, entry := range list {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == u.Hostname() || nostr.NormalizeURL(entry) == relayURL {
+			return true
+		}
+	}
+	return false
+}
+
+// relayHints extracts the relay urls an event refers to.
+func relayHints(ev *nostr.Event) []string {
+	var hints []string
+	for _, tag := range ev.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+
+		var hint string
+		switch tag[0] {
+		case "r":
+			hint = tag[1]
+		case "e", "p":
+			if len(tag) > 2 {
+				hint = tag[2]
+			}
+		}
+
+		if hint = normalizeRelayURL(hint); hint != "" && !slices.Contains(hints, hint) {
+			hints = append(hints, hint)
+		}
+	}
+	return hints
+}
+
+// normalizeRelayURL returns the normalized url of a public websocket relay,
+// or an empty string if the url does not look like one.
+func normalizeRelayURL(relayURL string) string {
+	relayURL = strings.TrimSpace(relayURL)
+	if !strings.HasPrefix(relayURL, "wss://") && !strings.HasPrefix(relayURL, "ws://") {
+		return ""
+	}
+
+	normalized := nostr.NormalizeURL(relayURL)
+	u, err := url.Parse(normalized)
+	if err != nil || u.Hostname() == "" || u.User != nil || u.RawQuery != "" {
+		return ""
+	}
+
+	host := u.Hostname()
+	if host == "localhost" || strings.HasSuffix(host, ".local") || strings.HasSuffix(host, ".onion") {
+		return ""
+	}
+	if ip := net.ParseIP(host); ip != nil && (ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified()) {
+		return ""
+	}
+	if !strings.Contains(host, ".") && net.ParseIP(host) == nil {
+		return ""
+	}
+
+	return normalized
+}
+
+// seenEvents remembers recently seen event ids in two generations, so that
+// memory stays bounded while the most recent ids are always kept.
+type seenEvents struct {
+	mu       sync.Mutex
+	size     int
+	current  map[string]struct{}
+	previous map[string]struct{}
+}
+
+func newSeenEvents(size int) *seenEvents {
+	return &seenEvents{
+		size:     size,
+		current:  make(map[string]struct{}),
+		previous: make(map[string]struct{}),
+	}
+}
+
+// Add returns true if the id has not been seen before.
+func (s *seenEvents) Add(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.current[id]; ok {
+		return false
+	}
+	if _, ok := s.previous[id]; ok {
+		return false
+	}
+
+	s.current[id] = struct{}{}
+	if len(s.current) >= s.size {
+		s.previous = s.current
+		s.current = make(map[string]struct{})
+	}
+	return true
+}
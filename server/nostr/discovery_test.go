@@ -0,0 +1,76 @@
+package nostr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelayHints(t *testing.T) {
+	ev := &nostr.Event{
+		Kind: 10002,
+		Tags: nostr.Tags{
+			nostr.Tag{"r", "wss://relay.one.com", "read"},
+			nostr.Tag{"r", "wss://relay.one.com/"},
+			nostr.Tag{"r", "https://example.com/article"},
+			nostr.Tag{"e", "abcd", "wss://Relay.Two.com"},
+			nostr.Tag{"p", "abcd", "ws://localhost:7777"},
+			nostr.Tag{"p", "abcd", "wss://192.168.1.10"},
+			nostr.Tag{"p", "abcd", ""},
+			nostr.Tag{"t", "wss://relay.three.com"},
+		},
+	}
+
+	assert.Equal(t, []string{"wss://relay.one.com", "wss://relay.two.com"}, relayHints(ev))
+}
+
+func TestDiscoveryRebalance(t *testing.T) {
+	config := types.DiscoveryConfig{
+		MaxRelays: 3,
+		Interval:  "30m",
+		MinUnique: 2,
+		Deny:      []string{"relay.denied.com"},
+	}
+	d := newDiscovery(config, []string{"wss://relay.pinned.com"})
+
+	hint := func(urls ...string) *nostr.Event {
+		ev := &nostr.Event{ID: nostr.GeneratePrivateKey(), Kind: 10002}
+		for _, u := range urls {
+			ev.Tags = append(ev.Tags, nostr.Tag{"r", u})
+		}
+		return ev
+	}
+
+	d.Observe("wss://relay.pinned.com", hint("wss://relay.a.com", "wss://relay.b.com", "wss://relay.denied.com"))
+	d.Observe("wss://relay.pinned.com", hint("wss://relay.b.com", "wss://relay.c.com"))
+	d.Observe("wss://relay.pinned.com", hint("wss://relay.b.com", "wss://relay.denied.com"))
+
+	// two free slots go to the most mentioned candidates
+	now := time.Now()
+	add, remove := d.Rebalance(now)
+	assert.Equal(t, []string{"wss://relay.b.com", "wss://relay.a.com"}, add)
+	assert.Empty(t, remove)
+
+	// b delivers unique events, a only duplicates of what pinned delivered
+	for i := 0; i < 3; i++ {
+		d.Observe("wss://relay.b.com", &nostr.Event{ID: nostr.GeneratePrivateKey()})
+		ev := &nostr.Event{ID: nostr.GeneratePrivateKey()}
+		d.Observe("wss://relay.pinned.com", ev)
+		d.Observe("wss://relay.a.com", ev)
+	}
+
+	// nothing is evicted before the trial interval is over
+	add, remove = d.Rebalance(now.Add(10 * time.Minute))
+	assert.Empty(t, add)
+	assert.Empty(t, remove)
+
+	for i := 0; i < 3; i++ {
+		d.Observe("wss://relay.b.com", &nostr.Event{ID: nostr.GeneratePrivateKey()})
+	}
+	add, remove = d.Rebalance(now.Add(time.Hour))
+	assert.Equal(t, []string{"wss://relay.a.com"}, remove)
+	assert.Equal(t, []string{"wss://relay.c.com"}, add)
+}
@@ -0,0 +1,422 @@
+package nostr
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	OverflowBackpressure = "backpressure"
+	OverflowDrop         = "drop"
+	OverflowSpill        = "spill"
+)
+
+const (
+	priorityHigh = iota
+	priorityNormal
+	priorityLow
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"high", "normal", "low"}
+
+// every starvationInterval events the workers take one of the lowest
+// priority waiting, so that lower priorities are slowed down but not starved
+const starvationInterval = 8
+
+// how long to wait before reading the spill file again after it failed,
+// doubling up to the maximum while it keeps failing
+const (
+	spillRetryDelay    = time.Second
+	spillMaxRetryDelay = time.Minute
+)
+
+// errCorruptSpill is returned for a spilled line that cannot be read, it is
+// moved aside and the next one is read
+var errCorruptSpill = errors.New("corrupt spilled event")
+
+// kindPriority ranks event kinds for storage. Posts are what the feeds are
+// made of, reactions only score them, and contact and relay lists are
+// replaceable and large.
+func kindPriority(kind int) int {
+	switch kind {
+	case 1:
+		return priorityHigh
+	case 6, 7, 9735:
+		return priorityNormal
+	default:
+		return priorityLow
+	}
+}
+
+// ingestQueue decouples the relay readers from storage. Events are queued per
+// priority and stored by a pool of workers, so that a slow write does not
+// stall the websocket of a relay. What happens when a queue is full depends
+// on the overflow policy: backpressure blocks the reader, drop discards the
+// event and spill writes it to disk to be stored later.
+type ingestQueue struct {
+	config types.IngestConfig
+	store  func(*nostr.Event) error
+	lanes  [numPriorities]chan ingestItem
+	spill  *spillFile
+	pops   uint64
+
+	stored  uint64
+	failed  uint64
+	dropped uint64
+}
+
+// ingestItem is a queued event and what to do once it has been stored.
+type ingestItem struct {
+	ev     *nostr.Event
+	stored func()
+}
+
+type IngestStats struct {
+	Depth    map[string]int `json:"depth"`
+	Capacity int            `json:"capacity"`
+	Overflow string         `json:"overflow"`
+	Spilled  int            `json:"spilled"`
+	Stored   uint64         `json:"stored"`
+	Failed   uint64         `json:"failed"`
+	Dropped  uint64         `json:"dropped"`
+}
+
+func newIngestQueue(config types.IngestConfig, spillDir string, store func(*nostr.Event) error) (*ingestQueue, error) {
+	if config.QueueSize <= 0 {
+		config.QueueSize = 10000
+	}
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
+
+	q := &ingestQueue{
+		config: config,
+		store:  store,
+	}
+	for i := range q.lanes {
+		q.lanes[i] = make(chan ingestItem, config.QueueSize)
+	}
+
+	if config.Overflow == OverflowSpill {
+		if config.SpillDir != "" {
+			spillDir = config.SpillDir
+		}
+		spill, err := openSpillFile(filepath.Join(spillDir, "ingest.spill"))
+		if err != nil {
+			return nil, err
+		}
+		q.spill = spill
+	}
+
+	return q, nil
+}
+
+// Enqueue queues an event for storage, applying the overflow policy if its
+// queue is full. With backpressure it blocks until there is room or ctx is
+// done. stored, if not nil, is called once the event has been stored, or
+// spilled to disk as it is stored from there eventually.
+func (q *ingestQueue) Enqueue(ctx context.Context, ev *nostr.Event, stored func()) {
+	item := ingestItem{ev: ev, stored: stored}
+	lane := q.lanes[kindPriority(ev.Kind)]
+	select {
+	case lane <- item:
+		return
+	default:
+	}
+
+	switch q.config.Overflow {
+	case OverflowDrop:
+		if atomic.AddUint64(&q.dropped, 1)%1000 == 1 {
+			log.Warn("Ingestion queue is full, dropping events", "kind", ev.Kind, "dropped", atomic.LoadUint64(&q.dropped))
+		}
+	case OverflowSpill:
+		if err := q.spill.Write(ev); err != nil {
+			log.Error("Failed to spill event to disk, dropping it", "id", ev.ID, "err", err)
+			atomic.AddUint64(&q.dropped, 1)
+		} else if stored != nil {
+			stored()
+		}
+	default:
+		select {
+		case lane <- item:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// Run starts the storage workers and reports the queue depth periodically,
+// it never returns.
+func (q *ingestQueue) Run() {
+	log.Info("Starting ingestion workers", "workers", q.config.Workers, "queue_size", q.config.QueueSize, "overflow", q.config.Overflow)
+	for i := 0; i < q.config.Workers; i++ {
+		go q.work()
+	}
+	if q.spill != nil {
+		go q.unspill()
+	}
+
+	if q.config.ReportInterval == "" {
+		select {}
+	}
+	for range time.Tick(timeOffset(q.config.ReportInterval)) {
+		stats := q.Stats()
+		log.Info("Ingestion queue", "depth", stats.Depth, "spilled", stats.Spilled, "stored", stats.Stored, "failed", stats.Failed, "dropped", stats.Dropped)
+	}
+}
+
+func (q *ingestQueue) Stats() IngestStats {
+	stats := IngestStats{
+		Depth:    make(map[string]int, numPriorities),
+		Capacity: q.config.QueueSize,
+		Overflow: q.config.Overflow,
+		Stored:   atomic.LoadUint64(&q.stored),
+		Failed:   atomic.LoadUint64(&q.failed),
+		Dropped:  atomic.LoadUint64(&q.dropped),
+	}
+	for i, lane := range q.lanes {
+		stats.Depth[priorityNames[i]] = len(lane)
+	}
+	if q.spill != nil {
+		stats.Spilled = q.spill.Len()
+	}
+	return stats
+}
+
+func (q *ingestQueue) work() {
+	for {
+		item := q.next()
+		if err := q.store(item.ev); err != nil {
+			log.Error("Failed to store event", "event", item.ev, "err", err)
+			atomic.AddUint64(&q.failed, 1)
+			continue
+		}
+		atomic.AddUint64(&q.stored, 1)
+		if item.stored != nil {
+			item.stored()
+		}
+	}
+}
+
+// next takes the waiting event of the highest priority, except for every
+// starvationInterval-th event which is taken from the lowest priority.
+func (q *ingestQueue) next() ingestItem {
+	order := [numPriorities]int{priorityHigh, priorityNormal, priorityLow}
+	if atomic.AddUint64(&q.pops, 1)%starvationInterval == 0 {
+		order = [numPriorities]int{priorityLow, priorityNormal, priorityHigh}
+	}
+
+	for _, p := range order {
+		select {
+		case item := <-q.lanes[p]:
+			return item
+		default:
+		}
+	}
+
+	select {
+	case item := <-q.lanes[priorityHigh]:
+		return item
+	case item := <-q.lanes[priorityNormal]:
+		return item
+	case item := <-q.lanes[priorityLow]:
+		return item
+	}
+}
+
+// unspill moves spilled events back into the queues as soon as there is room.
+func (q *ingestQueue) unspill() {
+	delay := spillRetryDelay
+	for {
+		ev, err := q.spill.Next()
+		if errors.Is(err, errCorruptSpill) {
+			log.Error("Skipped spilled event", "err", err)
+			continue
+		}
+		if err != nil {
+			log.Error("Failed to read spilled event", "err", err, "retry", delay)
+			time.Sleep(delay)
+			if delay *= 2; delay > spillMaxRetryDelay {
+				delay = spillMaxRetryDelay
+			}
+			continue
+		}
+		delay = spillRetryDelay
+		q.lanes[kindPriority(ev.Kind)] <- ingestItem{ev: ev}
+	}
+}
+
+// spillFile is an append-only file of events, one JSON object per line, that
+// is read back in order and truncated once it has been read completely.
+type spillFile struct {
+	mu      sync.Mutex
+	path    string
+	writer  *os.File
+	reader  *bufio.Reader
+	file    *os.File
+	pending int
+	ready   chan struct{}
+}
+
+// openSpillFile opens a spill file, events spilled before a restart are kept.
+func openSpillFile(path string) (*spillFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	writer, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		writer.Close()
+		return nil, err
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		writer.Close()
+		file.Close()
+		return nil, err
+	}
+
+	s := &spillFile{
+		path:    path,
+		writer:  writer,
+		reader:  bufio.NewReader(file),
+		file:    file,
+		pending: bytes.Count(raw, []byte("\n")),
+		ready:   make(chan struct{}, 1),
+	}
+	// end a line cut off by a crash, so that it is read and moved aside on its
+	// own instead of being joined with the next event written
+	if len(raw) > 0 && raw[len(raw)-1] != '\n' {
+		if _, err := writer.Write([]byte("\n")); err != nil {
+			writer.Close()
+			file.Close()
+			return nil, err
+		}
+		s.pending++
+	}
+	if s.pending > 0 {
+		log.Info("Found spilled events", "path", path, "events", s.pending)
+		s.ready <- struct{}{}
+	}
+	return s, nil
+}
+
+func (s *spillFile) Write(ev *nostr.Event) error {
+	raw, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.writer.Write(append(raw, '\n')); err != nil {
+		return err
+	}
+	s.pending++
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Next blocks until there is a spilled event and returns it. A line that
+// cannot be parsed is moved to a file next to the spill file and reported as
+// errCorruptSpill, so that it is not read again.
+func (s *spillFile) Next() (*nostr.Event, error) {
+	for {
+		s.mu.Lock()
+		if s.pending > 0 {
+			line, err := s.reader.ReadBytes('\n')
+			if errors.Is(err, io.EOF) {
+				// the file ends before all counted events, e.g. it has been
+				// cut off in the middle of a line, there is nothing to wait for
+				s.quarantine(line)
+				s.pending = 0
+				s.reset()
+				s.mu.Unlock()
+				return nil, fmt.Errorf("%w: %d bytes at end of file", errCorruptSpill, len(line))
+			}
+			if err != nil {
+				s.mu.Unlock()
+				return nil, err
+			}
+			s.pending--
+			if s.pending == 0 {
+				s.reset()
+			}
+
+			var ev nostr.Event
+			if err := json.Unmarshal(line, &ev); err != nil {
+				s.quarantine(line)
+				s.mu.Unlock()
+				return nil, fmt.Errorf("%w: %v", errCorruptSpill, err)
+			}
+			s.mu.Unlock()
+			return &ev, nil
+		}
+		s.mu.Unlock()
+
+		<-s.ready
+	}
+}
+
+// quarantine appends a line that cannot be read to the corrupt file next to
+// the spill file, for an operator to look at. Must be called with s.mu held.
+func (s *spillFile) quarantine(line []byte) {
+	if len(line) == 0 {
+		return
+	}
+	path := s.path + ".corrupt"
+	log.Warn("Moving corrupt spilled event aside", "path", path, "bytes", len(line))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Error("Failed to open corrupt spill file", "path", path, "err", err)
+		return
+	}
+	defer f.Close()
+	if !bytes.HasSuffix(line, []byte("\n")) {
+		line = append(line, '\n')
+	}
+	if _, err := f.Write(line); err != nil {
+		log.Error("Failed to write corrupt spill file", "path", path, "err", err)
+	}
+}
+
+func (s *spillFile) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pending
+}
+
+// reset truncates the file once everything has been read, must be called
+// with s.mu held.
+func (s *spillFile) reset() {
+	if err := s.writer.Truncate(0); err != nil {
+		log.Warn("Failed to truncate spill file", "path", s.path, "err", err)
+		return
+	}
+	s.file.Seek(0, 0)
+	s.reader.Reset(s.file)
+}
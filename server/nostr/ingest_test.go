@@ -0,0 +1,187 @@
+package nostr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingStore struct {
+	mu     sync.Mutex
+	events []*nostr.Event
+}
+
+func (r *recordingStore) StoreEvent(ev *nostr.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+	return nil
+}
+
+func (r *recordingStore) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.events)
+}
+
+func testEvent(kind, n int) *nostr.Event {
+	return &nostr.Event{ID: strconv.Itoa(kind) + ":" + strconv.Itoa(n), Kind: kind}
+}
+
+func TestIngestPriority(t *testing.T) {
+	q, err := newIngestQueue(types.IngestConfig{QueueSize: 100}, "", nil)
+	assert.NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		q.Enqueue(context.Background(), testEvent(3, i), nil)
+	}
+	for i := 0; i < 20; i++ {
+		q.Enqueue(context.Background(), testEvent(1, i), nil)
+	}
+
+	// posts go first, but contact lists are not starved
+	var kinds []int
+	for i := 0; i < starvationInterval; i++ {
+		kinds = append(kinds, q.next().ev.Kind)
+	}
+	assert.Equal(t, []int{1, 1, 1, 1, 1, 1, 1, 3}, kinds)
+	assert.Equal(t, 13, q.Stats().Depth["high"])
+	assert.Equal(t, 19, q.Stats().Depth["low"])
+}
+
+func TestIngestDrop(t *testing.T) {
+	q, err := newIngestQueue(types.IngestConfig{QueueSize: 2, Overflow: OverflowDrop}, "", nil)
+	assert.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		q.Enqueue(context.Background(), testEvent(1, i), nil)
+	}
+
+	stats := q.Stats()
+	assert.Equal(t, 2, stats.Depth["high"])
+	assert.Equal(t, uint64(3), stats.Dropped)
+}
+
+func TestIngestBackpressure(t *testing.T) {
+	q, err := newIngestQueue(types.IngestConfig{QueueSize: 1, Overflow: OverflowBackpressure}, "", nil)
+	assert.NoError(t, err)
+
+	q.Enqueue(context.Background(), testEvent(1, 0), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	q.Enqueue(ctx, testEvent(1, 1), nil)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, 1, q.Stats().Depth["high"])
+}
+
+func TestIngestSpill(t *testing.T) {
+	dir := t.TempDir()
+	config := types.IngestConfig{QueueSize: 2, Workers: 2, Overflow: OverflowSpill}
+
+	q, err := newIngestQueue(config, dir, nil)
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		q.Enqueue(context.Background(), testEvent(1, i), nil)
+	}
+	assert.Equal(t, 8, q.Stats().Spilled)
+
+	// spilled events survive a restart
+	q.spill.writer.Close()
+	store := &recordingStore{}
+	q, err = newIngestQueue(config, dir, store.StoreEvent)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, q.Stats().Spilled)
+
+	go q.Run()
+	assert.Eventually(t, func() bool { return store.Len() == 8 }, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, q.Stats().Spilled)
+
+	// the file is truncated once it has been read completely
+	q.spill.Write(testEvent(1, 10))
+	assert.Eventually(t, func() bool { return store.Len() == 9 }, 3*time.Second, 10*time.Millisecond)
+	info, err := os.Stat(filepath.Join(dir, "ingest.spill"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+}
+
+func TestIngestCorruptSpill(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ingest.spill")
+	first, _ := json.Marshal(testEvent(1, 1))
+	second, _ := json.Marshal(testEvent(1, 2))
+	content := string(first) + "\n{not json\n" + string(second) + "\n" + `{"id":"cut off`
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+
+	s, err := openSpillFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, s.Len())
+
+	ev, err := s.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "1:1", ev.ID)
+
+	// a bad line is moved aside and not read again
+	_, err = s.Next()
+	assert.ErrorIs(t, err, errCorruptSpill)
+	assert.Equal(t, 2, s.Len())
+
+	ev, err = s.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "1:2", ev.ID)
+
+	// so is a line cut off at the end of the file
+	_, err = s.Next()
+	assert.ErrorIs(t, err, errCorruptSpill)
+	assert.Equal(t, 0, s.Len())
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+	corrupt, err := os.ReadFile(path + ".corrupt")
+	assert.NoError(t, err)
+	assert.Equal(t, "{not json\n{\"id\":\"cut off\n", string(corrupt))
+}
+
+func TestIngestStored(t *testing.T) {
+	failing := errors.New("database is down")
+	var mu sync.Mutex
+	var stored []string
+	q, err := newIngestQueue(types.IngestConfig{QueueSize: 10}, "", func(ev *nostr.Event) error {
+		if ev.ID == "1:1" {
+			return failing
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		ev := testEvent(1, i)
+		q.Enqueue(context.Background(), ev, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			stored = append(stored, ev.ID)
+		})
+	}
+
+	// events that failed to be stored are not reported as stored
+	go q.Run()
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(stored) == 2
+	}, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint64(1), q.Stats().Failed)
+	assert.Equal(t, []string{"1:0", "1:2"}, stored)
+}
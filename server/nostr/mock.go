@@ -2,7 +2,12 @@ package nostr
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
 
+	"github.com/dyng/nosdaily/relay"
 	"github.com/dyng/nosdaily/types"
 	"github.com/nbd-wtf/go-nostr"
 	"github.com/stretchr/testify/mock"
@@ -13,8 +18,8 @@ type MockClient struct {
 }
 
 // Metadata implements IClient
-func (m *MockClient) Metadata(ctx context.Context, sk string, name string, about string, picture string, nip05 string, relays []types.RelayInfo) error {
-	args := m.Called(ctx, sk, name, about, picture, nip05, relays)
+func (m *MockClient) Metadata(ctx context.Context, signer Signer, name string, about string, picture string, nip05 string, relays []types.RelayInfo) error {
+	args := m.Called(ctx, signer, name, about, picture, nip05, relays)
 	return args.Error(0)
 }
 
@@ -23,17 +28,220 @@ func (m *MockClient) Subscribe(ctx context.Context, filters []nostr.Filter) <-ch
 	return args.Get(0).(<-chan nostr.Event)
 }
 
-func (m *MockClient) Repost(ctx context.Context, sk, id, author, raw string) error {
-	args := m.Called(ctx, sk, id, author, raw)
+func (m *MockClient) Repost(ctx context.Context, signer Signer, entry types.FeedEntry) error {
+	args := m.Called(ctx, signer, entry)
 	return args.Error(0)
 }
 
-func (m *MockClient) Mention(ctx context.Context, sk, msg string, mentions []string) error {
-	args := m.Called(ctx, sk, msg, mentions)
+func (m *MockClient) Mention(ctx context.Context, signer Signer, msg string, mentions []string) error {
+	args := m.Called(ctx, signer, msg, mentions)
 	return args.Error(0)
 }
 
-func (m *MockClient) Quote(ctx context.Context, sk string, comment string, id []string) error {
-	args := m.Called(ctx, sk, comment, id)
+func (m *MockClient) Reply(ctx context.Context, signer Signer, parent nostr.Event, seenOn []types.SeenOn, msg string) error {
+	args := m.Called(ctx, signer, parent, seenOn, msg)
 	return args.Error(0)
 }
+
+func (m *MockClient) ReceivedOn(id string) []types.SeenOn {
+	args := m.Called(id)
+	return args.Get(0).([]types.SeenOn)
+}
+
+func (m *MockClient) Digest(ctx context.Context, signer Signer, kind int, identifier, title string, items []DigestItem) error {
+	args := m.Called(ctx, signer, kind, identifier, title, items)
+	return args.Error(0)
+}
+
+func (m *MockClient) Profiles(ctx context.Context, pubkeys []string) map[string]string {
+	args := m.Called(ctx, pubkeys)
+	return args.Get(0).(map[string]string)
+}
+
+func (m *MockClient) Quote(ctx context.Context, signer Signer, comment string, entries []types.FeedEntry) error {
+	args := m.Called(ctx, signer, comment, entries)
+	return args.Error(0)
+}
+
+func (m *MockClient) SendMessage(ctx context.Context, signer Signer, receiverPub, msg string) error {
+	args := m.Called(ctx, signer, receiverPub, msg)
+	return args.Error(0)
+}
+
+func (m *MockClient) ReplyMessage(ctx context.Context, signer Signer, msg DirectMessage, reply string) error {
+	args := m.Called(ctx, signer, msg, reply)
+	return args.Error(0)
+}
+
+func (m *MockClient) Messages(ctx context.Context, signer Signer, cursor *MessageCursor) <-chan DirectMessage {
+	args := m.Called(ctx, signer, cursor)
+	return args.Get(0).(<-chan DirectMessage)
+}
+
+// MockBunker is an in-process NIP-46 remote signer for tests. It holds the
+// key of an account and answers the requests sent to it on a relay with a
+// key of its own.
+type MockBunker struct {
+	URI string
+
+	// Tamper changes an event after it has been asked to be signed, e.g. to
+	// test that signed events are checked, it must be set before the first
+	// request.
+	Tamper func(ev *nostr.Event)
+
+	relayURL string
+	pool     *relay.Pool
+	bunker   *LocalSigner
+	account  *LocalSigner
+	secret   string
+	cancel   context.CancelFunc
+
+	mu        sync.Mutex
+	sessions  map[string]bool
+	methods   []string
+	responded map[string]bool
+}
+
+func NewMockBunker(pool *relay.Pool, relayURL, sk, secret string) *MockBunker {
+	bunker, _ := NewLocalSigner(nostr.GeneratePrivateKey())
+	account, err := NewLocalSigner(sk)
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &MockBunker{
+		URI:       "bunker://" + bunker.pub + "?relay=" + relayURL + "&secret=" + secret,
+		relayURL:  relayURL,
+		pool:      pool,
+		bunker:    bunker,
+		account:   account,
+		secret:    secret,
+		cancel:    cancel,
+		sessions:  make(map[string]bool),
+		responded: make(map[string]bool),
+	}
+
+	since := time.Now().Add(-time.Minute)
+	r := pool.Acquire(relayURL)
+	sub := r.Subscribe(ctx, nostr.Filters{{
+		Kinds: []int{kindNostrConnect},
+		Tags:  nostr.TagMap{"p": []string{bunker.pub}},
+		Since: &since,
+	}})
+	go func() {
+		for ev := range sub.Events {
+			m.handle(ctx, r, ev)
+		}
+	}()
+	return m
+}
+
+func (m *MockBunker) Close() {
+	m.cancel()
+	m.pool.Release(m.relayURL)
+}
+
+// Methods returns the methods requested so far.
+func (m *MockBunker) Methods() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.methods...)
+}
+
+func (m *MockBunker) handle(ctx context.Context, r *relay.Relay, ev *nostr.Event) {
+	m.mu.Lock()
+	if m.responded[ev.ID] {
+		m.mu.Unlock()
+		return
+	}
+	m.responded[ev.ID] = true
+	m.mu.Unlock()
+
+	content, err := m.bunker.Nip44Decrypt(ctx, ev.PubKey, ev.Content)
+	if err != nil {
+		return
+	}
+	var req nip46Request
+	if err := json.Unmarshal([]byte(content), &req); err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	m.methods = append(m.methods, req.Method)
+	connected := m.sessions[ev.PubKey]
+	m.mu.Unlock()
+
+	resp := nip46Response{ID: req.ID}
+	switch {
+	case req.Method == "connect":
+		if len(req.Params) < 2 || req.Params[1] != m.secret {
+			resp.Error = "invalid secret"
+			break
+		}
+		m.mu.Lock()
+		m.sessions[ev.PubKey] = true
+		m.mu.Unlock()
+		resp.Result = "ack"
+	case !connected:
+		resp.Error = "not connected"
+	default:
+		resp.Result, err = m.call(ctx, req)
+		if err != nil {
+			resp.Error = err.Error()
+		}
+	}
+
+	raw, _ := json.Marshal(resp)
+	encrypted, err := m.bunker.Nip44Encrypt(ctx, ev.PubKey, string(raw))
+	if err != nil {
+		return
+	}
+	reply := nostr.Event{
+		CreatedAt: time.Now(),
+		Kind:      kindNostrConnect,
+		Tags:      nostr.Tags{nostr.Tag{"p", ev.PubKey}},
+		Content:   encrypted,
+	}
+	if err := m.bunker.Sign(ctx, &reply); err != nil {
+		return
+	}
+	r.Publish(ctx, reply)
+}
+
+func (m *MockBunker) call(ctx context.Context, req nip46Request) (string, error) {
+	param := func(i int) string {
+		if i < len(req.Params) {
+			return req.Params[i]
+		}
+		return ""
+	}
+
+	switch req.Method {
+	case "get_public_key":
+		return m.account.pub, nil
+	case "sign_event":
+		var ev nostr.Event
+		if err := json.Unmarshal([]byte(param(0)), &ev); err != nil {
+			return "", err
+		}
+		if m.Tamper != nil {
+			m.Tamper(&ev)
+		}
+		if err := m.account.Sign(ctx, &ev); err != nil {
+			return "", err
+		}
+		raw, err := json.Marshal(ev)
+		return string(raw), err
+	case "nip04_encrypt":
+		return m.account.Nip04Encrypt(ctx, param(0), param(1))
+	case "nip04_decrypt":
+		return m.account.Nip04Decrypt(ctx, param(0), param(1))
+	case "nip44_encrypt":
+		return m.account.Nip44Encrypt(ctx, param(0), param(1))
+	case "nip44_decrypt":
+		return m.account.Nip44Decrypt(ctx, param(0), param(1))
+	default:
+		return "", errors.New("unsupported method " + req.Method)
+	}
+}
@@ -0,0 +1,418 @@
+package nostr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	MessageNip04 = "nip04"
+	MessageNip17 = "nip17"
+
+	kindEncryptedDM = 4
+	kindSeal        = 13
+	kindChatMessage = 14
+	kindGiftWrap    = 1059
+	kindInboxRelays = 10050
+
+	// how far the timestamps of seals and gift wraps are moved into the past
+	giftWrapJitter = 2 * 24 * time.Hour
+	// how long to wait for relays to send the inbox relays of a receiver
+	inboxTimeout = 5 * time.Second
+)
+
+// DirectMessage is a private message received in either format.
+type DirectMessage struct {
+	ID        string
+	Sender    string
+	Content   string
+	CreatedAt time.Time
+	Format    string
+}
+
+// rumor is an unsigned event, it is marshaled without signature.
+type rumor struct {
+	ID        string     `json:"id"`
+	PubKey    string     `json:"pubkey"`
+	CreatedAt int64      `json:"created_at"`
+	Kind      int        `json:"kind"`
+	Tags      nostr.Tags `json:"tags"`
+	Content   string     `json:"content"`
+}
+
+// giftWrap creates a NIP-17 chat message from signer to receiverPub, sealed
+// with NIP-44 and wrapped in an event signed by a random key.
+func giftWrap(ctx context.Context, signer Signer, receiverPub, msg string, now time.Time) (nostr.Event, error) {
+	senderPub, err := signer.PublicKey(ctx)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+
+	chat := nostr.Event{
+		PubKey:    senderPub,
+		CreatedAt: now,
+		Kind:      kindChatMessage,
+		Tags:      nostr.Tags{nostr.Tag{"p", receiverPub}},
+		Content:   msg,
+	}
+	chat.ID = chat.GetID()
+	rawRumor, err := json.Marshal(rumor{
+		ID:        chat.ID,
+		PubKey:    chat.PubKey,
+		CreatedAt: chat.CreatedAt.Unix(),
+		Kind:      chat.Kind,
+		Tags:      chat.Tags,
+		Content:   chat.Content,
+	})
+	if err != nil {
+		return nostr.Event{}, err
+	}
+
+	seal, err := sealEvent(ctx, signer, receiverPub, kindSeal, nil, string(rawRumor), now)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+	rawSeal, err := json.Marshal(seal)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+
+	wrapper, err := NewLocalSigner(nostr.GeneratePrivateKey())
+	if err != nil {
+		return nostr.Event{}, err
+	}
+	return sealEvent(ctx, wrapper, receiverPub, kindGiftWrap, nostr.Tags{nostr.Tag{"p", receiverPub}}, string(rawSeal), now)
+}
+
+// sealEvent creates an event of kind signed by signer with content encrypted
+// to receiverPub and a randomized timestamp.
+func sealEvent(ctx context.Context, signer Signer, receiverPub string, kind int, tags nostr.Tags, content string, now time.Time) (nostr.Event, error) {
+	encrypted, err := signer.Nip44Encrypt(ctx, receiverPub, content)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+
+	if tags == nil {
+		tags = nostr.Tags{}
+	}
+	ev := nostr.Event{
+		CreatedAt: now.Add(-time.Duration(rand.Int63n(int64(giftWrapJitter)))),
+		Kind:      kind,
+		Tags:      tags,
+		Content:   encrypted,
+	}
+	if err := signer.Sign(ctx, &ev); err != nil {
+		return nostr.Event{}, err
+	}
+	return ev, nil
+}
+
+// encryptedDM returns a NIP-04 private message.
+func encryptedDM(ctx context.Context, signer Signer, receiverPub, msg string, now time.Time) (nostr.Event, error) {
+	content, err := signer.Nip04Encrypt(ctx, receiverPub, msg)
+	if err != nil {
+		return nostr.Event{}, err
+	}
+	ev := nostr.Event{
+		CreatedAt: now,
+		Kind:      kindEncryptedDM,
+		Tags:      nostr.Tags{nostr.Tag{"p", receiverPub}},
+		Content:   content,
+	}
+	if err := signer.Sign(ctx, &ev); err != nil {
+		return nostr.Event{}, err
+	}
+	return ev, nil
+}
+
+// openMessage decrypts a NIP-04 message or unwraps a NIP-17 gift wrap sent
+// to signer.
+func openMessage(ctx context.Context, signer Signer, ev *nostr.Event) (*DirectMessage, error) {
+	switch ev.Kind {
+	case kindEncryptedDM:
+		content, err := signer.Nip04Decrypt(ctx, ev.PubKey, ev.Content)
+		if err != nil {
+			return nil, err
+		}
+		return &DirectMessage{
+			ID:        ev.ID,
+			Sender:    ev.PubKey,
+			Content:   content,
+			CreatedAt: ev.CreatedAt,
+			Format:    MessageNip04,
+		}, nil
+	case kindGiftWrap:
+		seal, err := unseal(ctx, signer, ev)
+		if err != nil {
+			return nil, err
+		}
+		if seal.Kind != kindSeal {
+			return nil, fmt.Errorf("unexpected kind %d of seal", seal.Kind)
+		}
+		if ok, _ := seal.CheckSignature(); !ok {
+			return nil, errors.New("invalid signature of seal")
+		}
+
+		chat, err := unseal(ctx, signer, seal)
+		if err != nil {
+			return nil, err
+		}
+		if chat.Kind != kindChatMessage {
+			return nil, fmt.Errorf("unexpected kind %d of chat message", chat.Kind)
+		}
+		// the seal proves the sender, the rumor could claim anyone
+		if chat.PubKey != seal.PubKey {
+			return nil, errors.New("chat message not from the sealer")
+		}
+		return &DirectMessage{
+			ID:        chat.GetID(),
+			Sender:    chat.PubKey,
+			Content:   chat.Content,
+			CreatedAt: chat.CreatedAt,
+			Format:    MessageNip17,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unexpected kind %d of private message", ev.Kind)
+	}
+}
+
+// unseal decrypts the event in the content of ev.
+func unseal(ctx context.Context, signer Signer, ev *nostr.Event) (*nostr.Event, error) {
+	content, err := signer.Nip44Decrypt(ctx, ev.PubKey, ev.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	var inner nostr.Event
+	if err := json.Unmarshal([]byte(content), &inner); err != nil {
+		return nil, err
+	}
+	return &inner, nil
+}
+
+// inboxRelays returns the relays receiverPub wants to receive private
+// messages on according to its newest kind 10050 event on the relays
+// listened to, or nil if it has none.
+func (c *Client) inboxRelays(ctx context.Context, receiverPub string) []string {
+	ctx, cancel := context.WithTimeout(ctx, inboxTimeout)
+	defer cancel()
+
+	filter := nostr.Filter{Kinds: []int{kindInboxRelays}, Authors: []string{receiverPub}, Limit: 1}
+	var newest *nostr.Event
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for uri := range c.ListenTo {
+		wg.Add(1)
+		go func(uri string) {
+			defer wg.Done()
+			conn := c.pool.Acquire(uri)
+			defer c.pool.Release(uri)
+
+			events, err := conn.QuerySync(ctx, filter)
+			if err != nil {
+				logger.Debug("failed to query inbox relays", "uri", uri, "err", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, ev := range events {
+				if ev.Kind != kindInboxRelays || ev.PubKey != receiverPub {
+					continue
+				}
+				if newest == nil || ev.CreatedAt.After(newest.CreatedAt) {
+					newest = ev
+				}
+			}
+		}(uri)
+	}
+	wg.Wait()
+
+	if newest == nil {
+		return nil
+	}
+	var relays []string
+	for _, tag := range newest.Tags {
+		if len(tag) >= 2 && tag[0] == "relay" && tag[1] != "" {
+			relays = append(relays, nostr.NormalizeURL(tag[1]))
+		}
+	}
+	return relays
+}
+
+// publishInbox publishes a gift wrap to the inbox relays of its receiver,
+// it fails unless one of them accepted it.
+func (c *Client) publishInbox(ctx context.Context, relays []string, wrap nostr.Event) error {
+	ch := make(chan PublishResult, len(relays))
+	for _, uri := range relays {
+		go func(uri string) {
+			r := c.pool.Acquire(uri)
+			defer c.pool.Release(uri)
+			ch <- c.publish(ctx, uri, r, wrap)
+		}(uri)
+	}
+
+	results := make(PublishResults, 0, len(relays))
+	for range relays {
+		results = append(results, <-ch)
+	}
+	if results.Accepted() == 0 {
+		return &QuorumError{ID: wrap.ID, Quorum: 1, Results: results}
+	}
+	return nil
+}
+
+// MessageCursor remembers the newest private messages processed in a file,
+// so that the messages sent while the bot was down are received after a
+// restart and the ones processed before are not received again.
+type MessageCursor struct {
+	path string
+
+	mu    sync.Mutex
+	state messageCursorState
+}
+
+type messageCursorState struct {
+	// the time of the newest message processed, and the ids of the
+	// messages processed of that second
+	CreatedAt time.Time `json:"created_at"`
+	IDs       []string  `json:"ids"`
+}
+
+// OpenMessageCursor reads the cursor kept in path, a missing file is a
+// cursor at which no message has been processed yet.
+func OpenMessageCursor(path string) (*MessageCursor, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	cursor := &MessageCursor{path: path}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cursor, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &cursor.state); err != nil {
+		logger.Warn("skipping corrupt message cursor", "path", path, "err", err)
+	}
+	return cursor, nil
+}
+
+// Done records that msg has been processed.
+func (c *MessageCursor) Done(msg DirectMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	second := msg.CreatedAt.Truncate(time.Second)
+	switch {
+	case second.After(c.state.CreatedAt):
+		c.state = messageCursorState{CreatedAt: second, IDs: []string{msg.ID}}
+	case second.Equal(c.state.CreatedAt):
+		c.state.IDs = append(c.state.IDs, msg.ID)
+	default:
+		return nil
+	}
+
+	raw, err := json.Marshal(c.state)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+func (c *MessageCursor) position() messageCursorState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return messageCursorState{CreatedAt: c.state.CreatedAt, IDs: append([]string(nil), c.state.IDs...)}
+}
+
+// Messages receives the private messages sent to signer, in both NIP-04 and
+// NIP-17 format, from the newest message processed according to cursor on,
+// or from now on if cursor is nil or empty. Messages arriving from several
+// relays are delivered once.
+func (c *Client) Messages(ctx context.Context, signer Signer, cursor *MessageCursor) <-chan DirectMessage {
+	ch := make(chan DirectMessage)
+	pub, err := signer.PublicKey(ctx)
+	if err != nil {
+		logger.Error("invalid key to receive messages with", "err", err)
+		close(ch)
+		return ch
+	}
+
+	var start messageCursorState
+	if cursor != nil {
+		start = cursor.position()
+	}
+	if start.CreatedAt.IsZero() {
+		start.CreatedAt = time.Now().Truncate(time.Second)
+	}
+
+	// gift wraps are backdated, so they are asked for as far back as they
+	// can be, also after a reconnect, and filtered by the time of the
+	// message inside
+	since := start.CreatedAt
+	wrapsSince := since.Add(-giftWrapJitter)
+	dms := nostr.Filters{{Kinds: []int{kindEncryptedDM}, Tags: nostr.TagMap{"p": []string{pub}}, Since: &since}}
+	wraps := nostr.Filters{{Kinds: []int{kindGiftWrap}, Tags: nostr.TagMap{"p": []string{pub}}, Since: &wrapsSince}}
+
+	events := make(chan nostr.Event)
+	for uri, r := range c.ListenTo {
+		logger.Info("subscribing to private messages", "uri", uri)
+		go c.consume(ctx, r.Subscribe(ctx, dms), events)
+		go c.consume(ctx, r.SubscribeBackdated(ctx, wraps, giftWrapJitter), events)
+	}
+	// the messages of the second of the cursor processed before are not
+	// delivered again, nor are the older ones
+	seen := newSeenEvents(seenGenerationSize)
+	for _, id := range start.IDs {
+		seen.Add(id)
+	}
+	go func() {
+		defer close(ch)
+		for {
+			var ev nostr.Event
+			select {
+			case ev = <-events:
+			case <-ctx.Done():
+				return
+			}
+			if !seen.Add(ev.ID) {
+				continue
+			}
+
+			msg, err := openMessage(ctx, signer, &ev)
+			if err != nil {
+				logger.Warn("failed to open private message", "id", ev.ID, "kind", ev.Kind, "err", err)
+				continue
+			}
+			if msg.CreatedAt.Unix() < since.Unix() {
+				continue
+			}
+			// the same chat message may arrive in several gift wraps
+			if msg.Format == MessageNip17 && !seen.Add(msg.ID) {
+				continue
+			}
+
+			select {
+			case ch <- *msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch
+}
@@ -0,0 +1,304 @@
+package nostr
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dyng/nosdaily/relay"
+	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGiftWrap(t *testing.T) {
+	senderSK, senderPub := getIdentity()
+	receiverSK, receiverPub := getIdentity()
+	now := time.Now()
+
+	wrap, err := giftWrap(context.Background(), signerOf(senderSK), receiverPub, "hello", now)
+	assert.NoError(t, err)
+	assert.Equal(t, kindGiftWrap, wrap.Kind)
+	assert.NotEqual(t, senderPub, wrap.PubKey)
+	assert.Equal(t, receiverPub, wrap.Tags.GetFirst([]string{"p"}).Value())
+	assert.False(t, wrap.CreatedAt.After(now))
+	ok, _ := wrap.CheckSignature()
+	assert.True(t, ok)
+
+	msg, err := openMessage(context.Background(), signerOf(receiverSK), &wrap)
+	assert.NoError(t, err)
+	assert.Equal(t, senderPub, msg.Sender)
+	assert.Equal(t, "hello", msg.Content)
+	assert.Equal(t, MessageNip17, msg.Format)
+	assert.Equal(t, now.Unix(), msg.CreatedAt.Unix())
+
+	// nobody else can open it
+	otherSK, _ := getIdentity()
+	_, err = openMessage(context.Background(), signerOf(otherSK), &wrap)
+	assert.Error(t, err)
+}
+
+func TestGiftWrapSpoofedSender(t *testing.T) {
+	sealerSK, _ := getIdentity()
+	_, victimPub := getIdentity()
+	receiverSK, receiverPub := getIdentity()
+	now := time.Now()
+
+	// a rumor claiming to be from somebody else than the sealer
+	raw, _ := json.Marshal(rumor{PubKey: victimPub, CreatedAt: now.Unix(), Kind: kindChatMessage, Tags: nostr.Tags{}, Content: "hi"})
+	seal, err := sealEvent(context.Background(), signerOf(sealerSK), receiverPub, kindSeal, nil, string(raw), now)
+	assert.NoError(t, err)
+	rawSeal, _ := json.Marshal(seal)
+	wrap, err := sealEvent(context.Background(), signerOf(nostr.GeneratePrivateKey()), receiverPub, kindGiftWrap, nostr.Tags{nostr.Tag{"p", receiverPub}}, string(rawSeal), now)
+	assert.NoError(t, err)
+
+	_, err = openMessage(context.Background(), signerOf(receiverSK), &wrap)
+	assert.Error(t, err)
+}
+
+func TestOpenNip04Message(t *testing.T) {
+	senderSK, senderPub := getIdentity()
+	receiverSK, receiverPub := getIdentity()
+
+	shared, _ := nip04.ComputeSharedSecret(receiverPub, senderSK)
+	content, _ := nip04.Encrypt("hello", shared)
+	ev := nostr.Event{PubKey: senderPub, CreatedAt: time.Now(), Kind: kindEncryptedDM, Content: content}
+	assert.NoError(t, ev.Sign(senderSK))
+
+	msg, err := openMessage(context.Background(), signerOf(receiverSK), &ev)
+	assert.NoError(t, err)
+	assert.Equal(t, senderPub, msg.Sender)
+	assert.Equal(t, "hello", msg.Content)
+	assert.Equal(t, MessageNip04, msg.Format)
+}
+
+func TestMessages(t *testing.T) {
+	relay1 := relay.NewMockRelay()
+	defer relay1.Close()
+	relay2 := relay.NewMockRelay()
+	defer relay2.Close()
+
+	pool := relay.NewPool(relay.NewHealth(types.HealthConfig{}), types.AuthConfig{})
+	client, err := NewClient(context.Background(), []string{relay1.URL, relay2.URL}, nil, pool, 2, nil, types.RateLimitConfig{})
+	assert.NoError(t, err)
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	botSK, botPub := getIdentity()
+	messages := client.Messages(ctx, signerOf(botSK), nil)
+
+	// wait for the subscriptions to be sent before publishing
+	for _, r := range client.ListenTo {
+		assert.NoError(t, r.WaitConnected(ctx))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	senderSK, senderPub := getIdentity()
+	assert.NoError(t, client.SendMessage(ctx, signerOf(senderSK), botPub, "#help"))
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, senderPub, msg.Sender)
+		assert.Equal(t, "#help", msg.Content)
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for message")
+	}
+
+	// the copy from the other relay is not delivered again
+	select {
+	case msg := <-messages:
+		t.Fatalf("unexpected message %v", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestMessagesAfterReconnect(t *testing.T) {
+	mock := relay.NewMockRelay()
+	defer mock.Close()
+
+	pool := relay.NewPool(relay.NewHealth(types.HealthConfig{BaseDelay: "1s"}), types.AuthConfig{})
+	client, err := NewClient(context.Background(), []string{mock.URL}, nil, pool, 1, nil, types.RateLimitConfig{})
+	assert.NoError(t, err)
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	botSK, botPub := getIdentity()
+	messages := client.Messages(ctx, signerOf(botSK), nil)
+	r := client.ListenTo[mock.URL]
+	assert.NoError(t, r.WaitConnected(ctx))
+	time.Sleep(100 * time.Millisecond)
+
+	senderSK, _ := getIdentity()
+	receive := func(content string) {
+		select {
+		case msg := <-messages:
+			assert.Equal(t, content, msg.Content)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %q", content)
+		}
+	}
+
+	// a message wrapped just now moves the newest event received
+	wrap := wrapAt(t, senderSK, botPub, "before", time.Now())
+	mock.AddEvent(&wrap)
+	receive("before")
+
+	mock.DropConnections()
+	assert.Eventually(t, func() bool {
+		return r.State() == relay.StateConnected && mock.Connections() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+
+	// wraps are still asked for as far back as they may be backdated
+	wrap = wrapAt(t, senderSK, botPub, "after", time.Now().Add(-giftWrapJitter+time.Hour))
+	mock.AddEvent(&wrap)
+	receive("after")
+}
+
+func TestMessagesCursor(t *testing.T) {
+	mock := relay.NewMockRelay()
+	defer mock.Close()
+
+	pool := relay.NewPool(relay.NewHealth(types.HealthConfig{}), types.AuthConfig{})
+	client, err := NewClient(context.Background(), []string{mock.URL}, nil, pool, 1, nil, types.RateLimitConfig{})
+	assert.NoError(t, err)
+	defer client.Close()
+
+	botSK, botPub := getIdentity()
+	senderSK, _ := getIdentity()
+	now := time.Now().Truncate(time.Second)
+	cursorAt := now.Add(-time.Hour)
+
+	// one message processed before the restart, one of the same second and
+	// one later that were not, and one older than the cursor
+	processed := wrapMessageAt(t, senderSK, botPub, "processed", cursorAt, now)
+	sameSecond := wrapMessageAt(t, senderSK, botPub, "same second", cursorAt, now)
+	later := wrapMessageAt(t, senderSK, botPub, "later", cursorAt.Add(time.Minute), now)
+	older := wrapMessageAt(t, senderSK, botPub, "older", cursorAt.Add(-time.Minute), now)
+	for _, wrap := range []*nostr.Event{&processed, &sameSecond, &later, &older} {
+		mock.AddEvent(wrap)
+	}
+
+	path := filepath.Join(t.TempDir(), "messages.json")
+	cursor, err := OpenMessageCursor(path)
+	assert.NoError(t, err)
+	msg, err := openMessage(context.Background(), signerOf(botSK), &processed)
+	assert.NoError(t, err)
+	assert.NoError(t, cursor.Done(*msg))
+
+	// the cursor survives a restart
+	cursor, err = OpenMessageCursor(path)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages := client.Messages(ctx, signerOf(botSK), cursor)
+
+	var received []string
+	timeout := time.After(3 * time.Second)
+	for waiting := true; waiting; {
+		select {
+		case msg := <-messages:
+			received = append(received, msg.Content)
+			if len(received) == 2 {
+				timeout = time.After(200 * time.Millisecond)
+			}
+		case <-timeout:
+			waiting = false
+		}
+	}
+	assert.ElementsMatch(t, []string{"same second", "later"}, received)
+}
+
+func TestSendMessageInbox(t *testing.T) {
+	ours := relay.NewMockRelay()
+	defer ours.Close()
+	inbox := relay.NewMockRelay()
+	defer inbox.Close()
+
+	pool := relay.NewPool(relay.NewHealth(types.HealthConfig{}), types.AuthConfig{})
+	client, err := NewClient(context.Background(), []string{ours.URL}, nil, pool, 1, nil, types.RateLimitConfig{})
+	assert.NoError(t, err)
+	defer client.Close()
+
+	botSK, _ := getIdentity()
+	receiverSK, receiverPub := getIdentity()
+	_, otherPub := getIdentity()
+
+	// the receiver wants messages on its inbox relay
+	relays := nostr.Event{PubKey: receiverPub, CreatedAt: time.Now(), Kind: kindInboxRelays, Tags: nostr.Tags{nostr.Tag{"relay", inbox.URL}}}
+	assert.NoError(t, relays.Sign(receiverSK))
+	ours.AddEvent(&relays)
+
+	assert.NoError(t, client.SendMessage(context.Background(), signerOf(botSK), receiverPub, "hello"))
+	assert.Len(t, inbox.Events(), 1)
+	assert.Len(t, ours.Events(), 1)
+	assert.Equal(t, kindGiftWrap, inbox.Events()[0].Kind)
+
+	// somebody without inbox relays gets it on ours
+	assert.NoError(t, client.SendMessage(context.Background(), signerOf(botSK), otherPub, "hello"))
+	assert.Len(t, inbox.Events(), 1)
+	assert.Len(t, ours.Events(), 2)
+	assert.Equal(t, kindGiftWrap, ours.Events()[1].Kind)
+}
+
+// wrapAt gift wraps a message like giftWrap does, but with the wrap created
+// at the given time instead of a random one.
+func wrapAt(t *testing.T, senderSK, receiverPub, msg string, createdAt time.Time) nostr.Event {
+	return wrapMessageAt(t, senderSK, receiverPub, msg, time.Now(), createdAt)
+}
+
+// wrapMessageAt is wrapAt for a message sent at the given time.
+func wrapMessageAt(t *testing.T, senderSK, receiverPub, msg string, sentAt, createdAt time.Time) nostr.Event {
+	senderPub, _ := nostr.GetPublicKey(senderSK)
+	now := sentAt
+	raw, _ := json.Marshal(rumor{PubKey: senderPub, CreatedAt: now.Unix(), Kind: kindChatMessage, Tags: nostr.Tags{nostr.Tag{"p", receiverPub}}, Content: msg})
+	seal, err := sealEvent(context.Background(), signerOf(senderSK), receiverPub, kindSeal, nil, string(raw), now)
+	assert.NoError(t, err)
+	rawSeal, _ := json.Marshal(seal)
+
+	wrapper := signerOf(nostr.GeneratePrivateKey())
+	content, err := wrapper.Nip44Encrypt(context.Background(), receiverPub, string(rawSeal))
+	assert.NoError(t, err)
+	wrap := nostr.Event{
+		CreatedAt: createdAt,
+		Kind:      kindGiftWrap,
+		Tags:      nostr.Tags{nostr.Tag{"p", receiverPub}},
+		Content:   content,
+	}
+	assert.NoError(t, wrapper.Sign(context.Background(), &wrap))
+	return wrap
+}
+
+func TestReplyMessage(t *testing.T) {
+	mock := relay.NewMockRelay()
+	defer mock.Close()
+
+	client, err := NewClient(context.Background(), []string{mock.URL}, nil, relay.NewPool(relay.NewHealth(types.HealthConfig{}), types.AuthConfig{}), 1, nil, types.RateLimitConfig{})
+	assert.NoError(t, err)
+	defer client.Close()
+
+	botSK, _ := getIdentity()
+	senderSK, senderPub := getIdentity()
+
+	// a NIP-04 message is answered with NIP-04, a NIP-17 one with NIP-17
+	assert.NoError(t, client.ReplyMessage(context.Background(), signerOf(botSK), DirectMessage{Sender: senderPub, Format: MessageNip04}, "old"))
+	assert.NoError(t, client.ReplyMessage(context.Background(), signerOf(botSK), DirectMessage{Sender: senderPub, Format: MessageNip17}, "new"))
+
+	events := mock.Events()
+	assert.Len(t, events, 2)
+	replies := map[int]string{}
+	for _, ev := range events {
+		msg, err := openMessage(context.Background(), signerOf(senderSK), ev)
+		if assert.NoError(t, err) {
+			replies[ev.Kind] = msg.Content
+		}
+	}
+	assert.Equal(t, "old", replies[kindEncryptedDM])
+	assert.Equal(t, "new", replies[kindGiftWrap])
+}
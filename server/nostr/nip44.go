@@ -0,0 +1,186 @@
+package nostr
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/bits"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/hkdf"
+)
+
+// NIP-44 v2 encryption, see https://github.com/nostr-protocol/nips/blob/master/44.md
+
+const (
+	nip44Version = 2
+
+	nip44MinPlaintext = 1
+	nip44MaxPlaintext = 65535
+)
+
+var (
+	ErrNip44Version = errors.New("nip44: unknown version")
+	ErrNip44Payload = errors.New("nip44: invalid payload")
+	ErrNip44MAC     = errors.New("nip44: invalid mac")
+	ErrNip44Length  = errors.New("nip44: invalid plaintext length")
+)
+
+// nip44ConversationKey derives the key shared by sk and the owner of pub,
+// which is the same in both directions.
+func nip44ConversationKey(sk, pub string) ([]byte, error) {
+	skBytes, err := hex.DecodeString(padSecretKey(sk))
+	if err != nil || len(skBytes) != 32 {
+		return nil, errors.New("nip44: invalid private key")
+	}
+	pubBytes, err := hex.DecodeString("02" + pub)
+	if err != nil {
+		return nil, errors.New("nip44: invalid public key")
+	}
+	pubKey, err := btcec.ParsePubKey(pubBytes)
+	if err != nil {
+		return nil, errors.New("nip44: invalid public key")
+	}
+
+	privKey, _ := btcec.PrivKeyFromBytes(skBytes)
+	shared := btcec.GenerateSharedSecret(privKey, pubKey)
+	return hkdf.Extract(sha256.New, shared, []byte("nip44-v2")), nil
+}
+
+// nip44Encrypt encrypts plaintext with a conversation key.
+func nip44Encrypt(key []byte, plaintext string) (string, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return nip44EncryptWithNonce(key, plaintext, nonce)
+}
+
+func nip44EncryptWithNonce(key []byte, plaintext string, nonce []byte) (string, error) {
+	chachaKey, chachaNonce, hmacKey, err := nip44MessageKeys(key, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	padded, err := nip44Pad(plaintext)
+	if err != nil {
+		return "", err
+	}
+
+	cipher, err := chacha20.NewUnauthenticatedCipher(chachaKey, chachaNonce)
+	if err != nil {
+		return "", err
+	}
+	ciphertext := make([]byte, len(padded))
+	cipher.XORKeyStream(ciphertext, padded)
+
+	payload := make([]byte, 0, 1+len(nonce)+len(ciphertext)+sha256.Size)
+	payload = append(payload, nip44Version)
+	payload = append(payload, nonce...)
+	payload = append(payload, ciphertext...)
+	payload = append(payload, nip44MAC(hmacKey, nonce, ciphertext)...)
+	return base64.StdEncoding.EncodeToString(payload), nil
+}
+
+// nip44Decrypt decrypts a payload with a conversation key.
+func nip44Decrypt(key []byte, payload string) (string, error) {
+	if payload == "" || payload[0] == '#' {
+		return "", ErrNip44Version
+	}
+	if len(payload) < 132 || len(payload) > 87472 {
+		return "", ErrNip44Payload
+	}
+
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil || len(data) < 99 || len(data) > 65603 {
+		return "", ErrNip44Payload
+	}
+	if data[0] != nip44Version {
+		return "", ErrNip44Version
+	}
+
+	nonce := data[1:33]
+	ciphertext := data[33 : len(data)-sha256.Size]
+	mac := data[len(data)-sha256.Size:]
+
+	chachaKey, chachaNonce, hmacKey, err := nip44MessageKeys(key, nonce)
+	if err != nil {
+		return "", err
+	}
+	if !hmac.Equal(mac, nip44MAC(hmacKey, nonce, ciphertext)) {
+		return "", ErrNip44MAC
+	}
+
+	cipher, err := chacha20.NewUnauthenticatedCipher(chachaKey, chachaNonce)
+	if err != nil {
+		return "", err
+	}
+	padded := make([]byte, len(ciphertext))
+	cipher.XORKeyStream(padded, ciphertext)
+	return nip44Unpad(padded)
+}
+
+func nip44MessageKeys(key, nonce []byte) (chachaKey, chachaNonce, hmacKey []byte, err error) {
+	if len(key) != 32 {
+		return nil, nil, nil, errors.New("nip44: invalid conversation key")
+	}
+	if len(nonce) != 32 {
+		return nil, nil, nil, errors.New("nip44: invalid nonce")
+	}
+
+	keys := make([]byte, 76)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, key, nonce), keys); err != nil {
+		return nil, nil, nil, err
+	}
+	return keys[0:32], keys[32:44], keys[44:76], nil
+}
+
+func nip44MAC(key, nonce, ciphertext []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(nonce)
+	h.Write(ciphertext)
+	return h.Sum(nil)
+}
+
+// nip44PaddedLen rounds a plaintext length up, so that the length of a
+// message leaks as little as possible.
+func nip44PaddedLen(n int) int {
+	if n <= 32 {
+		return 32
+	}
+	next := 1 << bits.Len(uint(n-1))
+	chunk := 32
+	if next > 256 {
+		chunk = next / 8
+	}
+	return chunk * ((n-1)/chunk + 1)
+}
+
+func nip44Pad(plaintext string) ([]byte, error) {
+	n := len(plaintext)
+	if n < nip44MinPlaintext || n > nip44MaxPlaintext {
+		return nil, ErrNip44Length
+	}
+
+	padded := make([]byte, 2+nip44PaddedLen(n))
+	binary.BigEndian.PutUint16(padded, uint16(n))
+	copy(padded[2:], plaintext)
+	return padded, nil
+}
+
+func nip44Unpad(padded []byte) (string, error) {
+	if len(padded) < 2 {
+		return "", ErrNip44Payload
+	}
+	n := int(binary.BigEndian.Uint16(padded))
+	if n < nip44MinPlaintext || n > nip44MaxPlaintext || len(padded) != 2+nip44PaddedLen(n) {
+		return "", ErrNip44Payload
+	}
+	return string(padded[2 : 2+n]), nil
+}
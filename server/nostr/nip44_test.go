@@ -0,0 +1,94 @@
+package nostr
+
+import (
+	"context"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNip44Vector(t *testing.T) {
+	sk1 := strings.Repeat("0", 63) + "1"
+	sk2 := strings.Repeat("0", 63) + "2"
+	pub2, _ := nostr.GetPublicKey(sk2)
+
+	key, err := nip44ConversationKey(sk1, pub2)
+	assert.NoError(t, err)
+	assert.Equal(t, "c41c775356fd92eadc63ff5a0dc1da211b268cbea22316767095b2871ea1412d", hex.EncodeToString(key))
+
+	nonce, _ := hex.DecodeString(strings.Repeat("0", 63) + "1")
+	payload, err := nip44EncryptWithNonce(key, "a", nonce)
+	assert.NoError(t, err)
+	assert.Equal(t, "AgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAABee0G5VSK0/9YypIObAtDKfYEAjD35uVkHyB0F4DwrcNaCXlCWZKaArsGrY6M9wnuTMxWfp1RTN9Xga8no+kF5Vsb", payload)
+
+	plaintext, err := nip44Decrypt(key, payload)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", plaintext)
+}
+
+func TestNip44RoundTrip(t *testing.T) {
+	sk1, pub1 := getIdentity()
+	sk2, pub2 := getIdentity()
+
+	key1, err := nip44ConversationKey(sk1, pub2)
+	assert.NoError(t, err)
+	key2, err := nip44ConversationKey(sk2, pub1)
+	assert.NoError(t, err)
+	assert.Equal(t, key1, key2)
+
+	for _, msg := range []string{"a", "hello world", strings.Repeat("x", 1000), strings.Repeat("ü", 20000)} {
+		payload, err := nip44Encrypt(key1, msg)
+		assert.NoError(t, err)
+		plaintext, err := nip44Decrypt(key2, payload)
+		assert.NoError(t, err)
+		assert.Equal(t, msg, plaintext)
+	}
+
+	_, err = nip44Encrypt(key1, "")
+	assert.ErrorIs(t, err, ErrNip44Length)
+
+	// a tampered payload fails authentication
+	payload, _ := nip44Encrypt(key1, "hello world")
+	raw := []byte(payload)
+	raw[50] ^= 1
+	if raw[50] == '+' || raw[50] == '/' {
+		raw[50] = 'A'
+	}
+	_, err = nip44Decrypt(key2, string(raw))
+	assert.Error(t, err)
+
+	_, err = nip44Decrypt(key2, "#"+payload[1:])
+	assert.ErrorIs(t, err, ErrNip44Version)
+}
+
+func TestNip44ShortKey(t *testing.T) {
+	// a key with a leading zero byte as go-nostr generates it
+	sk := strings.Repeat("0", 2) + strings.Repeat("ab", 31)
+	_, pub2 := getIdentity()
+
+	key, err := nip44ConversationKey(sk[2:], pub2)
+	assert.NoError(t, err)
+	padded, err := nip44ConversationKey(sk, pub2)
+	assert.NoError(t, err)
+	assert.Equal(t, padded, key)
+
+	signer, err := NewLocalSigner(sk[1:])
+	assert.NoError(t, err)
+	_, err = signer.Nip44Encrypt(context.Background(), pub2, "hello")
+	assert.NoError(t, err)
+}
+
+func TestNip44PaddedLen(t *testing.T) {
+	cases := map[int]int{
+		1: 32, 16: 32, 32: 32, 33: 64, 37: 64, 45: 64, 49: 64, 64: 64, 65: 96,
+		100: 128, 111: 128, 200: 224, 250: 256, 320: 320, 383: 384, 384: 384,
+		400: 448, 500: 512, 512: 512, 515: 640, 700: 768, 800: 896, 900: 1024,
+		1020: 1024, 65536: 65536,
+	}
+	for n, padded := range cases {
+		assert.Equal(t, padded, nip44PaddedLen(n), "length %d", n)
+	}
+}
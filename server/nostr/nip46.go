@@ -0,0 +1,362 @@
+package nostr
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dyng/nosdaily/relay"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	kindNostrConnect = 24133
+
+	// how long to wait for the bunker to answer a request
+	nip46Timeout = time.Minute
+)
+
+var ErrBunkerTimeout = errors.New("bunker did not respond in time")
+
+type nip46Request struct {
+	ID     string   `json:"id"`
+	Method string   `json:"method"`
+	Params []string `json:"params"`
+}
+
+type nip46Response struct {
+	ID     string `json:"id"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// BunkerSigner is a Signer asking a NIP-46 remote signer, a bunker, to sign
+// and encrypt. Requests are sent to the bunker over relays in events signed
+// with a session key of our own, the key of the account never leaves the
+// bunker.
+type BunkerSigner struct {
+	remotePub string
+	secret    string
+	relays    map[string]*relay.Relay
+	pool      *relay.Pool
+	session   *LocalSigner
+	userPub   string
+	cancel    context.CancelFunc
+
+	mu      sync.Mutex
+	pending map[string]chan nip46Response
+}
+
+// ParseBunkerURI parses a bunker://<remote-signer-pubkey>?relay=...&secret=...
+// connection string.
+func ParseBunkerURI(uri string) (remotePub string, relays []string, secret string, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", nil, "", err
+	}
+	if u.Scheme != "bunker" {
+		return "", nil, "", fmt.Errorf("invalid bunker uri scheme: %s", u.Scheme)
+	}
+	if _, err := hex.DecodeString(u.Host); err != nil || len(u.Host) != 64 {
+		return "", nil, "", fmt.Errorf("invalid bunker public key: %s", u.Host)
+	}
+
+	query := u.Query()
+	relays = query["relay"]
+	if len(relays) == 0 {
+		return "", nil, "", errors.New("bunker uri has no relay")
+	}
+	return u.Host, relays, query.Get("secret"), nil
+}
+
+// NewBunkerSigner connects to the bunker of uri. The session key identifies
+// us to the bunker, a bunker remembering what it authorized expects the same
+// key on every connect; a random key is used if it is empty.
+func NewBunkerSigner(ctx context.Context, uri, sessionSK string, pool *relay.Pool) (*BunkerSigner, error) {
+	remotePub, urls, secret, err := ParseBunkerURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if sessionSK == "" {
+		sessionSK = nostr.GeneratePrivateKey()
+	}
+	session, err := NewLocalSigner(sessionSK)
+	if err != nil {
+		return nil, err
+	}
+
+	listenCtx, cancel := context.WithCancel(context.Background())
+	s := &BunkerSigner{
+		remotePub: remotePub,
+		secret:    secret,
+		relays:    make(map[string]*relay.Relay),
+		pool:      pool,
+		session:   session,
+		cancel:    cancel,
+		pending:   make(map[string]chan nip46Response),
+	}
+
+	// responses may be stored by a relay before we subscribe to them, so
+	// the subscription starts a bit in the past
+	since := time.Now().Add(-time.Minute)
+	filters := nostr.Filters{{
+		Kinds: []int{kindNostrConnect},
+		Tags:  nostr.TagMap{"p": []string{session.pub}},
+		Since: &since,
+	}}
+	for _, url := range urls {
+		r := pool.Acquire(url)
+		s.relays[url] = r
+		go s.listen(listenCtx, r.Subscribe(listenCtx, filters))
+	}
+
+	if _, err := s.request(ctx, "connect", remotePub, secret); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to connect to bunker: %w", err)
+	}
+	s.userPub, err = s.request(ctx, "get_public_key")
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to get public key from bunker: %w", err)
+	}
+
+	logger.Info("connected to bunker", "remote_pub", remotePub, "user_pub", s.userPub, "relays", urls)
+	return s, nil
+}
+
+// Close stops listening to the bunker.
+func (s *BunkerSigner) Close() {
+	s.cancel()
+	for url := range s.relays {
+		s.pool.Release(url)
+	}
+}
+
+func (s *BunkerSigner) PublicKey(ctx context.Context) (string, error) {
+	return s.userPub, nil
+}
+
+func (s *BunkerSigner) Sign(ctx context.Context, ev *nostr.Event) error {
+	if ev.Tags == nil {
+		ev.Tags = nostr.Tags{}
+	}
+	unsigned, err := json.Marshal(map[string]any{
+		"kind":       ev.Kind,
+		"content":    ev.Content,
+		"tags":       ev.Tags,
+		"created_at": ev.CreatedAt.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	result, err := s.request(ctx, "sign_event", string(unsigned))
+	if err != nil {
+		return err
+	}
+
+	var signed nostr.Event
+	if err := json.Unmarshal([]byte(result), &signed); err != nil {
+		return fmt.Errorf("invalid event signed by bunker: %w", err)
+	}
+	// the bunker must sign exactly what was asked for, by the account
+	if signed.PubKey != s.userPub || signed.Kind != ev.Kind || signed.Content != ev.Content ||
+		signed.CreatedAt.Unix() != ev.CreatedAt.Unix() || !sameTags(signed.Tags, ev.Tags) {
+		return errors.New("bunker signed a different event")
+	}
+	if signed.ID != signed.GetID() {
+		return errors.New("bunker returned an event with a wrong id")
+	}
+	if ok, err := signed.CheckSignature(); !ok {
+		return fmt.Errorf("invalid signature from bunker: %v", err)
+	}
+
+	*ev = signed
+	return nil
+}
+
+func (s *BunkerSigner) Nip04Encrypt(ctx context.Context, receiverPub, plaintext string) (string, error) {
+	return s.request(ctx, "nip04_encrypt", receiverPub, plaintext)
+}
+
+func (s *BunkerSigner) Nip04Decrypt(ctx context.Context, senderPub, ciphertext string) (string, error) {
+	return s.request(ctx, "nip04_decrypt", senderPub, ciphertext)
+}
+
+func (s *BunkerSigner) Nip44Encrypt(ctx context.Context, receiverPub, plaintext string) (string, error) {
+	return s.request(ctx, "nip44_encrypt", receiverPub, plaintext)
+}
+
+func (s *BunkerSigner) Nip44Decrypt(ctx context.Context, senderPub, ciphertext string) (string, error) {
+	return s.request(ctx, "nip44_decrypt", senderPub, ciphertext)
+}
+
+// request sends a request to the bunker on all relays and waits for the
+// first response.
+func (s *BunkerSigner) request(ctx context.Context, method string, params ...string) (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	req := nip46Request{ID: hex.EncodeToString(id), Method: method, Params: params}
+	if req.Params == nil {
+		req.Params = []string{}
+	}
+
+	raw, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	content, err := s.session.Nip44Encrypt(ctx, s.remotePub, string(raw))
+	if err != nil {
+		return "", err
+	}
+	ev := nostr.Event{
+		CreatedAt: time.Now(),
+		Kind:      kindNostrConnect,
+		Tags:      nostr.Tags{nostr.Tag{"p", s.remotePub}},
+		Content:   content,
+	}
+	if err := s.session.Sign(ctx, &ev); err != nil {
+		return "", err
+	}
+
+	ch := make(chan nip46Response, 1)
+	s.mu.Lock()
+	s.pending[req.ID] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, req.ID)
+		s.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, nip46Timeout)
+	defer cancel()
+
+	sent := 0
+	var lastErr error
+	for url, r := range s.relays {
+		if err := r.WaitConnected(ctx); err != nil {
+			lastErr = err
+			continue
+		}
+		ok, msg, err := r.Publish(ctx, ev)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if !ok {
+			lastErr = fmt.Errorf("%s rejected the request: %s", url, msg)
+			continue
+		}
+		sent++
+	}
+	if sent == 0 {
+		return "", fmt.Errorf("failed to send %s request to bunker: %w", method, lastErr)
+	}
+
+	for {
+		select {
+		case resp := <-ch:
+			// the bunker wants the request approved by the user first, the
+			// actual response follows
+			if resp.Result == "auth_url" {
+				logger.Warn("bunker asks to approve the request", "method", method, "url", resp.Error)
+				continue
+			}
+			if resp.Error != "" {
+				return "", fmt.Errorf("bunker refused %s: %s", method, resp.Error)
+			}
+			return resp.Result, nil
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return "", ErrBunkerTimeout
+			}
+			return "", ctx.Err()
+		}
+	}
+}
+
+// listen hands the responses from the bunker to the requests waiting, until
+// ctx is done.
+func (s *BunkerSigner) listen(ctx context.Context, sub *relay.Subscription) {
+	for {
+		var ev *nostr.Event
+		select {
+		case e, ok := <-sub.Events:
+			if !ok {
+				return
+			}
+			ev = e
+		case <-ctx.Done():
+			return
+		}
+		if ev.PubKey != s.remotePub {
+			continue
+		}
+
+		resp, err := s.openResponse(ev)
+		if err != nil {
+			logger.Warn("failed to read bunker response", "id", ev.ID, "err", err)
+			continue
+		}
+
+		s.mu.Lock()
+		ch, ok := s.pending[resp.ID]
+		s.mu.Unlock()
+		if !ok {
+			continue
+		}
+		// the same response arrives from every relay
+		select {
+		case ch <- *resp:
+		default:
+		}
+	}
+}
+
+func sameTags(a, b nostr.Tags) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i]) != len(b[i]) {
+			return false
+		}
+		for j := range a[i] {
+			if a[i][j] != b[i][j] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// openResponse decrypts a response, older bunkers encrypt with NIP-04.
+func (s *BunkerSigner) openResponse(ev *nostr.Event) (*nip46Response, error) {
+	var content string
+	var err error
+	if strings.Contains(ev.Content, "?iv=") {
+		content, err = s.session.Nip04Decrypt(context.Background(), ev.PubKey, ev.Content)
+	} else {
+		content, err = s.session.Nip44Decrypt(context.Background(), ev.PubKey, ev.Content)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var resp nip46Response
+	if err := json.Unmarshal([]byte(content), &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
@@ -0,0 +1,119 @@
+package nostr
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dyng/nosdaily/relay"
+	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBunkerURI(t *testing.T) {
+	_, pub := getIdentity()
+	remotePub, relays, secret, err := ParseBunkerURI("bunker://" + pub + "?relay=wss://one.example.com&relay=wss://two.example.com&secret=abc")
+	assert.NoError(t, err)
+	assert.Equal(t, pub, remotePub)
+	assert.Equal(t, []string{"wss://one.example.com", "wss://two.example.com"}, relays)
+	assert.Equal(t, "abc", secret)
+
+	_, _, _, err = ParseBunkerURI("nostrconnect://" + pub + "?relay=wss://one.example.com")
+	assert.Error(t, err)
+	_, _, _, err = ParseBunkerURI("bunker://" + pub)
+	assert.Error(t, err)
+	_, _, _, err = ParseBunkerURI("bunker://npub1xyz?relay=wss://one.example.com")
+	assert.Error(t, err)
+}
+
+func TestBunkerSigner(t *testing.T) {
+	mock := relay.NewMockRelay()
+	defer mock.Close()
+	pool := relay.NewPool(relay.NewHealth(types.HealthConfig{}), types.AuthConfig{})
+
+	accountSK, accountPub := getIdentity()
+	bunker := NewMockBunker(pool, mock.URL, accountSK, "s3cret")
+	defer bunker.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	signer, err := NewBunkerSigner(ctx, bunker.URI, "", pool)
+	assert.NoError(t, err)
+	defer signer.Close()
+
+	pub, err := signer.PublicKey(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, accountPub, pub)
+
+	ev := nostr.Event{CreatedAt: time.Now(), Kind: 1, Tags: nostr.Tags{}, Content: "signed remotely"}
+	assert.NoError(t, signer.Sign(ctx, &ev))
+	assert.Equal(t, accountPub, ev.PubKey)
+	ok, _ := ev.CheckSignature()
+	assert.True(t, ok)
+
+	// private messages are sealed and opened by the bunker
+	receiverSK, receiverPub := getIdentity()
+	wrap, err := giftWrap(ctx, signer, receiverPub, "hello", time.Now())
+	assert.NoError(t, err)
+	msg, err := openMessage(ctx, signerOf(receiverSK), &wrap)
+	assert.NoError(t, err)
+	assert.Equal(t, accountPub, msg.Sender)
+	assert.Equal(t, "hello", msg.Content)
+
+	wrap, err = giftWrap(ctx, signerOf(receiverSK), accountPub, "hi back", time.Now())
+	assert.NoError(t, err)
+	msg, err = openMessage(ctx, signer, &wrap)
+	assert.NoError(t, err)
+	assert.Equal(t, receiverPub, msg.Sender)
+	assert.Equal(t, "hi back", msg.Content)
+
+	assert.Equal(t, []string{"connect", "get_public_key", "sign_event", "nip44_encrypt", "sign_event", "nip44_decrypt", "nip44_decrypt"}, bunker.Methods())
+}
+
+func TestBunkerSignerWrongSecret(t *testing.T) {
+	mock := relay.NewMockRelay()
+	defer mock.Close()
+	pool := relay.NewPool(relay.NewHealth(types.HealthConfig{}), types.AuthConfig{})
+
+	accountSK, _ := getIdentity()
+	bunker := NewMockBunker(pool, mock.URL, accountSK, "s3cret")
+	defer bunker.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := NewBunkerSigner(ctx, strings.Replace(bunker.URI, "s3cret", "guess", 1), "", pool)
+	assert.ErrorContains(t, err, "invalid secret")
+}
+
+func TestBunkerSignerTampered(t *testing.T) {
+	mock := relay.NewMockRelay()
+	defer mock.Close()
+	pool := relay.NewPool(relay.NewHealth(types.HealthConfig{}), types.AuthConfig{})
+
+	accountSK, _ := getIdentity()
+	bunker := NewMockBunker(pool, mock.URL, accountSK, "s3cret")
+	defer bunker.Close()
+	tamper := func(ev *nostr.Event) {}
+	bunker.Tamper = func(ev *nostr.Event) { tamper(ev) }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	signer, err := NewBunkerSigner(ctx, bunker.URI, "", pool)
+	assert.NoError(t, err)
+	defer signer.Close()
+
+	// a validly signed event that is not the one asked for is refused
+	tampers := []func(ev *nostr.Event){
+		func(ev *nostr.Event) { ev.Tags = append(ev.Tags, nostr.Tag{"p", ev.PubKey}) },
+		func(ev *nostr.Event) { ev.CreatedAt = ev.CreatedAt.Add(-time.Hour) },
+		func(ev *nostr.Event) { ev.Content = "something else" },
+	}
+	for _, f := range tampers {
+		tamper = f
+		ev := nostr.Event{CreatedAt: time.Now(), Kind: 1, Tags: nostr.Tags{nostr.Tag{"t", "nostr"}}, Content: "signed remotely"}
+		assert.ErrorContains(t, signer.Sign(ctx, &ev), "different event")
+		assert.Empty(t, ev.Sig)
+	}
+}
@@ -0,0 +1,73 @@
+package nostr
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	kindHTTPAuth = 27235
+
+	// how far the time of an authorization event may be off
+	httpAuthWindow = time.Minute
+)
+
+var ErrUnauthorized = errors.New("unauthorized")
+
+// VerifyHTTPAuth checks the NIP-98 Authorization header of a request and
+// returns the public key of who signed it. requestURI is the path and query
+// the request was sent to; the host is not compared as the server may be
+// behind a proxy. body is checked against the payload tag if there is one.
+func VerifyHTTPAuth(header, method, requestURI string, body []byte, now time.Time) (string, error) {
+	if !strings.HasPrefix(header, "Nostr ") {
+		return "", fmt.Errorf("%w: missing Nostr authorization", ErrUnauthorized)
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(strings.TrimPrefix(header, "Nostr ")))
+	if err != nil {
+		return "", fmt.Errorf("%w: malformed authorization", ErrUnauthorized)
+	}
+	var ev nostr.Event
+	if err := json.Unmarshal(raw, &ev); err != nil {
+		return "", fmt.Errorf("%w: malformed authorization event", ErrUnauthorized)
+	}
+
+	if ev.Kind != kindHTTPAuth {
+		return "", fmt.Errorf("%w: wrong kind %d", ErrUnauthorized, ev.Kind)
+	}
+	if ok, _ := ev.CheckSignature(); !ok {
+		return "", fmt.Errorf("%w: invalid signature", ErrUnauthorized)
+	}
+	if d := now.Sub(ev.CreatedAt); d > httpAuthWindow || d < -httpAuthWindow {
+		return "", fmt.Errorf("%w: authorization expired", ErrUnauthorized)
+	}
+
+	tag := ev.Tags.GetFirst([]string{"u", ""})
+	if tag == nil {
+		return "", fmt.Errorf("%w: no url", ErrUnauthorized)
+	}
+	u, err := url.Parse(tag.Value())
+	if err != nil || u.RequestURI() != requestURI {
+		return "", fmt.Errorf("%w: authorization is for another url", ErrUnauthorized)
+	}
+	tag = ev.Tags.GetFirst([]string{"method", ""})
+	if tag == nil || !strings.EqualFold(tag.Value(), method) {
+		return "", fmt.Errorf("%w: authorization is for another method", ErrUnauthorized)
+	}
+	if tag := ev.Tags.GetFirst([]string{"payload", ""}); tag != nil {
+		sum := sha256.Sum256(body)
+		if !strings.EqualFold(tag.Value(), hex.EncodeToString(sum[:])) {
+			return "", fmt.Errorf("%w: payload does not match", ErrUnauthorized)
+		}
+	}
+
+	return ev.PubKey, nil
+}
@@ -0,0 +1,59 @@
+package nostr
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func httpAuthHeader(sk string, createdAt time.Time, tags nostr.Tags) string {
+	pub, _ := nostr.GetPublicKey(sk)
+	ev := nostr.Event{PubKey: pub, CreatedAt: createdAt, Kind: kindHTTPAuth, Tags: tags}
+	ev.Sign(sk)
+	raw, _ := json.Marshal(ev)
+	return "Nostr " + base64.StdEncoding.EncodeToString(raw)
+}
+
+func TestVerifyHTTPAuth(t *testing.T) {
+	sk, pub := getIdentity()
+	now := time.Now()
+	body := []byte(`{"size":8}`)
+	sum := sha256.Sum256(body)
+	tags := nostr.Tags{
+		nostr.Tag{"u", "https://nossence.example/api/v1/preferences"},
+		nostr.Tag{"method", "PUT"},
+		nostr.Tag{"payload", hex.EncodeToString(sum[:])},
+	}
+
+	signer, err := VerifyHTTPAuth(httpAuthHeader(sk, now, tags), "PUT", "/api/v1/preferences", body, now)
+	assert.NoError(t, err)
+	assert.Equal(t, pub, signer)
+
+	for name, check := range map[string]func() (string, error){
+		"method": func() (string, error) {
+			return VerifyHTTPAuth(httpAuthHeader(sk, now, tags), "GET", "/api/v1/preferences", body, now)
+		},
+		"url": func() (string, error) {
+			return VerifyHTTPAuth(httpAuthHeader(sk, now, tags), "PUT", "/api/v1/other", body, now)
+		},
+		"payload": func() (string, error) {
+			return VerifyHTTPAuth(httpAuthHeader(sk, now, tags), "PUT", "/api/v1/preferences", []byte("{}"), now)
+		},
+		"expired": func() (string, error) {
+			return VerifyHTTPAuth(httpAuthHeader(sk, now.Add(-5*time.Minute), tags), "PUT", "/api/v1/preferences", body, now)
+		},
+		"scheme": func() (string, error) {
+			return VerifyHTTPAuth("Bearer token", "PUT", "/api/v1/preferences", body, now)
+		},
+	} {
+		_, err := check()
+		assert.True(t, errors.Is(err, ErrUnauthorized), name)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"github.com/dyng/nosdaily/database"
 	"github.com/dyng/nosdaily/types"
 	"github.com/ethereum/go-ethereum/log"
-	"github.com/nbd-wtf/go-nostr"
 )
 
 type NameServer struct {
@@ -22,18 +21,13 @@ type NameResponse struct {
 	Names map[string]string `json:"names"`
 }
 
-func NewNameServer(config *types.Config, neo4j *database.Neo4jDb) *NameServer {
-	pub, err := nostr.GetPublicKey(config.Bot.SK)
-	if err != nil {
-		log.Crit("failed to get public key", "err", err)
-	}
-
+func NewNameServer(config *types.Config, neo4j *database.Neo4jDb, mainPub string) *NameServer {
 	mainName := strings.Split(config.Bot.Metadata.Name, "@")[0]
 
 	return &NameServer{
 		config:  config,
 		neo4j:   neo4j,
-		mainPub: pub,
+		mainPub: mainPub,
 		mainName: mainName,
 	}
 }
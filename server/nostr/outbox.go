@@ -0,0 +1,198 @@
+package nostr
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+// name of the crawl profiles planned by the outbox
+const outboxProfile = "outbox"
+
+// outbox plans the crawling of the accounts subscribers follow on the relays
+// those accounts write to (the "outbox model"), so that personal feeds do not
+// depend on the configured relays carrying them. The plan is refreshed
+// periodically and shortly after a subscriber's contact list or the relay
+// list of a followed account has been received.
+type outbox struct {
+	config types.OutboxConfig
+	load   func() (*types.Outbox, error)
+	accept func(url string) bool
+
+	mu          sync.Mutex
+	subscribers map[string]bool
+	follows     map[string]bool
+	changed     chan struct{}
+}
+
+func newOutbox(config types.OutboxConfig, load func() (*types.Outbox, error), accept func(url string) bool) *outbox {
+	return &outbox{
+		config:      config,
+		load:        load,
+		accept:      accept,
+		subscribers: make(map[string]bool),
+		follows:     make(map[string]bool),
+		changed:     make(chan struct{}, 1),
+	}
+}
+
+// Observe requests a refresh of the plan if ev is the contact list of a
+// subscriber or the relay list of an account a subscriber follows.
+func (o *outbox) Observe(ev *nostr.Event) {
+	if ev.Kind != 3 && ev.Kind != 10002 {
+		return
+	}
+
+	o.mu.Lock()
+	relevant := (ev.Kind == 3 && o.subscribers[ev.PubKey]) || (ev.Kind == 10002 && o.follows[ev.PubKey])
+	o.mu.Unlock()
+
+	if relevant {
+		select {
+		case o.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run plans the outbox crawling and applies the plan whenever it may have
+// changed, it never returns. crawled returns the relays that are crawled
+// anyway, they are preferred and do not count against the relay limit.
+func (o *outbox) Run(crawled func() []string, apply func(profiles []types.CrawlProfile)) {
+	interval := timeOffset(o.config.Interval)
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	var debounce time.Duration
+	if o.config.Debounce != "" {
+		debounce = timeOffset(o.config.Debounce)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		o.refresh(crawled(), apply)
+
+		select {
+		case <-ticker.C:
+		case <-o.changed:
+			// contact lists arrive from many relays at once and have to be
+			// stored before they can be planned with
+			time.Sleep(debounce)
+			select {
+			case <-o.changed:
+			default:
+			}
+		}
+	}
+}
+
+func (o *outbox) refresh(crawled []string, apply func(profiles []types.CrawlProfile)) {
+	outbox, err := o.load()
+	if err != nil {
+		log.Error("Failed to load relays of follows", "err", err)
+		return
+	}
+
+	o.mu.Lock()
+	o.subscribers = make(map[string]bool, len(outbox.Subscribers))
+	for _, pubkey := range outbox.Subscribers {
+		o.subscribers[pubkey] = true
+	}
+	o.follows = make(map[string]bool, len(outbox.Relays))
+	for pubkey := range outbox.Relays {
+		o.follows[pubkey] = true
+	}
+	o.mu.Unlock()
+
+	profiles := planOutbox(o.config, outbox.Relays, crawled, o.accept)
+	log.Info("Planned crawling of follows", "subscribers", len(outbox.Subscribers), "follows", len(outbox.Relays), "relays", len(profileRelays(profiles)))
+	apply(profiles)
+}
+
+// planOutbox assigns authors to the relays they write to. Relays already
+// crawled come first, then the relays most authors write to, until every
+// author is assigned to RelaysPerAuthor relays or MaxRelays relays have been
+// picked. Authors are split into filters of at most MaxAuthors.
+func planOutbox(config types.OutboxConfig, relays map[string][]string, crawled []string, accept func(url string) bool) []types.CrawlProfile {
+	perAuthor := config.RelaysPerAuthor
+	if perAuthor <= 0 {
+		perAuthor = 1
+	}
+
+	writers := make(map[string][]string)
+	for author, urls := range relays {
+		for _, url := range urls {
+			url = normalizeRelayURL(url)
+			if url == "" || !accept(url) || slices.Contains(writers[url], author) {
+				continue
+			}
+			writers[url] = append(writers[url], author)
+		}
+	}
+
+	crawled = normalizeURLs(crawled)
+	urls := make([]string, 0, len(writers))
+	for url := range writers {
+		urls = append(urls, url)
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		a, b := slices.Contains(crawled, urls[i]), slices.Contains(crawled, urls[j])
+		if a != b {
+			return a
+		}
+		if len(writers[urls[i]]) != len(writers[urls[j]]) {
+			return len(writers[urls[i]]) > len(writers[urls[j]])
+		}
+		return urls[i] < urls[j]
+	})
+
+	var profiles []types.CrawlProfile
+	assigned := make(map[string]int)
+	opened := 0
+	for _, url := range urls {
+		free := slices.Contains(crawled, url)
+		if !free && opened >= config.MaxRelays {
+			continue
+		}
+
+		var authors []string
+		for _, author := range writers[url] {
+			if assigned[author] < perAuthor {
+				authors = append(authors, author)
+			}
+		}
+		if len(authors) == 0 {
+			continue
+		}
+		if !free {
+			opened++
+		}
+
+		sort.Strings(authors)
+		for _, author := range authors {
+			assigned[author]++
+		}
+		for len(authors) > 0 {
+			n := len(authors)
+			if config.MaxAuthors > 0 && n > config.MaxAuthors {
+				n = config.MaxAuthors
+			}
+			profiles = append(profiles, types.CrawlProfile{
+				Name:    outboxProfile,
+				Relays:  []string{url},
+				Kinds:   config.Kinds,
+				Authors: authors[:n],
+				Since:   config.Since,
+			})
+			authors = authors[n:]
+		}
+	}
+	return profiles
+}
@@ -0,0 +1,78 @@
+package nostr
+
+import (
+	"testing"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanOutbox(t *testing.T) {
+	config := types.OutboxConfig{Since: "-1d", MaxRelays: 2, RelaysPerAuthor: 1, MaxAuthors: 2}
+	relays := map[string][]string{
+		"alice": {"wss://big.relay", "wss://crawled.relay/"},
+		"bob":   {"wss://big.relay", "wss://denied.relay"},
+		"carol": {"wss://big.relay", "ws://localhost:7777"},
+		"dave":  {"wss://big.relay", "wss://small.relay"},
+		"erin":  {"wss://small.relay"},
+		"frank": {"wss://tiny.relay"},
+		"grace": nil,
+	}
+	accept := func(url string) bool { return url != "wss://denied.relay" }
+
+	profiles := planOutbox(config, relays, []string{"wss://crawled.relay"}, accept)
+	byRelay := make(map[string][][]string)
+	for _, p := range profiles {
+		assert.Equal(t, outboxProfile, p.Name)
+		assert.Equal(t, "-1d", p.Since)
+		byRelay[p.Relays[0]] = append(byRelay[p.Relays[0]], p.Authors)
+	}
+
+	// the crawled relay comes first and does not count against the limit,
+	// the remaining authors of the biggest relay are split into filters
+	assert.Equal(t, [][]string{{"alice"}}, byRelay["wss://crawled.relay"])
+	assert.Equal(t, [][]string{{"bob", "carol"}, {"dave"}}, byRelay["wss://big.relay"])
+	assert.Equal(t, [][]string{{"erin"}}, byRelay["wss://small.relay"])
+	assert.NotContains(t, byRelay, "wss://tiny.relay")
+	assert.Len(t, byRelay, 3)
+
+	// authors are fetched from as many relays as configured
+	config.RelaysPerAuthor = 2
+	config.MaxAuthors = 0
+	profiles = planOutbox(config, relays, nil, accept)
+	assert.Equal(t, []string{"wss://big.relay", "wss://small.relay"}, profileRelays(profiles))
+	assert.Equal(t, []string{"alice", "bob", "carol", "dave"}, profiles[0].Authors)
+	assert.Equal(t, []string{"dave", "erin"}, profiles[1].Authors)
+}
+
+func TestOutboxObserve(t *testing.T) {
+	o := newOutbox(types.OutboxConfig{MaxRelays: 1}, func() (*types.Outbox, error) {
+		return &types.Outbox{
+			Subscribers: []string{"subscriber"},
+			Relays:      map[string][]string{"alice": {"wss://relay.alice.com"}},
+		}, nil
+	}, func(string) bool { return true })
+
+	var applied []types.CrawlProfile
+	o.refresh(nil, func(profiles []types.CrawlProfile) { applied = profiles })
+	assert.Equal(t, []string{"wss://relay.alice.com"}, profileRelays(applied))
+
+	changed := func() bool {
+		select {
+		case <-o.changed:
+			return true
+		default:
+			return false
+		}
+	}
+
+	o.Observe(&nostr.Event{Kind: 1, PubKey: "subscriber"})
+	assert.False(t, changed())
+	o.Observe(&nostr.Event{Kind: 3, PubKey: "alice"})
+	assert.False(t, changed())
+	o.Observe(&nostr.Event{Kind: 3, PubKey: "subscriber"})
+	assert.True(t, changed())
+	o.Observe(&nostr.Event{Kind: 10002, PubKey: "alice"})
+	assert.True(t, changed())
+}
@@ -0,0 +1,96 @@
+package nostr
+
+import (
+	"time"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+// profilesFor returns the crawl profiles that apply to a relay: the profiles
+// listing the relay and those without relays. A relay no profile applies to
+// is crawled with the default profile, i.e. all kinds the crawler knows.
+func profilesFor(profiles []types.CrawlProfile, config types.CrawlerConfig, url string) []types.CrawlProfile {
+	var applied []types.CrawlProfile
+	for _, p := range profiles {
+		if len(p.Relays) == 0 || slices.Contains(normalizeURLs(p.Relays), url) {
+			applied = append(applied, p)
+		}
+	}
+
+	if len(applied) == 0 {
+		applied = append(applied, types.CrawlProfile{
+			Name:  "default",
+			Limit: config.Limit,
+		})
+	}
+	return applied
+}
+
+// listedProfiles returns the profiles listing a relay.
+func listedProfiles(profiles []types.CrawlProfile, url string) []types.CrawlProfile {
+	var listed []types.CrawlProfile
+	for _, p := range profiles {
+		if slices.Contains(normalizeURLs(p.Relays), url) {
+			listed = append(listed, p)
+		}
+	}
+	return listed
+}
+
+// profileRelays returns the relays listed by any profile.
+func profileRelays(profiles []types.CrawlProfile) []string {
+	var urls []string
+	for _, p := range profiles {
+		for _, url := range normalizeURLs(p.Relays) {
+			if !slices.Contains(urls, url) {
+				urls = append(urls, url)
+			}
+		}
+	}
+	return urls
+}
+
+// profileFilter builds the filter of a profile. The filter starts from since,
+// or from the profile's own offset if there is nothing to resume from.
+func profileFilter(p types.CrawlProfile, config types.CrawlerConfig, since *time.Time) nostr.Filter {
+	filter := nostr.Filter{
+		Kinds:   p.Kinds,
+		Authors: p.Authors,
+		Limit:   p.Limit,
+	}
+	if len(filter.Kinds) == 0 {
+		filter.Kinds = crawlKinds
+	}
+	if len(p.Hashtags) > 0 {
+		filter.Tags = nostr.TagMap{"t": p.Hashtags}
+	}
+
+	if since == nil {
+		offset := p.Since
+		if offset == "" {
+			offset = config.Since
+		}
+		t := time.Now().Add(timeOffset(offset))
+		since = &t
+	}
+	filter.Since = since
+	return filter
+}
+
+func profileNames(profiles []types.CrawlProfile) []string {
+	names := make([]string, len(profiles))
+	for i, p := range profiles {
+		names[i] = p.Name
+	}
+	return names
+}
+
+func normalizeURLs(urls []string) []string {
+	normalized := make([]string, len(urls))
+	for i, url := range urls {
+		normalized[i] = nostr.NormalizeURL(url)
+	}
+	return normalized
+}
@@ -0,0 +1,53 @@
+package nostr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProfilesFor(t *testing.T) {
+	config := types.CrawlerConfig{Since: "-1h", Limit: 100}
+	contacts := types.CrawlProfile{Name: "contacts", Relays: []string{"wss://purplepag.es"}, Kinds: []int{3}}
+	bitcoin := types.CrawlProfile{Name: "bitcoin", Relays: []string{"wss://niche.relay/"}, Kinds: []int{1}, Hashtags: []string{"bitcoin"}}
+
+	// no profiles at all, or none for the relay, means the default profile
+	assert.Equal(t, []string{"default"}, profileNames(profilesFor(nil, config, "wss://relay.damus.io")))
+	profiles := []types.CrawlProfile{contacts, bitcoin}
+	assert.Equal(t, []string{"default"}, profileNames(profilesFor(profiles, config, "wss://relay.damus.io")))
+	assert.Equal(t, []string{"contacts"}, profileNames(profilesFor(profiles, config, "wss://purplepag.es")))
+	assert.Equal(t, []string{"bitcoin"}, profileNames(profilesFor(profiles, config, "wss://niche.relay")))
+
+	// profiles without relays apply to every relay
+	all := types.CrawlProfile{Name: "all", Kinds: []int{1, 7}}
+	profiles = append(profiles, all)
+	assert.Equal(t, []string{"all"}, profileNames(profilesFor(profiles, config, "wss://relay.damus.io")))
+	assert.Equal(t, []string{"contacts", "all"}, profileNames(profilesFor(profiles, config, "wss://purplepag.es")))
+
+	assert.Equal(t, []string{"wss://purplepag.es", "wss://niche.relay"}, profileRelays(profiles))
+}
+
+func TestProfileFilter(t *testing.T) {
+	config := types.CrawlerConfig{Since: "-1h", Limit: 100}
+
+	filter := profileFilter(types.CrawlProfile{Name: "default", Limit: 100}, config, nil)
+	assert.Equal(t, crawlKinds, filter.Kinds)
+	assert.Equal(t, 100, filter.Limit)
+	assert.WithinDuration(t, time.Now().Add(-time.Hour), *filter.Since, time.Minute)
+
+	p := types.CrawlProfile{Kinds: []int{1}, Authors: []string{"abc"}, Hashtags: []string{"bitcoin"}, Since: "-2d"}
+	filter = profileFilter(p, config, nil)
+	assert.Equal(t, []int{1}, filter.Kinds)
+	assert.Equal(t, []string{"abc"}, filter.Authors)
+	assert.Equal(t, nostr.TagMap{"t": []string{"bitcoin"}}, filter.Tags)
+	assert.Equal(t, 0, filter.Limit)
+	assert.WithinDuration(t, time.Now().Add(-48*time.Hour), *filter.Since, time.Minute)
+
+	// a checkpoint overrides the offset of the profile
+	checkpoint := time.Now().Add(-5 * time.Minute)
+	filter = profileFilter(p, config, &checkpoint)
+	assert.Equal(t, checkpoint, *filter.Since)
+}
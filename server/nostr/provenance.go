@@ -0,0 +1,121 @@
+package nostr
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/nbd-wtf/go-nostr"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	// how often the relays events were seen on are persisted
+	provenanceInterval = 10 * time.Second
+	// how long to retry recording an event that is not stored yet, the
+	// ingestion queue may lag behind the relays
+	provenanceRetention = 10 * time.Minute
+	// the most sightings waiting to be persisted, further ones are dropped
+	provenanceMaxPending = 100000
+)
+
+// provenanceKinds are the kinds stored as posts, only those can be linked
+// to the relays they were seen on.
+var provenanceKinds = []int{1, 6, 7, 9735}
+
+type provenanceStore interface {
+	SaveSeenOn(seen []types.EventSeenOn) ([]string, error)
+}
+
+// provenance records which relays events were seen on. Sightings are
+// collected in memory and persisted in batches, as an event is usually
+// received from several relays at about the same time.
+type provenance struct {
+	store   provenanceStore
+	mu      sync.Mutex
+	seen    *seenEvents
+	pending []types.EventSeenOn
+	nowFunc func() time.Time
+}
+
+func newProvenance(store provenanceStore) *provenance {
+	return &provenance{
+		store:   store,
+		seen:    newSeenEvents(provenanceMaxPending),
+		nowFunc: time.Now,
+	}
+}
+
+// Observe records an event seen on a relay. Only the first sighting of an
+// event on a relay matters, later ones are ignored.
+func (p *provenance) Observe(url string, ev *nostr.Event) {
+	if !slices.Contains(provenanceKinds, ev.Kind) {
+		return
+	}
+	if !p.seen.Add(ev.ID + " " + url) {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.pending) >= provenanceMaxPending {
+		log.Warn("Too many event sightings pending, dropping", "id", ev.ID, "url", url)
+		return
+	}
+	p.pending = append(p.pending, types.EventSeenOn{
+		ID: ev.ID,
+		SeenOn: types.SeenOn{
+			URL:         url,
+			FirstSeenAt: p.nowFunc(),
+		},
+	})
+}
+
+// Flush persists the pending sightings. Sightings of events that are not
+// stored yet are kept for the next flush until they are too old.
+func (p *provenance) Flush() {
+	p.mu.Lock()
+	pending := p.pending
+	p.pending = nil
+	p.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	ids, err := p.store.SaveSeenOn(pending)
+	if err != nil {
+		log.Error("Failed to save relays events were seen on", "count", len(pending), "err", err)
+	}
+
+	stored := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		stored[id] = true
+	}
+	cutoff := p.nowFunc().Add(-provenanceRetention)
+	var retry []types.EventSeenOn
+	for _, s := range pending {
+		if !stored[s.ID] && s.FirstSeenAt.After(cutoff) {
+			retry = append(retry, s)
+		}
+	}
+	if len(retry) == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	p.pending = append(retry, p.pending...)
+	p.mu.Unlock()
+}
+
+// Run flushes sightings every provenanceInterval, it never returns.
+func (p *provenance) Run() {
+	ticker := time.NewTicker(provenanceInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		p.Flush()
+	}
+}
@@ -0,0 +1,76 @@
+package nostr
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryProvenanceStore struct {
+	posts map[string]bool
+	saved []types.EventSeenOn
+	err   error
+}
+
+func (m *memoryProvenanceStore) SaveSeenOn(seen []types.EventSeenOn) ([]string, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	var ids []string
+	for _, s := range seen {
+		if m.posts[s.ID] {
+			m.saved = append(m.saved, s)
+			ids = append(ids, s.ID)
+		}
+	}
+	return ids, nil
+}
+
+func TestProvenanceObserve(t *testing.T) {
+	store := &memoryProvenanceStore{posts: map[string]bool{"a": true}}
+	p := newProvenance(store)
+
+	p.Observe("wss://one.example.com", &nostr.Event{ID: "a", Kind: 1})
+	p.Observe("wss://two.example.com", &nostr.Event{ID: "a", Kind: 1})
+	// only the first sighting on a relay is recorded
+	p.Observe("wss://one.example.com", &nostr.Event{ID: "a", Kind: 1})
+	// contact lists are not stored as posts
+	p.Observe("wss://one.example.com", &nostr.Event{ID: "c", Kind: 3})
+	p.Flush()
+
+	assert.Len(t, store.saved, 2)
+	assert.Equal(t, "wss://one.example.com", store.saved[0].URL)
+	assert.Equal(t, "wss://two.example.com", store.saved[1].URL)
+	assert.Empty(t, p.pending)
+}
+
+func TestProvenanceRetry(t *testing.T) {
+	store := &memoryProvenanceStore{posts: map[string]bool{}, err: errors.New("unavailable")}
+	p := newProvenance(store)
+	now := time.Now()
+	p.nowFunc = func() time.Time { return now }
+
+	p.Observe("wss://one.example.com", &nostr.Event{ID: "a", Kind: 1})
+	p.Flush()
+	assert.Len(t, p.pending, 1)
+
+	// the post is not stored yet
+	store.err = nil
+	p.Flush()
+	assert.Len(t, p.pending, 1)
+
+	store.posts["a"] = true
+	p.Flush()
+	assert.Len(t, store.saved, 1)
+	assert.Empty(t, p.pending)
+
+	// sightings of events never stored are eventually given up
+	p.Observe("wss://one.example.com", &nostr.Event{ID: "b", Kind: 1})
+	now = now.Add(provenanceRetention + time.Second)
+	p.Flush()
+	assert.Empty(t, p.pending)
+}
@@ -0,0 +1,304 @@
+package nostr
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// PublishQueue is a durable outbox of signed events. Every event is written
+// to disk before it is published and stays there until each relay accepted
+// it, rejected it for good, or the event expired. Relays that did not accept
+// an event are retried with exponential backoff, also across restarts.
+type PublishQueue struct {
+	dir       string
+	expiry    time.Duration
+	baseDelay time.Duration
+	maxDelay  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*QueuedEvent
+
+	delivered uint64
+	rejected  uint64
+	expired   uint64
+}
+
+// QueuedEvent is an event waiting to be accepted by the relays listed.
+type QueuedEvent struct {
+	Event    nostr.Event                `json:"event"`
+	QueuedAt time.Time                  `json:"queued_at"`
+	Relays   map[string]*QueuedDelivery `json:"relays"`
+}
+
+// QueuedDelivery is the state of an event with one relay.
+type QueuedDelivery struct {
+	Attempts    int       `json:"attempts"`
+	LastStatus  string    `json:"last_status,omitempty"`
+	LastMessage string    `json:"last_message,omitempty"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+type PublishQueueStats struct {
+	Pending   []QueuedEvent `json:"pending"`
+	Delivered uint64        `json:"delivered"`
+	Rejected  uint64        `json:"rejected"`
+	Expired   uint64        `json:"expired"`
+}
+
+// PublishDropped is the status of a delivery to a relay the client does not
+// use anymore.
+const PublishDropped = "dropped"
+
+// NewPublishQueue opens the outbox in dir, events queued before a restart
+// are picked up again.
+func NewPublishQueue(config types.PublishConfig, dir string) (*PublishQueue, error) {
+	if config.Dir != "" {
+		dir = config.Dir
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	q := &PublishQueue{
+		dir:       dir,
+		expiry:    timeOffset(config.Expiry),
+		baseDelay: timeOffset(config.BaseDelay),
+		maxDelay:  timeOffset(config.MaxDelay),
+		entries:   make(map[string]*QueuedEvent),
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var entry QueuedEvent
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			logger.Warn("skipping corrupt outbox entry", "file", file, "err", err)
+			continue
+		}
+		q.entries[entry.Event.ID] = &entry
+	}
+	if len(q.entries) > 0 {
+		logger.Info("found queued events", "dir", dir, "events", len(q.entries))
+	}
+	return q, nil
+}
+
+// Add queues an event for the given relays. The first attempt is up to the
+// caller, the queue only retries after the base delay.
+func (q *PublishQueue) Add(ev nostr.Event, urls []string) error {
+	now := time.Now()
+	entry := &QueuedEvent{
+		Event:    ev,
+		QueuedAt: now,
+		Relays:   make(map[string]*QueuedDelivery, len(urls)),
+	}
+	for _, url := range urls {
+		entry.Relays[url] = &QueuedDelivery{NextAttempt: now.Add(q.baseDelay)}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.entries[ev.ID] = entry
+	return q.save(entry)
+}
+
+// Record updates the deliveries of an event with the results of an attempt.
+func (q *PublishQueue) Record(id string, results PublishResults) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entry, ok := q.entries[id]
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	for _, result := range results {
+		delivery, ok := entry.Relays[result.URL]
+		if !ok {
+			continue
+		}
+
+		delivery.Attempts++
+		delivery.LastStatus = result.Status
+		delivery.LastMessage = result.Message
+		switch {
+		case result.Status == PublishAccepted || strings.HasPrefix(result.Message, "duplicate:"):
+			atomic.AddUint64(&q.delivered, 1)
+			delete(entry.Relays, result.URL)
+		case result.Status == PublishDropped || result.Status == PublishBlocked ||
+			(result.Status == PublishRejected && strings.HasPrefix(result.Message, "invalid:")):
+			logger.Warn("giving up on event", "id", id, "uri", result.URL, "status", result.Status, "reason", result.Message)
+			atomic.AddUint64(&q.rejected, 1)
+			delete(entry.Relays, result.URL)
+		default:
+			delivery.NextAttempt = now.Add(q.backoff(delivery.Attempts))
+		}
+	}
+
+	if !q.expire(entry, now) {
+		if err := q.save(entry); err != nil {
+			logger.Error("failed to save outbox entry", "id", id, "err", err)
+		}
+	}
+}
+
+// Run retries the deliveries that are due until ctx is done.
+func (q *PublishQueue) Run(ctx context.Context, publish func(ctx context.Context, url string, ev nostr.Event) PublishResult) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		for id, urls := range q.due(time.Now()) {
+			ev := q.event(id)
+			if ev == nil {
+				continue
+			}
+
+			var wg sync.WaitGroup
+			results := make(PublishResults, len(urls))
+			for i, url := range urls {
+				wg.Add(1)
+				go func(i int, url string) {
+					defer wg.Done()
+					results[i] = publish(ctx, url, *ev)
+				}(i, url)
+			}
+			wg.Wait()
+
+			logger.Debug("retried event", "id", id, "relays", len(urls), "accepted", results.Accepted())
+			q.Record(id, results)
+		}
+	}
+}
+
+// Stats returns the queued events, oldest first, and what became of the
+// deliveries so far.
+func (q *PublishQueue) Stats() PublishQueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := PublishQueueStats{
+		Pending:   make([]QueuedEvent, 0, len(q.entries)),
+		Delivered: atomic.LoadUint64(&q.delivered),
+		Rejected:  atomic.LoadUint64(&q.rejected),
+		Expired:   atomic.LoadUint64(&q.expired),
+	}
+	for _, entry := range q.entries {
+		copied := *entry
+		copied.Relays = make(map[string]*QueuedDelivery, len(entry.Relays))
+		for url, delivery := range entry.Relays {
+			d := *delivery
+			copied.Relays[url] = &d
+		}
+		stats.Pending = append(stats.Pending, copied)
+	}
+
+	sort.Slice(stats.Pending, func(i, j int) bool {
+		return stats.Pending[i].QueuedAt.Before(stats.Pending[j].QueuedAt)
+	})
+	return stats
+}
+
+// due returns the relays of each event that are due for another attempt,
+// expiring events on the way.
+func (q *PublishQueue) due(now time.Time) map[string][]string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	due := make(map[string][]string)
+	for id, entry := range q.entries {
+		if q.expire(entry, now) {
+			continue
+		}
+		for url, delivery := range entry.Relays {
+			if !delivery.NextAttempt.After(now) {
+				due[id] = append(due[id], url)
+			}
+		}
+	}
+	return due
+}
+
+func (q *PublishQueue) event(id string) *nostr.Event {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if entry, ok := q.entries[id]; ok {
+		ev := entry.Event
+		return &ev
+	}
+	return nil
+}
+
+// expire removes an entry that is done or expired, it returns true if the
+// entry has been removed. It must be called with q.mu held.
+func (q *PublishQueue) expire(entry *QueuedEvent, now time.Time) bool {
+	id := entry.Event.ID
+	if len(entry.Relays) > 0 && q.expiry > 0 && now.Sub(entry.QueuedAt) > q.expiry {
+		logger.Warn("event expired before all relays accepted it", "id", id, "relays", len(entry.Relays))
+		atomic.AddUint64(&q.expired, uint64(len(entry.Relays)))
+		entry.Relays = nil
+	}
+
+	if len(entry.Relays) == 0 {
+		delete(q.entries, id)
+		if err := os.Remove(q.path(id)); err != nil && !os.IsNotExist(err) {
+			logger.Warn("failed to remove outbox entry", "id", id, "err", err)
+		}
+		return true
+	}
+	return false
+}
+
+// save writes an entry to disk atomically, must be called with q.mu held.
+func (q *PublishQueue) save(entry *QueuedEvent) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	path := q.path(entry.Event.ID)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (q *PublishQueue) path(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+func (q *PublishQueue) backoff(attempts int) time.Duration {
+	delay := q.maxDelay
+	if attempts < 32 {
+		if d := q.baseDelay << (attempts - 1); d > 0 && d < q.maxDelay {
+			delay = d
+		}
+	}
+	return delay
+}
@@ -0,0 +1,89 @@
+package nostr
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishQueue(t *testing.T) {
+	dir := t.TempDir()
+	config := types.PublishConfig{Expiry: "1d", BaseDelay: "1s", MaxDelay: "1m"}
+	q, err := NewPublishQueue(config, dir)
+	assert.NoError(t, err)
+
+	ev := nostr.Event{ID: "abc", Kind: 1, Content: "hello"}
+	assert.NoError(t, q.Add(ev, []string{"wss://a", "wss://b", "wss://c", "wss://d"}))
+	q.Record(ev.ID, PublishResults{
+		{URL: "wss://a", Status: PublishAccepted},
+		{URL: "wss://b", Status: PublishRejected, Message: "duplicate: have it already"},
+		{URL: "wss://c", Status: PublishRejected, Message: "invalid: bad signature"},
+		{URL: "wss://d", Status: PublishTimeout},
+	})
+
+	stats := q.Stats()
+	assert.Equal(t, uint64(2), stats.Delivered)
+	assert.Equal(t, uint64(1), stats.Rejected)
+	assert.Len(t, stats.Pending, 1)
+	assert.Equal(t, []string{"wss://d"}, keys(stats.Pending[0].Relays))
+	assert.Equal(t, PublishTimeout, stats.Pending[0].Relays["wss://d"].LastStatus)
+
+	// the queue survives a restart
+	q, err = NewPublishQueue(config, dir)
+	assert.NoError(t, err)
+	assert.Len(t, q.Stats().Pending, 1)
+
+	// retries back off exponentially
+	q.Record(ev.ID, PublishResults{{URL: "wss://d", Status: PublishFailed}})
+	delivery := q.Stats().Pending[0].Relays["wss://d"]
+	assert.WithinDuration(t, time.Now().Add(2*time.Second), delivery.NextAttempt, 500*time.Millisecond)
+	assert.Empty(t, q.due(time.Now()))
+	assert.Equal(t, map[string][]string{"abc": {"wss://d"}}, q.due(time.Now().Add(3*time.Second)))
+
+	// events are dropped once expired
+	assert.Empty(t, q.due(time.Now().Add(25*time.Hour)))
+	stats = q.Stats()
+	assert.Empty(t, stats.Pending)
+	assert.Equal(t, uint64(1), stats.Expired)
+
+	q, err = NewPublishQueue(config, dir)
+	assert.NoError(t, err)
+	assert.Empty(t, q.Stats().Pending)
+}
+
+func TestPublishQueueRun(t *testing.T) {
+	q, err := NewPublishQueue(types.PublishConfig{Expiry: "1d", BaseDelay: "1s", MaxDelay: "1m"}, t.TempDir())
+	assert.NoError(t, err)
+
+	ev := nostr.Event{ID: "abc", Kind: 1}
+	assert.NoError(t, q.Add(ev, []string{"wss://a"}))
+	q.Record(ev.ID, PublishResults{{URL: "wss://a", Status: PublishTimeout}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	attempts := make(chan string, 1)
+	go q.Run(ctx, func(ctx context.Context, url string, ev nostr.Event) PublishResult {
+		attempts <- ev.ID
+		return PublishResult{URL: url, Status: PublishAccepted}
+	})
+
+	select {
+	case id := <-attempts:
+		assert.Equal(t, ev.ID, id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for retry")
+	}
+	assert.Eventually(t, func() bool { return len(q.Stats().Pending) == 0 }, 3*time.Second, 10*time.Millisecond)
+}
+
+func keys(m map[string]*QueuedDelivery) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
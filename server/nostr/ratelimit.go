@@ -0,0 +1,143 @@
+package nostr
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// rateLimiter holds a token bucket per relay, so that publishing many events
+// at once, e.g. by the hourly push, is spread out instead of getting us
+// rate limited or blocked.
+type rateLimiter struct {
+	config types.RateLimitConfig
+	pause  time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second, zero means unlimited
+	burst   float64
+	tokens  float64
+	last    time.Time
+	till    time.Time // no tokens are handed out before
+	nowFunc func() time.Time
+}
+
+func newRateLimiter(config types.RateLimitConfig) *rateLimiter {
+	var pause time.Duration
+	if config.Pause != "" {
+		pause = timeOffset(config.Pause)
+	}
+	return &rateLimiter{
+		config:  config,
+		pause:   pause,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Wait blocks until an event may be published to a relay or ctx is done.
+func (l *rateLimiter) Wait(ctx context.Context, url string) error {
+	return l.bucket(url).Wait(ctx)
+}
+
+// Pause holds off publishing to a relay that told us to slow down.
+func (l *rateLimiter) Pause(url string) {
+	l.bucket(url).Pause(l.pause)
+}
+
+func (l *rateLimiter) bucket(url string) *tokenBucket {
+	url = nostr.NormalizeURL(url)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[url]
+	if !ok {
+		perMinute, burst := l.config.PerMinute, l.config.Burst
+		for _, r := range l.config.Relays {
+			if nostr.NormalizeURL(r.URL) == url {
+				perMinute, burst = r.PerMinute, r.Burst
+			}
+		}
+		b = newTokenBucket(float64(perMinute)/60, burst, time.Now)
+		l.buckets[url] = b
+	}
+	return b
+}
+
+func newTokenBucket(rate float64, burst int, now func() time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:    rate,
+		burst:   float64(burst),
+		tokens:  float64(burst),
+		last:    now(),
+		nowFunc: now,
+	}
+}
+
+// Wait takes a token, waiting for one if there is none left.
+func (b *tokenBucket) Wait(ctx context.Context) error {
+	for {
+		wait := b.take()
+		if wait <= 0 {
+			return nil
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// take takes a token if there is one, otherwise it returns how long to wait
+// for the next one.
+func (b *tokenBucket) take() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.nowFunc()
+	if now.Before(b.till) {
+		return b.till.Sub(now)
+	}
+	if b.rate <= 0 {
+		return 0
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Pause hands out no tokens for d and drains the bucket, so that publishing
+// resumes slowly.
+func (b *tokenBucket) Pause(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.nowFunc()
+	if till := now.Add(d); till.After(b.till) {
+		b.till = till
+	}
+	b.tokens = 0
+	b.last = b.till
+}
@@ -0,0 +1,82 @@
+package nostr
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dyng/nosdaily/relay"
+	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(1, 2, func() time.Time { return now })
+
+	// a full bucket allows a burst
+	assert.Zero(t, b.take())
+	assert.Zero(t, b.take())
+	assert.Equal(t, time.Second, b.take())
+
+	now = now.Add(500 * time.Millisecond)
+	assert.Equal(t, 500*time.Millisecond, b.take())
+	now = now.Add(500 * time.Millisecond)
+	assert.Zero(t, b.take())
+
+	// tokens do not pile up beyond the burst
+	now = now.Add(time.Hour)
+	assert.Zero(t, b.take())
+	assert.Zero(t, b.take())
+	assert.Equal(t, time.Second, b.take())
+
+	// a paused bucket starts empty after the pause
+	b.Pause(time.Minute)
+	assert.Equal(t, time.Minute, b.take())
+	now = now.Add(time.Minute)
+	assert.Equal(t, time.Second, b.take())
+}
+
+func TestRateLimiterOverrides(t *testing.T) {
+	l := newRateLimiter(types.RateLimitConfig{
+		PerMinute: 60,
+		Burst:     5,
+		Relays:    []types.RelayRateLimit{{URL: "wss://slow.relay/", PerMinute: 6, Burst: 1}},
+	})
+
+	assert.Equal(t, 1.0, l.bucket("wss://fast.relay").rate)
+	assert.Equal(t, 5.0, l.bucket("wss://fast.relay").burst)
+	assert.Equal(t, 0.1, l.bucket("wss://slow.relay").rate)
+	assert.Equal(t, 1.0, l.bucket("wss://slow.relay").burst)
+	assert.Same(t, l.bucket("wss://slow.relay"), l.bucket("wss://slow.relay/"))
+}
+
+func TestPublishRateLimited(t *testing.T) {
+	var attempts int32
+	mock := relay.NewMockRelay()
+	mock.Reject = func(ev *nostr.Event) string {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			return "rate-limited: slow down"
+		}
+		return ""
+	}
+	defer mock.Close()
+
+	pool := relay.NewPool(relay.NewHealth(types.HealthConfig{}), types.AuthConfig{})
+	client, err := NewClient(context.Background(), []string{mock.URL}, nil, pool, 1, nil, types.RateLimitConfig{Pause: "1s"})
+	assert.NoError(t, err)
+	defer client.Close()
+
+	sk, pub := getIdentity()
+	ev := nostr.Event{PubKey: pub, CreatedAt: time.Now(), Kind: 1, Content: "Hello World!"}
+	assert.NoError(t, ev.Sign(sk))
+
+	start := time.Now()
+	results, err := client.Publish(context.Background(), ev)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, results.Accepted())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+}
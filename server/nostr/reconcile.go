@@ -0,0 +1,59 @@
+package nostr
+
+import (
+	"context"
+	"time"
+
+	"github.com/dyng/nosdaily/relay"
+	"github.com/dyng/nosdaily/types"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// number of missing events requested by id at once
+const fetchBatchSize = 500
+
+// eventStore is the local set of events reconciled with relays.
+type eventStore interface {
+	GetEventRefs(kinds []int, authors []string, since, until time.Time) ([]types.EventRef, error)
+	StoreEvent(event *nostr.Event) error
+}
+
+// reconcile stores the events matching filter that the relay has but the
+// store has not, as found by negentropy. The filter must have a since and an
+// until. It returns the number of events fetched, or
+// relay.ErrNegentropyUnsupported if the caller has to fall back to a plain
+// REQ.
+func reconcile(ctx context.Context, conn *relay.Relay, store eventStore, filter nostr.Filter) (int, error) {
+	local, err := store.GetEventRefs(filter.Kinds, filter.Authors, *filter.Since, *filter.Until)
+	if err != nil {
+		return 0, err
+	}
+
+	need, err := conn.Reconcile(ctx, filter, local)
+	if err != nil {
+		return 0, err
+	}
+	log.Debug("Reconciled events with relay", "url", conn.URL, "filter", filter, "local", len(local), "missing", len(need))
+
+	count := 0
+	for start := 0; start < len(need); start += fetchBatchSize {
+		end := start + fetchBatchSize
+		if end > len(need) {
+			end = len(need)
+		}
+
+		events, err := conn.QuerySync(ctx, nostr.Filter{IDs: need[start:end]})
+		if err != nil {
+			return count, err
+		}
+		for _, ev := range events {
+			err := store.StoreEvent(ev)
+			if err != nil {
+				log.Error("Failed to store event", "event", ev, "err", err)
+			}
+		}
+		count += len(events)
+	}
+	return count, nil
+}
@@ -0,0 +1,76 @@
+package nostr
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dyng/nosdaily/relay"
+	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryEventStore struct {
+	events map[string]*nostr.Event
+	stored int
+}
+
+func (m *memoryEventStore) GetEventRefs(kinds []int, authors []string, since, until time.Time) ([]types.EventRef, error) {
+	var refs []types.EventRef
+	for _, ev := range m.events {
+		if ev.CreatedAt.Before(since) || ev.CreatedAt.After(until) {
+			continue
+		}
+		refs = append(refs, types.EventRef{ID: ev.ID, CreatedAt: ev.CreatedAt})
+	}
+	return refs, nil
+}
+
+func (m *memoryEventStore) StoreEvent(ev *nostr.Event) error {
+	m.events[ev.ID] = ev
+	m.stored++
+	return nil
+}
+
+func TestReconcile(t *testing.T) {
+	mock := relay.NewMockRelay()
+	defer mock.Close()
+
+	sk := nostr.GeneratePrivateKey()
+	pub, _ := nostr.GetPublicKey(sk)
+	now := time.Now().Truncate(time.Second)
+	store := &memoryEventStore{events: map[string]*nostr.Event{}}
+	for i := 0; i < 600; i++ {
+		ev := &nostr.Event{
+			PubKey:    pub,
+			CreatedAt: now.Add(-time.Duration(i) * time.Second),
+			Kind:      1,
+			Content:   "hello",
+		}
+		assert.NoError(t, ev.Sign(sk))
+		mock.AddEvent(ev)
+
+		// every third event has been stored before
+		if i%3 == 0 {
+			store.events[ev.ID] = ev
+		}
+	}
+
+	pool := relay.NewPool(relay.NewHealth(types.HealthConfig{}), types.AuthConfig{})
+	conn := pool.Acquire(mock.URL)
+	defer pool.Release(mock.URL)
+
+	since := now.Add(-time.Hour)
+	filter := nostr.Filter{Kinds: []int{1}, Since: &since, Until: &now}
+	count, err := reconcile(context.Background(), conn, store, filter)
+	assert.NoError(t, err)
+	assert.Equal(t, 400, count)
+	assert.Equal(t, 400, store.stored)
+	assert.Len(t, store.events, 600)
+
+	// nothing is fetched twice
+	count, err = reconcile(context.Background(), conn, store, filter)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
@@ -0,0 +1,88 @@
+package nostr
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+)
+
+// Signer holds the key of an account and signs and encrypts on its behalf,
+// so that the key itself may live elsewhere, e.g. in a NIP-46 bunker.
+type Signer interface {
+	// PublicKey returns the public key of the account.
+	PublicKey(ctx context.Context) (string, error)
+	// Sign sets the public key, id and signature of ev.
+	Sign(ctx context.Context, ev *nostr.Event) error
+	Nip04Encrypt(ctx context.Context, receiverPub, plaintext string) (string, error)
+	Nip04Decrypt(ctx context.Context, senderPub, ciphertext string) (string, error)
+	Nip44Encrypt(ctx context.Context, receiverPub, plaintext string) (string, error)
+	Nip44Decrypt(ctx context.Context, senderPub, ciphertext string) (string, error)
+}
+
+// LocalSigner is a Signer holding the secret key in memory.
+type LocalSigner struct {
+	sk  string
+	pub string
+}
+
+func NewLocalSigner(sk string) (*LocalSigner, error) {
+	sk = padSecretKey(sk)
+	pub, err := nostr.GetPublicKey(sk)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret key: %w", err)
+	}
+	return &LocalSigner{sk: sk, pub: pub}, nil
+}
+
+func (s *LocalSigner) PublicKey(ctx context.Context) (string, error) {
+	return s.pub, nil
+}
+
+func (s *LocalSigner) Sign(ctx context.Context, ev *nostr.Event) error {
+	ev.PubKey = s.pub
+	return ev.Sign(s.sk)
+}
+
+func (s *LocalSigner) Nip04Encrypt(ctx context.Context, receiverPub, plaintext string) (string, error) {
+	shared, err := nip04.ComputeSharedSecret(receiverPub, s.sk)
+	if err != nil {
+		return "", err
+	}
+	return nip04.Encrypt(plaintext, shared)
+}
+
+func (s *LocalSigner) Nip04Decrypt(ctx context.Context, senderPub, ciphertext string) (string, error) {
+	shared, err := nip04.ComputeSharedSecret(senderPub, s.sk)
+	if err != nil {
+		return "", err
+	}
+	return nip04.Decrypt(ciphertext, shared)
+}
+
+func (s *LocalSigner) Nip44Encrypt(ctx context.Context, receiverPub, plaintext string) (string, error) {
+	key, err := nip44ConversationKey(s.sk, receiverPub)
+	if err != nil {
+		return "", fmt.Errorf("invalid receiver public key: %s", receiverPub)
+	}
+	return nip44Encrypt(key, plaintext)
+}
+
+func (s *LocalSigner) Nip44Decrypt(ctx context.Context, senderPub, ciphertext string) (string, error) {
+	key, err := nip44ConversationKey(s.sk, senderPub)
+	if err != nil {
+		return "", fmt.Errorf("invalid sender public key: %s", senderPub)
+	}
+	return nip44Decrypt(key, ciphertext)
+}
+
+// padSecretKey left-pads a hex secret key to 32 bytes, go-nostr drops the
+// leading zeros of the keys it generates.
+func padSecretKey(sk string) string {
+	if len(sk) < 64 {
+		return strings.Repeat("0", 64-len(sk)) + sk
+	}
+	return sk
+}
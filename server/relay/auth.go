@@ -0,0 +1,131 @@
+package relay
+
+import (
+	"context"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip42"
+)
+
+// prefix of CLOSED and OK messages of relays that want us to authenticate
+const authRequiredPrefix = "auth-required:"
+
+// authKey returns the key to authenticate to a relay with, or an empty
+// string if the relay is not opted into authentication.
+func (p *Pool) authKey(url string) string {
+	if p.auth.SK == "" {
+		return ""
+	}
+	for _, entry := range p.auth.Relays {
+		if entry == "*" || nostr.NormalizeURL(entry) == url {
+			return p.auth.SK
+		}
+	}
+	return ""
+}
+
+// Authenticated returns whether the current connection has been
+// authenticated with NIP-42.
+func (r *Relay) Authenticated() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.authed
+}
+
+// authenticate answers the challenge of a relay. Once the relay accepts, the
+// subscriptions it closed for lack of authentication are sent again.
+func (r *Relay) authenticate(ctx context.Context, challenge, sk string) {
+	pub, err := nostr.GetPublicKey(sk)
+	if err != nil {
+		logger.Error("invalid key to authenticate with", "url", r.URL, "err", err)
+		return
+	}
+
+	ev := nip42.CreateUnsignedAuthEvent(challenge, pub, r.URL)
+	if err := ev.Sign(sk); err != nil {
+		logger.Error("failed to sign auth event", "url", r.URL, "err", err)
+		return
+	}
+
+	ch := make(chan okResult, 1)
+	r.mu.Lock()
+	r.oks[ev.ID] = append(r.oks[ev.ID], ch)
+	conn := r.conn
+	r.mu.Unlock()
+	defer r.removeOk(ev.ID, ch)
+
+	logger.Debug("authenticating to relay", "url", r.URL, "pubkey", pub)
+	if err := r.write(conn, []any{"AUTH", ev}); err != nil {
+		logger.Warn("failed to send auth event", "url", r.URL, "err", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+
+	select {
+	case res := <-ch:
+		if !res.ok {
+			logger.Warn("relay rejected authentication", "url", r.URL, "pubkey", pub, "reason", res.message)
+			return
+		}
+	case <-ctx.Done():
+		logger.Warn("relay did not answer authentication", "url", r.URL)
+		return
+	}
+
+	r.mu.Lock()
+	if r.conn != conn {
+		r.mu.Unlock()
+		return
+	}
+	r.authed = true
+	close(r.authReady)
+	var pending []*Subscription
+	for id := range r.authPending {
+		if sub, ok := r.subs[id]; ok {
+			pending = append(pending, sub)
+		}
+	}
+	r.authPending = make(map[string]bool)
+	r.mu.Unlock()
+
+	logger.Info("authenticated to relay", "url", r.URL, "pubkey", pub)
+	for _, sub := range pending {
+		r.sendReq(conn, sub)
+	}
+}
+
+// authRequired handles a subscription closed for lack of authentication. It
+// returns false if the subscription is not going to be sent again, i.e. the
+// relay is not opted into authentication or rejects us even though we have
+// authenticated.
+func (r *Relay) authRequired(sub *Subscription, reason string) bool {
+	if !strings.HasPrefix(reason, authRequiredPrefix) || r.pool.authKey(r.URL) == "" {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.authed {
+		return false
+	}
+	r.authPending[sub.ID] = true
+	return true
+}
+
+// waitAuthenticated blocks until the current connection has been
+// authenticated or ctx is done.
+func (r *Relay) waitAuthenticated(ctx context.Context) error {
+	r.mu.Lock()
+	ready := r.authReady
+	r.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return ErrTimeout
+	}
+}
@@ -0,0 +1,87 @@
+package relay
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticate(t *testing.T) {
+	mock := NewMockRelay()
+	mock.RequireAuth = true
+	defer mock.Close()
+
+	sk := nostr.GeneratePrivateKey()
+	existing := newTestEvent(t, sk, time.Now().Add(-time.Minute))
+	mock.AddEvent(existing)
+
+	pool := NewPool(NewHealth(types.HealthConfig{}), types.AuthConfig{SK: sk, Relays: []string{mock.URL}})
+	r := pool.Acquire(mock.URL)
+	defer pool.Release(mock.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the subscription is closed for lack of authentication and sent again
+	// once authenticated
+	sub := r.Subscribe(ctx, nostr.Filters{{Kinds: []int{1}}})
+	assert.Equal(t, existing.ID, receive(t, sub).ID)
+	assert.True(t, r.Authenticated())
+
+	ev := newTestEvent(t, sk, time.Now())
+	ok, msg, err := r.Publish(ctx, *ev)
+	assert.NoError(t, err)
+	assert.True(t, ok, msg)
+	assert.Equal(t, ev.ID, receive(t, sub).ID)
+}
+
+func TestAuthenticatePublish(t *testing.T) {
+	mock := NewMockRelay()
+	mock.RequireAuth = true
+	defer mock.Close()
+
+	sk := nostr.GeneratePrivateKey()
+	pool := NewPool(NewHealth(types.HealthConfig{}), types.AuthConfig{SK: sk, Relays: []string{"*"}})
+	r := pool.Acquire(mock.URL)
+	defer pool.Release(mock.URL)
+
+	// the event is rejected until authenticated and then sent again
+	ev := newTestEvent(t, sk, time.Now())
+	ok, msg, err := r.Publish(context.Background(), *ev)
+	assert.NoError(t, err)
+	assert.True(t, ok, msg)
+	assert.Len(t, mock.Events(), 1)
+}
+
+func TestAuthenticateNotOptedIn(t *testing.T) {
+	mock := NewMockRelay()
+	mock.RequireAuth = true
+	defer mock.Close()
+
+	sk := nostr.GeneratePrivateKey()
+	pool := NewPool(NewHealth(types.HealthConfig{}), types.AuthConfig{SK: sk, Relays: []string{"wss://other.relay"}})
+	r := pool.Acquire(mock.URL)
+	defer pool.Release(mock.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sub := r.Subscribe(ctx, nostr.Filters{{Kinds: []int{1}}})
+	select {
+	case reason := <-sub.ClosedReason:
+		assert.True(t, strings.HasPrefix(reason, authRequiredPrefix), reason)
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for subscription to be closed")
+	}
+
+	ok, msg, err := r.Publish(ctx, *newTestEvent(t, sk, time.Now()))
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.True(t, strings.HasPrefix(msg, authRequiredPrefix), msg)
+	assert.False(t, r.Authenticated())
+}
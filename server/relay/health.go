@@ -0,0 +1,308 @@
+package relay
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+var logger = log.New("module", "relay")
+
+const (
+	StateHealthy = "healthy"
+	StateBackoff = "backoff"
+	StateOpen    = "open"
+)
+
+// Health tracks the health of relays and decides when a relay should be
+// (re)connected. Failures back off exponentially with jitter, and after too
+// many consecutive failures the circuit opens: the relay is only probed
+// once per probe interval until a connection is stable again.
+type Health struct {
+	baseDelay     time.Duration
+	maxDelay      time.Duration
+	threshold     int
+	probeInterval time.Duration
+	stableAfter   time.Duration
+
+	mu     sync.Mutex
+	relays map[string]*relayHealth
+}
+
+type relayHealth struct {
+	failures      int
+	totalFailures int
+	connects      int
+	lastError     string
+	lastFailure   *time.Time
+	connectedAt   *time.Time
+	latency       time.Duration
+	notices       int
+	lastNotice    string
+	events        int
+	eventRate     float64
+	windowStart   time.Time
+	windowEvents  int
+}
+
+// Stats is a snapshot of the health of a relay.
+type Stats struct {
+	URL                 string     `json:"url"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	TotalFailures       int        `json:"total_failures"`
+	Connects            int        `json:"connects"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastFailure         *time.Time `json:"last_failure,omitempty"`
+	ConnectedAt         *time.Time `json:"connected_at,omitempty"`
+	LatencyMs           int64      `json:"latency_ms"`
+	Notices             int        `json:"notices"`
+	LastNotice          string     `json:"last_notice,omitempty"`
+	Events              int        `json:"events"`
+	EventsPerMinute     float64    `json:"events_per_minute"`
+}
+
+func NewHealth(config types.HealthConfig) *Health {
+	return &Health{
+		baseDelay:     parseDuration(config.BaseDelay, time.Second),
+		maxDelay:      parseDuration(config.MaxDelay, 5*time.Minute),
+		threshold:     config.FailureThreshold,
+		probeInterval: parseDuration(config.ProbeInterval, time.Hour),
+		stableAfter:   parseDuration(config.StableAfter, time.Minute),
+		relays:        make(map[string]*relayHealth),
+	}
+}
+
+// Connected records a successful connection and how long it took.
+func (h *Health) Connected(url string, latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := h.get(url)
+	now := time.Now()
+	r.connects++
+	r.connectedAt = &now
+	r.windowStart = now
+	r.windowEvents = 0
+	h.observeLatency(r, latency)
+}
+
+// Failed records a failed connection attempt or request.
+func (h *Health) Failed(url string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := h.get(url)
+	h.fail(r, err)
+	if r.failures == h.threshold {
+		logger.Warn("relay keeps failing, opening circuit", "url", url, "failures", r.failures, "err", err)
+	}
+}
+
+// Disconnected records a lost connection. Connections that drop before they
+// have been stable for a while count as failures, so that flapping relays
+// back off as well.
+func (h *Health) Disconnected(url string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := h.get(url)
+	if r.connectedAt != nil && time.Since(*r.connectedAt) >= h.stableAfter {
+		r.failures = 0
+		r.connectedAt = nil
+		return
+	}
+	h.fail(r, err)
+}
+
+// Reset forgets the failures of a relay, e.g. when an operator asks to
+// retry it right away.
+func (h *Health) Reset(url string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.get(url).failures = 0
+}
+
+// Latency records the round trip of a request, e.g. a publish.
+func (h *Health) Latency(url string, latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.observeLatency(h.get(url), latency)
+}
+
+func (h *Health) Notice(url, notice string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := h.get(url)
+	r.notices++
+	r.lastNotice = notice
+}
+
+func (h *Health) Event(url string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := h.get(url)
+	now := time.Now()
+	r.events++
+	r.windowEvents++
+	if elapsed := now.Sub(r.windowStart); elapsed >= time.Minute {
+		rate := float64(r.windowEvents) / elapsed.Minutes()
+		if r.eventRate == 0 {
+			r.eventRate = rate
+		} else {
+			r.eventRate = 0.7*r.eventRate + 0.3*rate
+		}
+		r.windowStart = now
+		r.windowEvents = 0
+	}
+
+	// a relay that delivers events is healthy
+	if r.connectedAt != nil && now.Sub(*r.connectedAt) >= h.stableAfter {
+		r.failures = 0
+	}
+}
+
+// Backoff returns how long to wait before the next attempt to a relay.
+func (h *Health) Backoff(url string) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := h.get(url)
+	if r.failures == 0 {
+		return 0
+	}
+
+	if h.threshold > 0 && r.failures >= h.threshold {
+		return jitter(h.probeInterval)
+	}
+
+	delay := h.maxDelay
+	if r.failures < 32 {
+		if d := h.baseDelay << (r.failures - 1); d > 0 && d < h.maxDelay {
+			delay = d
+		}
+	}
+	return jitter(delay)
+}
+
+// Available returns false while the circuit of a relay is open and its next
+// probe is not due yet.
+func (h *Health) Available(url string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := h.get(url)
+	if h.threshold <= 0 || r.failures < h.threshold {
+		return true
+	}
+	return r.lastFailure == nil || time.Since(*r.lastFailure) >= h.probeInterval
+}
+
+func (h *Health) State(url string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.state(h.get(url))
+}
+
+// Stats returns the health of all known relays, sorted by url.
+func (h *Health) Stats() []Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stats := make([]Stats, 0, len(h.relays))
+	for url, r := range h.relays {
+		stats = append(stats, Stats{
+			URL:                 url,
+			State:               h.state(r),
+			ConsecutiveFailures: r.failures,
+			TotalFailures:       r.totalFailures,
+			Connects:            r.connects,
+			LastError:           r.lastError,
+			LastFailure:         r.lastFailure,
+			ConnectedAt:         r.connectedAt,
+			LatencyMs:           r.latency.Milliseconds(),
+			Notices:             r.notices,
+			LastNotice:          r.lastNotice,
+			Events:              r.events,
+			EventsPerMinute:     r.eventRate,
+		})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].URL < stats[j].URL
+	})
+	return stats
+}
+
+func (h *Health) get(url string) *relayHealth {
+	r, ok := h.relays[url]
+	if !ok {
+		r = &relayHealth{}
+		h.relays[url] = r
+	}
+	return r
+}
+
+func (h *Health) fail(r *relayHealth, err error) {
+	now := time.Now()
+	r.failures++
+	r.totalFailures++
+	r.lastFailure = &now
+	r.connectedAt = nil
+	if err != nil {
+		r.lastError = err.Error()
+	}
+}
+
+func (h *Health) state(r *relayHealth) string {
+	switch {
+	case r.failures == 0:
+		return StateHealthy
+	case h.threshold > 0 && r.failures >= h.threshold:
+		return StateOpen
+	default:
+		return StateBackoff
+	}
+}
+
+func (h *Health) observeLatency(r *relayHealth, latency time.Duration) {
+	if r.latency == 0 {
+		r.latency = latency
+	} else {
+		r.latency = (4*r.latency + latency) / 5
+	}
+}
+
+// jitter returns a random duration between d/2 and d.
+func jitter(d time.Duration) time.Duration {
+	if d <= 1 {
+		return d
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)))
+}
+
+func parseDuration(s string, fallback time.Duration) time.Duration {
+	if s == "" {
+		return fallback
+	}
+	d, err := types.ParseTimeOffset(s)
+	if err == nil && d <= 0 {
+		err = errors.New("duration must be positive")
+	}
+	if err != nil {
+		logger.Error("invalid relay health setting, using default", "value", s, "default", fallback, "err", err)
+		return fallback
+	}
+	return d
+}
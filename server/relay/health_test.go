@@ -0,0 +1,79 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/stretchr/testify/assert"
+)
+
+var testHealthConfig = types.HealthConfig{
+	BaseDelay:        "1s",
+	MaxDelay:         "1m",
+	FailureThreshold: 5,
+	ProbeInterval:    "1h",
+	StableAfter:      "1m",
+}
+
+func TestHealthBackoff(t *testing.T) {
+	h := NewHealth(testHealthConfig)
+	url := "wss://relay.example.com"
+	err := errors.New("connection refused")
+
+	assert.Equal(t, time.Duration(0), h.Backoff(url))
+	assert.Equal(t, StateHealthy, h.State(url))
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}
+	for _, d := range expected {
+		h.Failed(url, err)
+		backoff := h.Backoff(url)
+		assert.GreaterOrEqual(t, backoff, d/2)
+		assert.LessOrEqual(t, backoff, d)
+		assert.Equal(t, StateBackoff, h.State(url))
+		assert.True(t, h.Available(url))
+	}
+
+	// the circuit opens after too many failures, and the relay is only
+	// probed once per probe interval
+	h.Failed(url, err)
+	assert.Equal(t, StateOpen, h.State(url))
+	assert.False(t, h.Available(url))
+	assert.GreaterOrEqual(t, h.Backoff(url), 30*time.Minute)
+
+	stats := h.Stats()
+	assert.Len(t, stats, 1)
+	assert.Equal(t, 5, stats[0].ConsecutiveFailures)
+	assert.Equal(t, err.Error(), stats[0].LastError)
+}
+
+func TestHealthFlapping(t *testing.T) {
+	h := NewHealth(testHealthConfig)
+	url := "wss://relay.example.com"
+	err := errors.New("connection reset")
+
+	// connections dropping right away keep backing off
+	for i := 0; i < 3; i++ {
+		h.Connected(url, 100*time.Millisecond)
+		h.Disconnected(url, err)
+	}
+	assert.Equal(t, StateBackoff, h.State(url))
+	assert.Greater(t, h.Backoff(url), time.Second)
+
+	// a stable connection resets the failures
+	h.Connected(url, 100*time.Millisecond)
+	stable := time.Now().Add(-2 * time.Minute)
+	h.relays[url].connectedAt = &stable
+	h.Disconnected(url, err)
+	assert.Equal(t, StateHealthy, h.State(url))
+	assert.Equal(t, time.Duration(0), h.Backoff(url))
+}
+
+func TestParseDuration(t *testing.T) {
+	assert.Equal(t, 24*time.Hour, parseDuration("1d", time.Hour))
+	assert.Equal(t, 30*time.Second, parseDuration("30s", time.Hour))
+	assert.Equal(t, time.Hour, parseDuration("", time.Hour))
+	assert.Equal(t, time.Hour, parseDuration("1.5h", time.Hour))
+	assert.Equal(t, time.Hour, parseDuration("-1m", time.Hour))
+}
@@ -0,0 +1,346 @@
+package relay
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/gorilla/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip42"
+)
+
+// MockRelay is an in-process relay for tests. It keeps published events in
+// memory, serves them to subscriptions and forwards new ones to live
+// subscriptions.
+type MockRelay struct {
+	URL string
+
+	// NoNegentropy makes the relay ignore NIP-77 messages like most relays
+	// do, it must be set before the first connection.
+	NoNegentropy bool
+
+	// RequireAuth makes the relay send a NIP-42 challenge on connect and
+	// refuse subscriptions and events until the client has authenticated.
+	RequireAuth bool
+
+	// Reject decides whether to reject a published event, a non-empty
+	// reason is sent back in the OK message.
+	Reject func(ev *nostr.Event) string
+
+	server   *httptest.Server
+	upgrader websocket.Upgrader
+
+	mu     sync.Mutex
+	events []*nostr.Event
+	conns  map[*mockConn]struct{}
+}
+
+type mockConn struct {
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	subs    map[string]nostr.Filters
+	negs    map[string]*negentropy
+
+	challenge string
+	authed    string // pubkey the connection authenticated as
+}
+
+func NewMockRelay() *MockRelay {
+	m := &MockRelay{
+		conns: make(map[*mockConn]struct{}),
+	}
+	m.server = httptest.NewServer(http.HandlerFunc(m.serve))
+	m.URL = "ws" + strings.TrimPrefix(m.server.URL, "http")
+	return m
+}
+
+func (m *MockRelay) Close() {
+	m.DropConnections()
+	m.server.Close()
+}
+
+// AddEvent stores an event as if it had been published to the relay.
+func (m *MockRelay) AddEvent(ev *nostr.Event) {
+	m.mu.Lock()
+	m.events = append(m.events, ev)
+	conns := m.connections()
+	m.mu.Unlock()
+
+	for _, c := range conns {
+		c.mu.Lock()
+		for id, filters := range c.subs {
+			if filters.Match(ev) {
+				c.send([]any{"EVENT", id, ev})
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Events returns all events stored in the relay.
+func (m *MockRelay) Events() []*nostr.Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*nostr.Event(nil), m.events...)
+}
+
+// Connections returns the number of open websocket connections.
+func (m *MockRelay) Connections() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.conns)
+}
+
+// DropConnections closes all websocket connections, e.g. to test reconnects.
+func (m *MockRelay) DropConnections() {
+	m.mu.Lock()
+	conns := m.connections()
+	m.mu.Unlock()
+
+	for _, c := range conns {
+		c.ws.Close()
+	}
+}
+
+func (m *MockRelay) connections() []*mockConn {
+	conns := make([]*mockConn, 0, len(m.conns))
+	for c := range m.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+func (m *MockRelay) serve(w http.ResponseWriter, r *http.Request) {
+	ws, err := m.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	c := &mockConn{
+		ws:   ws,
+		subs: make(map[string]nostr.Filters),
+		negs: make(map[string]*negentropy),
+	}
+	m.mu.Lock()
+	m.conns[c] = struct{}{}
+	m.mu.Unlock()
+
+	if m.RequireAuth {
+		c.challenge = strconv.FormatInt(rand.Int63(), 36)
+		c.send([]any{"AUTH", c.challenge})
+	}
+
+	defer func() {
+		m.mu.Lock()
+		delete(m.conns, c)
+		m.mu.Unlock()
+		ws.Close()
+	}()
+
+	for {
+		_, message, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var msg []json.RawMessage
+		if err := json.Unmarshal(message, &msg); err != nil || len(msg) < 2 {
+			continue
+		}
+
+		var command string
+		json.Unmarshal(msg[0], &command)
+		m.handle(c, command, msg)
+	}
+}
+
+func (m *MockRelay) handle(c *mockConn, command string, msg []json.RawMessage) {
+	switch command {
+	case "EVENT":
+		var ev nostr.Event
+		if err := json.Unmarshal(msg[1], &ev); err != nil {
+			return
+		}
+		if ok, _ := ev.CheckSignature(); !ok {
+			c.send([]any{"OK", ev.ID, false, "invalid: bad signature"})
+			return
+		}
+		if !c.authenticated(m) {
+			c.send([]any{"OK", ev.ID, false, "auth-required: we only accept events from authenticated users"})
+			return
+		}
+		if m.Reject != nil {
+			if reason := m.Reject(&ev); reason != "" {
+				c.send([]any{"OK", ev.ID, false, reason})
+				return
+			}
+		}
+		c.send([]any{"OK", ev.ID, true, ""})
+		m.AddEvent(&ev)
+	case "REQ":
+		var id string
+		json.Unmarshal(msg[1], &id)
+		var filters nostr.Filters
+		for _, raw := range msg[2:] {
+			var f nostr.Filter
+			if err := json.Unmarshal(raw, &f); err == nil {
+				filters = append(filters, f)
+			}
+		}
+		if !c.authenticated(m) {
+			c.send([]any{"CLOSED", id, "auth-required: we only serve authenticated users"})
+			return
+		}
+
+		c.mu.Lock()
+		c.subs[id] = filters
+		for _, ev := range m.query(filters) {
+			c.send([]any{"EVENT", id, ev})
+		}
+		c.send([]any{"EOSE", id})
+		c.mu.Unlock()
+	case "AUTH":
+		var ev nostr.Event
+		if err := json.Unmarshal(msg[1], &ev); err != nil {
+			return
+		}
+		pubkey, ok := nip42.ValidateAuthEvent(&ev, c.challenge, m.URL)
+		if !ok || c.challenge == "" {
+			c.send([]any{"OK", ev.ID, false, "restricted: invalid auth event"})
+			return
+		}
+		c.mu.Lock()
+		c.authed = pubkey
+		c.mu.Unlock()
+		c.send([]any{"OK", ev.ID, true, ""})
+	case "CLOSE":
+		var id string
+		json.Unmarshal(msg[1], &id)
+		c.mu.Lock()
+		delete(c.subs, id)
+		c.mu.Unlock()
+	case "NEG-OPEN":
+		if m.NoNegentropy || len(msg) < 4 {
+			return
+		}
+		var (
+			id     string
+			filter nostr.Filter
+		)
+		json.Unmarshal(msg[1], &id)
+		if err := json.Unmarshal(msg[2], &filter); err != nil {
+			c.send([]any{"NEG-ERR", id, "error: invalid filter"})
+			return
+		}
+
+		// negentropy reconciles the whole set, the limit does not apply
+		filter.Limit = 0
+		var refs []types.EventRef
+		for _, ev := range m.query(nostr.Filters{filter}) {
+			refs = append(refs, types.EventRef{ID: ev.ID, CreatedAt: ev.CreatedAt})
+		}
+		neg, err := newNegentropy(refs, false)
+		if err != nil {
+			c.send([]any{"NEG-ERR", id, "error: " + err.Error()})
+			return
+		}
+
+		c.mu.Lock()
+		c.negs[id] = neg
+		c.mu.Unlock()
+		m.reconcile(c, id, msg[3])
+	case "NEG-MSG":
+		if m.NoNegentropy || len(msg) < 3 {
+			return
+		}
+		var id string
+		json.Unmarshal(msg[1], &id)
+		m.reconcile(c, id, msg[2])
+	case "NEG-CLOSE":
+		var id string
+		json.Unmarshal(msg[1], &id)
+		c.mu.Lock()
+		delete(c.negs, id)
+		c.mu.Unlock()
+	}
+}
+
+func (m *MockRelay) reconcile(c *mockConn, id string, raw json.RawMessage) {
+	c.mu.Lock()
+	neg := c.negs[id]
+	c.mu.Unlock()
+	if neg == nil {
+		c.send([]any{"NEG-ERR", id, "closed: unknown subscription"})
+		return
+	}
+
+	var payload string
+	json.Unmarshal(raw, &payload)
+	query, err := hex.DecodeString(payload)
+	if err != nil {
+		c.send([]any{"NEG-ERR", id, "error: invalid message"})
+		return
+	}
+
+	out, _, _, err := neg.reconcile(query)
+	if err != nil {
+		c.send([]any{"NEG-ERR", id, "error: " + err.Error()})
+		return
+	}
+	c.send([]any{"NEG-MSG", id, hex.EncodeToString(out)})
+}
+
+// query returns the stored events matching filters, newest first and
+// truncated to the limit of each filter like a real relay would.
+func (m *MockRelay) query(filters nostr.Filters) []*nostr.Event {
+	m.mu.Lock()
+	events := append([]*nostr.Event(nil), m.events...)
+	m.mu.Unlock()
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].CreatedAt.After(events[j].CreatedAt)
+	})
+
+	seen := make(map[string]bool)
+	var result []*nostr.Event
+	for _, f := range filters {
+		n := 0
+		for _, ev := range events {
+			if f.Limit > 0 && n >= f.Limit {
+				break
+			}
+			if f.Matches(ev) {
+				n++
+				if !seen[ev.ID] {
+					seen[ev.ID] = true
+					result = append(result, ev)
+				}
+			}
+		}
+	}
+	return result
+}
+
+func (c *mockConn) send(v any) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.ws.WriteJSON(v)
+}
+
+func (c *mockConn) authenticated(m *MockRelay) bool {
+	if !m.RequireAuth {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.authed != ""
+}
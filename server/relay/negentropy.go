@@ -0,0 +1,499 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Negentropy (NIP-77) range-based set reconciliation, protocol version 1.
+// See https://github.com/hoytech/negentropy for the reference implementation.
+
+const (
+	negentropyVersion = 0x61
+
+	negModeSkip        = 0
+	negModeFingerprint = 1
+	negModeIdList      = 2
+
+	negBuckets         = 16
+	negFingerprintSize = 16
+	negIDSize          = 32
+)
+
+const (
+	negentropySupported   = "supported"
+	negentropyUnsupported = "unsupported"
+)
+
+var (
+	// how long to wait for each message of the relay, relays that do not
+	// speak negentropy usually ignore NEG-OPEN or answer with a NOTICE
+	negentropyTimeout = 10 * time.Second
+	// a relay is taken as not speaking negentropy once it did not answer
+	// that many times in a row, and is asked again after a while, as it may
+	// just have been busy
+	negentropyMaxTimeouts = 3
+	negentropyRetryAfter  = time.Hour
+
+	ErrNegentropyUnsupported = errors.New("relay does not support negentropy")
+
+	errNegentropyMessage = errors.New("malformed negentropy message")
+)
+
+type negMessage struct {
+	err     bool
+	payload string
+}
+
+// Reconcile runs a negentropy reconciliation of the events matching filter
+// between the relay and local, and returns the ids of the events only the
+// relay has. It fails with ErrNegentropyUnsupported if the relay does not
+// take part, in which case the caller should fall back to a plain REQ.
+func (r *Relay) Reconcile(ctx context.Context, filter nostr.Filter, local []types.EventRef) ([]string, error) {
+	support := r.negentropySupport()
+	if support == negentropyUnsupported {
+		return nil, ErrNegentropyUnsupported
+	}
+
+	neg, err := newNegentropy(local, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.WaitConnected(ctx); err != nil {
+		return nil, err
+	}
+
+	ch := make(chan negMessage, 1)
+	r.mu.Lock()
+	r.counter++
+	id := "neg:" + strconv.Itoa(r.counter)
+	r.negs[id] = ch
+	conn := r.conn
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		delete(r.negs, id)
+		conn := r.conn
+		r.mu.Unlock()
+		r.write(conn, []any{"NEG-CLOSE", id})
+	}()
+
+	msg := []any{"NEG-OPEN", id, filter, hex.EncodeToString(neg.initiate())}
+	if err := r.write(conn, msg); err != nil {
+		return nil, err
+	}
+
+	var need []string
+	for {
+		var reply negMessage
+		select {
+		case reply = <-ch:
+		case <-time.After(negentropyTimeout):
+			r.mu.Lock()
+			reconnected := r.conn != conn
+			r.mu.Unlock()
+			if reconnected {
+				return nil, ErrNotConnected
+			}
+			if support == "" {
+				r.negentropyIgnored()
+				return nil, ErrNegentropyUnsupported
+			}
+			return nil, ErrTimeout
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if reply.err {
+			return nil, fmt.Errorf("%w: %s", ErrNegentropyUnsupported, reply.payload)
+		}
+		r.setNegentropy(negentropySupported)
+		support = negentropySupported
+
+		query, err := hex.DecodeString(reply.payload)
+		if err != nil {
+			return nil, errNegentropyMessage
+		}
+		out, _, ids, err := neg.reconcile(query)
+		if err != nil {
+			return nil, err
+		}
+		need = append(need, ids...)
+		if out == nil {
+			return need, nil
+		}
+
+		r.mu.Lock()
+		conn = r.conn
+		r.mu.Unlock()
+		if err := r.write(conn, []any{"NEG-MSG", id, hex.EncodeToString(out)}); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (r *Relay) setNegentropy(support string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.negentropy = support
+	r.negentropyTimeouts = 0
+}
+
+// negentropySupport returns whether the relay speaks negentropy, empty if
+// unknown or if it has been given up on long enough ago to ask again.
+func (r *Relay) negentropySupport() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.negentropy == negentropyUnsupported && time.Since(r.negentropyGivenUpAt) >= negentropyRetryAfter {
+		r.negentropy = ""
+		r.negentropyTimeouts = 0
+	}
+	return r.negentropy
+}
+
+// negentropyIgnored records that the relay did not answer a NEG-OPEN, and
+// gives up on it after negentropyMaxTimeouts in a row.
+func (r *Relay) negentropyIgnored() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.negentropyTimeouts++
+	if r.negentropyTimeouts < negentropyMaxTimeouts {
+		logger.Debug("relay did not answer negentropy", "url", r.URL, "times", r.negentropyTimeouts)
+		return
+	}
+	logger.Info("relay does not answer negentropy", "url", r.URL, "retryAfter", negentropyRetryAfter)
+	r.negentropy = negentropyUnsupported
+	r.negentropyGivenUpAt = time.Now()
+}
+
+type negItem struct {
+	timestamp uint64
+	id        [negIDSize]byte
+}
+
+type negBound struct {
+	timestamp uint64
+	prefix    []byte
+}
+
+var negInfinity = negBound{timestamp: math.MaxUint64}
+
+// after returns true if the bound sorts after the item.
+func (b negBound) after(item negItem) bool {
+	if item.timestamp != b.timestamp {
+		return item.timestamp < b.timestamp
+	}
+	var id [negIDSize]byte
+	copy(id[:], b.prefix)
+	return bytes.Compare(item.id[:], id[:]) < 0
+}
+
+// negentropy is one side of a reconciliation. The initiator collects the ids
+// it has and the ids it needs, the other side only answers.
+type negentropy struct {
+	items     []negItem
+	initiator bool
+
+	lastTimestampIn  uint64
+	lastTimestampOut uint64
+}
+
+func newNegentropy(refs []types.EventRef, initiator bool) (*negentropy, error) {
+	items := make([]negItem, 0, len(refs))
+	for _, ref := range refs {
+		id, err := hex.DecodeString(ref.ID)
+		if err != nil || len(id) != negIDSize {
+			return nil, errors.New("invalid event id: " + ref.ID)
+		}
+		item := negItem{timestamp: uint64(ref.CreatedAt.Unix())}
+		copy(item.id[:], id)
+		items = append(items, item)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].timestamp != items[j].timestamp {
+			return items[i].timestamp < items[j].timestamp
+		}
+		return bytes.Compare(items[i].id[:], items[j].id[:]) < 0
+	})
+
+	return &negentropy{items: items, initiator: initiator}, nil
+}
+
+// initiate returns the first message of the initiator.
+func (n *negentropy) initiate() []byte {
+	n.lastTimestampOut = 0
+	out := []byte{negentropyVersion}
+	return n.splitRange(out, 0, len(n.items), negInfinity)
+}
+
+// reconcile processes a message of the other side and returns the answer.
+// For the initiator the answer is nil once both sides agree, and have/need
+// are the ids only present locally and only present remotely.
+func (n *negentropy) reconcile(query []byte) (out []byte, have []string, need []string, err error) {
+	n.lastTimestampIn = 0
+	n.lastTimestampOut = 0
+
+	r := bytes.NewReader(query)
+	version, err := r.ReadByte()
+	if err != nil {
+		return nil, nil, nil, errNegentropyMessage
+	}
+	if version != negentropyVersion {
+		if n.initiator {
+			return nil, nil, nil, errors.New("unsupported negentropy version")
+		}
+		// tell the initiator which version we speak
+		return []byte{negentropyVersion}, nil, nil, nil
+	}
+
+	out = []byte{negentropyVersion}
+	prevIndex := 0
+	prevBound := negBound{}
+	skip := false
+
+	for r.Len() > 0 {
+		var o []byte
+		doSkip := func() {
+			if skip {
+				skip = false
+				o = n.encodeBound(o, prevBound)
+				o = appendVarint(o, negModeSkip)
+			}
+		}
+
+		currBound, err := n.decodeBound(r)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		mode, err := readVarint(r)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		lower := prevIndex
+		upper := n.findLowerBound(prevIndex, currBound)
+
+		switch mode {
+		case negModeSkip:
+			skip = true
+		case negModeFingerprint:
+			theirs := make([]byte, negFingerprintSize)
+			if _, err := io.ReadFull(r, theirs); err != nil {
+				return nil, nil, nil, errNegentropyMessage
+			}
+			ours := n.fingerprint(lower, upper)
+			if !bytes.Equal(theirs, ours[:]) {
+				doSkip()
+				o = n.splitRange(o, lower, upper, currBound)
+			} else {
+				skip = true
+			}
+		case negModeIdList:
+			count, err := readVarint(r)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			theirs := make(map[[negIDSize]byte]bool, count)
+			for i := uint64(0); i < count; i++ {
+				var id [negIDSize]byte
+				if _, err := io.ReadFull(r, id[:]); err != nil {
+					return nil, nil, nil, errNegentropyMessage
+				}
+				theirs[id] = true
+			}
+
+			for _, item := range n.items[lower:upper] {
+				if !theirs[item.id] {
+					if n.initiator {
+						have = append(have, hex.EncodeToString(item.id[:]))
+					}
+				} else {
+					delete(theirs, item.id)
+				}
+			}
+
+			if n.initiator {
+				skip = true
+				for id := range theirs {
+					need = append(need, hex.EncodeToString(id[:]))
+				}
+			} else {
+				doSkip()
+				o = n.encodeBound(o, currBound)
+				o = appendVarint(o, negModeIdList)
+				o = appendVarint(o, uint64(upper-lower))
+				for _, item := range n.items[lower:upper] {
+					o = append(o, item.id[:]...)
+				}
+			}
+		default:
+			return nil, nil, nil, errNegentropyMessage
+		}
+
+		out = append(out, o...)
+		prevIndex = upper
+		prevBound = currBound
+	}
+
+	if n.initiator && len(out) == 1 {
+		return nil, have, need, nil
+	}
+	return out, have, need, nil
+}
+
+// splitRange describes the items in [lower, upper) either as a list of ids,
+// or as fingerprints of buckets if there are too many of them.
+func (n *negentropy) splitRange(o []byte, lower, upper int, upperBound negBound) []byte {
+	count := upper - lower
+	if count < negBuckets*2 {
+		o = n.encodeBound(o, upperBound)
+		o = appendVarint(o, negModeIdList)
+		o = appendVarint(o, uint64(count))
+		for _, item := range n.items[lower:upper] {
+			o = append(o, item.id[:]...)
+		}
+		return o
+	}
+
+	perBucket := count / negBuckets
+	extra := count % negBuckets
+	curr := lower
+	for i := 0; i < negBuckets; i++ {
+		size := perBucket
+		if i < extra {
+			size++
+		}
+		fp := n.fingerprint(curr, curr+size)
+		curr += size
+
+		next := upperBound
+		if curr != upper {
+			next = minimalBound(n.items[curr-1], n.items[curr])
+		}
+		o = n.encodeBound(o, next)
+		o = appendVarint(o, negModeFingerprint)
+		o = append(o, fp[:]...)
+	}
+	return o
+}
+
+// findLowerBound returns the index of the first item from start on that does
+// not sort before bound.
+func (n *negentropy) findLowerBound(start int, bound negBound) int {
+	return start + sort.Search(len(n.items)-start, func(i int) bool {
+		return !bound.after(n.items[start+i])
+	})
+}
+
+// fingerprint hashes the sum of the ids in [lower, upper) modulo 2^256
+// together with their count.
+func (n *negentropy) fingerprint(lower, upper int) [negFingerprintSize]byte {
+	var sum [negIDSize]byte
+	for _, item := range n.items[lower:upper] {
+		var carry uint16
+		for i := 0; i < negIDSize; i++ {
+			carry += uint16(sum[i]) + uint16(item.id[i])
+			sum[i] = byte(carry)
+			carry >>= 8
+		}
+	}
+
+	input := appendVarint(sum[:], uint64(upper-lower))
+	hash := sha256.Sum256(input)
+
+	var fp [negFingerprintSize]byte
+	copy(fp[:], hash[:])
+	return fp
+}
+
+func (n *negentropy) encodeBound(o []byte, bound negBound) []byte {
+	if bound.timestamp == math.MaxUint64 {
+		n.lastTimestampOut = math.MaxUint64
+		o = appendVarint(o, 0)
+	} else {
+		delta := bound.timestamp - n.lastTimestampOut
+		n.lastTimestampOut = bound.timestamp
+		o = appendVarint(o, delta+1)
+	}
+	o = appendVarint(o, uint64(len(bound.prefix)))
+	return append(o, bound.prefix...)
+}
+
+func (n *negentropy) decodeBound(r *bytes.Reader) (negBound, error) {
+	timestamp, err := readVarint(r)
+	if err != nil {
+		return negBound{}, err
+	}
+	if timestamp == 0 || n.lastTimestampIn == math.MaxUint64 {
+		timestamp = math.MaxUint64
+	} else {
+		timestamp = timestamp - 1 + n.lastTimestampIn
+	}
+	n.lastTimestampIn = timestamp
+
+	length, err := readVarint(r)
+	if err != nil || length > negIDSize {
+		return negBound{}, errNegentropyMessage
+	}
+	prefix := make([]byte, length)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return negBound{}, errNegentropyMessage
+	}
+	return negBound{timestamp: timestamp, prefix: prefix}, nil
+}
+
+// minimalBound returns the shortest bound that separates prev from curr.
+func minimalBound(prev, curr negItem) negBound {
+	if curr.timestamp != prev.timestamp {
+		return negBound{timestamp: curr.timestamp}
+	}
+
+	shared := 0
+	for shared < negIDSize && prev.id[shared] == curr.id[shared] {
+		shared++
+	}
+	return negBound{timestamp: curr.timestamp, prefix: append([]byte(nil), curr.id[:shared+1]...)}
+}
+
+// appendVarint encodes a varint as specified by negentropy, i.e. base 128
+// with the most significant group first.
+func appendVarint(o []byte, v uint64) []byte {
+	var buf [10]byte
+	i := len(buf) - 1
+	buf[i] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		buf[i] = byte(v&0x7f) | 0x80
+	}
+	return append(o, buf[i:]...)
+}
+
+func readVarint(r *bytes.Reader) (uint64, error) {
+	var v uint64
+	for i := 0; i < 10; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, errNegentropyMessage
+		}
+		v = v<<7 | uint64(b&0x7f)
+		if b&0x80 == 0 {
+			return v, nil
+		}
+	}
+	return 0, errNegentropyMessage
+}
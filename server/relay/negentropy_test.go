@@ -0,0 +1,144 @@
+package relay
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func testRefs(from, to int) []types.EventRef {
+	base := time.Unix(1680000000, 0)
+	var refs []types.EventRef
+	for i := from; i < to; i++ {
+		id := sha256.Sum256([]byte(fmt.Sprint(i)))
+		// several events share a second to exercise id prefix bounds
+		refs = append(refs, types.EventRef{ID: hex.EncodeToString(id[:]), CreatedAt: base.Add(time.Duration(i/3) * time.Second)})
+	}
+	return refs
+}
+
+func refIDs(refs []types.EventRef) []string {
+	ids := make([]string, len(refs))
+	for i, ref := range refs {
+		ids[i] = ref.ID
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestVarint(t *testing.T) {
+	assert.Equal(t, []byte{0x00}, appendVarint(nil, 0))
+	assert.Equal(t, []byte{0x7f}, appendVarint(nil, 127))
+	assert.Equal(t, []byte{0x81, 0x00}, appendVarint(nil, 128))
+	assert.Equal(t, []byte{0x83, 0xff, 0x7f}, appendVarint(nil, 65535))
+}
+
+func TestNegentropyReconcile(t *testing.T) {
+	// the client has 0..1500, the relay has 1000..3000
+	client, err := newNegentropy(testRefs(0, 1500), true)
+	assert.NoError(t, err)
+	server, err := newNegentropy(testRefs(1000, 3000), false)
+	assert.NoError(t, err)
+
+	var have, need []string
+	msg := client.initiate()
+	for rounds := 0; msg != nil; rounds++ {
+		assert.Less(t, rounds, 20)
+
+		reply, _, _, err := server.reconcile(msg)
+		assert.NoError(t, err)
+
+		var h, n []string
+		msg, h, n, err = client.reconcile(reply)
+		assert.NoError(t, err)
+		have = append(have, h...)
+		need = append(need, n...)
+	}
+
+	sort.Strings(have)
+	sort.Strings(need)
+	assert.Equal(t, refIDs(testRefs(0, 1000)), have)
+	assert.Equal(t, refIDs(testRefs(1500, 3000)), need)
+}
+
+func TestRelayReconcile(t *testing.T) {
+	mock := NewMockRelay()
+	defer mock.Close()
+
+	sk := nostr.GeneratePrivateKey()
+	now := time.Now()
+	var events []*nostr.Event
+	for i := 0; i < 100; i++ {
+		ev := newTestEvent(t, sk, now.Add(-time.Duration(i)*time.Second))
+		events = append(events, ev)
+		mock.AddEvent(ev)
+	}
+
+	// we know the first half and an event the relay does not have
+	var local []types.EventRef
+	for _, ev := range events[:50] {
+		local = append(local, types.EventRef{ID: ev.ID, CreatedAt: ev.CreatedAt})
+	}
+	unknown := newTestEvent(t, sk, now)
+	local = append(local, types.EventRef{ID: unknown.ID, CreatedAt: unknown.CreatedAt})
+
+	pool := newTestPool()
+	r := pool.Acquire(mock.URL)
+	defer pool.Release(mock.URL)
+
+	need, err := r.Reconcile(context.Background(), nostr.Filter{Kinds: []int{1}}, local)
+	assert.NoError(t, err)
+
+	var expected []string
+	for _, ev := range events[50:] {
+		expected = append(expected, ev.ID)
+	}
+	sort.Strings(expected)
+	sort.Strings(need)
+	assert.Equal(t, expected, need)
+}
+
+func TestRelayReconcileUnsupported(t *testing.T) {
+	defer func(timeout, retry time.Duration) {
+		negentropyTimeout, negentropyRetryAfter = timeout, retry
+	}(negentropyTimeout, negentropyRetryAfter)
+	negentropyTimeout = 100 * time.Millisecond
+	negentropyRetryAfter = time.Hour
+
+	mock := NewMockRelay()
+	mock.NoNegentropy = true
+	defer mock.Close()
+
+	pool := newTestPool()
+	r := pool.Acquire(mock.URL)
+	defer pool.Release(mock.URL)
+
+	// a relay not answering is asked again a few times, it may be busy
+	for i := 0; i < negentropyMaxTimeouts; i++ {
+		start := time.Now()
+		_, err := r.Reconcile(context.Background(), nostr.Filter{Kinds: []int{1}}, nil)
+		assert.ErrorIs(t, err, ErrNegentropyUnsupported)
+		assert.GreaterOrEqual(t, time.Since(start), negentropyTimeout)
+	}
+
+	// then it is not asked again for a while
+	start := time.Now()
+	_, err := r.Reconcile(context.Background(), nostr.Filter{Kinds: []int{1}}, nil)
+	assert.ErrorIs(t, err, ErrNegentropyUnsupported)
+	assert.Less(t, time.Since(start), negentropyTimeout)
+
+	// but asked again after that
+	negentropyRetryAfter = 0
+	start = time.Now()
+	_, err = r.Reconcile(context.Background(), nostr.Filter{Kinds: []int{1}}, nil)
+	assert.ErrorIs(t, err, ErrNegentropyUnsupported)
+	assert.GreaterOrEqual(t, time.Since(start), negentropyTimeout)
+}
@@ -0,0 +1,848 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/gorilla/websocket"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+const (
+	StateConnecting   = "connecting"
+	StateConnected    = "connected"
+	StateReconnecting = "reconnecting"
+	StateClosed       = "closed"
+
+	// how far back a live subscription reaches when it is resubscribed
+	// after a reconnect, relative to the newest event it has received
+	resubscribeMargin = 5 * time.Minute
+
+	connectTimeout = 7 * time.Second
+	publishTimeout = 7 * time.Second
+	queryTimeout   = 15 * time.Second
+)
+
+var (
+	ErrNotConnected = errors.New("relay is not connected")
+	ErrTimeout      = errors.New("relay did not respond in time")
+	ErrClosed       = errors.New("subscription closed by relay")
+
+	// how many events are queued for the consumer of a subscription before
+	// the connection stops reading from the relay
+	subscriptionQueueSize = 1000
+)
+
+// Pool shares one connection per relay url between all users in the process.
+// Relays are reference counted: the connection is opened by the first
+// Acquire and closed by the last Release. In between, the pool reconnects
+// as long as the relay's health suggests and resubscribes all active
+// subscriptions. Relays opted into NIP-42 are authenticated to whenever
+// they send a challenge.
+type Pool struct {
+	health *Health
+	auth   types.AuthConfig
+
+	mu     sync.Mutex
+	relays map[string]*Relay
+}
+
+func NewPool(health *Health, auth types.AuthConfig) *Pool {
+	// the bot key the auth key defaults to is empty when a bunker signs for
+	// the bot, AUTH is not signed through the bunker
+	if len(auth.Relays) > 0 && auth.SK == "" {
+		logger.Warn("no key to authenticate to relays with, set relay.auth.sk", "relays", auth.Relays)
+	}
+	return &Pool{
+		health: health,
+		auth:   auth,
+		relays: make(map[string]*Relay),
+	}
+}
+
+// Acquire returns the relay for url, connecting to it in the background if
+// this is its first user. Every Acquire must be paired with a Release.
+func (p *Pool) Acquire(url string) *Relay {
+	url = nostr.NormalizeURL(url)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	r, ok := p.relays[url]
+	if !ok {
+		r = newRelay(p, url)
+		p.relays[url] = r
+		go r.run()
+	}
+	r.refs++
+	return r
+}
+
+// Release gives up a reference to a relay and closes its connection if
+// nobody uses it anymore.
+func (p *Pool) Release(url string) {
+	url = nostr.NormalizeURL(url)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	r, ok := p.relays[url]
+	if !ok {
+		return
+	}
+
+	r.refs--
+	if r.refs <= 0 {
+		delete(p.relays, url)
+		r.close()
+	}
+}
+
+// State returns the connection state of a relay, or StateClosed if the
+// relay is not in use.
+func (p *Pool) State(url string) string {
+	url = nostr.NormalizeURL(url)
+
+	p.mu.Lock()
+	r, ok := p.relays[url]
+	p.mu.Unlock()
+
+	if !ok {
+		return StateClosed
+	}
+	return r.State()
+}
+
+func (p *Pool) Health() *Health {
+	return p.health
+}
+
+// Relay is a single connection to a relay shared by many subscriptions.
+type Relay struct {
+	URL string
+
+	pool   *Pool
+	ctx    context.Context
+	cancel context.CancelFunc
+	refs   int // guarded by pool.mu
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	conn    *websocket.Conn
+	state   string
+	since   *time.Time
+	ready   chan struct{} // closed once connected, replaced on disconnect
+	retry   chan struct{}
+	counter int
+	subs    map[string]*Subscription
+	oks     map[string][]chan okResult
+	negs    map[string]chan negMessage
+
+	// NIP-42 state of the current connection
+	authed      bool
+	authReady   chan struct{} // closed once authenticated
+	authPending map[string]bool
+
+	// whether the relay answered or ignored negentropy before, how often
+	// in a row it did not answer, and when it was given up on
+	negentropy          string
+	negentropyTimeouts  int
+	negentropyGivenUpAt time.Time
+}
+
+type okResult struct {
+	ok      bool
+	message string
+}
+
+func newRelay(pool *Pool, url string) *Relay {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Relay{
+		URL:    url,
+		pool:   pool,
+		ctx:    ctx,
+		cancel: cancel,
+		state:  StateConnecting,
+		ready:  make(chan struct{}),
+		retry:  make(chan struct{}, 1),
+		subs:   make(map[string]*Subscription),
+		oks:    make(map[string][]chan okResult),
+		negs:   make(map[string]chan negMessage),
+
+		authReady:   make(chan struct{}),
+		authPending: make(map[string]bool),
+	}
+}
+
+func (r *Relay) State() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
+
+// Retry cuts short the wait for the next connection attempt.
+func (r *Relay) Retry() {
+	select {
+	case r.retry <- struct{}{}:
+	default:
+	}
+}
+
+// ConnectedAt returns when the current connection was established, or nil
+// if the relay is not connected.
+func (r *Relay) ConnectedAt() *time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.since
+}
+
+// Subscribe sends a REQ to the relay, now if connected or as soon as it
+// connects, and again after every reconnect until ctx is done.
+func (r *Relay) Subscribe(ctx context.Context, filters nostr.Filters) *Subscription {
+	return r.subscribe(ctx, filters, false, 0)
+}
+
+// SubscribeLive is like Subscribe, but after a reconnect it only asks for
+// events created since the connection was lost. The caller is expected to
+// catch up on older events itself, e.g. with Reconcile.
+func (r *Relay) SubscribeLive(ctx context.Context, filters nostr.Filters) *Subscription {
+	return r.subscribe(ctx, filters, true, 0)
+}
+
+// SubscribeBackdated is like Subscribe for events that are backdated on
+// purpose by up to reach, e.g. NIP-59 gift wraps. The newest event received
+// says nothing about what is still to come, so after a reconnect the
+// subscription asks for events created since reach before now.
+func (r *Relay) SubscribeBackdated(ctx context.Context, filters nostr.Filters, reach time.Duration) *Subscription {
+	return r.subscribe(ctx, filters, false, reach)
+}
+
+func (r *Relay) subscribe(ctx context.Context, filters nostr.Filters, live bool, reach time.Duration) *Subscription {
+	ctx, cancel := context.WithCancel(ctx)
+
+	r.mu.Lock()
+	r.counter++
+	sub := &Subscription{
+		ID:                "sub:" + strconv.Itoa(r.counter),
+		Relay:             r,
+		Events:            make(chan *nostr.Event),
+		EndOfStoredEvents: make(chan struct{}, 1),
+		ClosedReason:      make(chan string, 1),
+		filters:           filters,
+		live:              live,
+		reach:             reach,
+		ctx:               ctx,
+		cancel:            cancel,
+		wake:              make(chan struct{}, 1),
+		space:             make(chan struct{}, 1),
+		queueSize:         subscriptionQueueSize,
+	}
+	r.subs[sub.ID] = sub
+	conn := r.conn
+	r.mu.Unlock()
+
+	go sub.deliver()
+	if conn != nil {
+		r.sendReq(conn, sub)
+	}
+
+	go func() {
+		<-ctx.Done()
+		r.unsubscribe(sub)
+	}()
+
+	return sub
+}
+
+// QuerySync returns the stored events matching filter, i.e. all events
+// received before EOSE.
+func (r *Relay) QuerySync(ctx context.Context, filter nostr.Filter) ([]*nostr.Event, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, queryTimeout)
+		defer cancel()
+	}
+
+	if err := r.WaitConnected(ctx); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sub := r.Subscribe(ctx, nostr.Filters{filter})
+
+	var events []*nostr.Event
+	for {
+		select {
+		case ev, ok := <-sub.Events:
+			if !ok {
+				return events, ErrTimeout
+			}
+			events = append(events, ev)
+		case <-sub.EndOfStoredEvents:
+			return events, nil
+		case reason := <-sub.ClosedReason:
+			return events, fmt.Errorf("%w: %s", ErrClosed, reason)
+		case <-sub.Disconnected():
+			return events, ErrNotConnected
+		case <-ctx.Done():
+			return events, ErrTimeout
+		}
+	}
+}
+
+// Publish sends an event and waits for the relay to acknowledge it with an
+// OK message. It returns whether the relay accepted the event along with
+// the relay's message. If the relay requires authentication and is opted
+// into it, the event is sent once more after authenticating.
+func (r *Relay) Publish(ctx context.Context, ev nostr.Event) (bool, string, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, publishTimeout)
+		defer cancel()
+	}
+
+	ok, message, err := r.publish(ctx, ev)
+	if err != nil || ok || !strings.HasPrefix(message, authRequiredPrefix) || r.pool.authKey(r.URL) == "" {
+		return ok, message, err
+	}
+
+	logger.Debug("relay requires authentication to publish", "url", r.URL, "id", ev.ID)
+	if err := r.waitAuthenticated(ctx); err != nil {
+		return ok, message, nil
+	}
+	return r.publish(ctx, ev)
+}
+
+func (r *Relay) publish(ctx context.Context, ev nostr.Event) (bool, string, error) {
+	if err := r.WaitConnected(ctx); err != nil {
+		return false, "", err
+	}
+
+	ch := make(chan okResult, 1)
+	r.mu.Lock()
+	r.oks[ev.ID] = append(r.oks[ev.ID], ch)
+	conn := r.conn
+	r.mu.Unlock()
+	defer r.removeOk(ev.ID, ch)
+
+	start := time.Now()
+	if err := r.write(conn, []any{"EVENT", ev}); err != nil {
+		return false, "", err
+	}
+
+	select {
+	case res := <-ch:
+		r.pool.health.Latency(r.URL, time.Since(start))
+		return res.ok, res.message, nil
+	case <-ctx.Done():
+		return false, "", ErrTimeout
+	}
+}
+
+// WaitConnected blocks until the relay is connected or ctx is done. It fails
+// right away if the relay is given up on and not due for a probe.
+func (r *Relay) WaitConnected(ctx context.Context) error {
+	r.mu.Lock()
+	ready := r.ready
+	connected := r.conn != nil
+	r.mu.Unlock()
+
+	if connected {
+		return nil
+	}
+	if !r.pool.health.Available(r.URL) {
+		return ErrNotConnected
+	}
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return ErrNotConnected
+	case <-r.ctx.Done():
+		return ErrNotConnected
+	}
+}
+
+// run keeps the relay connected until it is closed.
+func (r *Relay) run() {
+	for {
+		wait := r.pool.health.Backoff(r.URL)
+		if wait > 0 {
+			logger.Debug("waiting to connect to relay", "url", r.URL, "wait", wait)
+		}
+		select {
+		case <-time.After(wait):
+		case <-r.retry:
+		case <-r.ctx.Done():
+			return
+		}
+
+		start := time.Now()
+		dialCtx, cancel := context.WithTimeout(r.ctx, connectTimeout)
+		conn, _, err := websocket.DefaultDialer.DialContext(dialCtx, r.URL, nil)
+		cancel()
+		if err != nil {
+			if r.ctx.Err() != nil {
+				return
+			}
+			logger.Debug("failed to connect to relay", "url", r.URL, "err", err)
+			r.pool.health.Failed(r.URL, err)
+			r.setState(StateReconnecting)
+			continue
+		}
+		r.pool.health.Connected(r.URL, time.Since(start))
+		logger.Info("connected to relay", "url", r.URL)
+
+		r.mu.Lock()
+		now := time.Now()
+		r.conn = conn
+		r.state = StateConnected
+		r.since = &now
+		r.authed = false
+		r.authReady = make(chan struct{})
+		r.authPending = make(map[string]bool)
+		close(r.ready)
+		subs := make([]*Subscription, 0, len(r.subs))
+		for _, sub := range r.subs {
+			subs = append(subs, sub)
+		}
+		r.mu.Unlock()
+
+		for _, sub := range subs {
+			r.sendReq(conn, sub)
+		}
+
+		err = r.readLoop(conn)
+		conn.Close()
+
+		r.mu.Lock()
+		r.conn = nil
+		r.since = nil
+		r.ready = make(chan struct{})
+		r.state = StateReconnecting
+		for _, sub := range r.subs {
+			sub.connectionLost()
+		}
+		r.mu.Unlock()
+
+		if r.ctx.Err() != nil {
+			return
+		}
+		logger.Warn("lost connection to relay", "url", r.URL, "err", err)
+		r.pool.health.Disconnected(r.URL, err)
+	}
+}
+
+func (r *Relay) close() {
+	r.cancel()
+
+	r.mu.Lock()
+	conn := r.conn
+	r.state = StateClosed
+	subs := r.subs
+	r.subs = make(map[string]*Subscription)
+	r.mu.Unlock()
+
+	for _, sub := range subs {
+		sub.cancel()
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+func (r *Relay) setState(state string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state != StateClosed {
+		r.state = state
+	}
+}
+
+func (r *Relay) readLoop(conn *websocket.Conn) error {
+	for {
+		typ, message, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		if typ != websocket.TextMessage || len(message) == 0 || message[0] != '[' {
+			continue
+		}
+
+		var msg []json.RawMessage
+		if err := json.Unmarshal(message, &msg); err != nil || len(msg) < 2 {
+			continue
+		}
+
+		var command string
+		json.Unmarshal(msg[0], &command)
+		r.handle(command, msg)
+	}
+}
+
+func (r *Relay) handle(command string, msg []json.RawMessage) {
+	switch command {
+	case "EVENT":
+		if len(msg) < 3 {
+			return
+		}
+		var subID string
+		json.Unmarshal(msg[1], &subID)
+		sub := r.subscription(subID)
+		if sub == nil {
+			return
+		}
+
+		var ev nostr.Event
+		if err := json.Unmarshal(msg[2], &ev); err != nil {
+			return
+		}
+		if !sub.Filters().Match(&ev) {
+			logger.Debug("event does not match filters", "url", r.URL, "id", ev.ID)
+			return
+		}
+		if ok, _ := ev.CheckSignature(); !ok {
+			logger.Debug("event has bad signature", "url", r.URL, "id", ev.ID)
+			return
+		}
+		r.pool.health.Event(r.URL)
+		sub.dispatch(&ev)
+	case "EOSE":
+		var subID string
+		json.Unmarshal(msg[1], &subID)
+		if sub := r.subscription(subID); sub != nil {
+			sub.push(subMessage{eose: true})
+		}
+	case "OK":
+		if len(msg) < 3 {
+			return
+		}
+		var (
+			id      string
+			ok      bool
+			message string
+		)
+		json.Unmarshal(msg[1], &id)
+		json.Unmarshal(msg[2], &ok)
+		if len(msg) > 3 {
+			json.Unmarshal(msg[3], &message)
+		}
+
+		r.mu.Lock()
+		waiters := r.oks[id]
+		r.mu.Unlock()
+		for _, ch := range waiters {
+			select {
+			case ch <- okResult{ok: ok, message: message}:
+			default:
+			}
+		}
+	case "CLOSED":
+		var subID, reason string
+		json.Unmarshal(msg[1], &subID)
+		if len(msg) > 2 {
+			json.Unmarshal(msg[2], &reason)
+		}
+		sub := r.subscription(subID)
+		if sub != nil && r.authRequired(sub, reason) {
+			logger.Debug("relay requires authentication to subscribe", "url", r.URL, "id", subID)
+			return
+		}
+		logger.Warn("subscription closed by relay", "url", r.URL, "id", subID, "reason", reason)
+		if sub != nil {
+			sub.push(subMessage{closed: true, reason: reason})
+		}
+	case "NEG-MSG", "NEG-ERR":
+		var subID, payload string
+		json.Unmarshal(msg[1], &subID)
+		if len(msg) > 2 {
+			json.Unmarshal(msg[2], &payload)
+		}
+
+		r.mu.Lock()
+		ch := r.negs[subID]
+		r.mu.Unlock()
+		if ch != nil {
+			select {
+			case ch <- negMessage{err: command == "NEG-ERR", payload: payload}:
+			default:
+			}
+		}
+	case "AUTH":
+		var challenge string
+		json.Unmarshal(msg[1], &challenge)
+		sk := r.pool.authKey(r.URL)
+		if sk == "" {
+			logger.Debug("ignoring auth challenge of relay", "url", r.URL)
+			return
+		}
+		go r.authenticate(r.ctx, challenge, sk)
+	case "NOTICE":
+		var notice string
+		json.Unmarshal(msg[1], &notice)
+		logger.Warn("relay notice", "url", r.URL, "notice", notice)
+		r.pool.health.Notice(r.URL, notice)
+	}
+}
+
+func (r *Relay) subscription(id string) *Subscription {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.subs[id]
+}
+
+func (r *Relay) sendReq(conn *websocket.Conn, sub *Subscription) {
+	message := []any{"REQ", sub.ID}
+	for _, filter := range sub.Filters() {
+		message = append(message, filter)
+	}
+
+	logger.Debug("subscribing to relay", "url", r.URL, "id", sub.ID, "filters", sub.Filters())
+	if err := r.write(conn, message); err != nil {
+		logger.Debug("failed to send subscription", "url", r.URL, "id", sub.ID, "err", err)
+	}
+}
+
+func (r *Relay) unsubscribe(sub *Subscription) {
+	r.mu.Lock()
+	_, ok := r.subs[sub.ID]
+	delete(r.subs, sub.ID)
+	conn := r.conn
+	r.mu.Unlock()
+
+	if ok && conn != nil {
+		r.write(conn, []any{"CLOSE", sub.ID})
+	}
+}
+
+func (r *Relay) removeOk(id string, ch chan okResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	waiters := r.oks[id]
+	for i, w := range waiters {
+		if w == ch {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(r.oks, id)
+	} else {
+		r.oks[id] = waiters
+	}
+}
+
+func (r *Relay) write(conn *websocket.Conn, v any) error {
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(publishTimeout))
+	return conn.WriteJSON(v)
+}
+
+// Subscription is a REQ on a pooled relay. Messages from the relay are
+// queued per subscription, so that a slow consumer does not hold up the
+// other subscriptions of the connection right away. Once a consumer falls
+// subscriptionQueueSize events behind, the connection stops reading until
+// it catches up, which pushes back on the relay instead of buffering
+// without limit. Events is closed once the subscription is closed, the
+// other channels are never closed.
+type Subscription struct {
+	ID                string
+	Relay             *Relay
+	Events            chan *nostr.Event
+	EndOfStoredEvents chan struct{}
+	ClosedReason      chan string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	eose   sync.Once
+	wake   chan struct{}
+	space  chan struct{}
+
+	// how many events may wait for the consumer
+	queueSize int
+
+	mu         sync.Mutex
+	filters    nostr.Filters
+	live       bool
+	reach      time.Duration
+	latest     time.Time
+	disconnect chan struct{}
+	queue      []subMessage
+}
+
+// subMessage is a message of the relay waiting to be delivered to the
+// consumer of a subscription, in the order it was received.
+type subMessage struct {
+	ev     *nostr.Event
+	eose   bool
+	closed bool
+	reason string
+}
+
+// Filters returns the filters the subscription is currently sent with.
+func (s *Subscription) Filters() nostr.Filters {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.filters
+}
+
+// Live returns whether the subscription has been made with SubscribeLive.
+func (s *Subscription) Live() bool {
+	return s.live
+}
+
+func (s *Subscription) Close() {
+	s.cancel()
+}
+
+func (s *Subscription) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Disconnected returns a channel that is closed when the connection of the
+// subscription is lost. The subscription is sent again once the relay has
+// reconnected, callers wanting to wait for that use Relay.WaitConnected.
+func (s *Subscription) Disconnected() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.disconnect == nil {
+		s.disconnect = make(chan struct{})
+	}
+	return s.disconnect
+}
+
+func (s *Subscription) dispatch(ev *nostr.Event) {
+	s.mu.Lock()
+	if ev.CreatedAt.After(s.latest) && ev.CreatedAt.Before(time.Now()) {
+		s.latest = ev.CreatedAt
+	}
+	s.mu.Unlock()
+
+	s.push(subMessage{ev: ev})
+}
+
+// push queues a message for the consumer. An event blocks the read loop
+// while the queue is full, until the consumer takes one or the subscription
+// is closed, other messages are always queued.
+func (s *Subscription) push(msg subMessage) {
+	s.mu.Lock()
+	for msg.ev != nil && len(s.queue) >= s.queueSize {
+		s.mu.Unlock()
+		select {
+		case <-s.space:
+		case <-s.ctx.Done():
+			return
+		}
+		s.mu.Lock()
+	}
+	s.queue = append(s.queue, msg)
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliver hands the queued messages to the consumer until the subscription
+// is closed, then closes Events.
+func (s *Subscription) deliver() {
+	defer close(s.Events)
+
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			select {
+			case <-s.wake:
+				continue
+			case <-s.ctx.Done():
+				return
+			}
+		}
+		msg := s.queue[0]
+		s.queue[0] = subMessage{}
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+
+		select {
+		case s.space <- struct{}{}:
+		default:
+		}
+
+		switch {
+		case msg.eose:
+			s.eose.Do(func() {
+				s.EndOfStoredEvents <- struct{}{}
+			})
+		case msg.closed:
+			select {
+			case s.ClosedReason <- msg.reason:
+			default:
+			}
+		default:
+			select {
+			case s.Events <- msg.ev:
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// connectionLost moves the since of the filters forward to the newest event
+// received, so that a resubscribe does not fetch everything again. Live
+// subscriptions continue from the time the connection was lost, backdated
+// ones from their reach before it.
+func (s *Subscription) connectionLost() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.disconnect != nil {
+		close(s.disconnect)
+		s.disconnect = nil
+	}
+
+	if s.live || s.reach > 0 {
+		since := time.Now().Add(-s.reach)
+		filters := make(nostr.Filters, len(s.filters))
+		for i, f := range s.filters {
+			f.Since = &since
+			f.Limit = 0
+			filters[i] = f
+		}
+		s.filters = filters
+		return
+	}
+
+	if s.latest.IsZero() {
+		return
+	}
+
+	resume := s.latest.Add(-resubscribeMargin)
+	filters := make(nostr.Filters, len(s.filters))
+	for i, f := range s.filters {
+		if f.Since != nil && f.Since.Before(resume) {
+			since := resume
+			f.Since = &since
+		}
+		filters[i] = f
+	}
+	s.filters = filters
+}
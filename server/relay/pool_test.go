@@ -0,0 +1,236 @@
+package relay
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestPool() *Pool {
+	return NewPool(NewHealth(types.HealthConfig{BaseDelay: "10ms", MaxDelay: "50ms"}), types.AuthConfig{})
+}
+
+func newTestEvent(t *testing.T, sk string, createdAt time.Time) *nostr.Event {
+	pub, _ := nostr.GetPublicKey(sk)
+	ev := &nostr.Event{
+		PubKey:    pub,
+		CreatedAt: createdAt,
+		Kind:      1,
+		Content:   "hello " + createdAt.String(),
+	}
+	assert.NoError(t, ev.Sign(sk))
+	return ev
+}
+
+func receive(t *testing.T, sub *Subscription) *nostr.Event {
+	t.Helper()
+	select {
+	case ev := <-sub.Events:
+		return ev
+	case <-time.After(3 * time.Second):
+		t.Fatal("timeout waiting for event")
+		return nil
+	}
+}
+
+func TestPoolSharesConnection(t *testing.T) {
+	mock := NewMockRelay()
+	defer mock.Close()
+	pool := newTestPool()
+
+	a := pool.Acquire(mock.URL)
+	b := pool.Acquire(mock.URL)
+	assert.Same(t, a, b)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub1 := a.Subscribe(ctx, nostr.Filters{{Kinds: []int{1}}})
+	sub2 := b.Subscribe(ctx, nostr.Filters{{Kinds: []int{1}}})
+	assert.NoError(t, a.WaitConnected(ctx))
+
+	sk := nostr.GeneratePrivateKey()
+	ev := newTestEvent(t, sk, time.Now().Add(-time.Second))
+	ok, msg, err := a.Publish(ctx, *ev)
+	assert.NoError(t, err)
+	assert.True(t, ok, msg)
+
+	assert.Equal(t, ev.ID, receive(t, sub2).ID)
+	assert.Equal(t, ev.ID, receive(t, sub1).ID)
+	assert.Equal(t, 1, mock.Connections())
+
+	pool.Release(mock.URL)
+	assert.Equal(t, StateConnected, pool.State(mock.URL))
+	pool.Release(mock.URL)
+	assert.Equal(t, StateClosed, pool.State(mock.URL))
+	assert.Eventually(t, func() bool { return mock.Connections() == 0 }, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestPoolResubscribesAfterReconnect(t *testing.T) {
+	mock := NewMockRelay()
+	defer mock.Close()
+	pool := newTestPool()
+
+	r := pool.Acquire(mock.URL)
+	defer pool.Release(mock.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	since := time.Now().Add(-time.Hour)
+	sub := r.Subscribe(ctx, nostr.Filters{{Kinds: []int{1}, Since: &since}})
+
+	sk := nostr.GeneratePrivateKey()
+	first := newTestEvent(t, sk, time.Now().Add(-time.Minute))
+	mock.AddEvent(first)
+	assert.Equal(t, first.ID, receive(t, sub).ID)
+
+	mock.DropConnections()
+	assert.Eventually(t, func() bool {
+		return r.State() == StateConnected && mock.Connections() == 1
+	}, 3*time.Second, 10*time.Millisecond)
+
+	// the resubscription starts shortly before the newest event received
+	assert.True(t, sub.Filters()[0].Since.After(since))
+	assert.Equal(t, first.ID, receive(t, sub).ID)
+
+	second := newTestEvent(t, sk, time.Now())
+	mock.AddEvent(second)
+	assert.Equal(t, second.ID, receive(t, sub).ID)
+}
+
+func TestPoolSlowConsumer(t *testing.T) {
+	mock := NewMockRelay()
+	defer mock.Close()
+	pool := newTestPool()
+
+	r := pool.Acquire(mock.URL)
+	defer pool.Release(mock.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	slow := r.Subscribe(ctx, nostr.Filters{{Kinds: []int{1}}})
+	fast := r.Subscribe(ctx, nostr.Filters{{Kinds: []int{1}}})
+	assert.NoError(t, r.WaitConnected(ctx))
+
+	// nobody reads the slow subscription, which must neither hold up the
+	// other one nor the OK messages of the connection
+	sk := nostr.GeneratePrivateKey()
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		ev := newTestEvent(t, sk, now.Add(-time.Duration(i)*time.Second))
+		ok, msg, err := r.Publish(ctx, *ev)
+		assert.NoError(t, err)
+		assert.True(t, ok, msg)
+		assert.Equal(t, ev.ID, receive(t, fast).ID)
+	}
+
+	// the queued events are still delivered in order, and Events is closed
+	// once the subscription is closed
+	first := receive(t, slow)
+	assert.Equal(t, "hello "+now.String(), first.Content)
+	slow.Close()
+	assert.Eventually(t, func() bool {
+		for {
+			select {
+			case _, ok := <-slow.Events:
+				if !ok {
+					return true
+				}
+			default:
+				return false
+			}
+		}
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+// a consumer falling too far behind stops the connection from reading, its
+// queue does not grow past the limit
+func TestPoolBackpressure(t *testing.T) {
+	defer func(size int) { subscriptionQueueSize = size }(subscriptionQueueSize)
+	subscriptionQueueSize = 3
+
+	mock := NewMockRelay()
+	defer mock.Close()
+	pool := newTestPool()
+
+	r := pool.Acquire(mock.URL)
+	defer pool.Release(mock.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	slow := r.Subscribe(ctx, nostr.Filters{{Kinds: []int{1}}})
+	fast := r.Subscribe(ctx, nostr.Filters{{Kinds: []int{1}}})
+	assert.NoError(t, r.WaitConnected(ctx))
+
+	// the events must not be taken for stored ones, which come before EOSE
+	for _, sub := range []*Subscription{slow, fast} {
+		select {
+		case <-sub.EndOfStoredEvents:
+		case <-time.After(3 * time.Second):
+			t.Fatal("timeout waiting for EOSE")
+		}
+	}
+
+	sk := nostr.GeneratePrivateKey()
+	now := time.Now()
+	var events []*nostr.Event
+	for i := 0; i < 6; i++ {
+		events = append(events, newTestEvent(t, sk, now.Add(-time.Duration(i)*time.Second)))
+	}
+
+	// the slow subscription queues up to the limit, besides the event
+	// waiting to be received
+	for _, ev := range events[:4] {
+		mock.AddEvent(ev)
+		assert.Equal(t, ev.ID, receive(t, fast).ID)
+	}
+
+	// then the connection waits for it, at the latest at the next event
+	mock.AddEvent(events[4])
+	mock.AddEvent(events[5])
+	var received []string
+	timeout := time.After(200 * time.Millisecond)
+	for waiting := true; waiting; {
+		select {
+		case ev := <-fast.Events:
+			received = append(received, ev.ID)
+		case <-timeout:
+			waiting = false
+		}
+	}
+	assert.NotContains(t, received, events[5].ID)
+	slow.mu.Lock()
+	assert.Len(t, slow.queue, 3)
+	slow.mu.Unlock()
+
+	// and reads on once it has caught up
+	for _, ev := range events {
+		assert.Equal(t, ev.ID, receive(t, slow).ID)
+	}
+	for len(received) < 2 {
+		received = append(received, receive(t, fast).ID)
+	}
+	assert.Equal(t, []string{events[4].ID, events[5].ID}, received)
+}
+
+func TestQuerySync(t *testing.T) {
+	mock := NewMockRelay()
+	defer mock.Close()
+	pool := newTestPool()
+
+	sk := nostr.GeneratePrivateKey()
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		mock.AddEvent(newTestEvent(t, sk, now.Add(-time.Duration(i)*time.Minute)))
+	}
+
+	r := pool.Acquire(mock.URL)
+	defer pool.Release(mock.URL)
+
+	events, err := r.QuerySync(context.Background(), nostr.Filter{Kinds: []int{1}, Limit: 3})
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+}
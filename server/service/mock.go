@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/dyng/nosdaily/types"
+	"github.com/nbd-wtf/go-nostr"
 	"github.com/stretchr/testify/mock"
 )
 
@@ -12,6 +13,11 @@ type MockService struct {
 	mock.Mock
 }
 
+func (m *MockService) GetRecommendationsTrends(start time.Time, end time.Time, limit int) ([]nostr.Event, error) {
+	args := m.Called(start, end, limit)
+	return args.Get(0).([]nostr.Event), args.Error(1)
+}
+
 func (m *MockService) GetFeed(subscriberPub string, start time.Time, end time.Time, limit int) []types.FeedEntry {
 	args := m.Called(subscriberPub, start, end, limit)
 	return args.Get(0).([]types.FeedEntry)
@@ -27,6 +33,21 @@ func (m *MockService) GetSubscriber(pubkey string) *types.Subscriber {
 	return args.Get(0).(*types.Subscriber)
 }
 
+func (m *MockService) GetEngagement(ids []string) (map[string]types.Engagement, error) {
+	args := m.Called(ids)
+	return args.Get(0).(map[string]types.Engagement), args.Error(1)
+}
+
+func (m *MockService) GetDelivered(subscriberPub, channelPub string, since time.Time) ([]string, error) {
+	args := m.Called(subscriberPub, channelPub, since)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *MockService) MarkDelivered(subscriberPub, channelPub string, ids []string, deliveredAt time.Time) error {
+	args := m.Called(subscriberPub, channelPub, ids, deliveredAt)
+	return args.Error(0)
+}
+
 func (m *MockService) CreateSubscriber(pubkey, channelSK string, subscribedAt time.Time) error {
 	args := m.Called(pubkey, channelSK, subscribedAt)
 	return args.Error(0)
@@ -41,3 +62,23 @@ func (m *MockService) RestoreSubscriber(pubkey string, subscribedAt time.Time) (
 	args := m.Called(pubkey, subscribedAt)
 	return args.Bool(0), args.Error(1)
 }
+
+func (m *MockService) UpdatePreferences(pubkey string, prefs types.Preferences) error {
+	args := m.Called(pubkey, prefs)
+	return args.Error(0)
+}
+
+func (m *MockService) MarkPushed(pubkey string, pushedAt time.Time) error {
+	args := m.Called(pubkey, pushedAt)
+	return args.Error(0)
+}
+
+func (m *MockService) RotateChannelSecret(pubkey, channelSK string, rotatedAt time.Time) (string, error) {
+	args := m.Called(pubkey, channelSK, rotatedAt)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockService) OpenChannelSecret(pubkey, stored string) (string, error) {
+	args := m.Called(pubkey, stored)
+	return args.String(0), args.Error(1)
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+const (
+	FormatQuote  = "quote"
+	FormatRepost = "repost"
+	FormatDigest = "digest"
+
+	MaxPushSize = 20
+)
+
+// DefaultPreferences apply to subscribers who did not set their own.
+var DefaultPreferences = types.Preferences{
+	IntervalHours: 1,
+	Size:          4,
+	Format:        FormatQuote,
+	Timezone:      "UTC",
+}
+
+var ErrInvalidPreferences = errors.New("invalid preferences")
+
+// ValidatePreferences checks that preferences can be honored. Pushes are
+// scheduled every hour, so the interval must divide a day into whole hours,
+// or be a week.
+func ValidatePreferences(prefs types.Preferences) error {
+	switch prefs.IntervalHours {
+	case 1, 2, 3, 4, 6, 8, 12, 24, 168:
+	default:
+		return fmt.Errorf("%w: interval must be one of 1, 2, 3, 4, 6, 8, 12, 24 or 168 hours", ErrInvalidPreferences)
+	}
+	if prefs.Size < 1 || prefs.Size > MaxPushSize {
+		return fmt.Errorf("%w: size must be between 1 and %d", ErrInvalidPreferences, MaxPushSize)
+	}
+	if prefs.Format != FormatQuote && prefs.Format != FormatRepost && prefs.Format != FormatDigest {
+		return fmt.Errorf("%w: format must be %s, %s or %s", ErrInvalidPreferences, FormatQuote, FormatRepost, FormatDigest)
+	}
+	if prefs.QuietFrom < 0 || prefs.QuietFrom > 23 || prefs.QuietTo < 0 || prefs.QuietTo > 23 {
+		return fmt.Errorf("%w: quiet hours must be between 0 and 23", ErrInvalidPreferences)
+	}
+	if _, err := time.LoadLocation(prefs.Timezone); err != nil || prefs.Timezone == "" {
+		return fmt.Errorf("%w: unknown timezone %q", ErrInvalidPreferences, prefs.Timezone)
+	}
+	return nil
+}
+
+// preferencesFromProps reads the preferences stored on a subscriber node,
+// the defaults fill in what is not stored.
+func preferencesFromProps(props map[string]any) types.Preferences {
+	prefs := DefaultPreferences
+	if v, ok := props["pref_interval_hours"].(int64); ok {
+		prefs.IntervalHours = int(v)
+	}
+	if v, ok := props["pref_size"].(int64); ok {
+		prefs.Size = int(v)
+	}
+	if v, ok := props["pref_format"].(string); ok {
+		prefs.Format = v
+	}
+	if v, ok := props["pref_quiet_from"].(int64); ok {
+		prefs.QuietFrom = int(v)
+	}
+	if v, ok := props["pref_quiet_to"].(int64); ok {
+		prefs.QuietTo = int(v)
+	}
+	if v, ok := props["pref_timezone"].(string); ok {
+		prefs.Timezone = v
+	}
+	return prefs
+}
+
+// UpdatePreferences stores the delivery preferences of a subscriber.
+func (s *Service) UpdatePreferences(pubkey string, prefs types.Preferences) error {
+	logger.Debug("Update preferences", "pubkey", pubkey, "preferences", prefs)
+	if err := ValidatePreferences(prefs); err != nil {
+		return err
+	}
+
+	_, err := s.neo4j.ExecuteWrite(func(tx neo4j.ManagedTransaction) (any, error) {
+		ctx := context.Background()
+
+		query := `
+			MATCH (s:Subscriber {pubkey: $Pubkey})
+			SET
+				s.pref_interval_hours = $IntervalHours,
+				s.pref_size = $Size,
+				s.pref_format = $Format,
+				s.pref_quiet_from = $QuietFrom,
+				s.pref_quiet_to = $QuietTo,
+				s.pref_timezone = $Timezone
+			RETURN count(s);
+		`
+		result, err := tx.Run(ctx, query,
+			map[string]any{
+				"Pubkey":        pubkey,
+				"IntervalHours": prefs.IntervalHours,
+				"Size":          prefs.Size,
+				"Format":        prefs.Format,
+				"QuietFrom":     prefs.QuietFrom,
+				"QuietTo":       prefs.QuietTo,
+				"Timezone":      prefs.Timezone,
+			})
+		if err != nil {
+			return nil, err
+		}
+		record, err := result.Single(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if count, _ := record.Values[0].(int64); count == 0 {
+			return nil, ErrSubscriberNotFound
+		}
+		return nil, nil
+	})
+	return err
+}
+
+// MarkPushed records when the feed was last pushed to a subscriber.
+func (s *Service) MarkPushed(pubkey string, pushedAt time.Time) error {
+	_, err := s.neo4j.ExecuteWrite(func(tx neo4j.ManagedTransaction) (any, error) {
+		query := `
+			MATCH (s:Subscriber {pubkey: $Pubkey})
+			SET s.last_pushed_at = $PushedAt;
+		`
+		_, err := tx.Run(context.Background(), query,
+			map[string]any{
+				"Pubkey":   pubkey,
+				"PushedAt": pushedAt.Unix(),
+			})
+		return nil, err
+	})
+	return err
+}
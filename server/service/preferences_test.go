@@ -0,0 +1,54 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePreferences(t *testing.T) {
+	assert.NoError(t, ValidatePreferences(DefaultPreferences))
+
+	prefs := DefaultPreferences
+	prefs.IntervalHours, prefs.Format, prefs.QuietFrom, prefs.QuietTo, prefs.Timezone = 6, FormatRepost, 22, 7, "Europe/Berlin"
+	assert.NoError(t, ValidatePreferences(prefs))
+	prefs.IntervalHours, prefs.Format = 168, FormatDigest
+	assert.NoError(t, ValidatePreferences(prefs))
+
+	invalid := DefaultPreferences
+	invalid.IntervalHours = 5
+	assert.True(t, errors.Is(ValidatePreferences(invalid), ErrInvalidPreferences))
+
+	invalid = DefaultPreferences
+	invalid.Size = MaxPushSize + 1
+	assert.True(t, errors.Is(ValidatePreferences(invalid), ErrInvalidPreferences))
+
+	invalid = DefaultPreferences
+	invalid.Format = "thread"
+	assert.True(t, errors.Is(ValidatePreferences(invalid), ErrInvalidPreferences))
+
+	invalid = DefaultPreferences
+	invalid.QuietTo = 24
+	assert.True(t, errors.Is(ValidatePreferences(invalid), ErrInvalidPreferences))
+
+	invalid = DefaultPreferences
+	invalid.Timezone = "Mars/Olympus"
+	assert.True(t, errors.Is(ValidatePreferences(invalid), ErrInvalidPreferences))
+}
+
+func TestPreferencesFromProps(t *testing.T) {
+	assert.Equal(t, DefaultPreferences, preferencesFromProps(map[string]any{}))
+
+	prefs := preferencesFromProps(map[string]any{
+		"pref_interval_hours": int64(24),
+		"pref_format":         FormatRepost,
+		"pref_quiet_from":     int64(23),
+		"pref_quiet_to":       int64(6),
+	})
+	assert.Equal(t, 24, prefs.IntervalHours)
+	assert.Equal(t, DefaultPreferences.Size, prefs.Size)
+	assert.Equal(t, FormatRepost, prefs.Format)
+	assert.Equal(t, 23, prefs.QuietFrom)
+	assert.Equal(t, 6, prefs.QuietTo)
+}
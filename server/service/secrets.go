@@ -0,0 +1,133 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dyng/nosdaily/types"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// sealedPrefix marks a secret encrypted at rest, it is followed by the id of
+// the master key and the base64 of the nonce and the ciphertext.
+const sealedPrefix = "sealed:v1:"
+
+var ErrNoMasterKey = errors.New("secret is encrypted but no master key is configured")
+
+// secretBox encrypts secrets with XChaCha20-Poly1305 under the master key.
+// Secrets encrypted under an old master key or not at all can still be
+// opened, so that they can be re-encrypted under the current key.
+type secretBox struct {
+	current string
+	keys    map[string][]byte
+}
+
+func newSecretBox(config types.SecretsConfig) (*secretBox, error) {
+	b := &secretBox{keys: make(map[string][]byte)}
+	for _, key := range config.OldKeys {
+		if _, err := b.addKey(key); err != nil {
+			return nil, err
+		}
+	}
+	if config.MasterKey != "" {
+		id, err := b.addKey(config.MasterKey)
+		if err != nil {
+			return nil, err
+		}
+		b.current = id
+	}
+	return b, nil
+}
+
+// addKey adds a hex encoded 32 byte key and returns its id.
+func (b *secretBox) addKey(encoded string) (string, error) {
+	key, err := hex.DecodeString(encoded)
+	if err != nil || len(key) != chacha20poly1305.KeySize {
+		return "", fmt.Errorf("master key must be %d bytes in hex", chacha20poly1305.KeySize)
+	}
+	sum := sha256.Sum256(key)
+	id := hex.EncodeToString(sum[:4])
+	b.keys[id] = key
+	return id, nil
+}
+
+// Enabled tells whether secrets are encrypted, i.e. a master key is set.
+func (b *secretBox) Enabled() bool {
+	return b.current != ""
+}
+
+// Seal encrypts a secret under the current master key, bound to owner so
+// that it cannot be swapped with the secret of somebody else. Without a
+// master key the secret is returned as is.
+func (b *secretBox) Seal(owner, secret string) (string, error) {
+	if !b.Enabled() {
+		return secret, nil
+	}
+
+	aead, err := chacha20poly1305.NewX(b.keys[b.current])
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(secret)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(secret), []byte(owner))
+	return sealedPrefix + b.current + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a secret of owner, secrets stored in plain text are
+// returned as is.
+func (b *secretBox) Open(owner, stored string) (string, error) {
+	if !strings.HasPrefix(stored, sealedPrefix) {
+		return stored, nil
+	}
+
+	id, encoded, ok := strings.Cut(strings.TrimPrefix(stored, sealedPrefix), ":")
+	if !ok {
+		return "", errors.New("malformed sealed secret")
+	}
+	key, ok := b.keys[id]
+	if !ok {
+		if !b.Enabled() {
+			return "", ErrNoMasterKey
+		}
+		return "", fmt.Errorf("secret is encrypted with unknown master key %s", id)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed sealed secret")
+	}
+	secret, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(owner))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret: %w", err)
+	}
+	return string(secret), nil
+}
+
+// Sealed tells whether a stored secret is encrypted.
+func (b *secretBox) Sealed(stored string) bool {
+	return strings.HasPrefix(stored, sealedPrefix)
+}
+
+// Stale tells whether a stored secret is not encrypted under the current
+// master key and needs to be sealed again.
+func (b *secretBox) Stale(stored string) bool {
+	if !b.Enabled() {
+		return false
+	}
+	return !strings.HasPrefix(stored, sealedPrefix+b.current+":")
+}
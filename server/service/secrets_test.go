@@ -0,0 +1,81 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dyng/nosdaily/types"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	oldMasterKey = "0000000000000000000000000000000000000000000000000000000000000001"
+	newMasterKey = "0000000000000000000000000000000000000000000000000000000000000002"
+)
+
+func TestSecretBox(t *testing.T) {
+	box, err := newSecretBox(types.SecretsConfig{MasterKey: oldMasterKey})
+	assert.NoError(t, err)
+
+	sealed, err := box.Seal("alice", "channel-secret")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(sealed, sealedPrefix))
+	assert.True(t, box.Sealed(sealed))
+	assert.NotContains(t, sealed, "channel-secret")
+	assert.False(t, box.Stale(sealed))
+
+	secret, err := box.Open("alice", sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "channel-secret", secret)
+
+	// a secret is bound to its owner
+	_, err = box.Open("bob", sealed)
+	assert.Error(t, err)
+
+	// secrets stored before encryption was enabled are read as they are
+	secret, err = box.Open("alice", "plain")
+	assert.NoError(t, err)
+	assert.Equal(t, "plain", secret)
+	assert.True(t, box.Stale("plain"))
+	assert.False(t, box.Sealed("plain"))
+}
+
+func TestSecretBoxRotation(t *testing.T) {
+	old, err := newSecretBox(types.SecretsConfig{MasterKey: oldMasterKey})
+	assert.NoError(t, err)
+	sealed, err := old.Seal("alice", "channel-secret")
+	assert.NoError(t, err)
+
+	box, err := newSecretBox(types.SecretsConfig{MasterKey: newMasterKey, OldKeys: []string{oldMasterKey}})
+	assert.NoError(t, err)
+	assert.True(t, box.Stale(sealed))
+	secret, err := box.Open("alice", sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "channel-secret", secret)
+
+	resealed, err := box.Seal("alice", secret)
+	assert.NoError(t, err)
+	assert.False(t, box.Stale(resealed))
+
+	// once the old key is dropped, only secrets sealed again can be opened
+	box, err = newSecretBox(types.SecretsConfig{MasterKey: newMasterKey})
+	assert.NoError(t, err)
+	_, err = box.Open("alice", sealed)
+	assert.Error(t, err)
+	secret, err = box.Open("alice", resealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "channel-secret", secret)
+
+	// without any key sealed secrets cannot be opened
+	box, err = newSecretBox(types.SecretsConfig{})
+	assert.NoError(t, err)
+	_, err = box.Open("alice", resealed)
+	assert.ErrorIs(t, err, ErrNoMasterKey)
+}
+
+func TestSecretBoxInvalidKey(t *testing.T) {
+	_, err := newSecretBox(types.SecretsConfig{MasterKey: "not-hex"})
+	assert.Error(t, err)
+	_, err = newSecretBox(types.SecretsConfig{MasterKey: "00ff"})
+	assert.Error(t, err)
+}
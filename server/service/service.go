@@ -2,7 +2,9 @@ package service
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path"
@@ -21,28 +23,47 @@ import (
 
 var logger = log.New("module", "service")
 
+var ErrSubscriberNotFound = errors.New("subscriber not found")
+
 type Service struct {
 	config    *types.Config
 	neo4j     *database.Neo4jDb
 	engine    *algo.Engine
 	scheduler *gocron.Scheduler
+	secrets   *secretBox
 }
 
 type IService interface {
 	GetRecommendationsTrends(start time.Time, end time.Time, limit int) ([]nostr.Event, error)
 	GetFeed(subscriberPub string, start time.Time, end time.Time, limit int) []types.FeedEntry
+	GetEngagement(ids []string) (map[string]types.Engagement, error)
+	GetDelivered(subscriberPub, channelPub string, since time.Time) ([]string, error)
+	MarkDelivered(subscriberPub, channelPub string, ids []string, deliveredAt time.Time) error
 	ListSubscribers(ctx context.Context, limit, skip int) ([]types.Subscriber, error)
 	GetSubscriber(pubkey string) *types.Subscriber
 	CreateSubscriber(pubkey, channelSK string, subscribedAt time.Time) error
 	DeleteSubscriber(pubkey string, unsubscribedAt time.Time) error
 	RestoreSubscriber(pubkey string, subscribedAt time.Time) (bool, error)
+	UpdatePreferences(pubkey string, prefs types.Preferences) error
+	MarkPushed(pubkey string, pushedAt time.Time) error
+	RotateChannelSecret(pubkey, channelSK string, rotatedAt time.Time) (string, error)
+	OpenChannelSecret(pubkey, stored string) (string, error)
 }
 
 func NewService(config *types.Config, neo4j *database.Neo4jDb) *Service {
+	secrets, err := newSecretBox(config.Secrets)
+	if err != nil {
+		log.Crit("Invalid secrets configuration", "err", err)
+	}
+	if !secrets.Enabled() {
+		logger.Warn("No master key configured, channel secrets are stored in plain text")
+	}
+
 	return &Service{
 		config:    config,
 		neo4j:     neo4j,
 		scheduler: gocron.NewScheduler(time.UTC),
+		secrets:   secrets,
 	}
 }
 
@@ -55,9 +76,26 @@ func (s *Service) Init() error {
 		if _, err := tx.Run(ctx, "CREATE CONSTRAINT user_pk_uniq IF NOT EXISTS FOR (u:User) REQUIRE u.pubkey IS UNIQUE;", nil); err != nil {
 			return nil, err
 		}
+		if _, err := tx.Run(ctx, "CREATE CONSTRAINT relay_url_uniq IF NOT EXISTS FOR (r:Relay) REQUIRE r.url IS UNIQUE;", nil); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Run(ctx, "CREATE INDEX post_created_at IF NOT EXISTS FOR (p:Post) ON (p.created_at);", nil); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Run(ctx, "CREATE CONSTRAINT channel_pk_uniq IF NOT EXISTS FOR (c:Channel) REQUIRE c.pubkey IS UNIQUE;", nil); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Run(ctx, "CREATE INDEX channel_subscriber IF NOT EXISTS FOR (c:Channel) ON (c.subscriber);", nil); err != nil {
+			return nil, err
+		}
 		return nil, nil
 	})
 
+	// encrypt channel secrets stored in plain text or under an old key
+	if err := s.sealSecrets(); err != nil {
+		logger.Error("Failed to encrypt channel secrets", "err", err)
+	}
+
 	// init algo engine
 	s.engine = algo.NewEngine(s.neo4j.GetDriver())
 
@@ -103,9 +141,131 @@ func (s *Service) GetFeed(subscriberPub string, start time.Time, end time.Time,
 			Raw:       raw,
 		})
 	}
+
+	if len(feed) > 0 {
+		ids := make([]string, len(feed))
+		for i, entry := range feed {
+			ids[i] = entry.Id
+		}
+		seenOn, err := s.GetSeenOn(ids)
+		if err != nil {
+			log.Error("Failed to read relays the feed was seen on", "err", err)
+		}
+		for i := range feed {
+			feed[i].SeenOn = seenOn[feed[i].Id]
+		}
+	}
 	return feed
 }
 
+// GetEngagement counts the replies, likes, reposts and zaps of the posts of
+// ids.
+func (s *Service) GetEngagement(ids []string) (map[string]types.Engagement, error) {
+	engagement, err := s.neo4j.ExecuteRead(func(tx neo4j.ManagedTransaction) (any, error) {
+		ctx := context.Background()
+
+		query := `
+			MATCH (:Post)-[r:REPLY|LIKE|REPOST|ZAP]->(p:Post)
+			WHERE p.id IN $Ids
+			RETURN p.id, type(r), count(r), sum(coalesce(r.amount, 0));
+		`
+		result, err := tx.Run(ctx, query,
+			map[string]any{
+				"Ids": ids,
+			})
+		if err != nil {
+			return nil, err
+		}
+
+		engagement := make(map[string]types.Engagement)
+		for result.Next(ctx) {
+			values := result.Record().Values
+			id, _ := values[0].(string)
+			count, _ := values[2].(int64)
+			e := engagement[id]
+			switch values[1] {
+			case "REPLY":
+				e.Replies = int(count)
+			case "LIKE":
+				e.Likes = int(count)
+			case "REPOST":
+				e.Reposts = int(count)
+			case "ZAP":
+				e.Zaps = int(count)
+				e.ZapSats, _ = values[3].(int64)
+			}
+			engagement[id] = e
+		}
+		return engagement, result.Err()
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return engagement.(map[string]types.Engagement), nil
+}
+
+// GetDelivered returns the ids of the events delivered since the given time
+// to a channel, or to any channel of the subscriber.
+func (s *Service) GetDelivered(subscriberPub, channelPub string, since time.Time) ([]string, error) {
+	ids, err := s.neo4j.ExecuteRead(func(tx neo4j.ManagedTransaction) (any, error) {
+		ctx := context.Background()
+
+		query := `
+			MATCH (c:Channel)-[d:DELIVERED]->(p:Post)
+			WHERE (c.pubkey = $Channel OR ($Subscriber <> '' AND c.subscriber = $Subscriber))
+				AND d.delivered_at >= $Since
+			RETURN DISTINCT p.id;
+		`
+		result, err := tx.Run(ctx, query,
+			map[string]any{
+				"Subscriber": subscriberPub,
+				"Channel":    channelPub,
+				"Since":      since.Unix(),
+			})
+		if err != nil {
+			return nil, err
+		}
+
+		ids := []string{}
+		for result.Next(ctx) {
+			if id, ok := result.Record().Values[0].(string); ok {
+				ids = append(ids, id)
+			}
+		}
+		return ids, result.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids.([]string), nil
+}
+
+// MarkDelivered records that the events of ids were delivered to the channel
+// of a subscriber, the subscriber is empty for the main channel.
+func (s *Service) MarkDelivered(subscriberPub, channelPub string, ids []string, deliveredAt time.Time) error {
+	_, err := s.neo4j.ExecuteWrite(func(tx neo4j.ManagedTransaction) (any, error) {
+		query := `
+			MERGE (c:Channel {pubkey: $Channel})
+			SET c.subscriber = $Subscriber
+			WITH c
+			UNWIND $Ids AS id
+			MATCH (p:Post {id: id})
+			MERGE (c)-[d:DELIVERED]->(p)
+			SET d.delivered_at = $DeliveredAt;
+		`
+		_, err := tx.Run(context.Background(), query,
+			map[string]any{
+				"Subscriber":  subscriberPub,
+				"Channel":     channelPub,
+				"Ids":         ids,
+				"DeliveredAt": deliveredAt.Unix(),
+			})
+		return nil, err
+	})
+	return err
+}
+
 func (s *Service) StoreEvent(event *nostr.Event) error {
 	switch event.Kind {
 	case 1:
@@ -118,6 +278,8 @@ func (s *Service) StoreEvent(event *nostr.Event) error {
 		return s.StoreContact(event)
 	case 9735:
 		return s.StoreZap(event)
+	case 10002:
+		return s.StoreRelayList(event)
 	default:
 		logger.Warn("Unsupported event kind", "kind", event.Kind)
 		return nil
@@ -278,6 +440,70 @@ func (s *Service) StoreZap(event *nostr.Event) error {
 	return err
 }
 
+// StoreRelayList saves a NIP-65 relay list as USES relations between the user
+// and the relays, replacing the previous list unless it is newer.
+func (s *Service) StoreRelayList(event *nostr.Event) error {
+	_, err := s.neo4j.ExecuteWrite(func(tx neo4j.ManagedTransaction) (any, error) {
+		ctx := context.Background()
+
+		result, err := tx.Run(ctx, "merge (u:User {pubkey: $Pubkey}) return u.relay_list_at;",
+			map[string]any{
+				"Pubkey": event.PubKey,
+			})
+		if err != nil {
+			return nil, err
+		}
+		record, err := result.Single(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if updatedAt, ok := record.Values[0].(int64); ok && updatedAt >= event.CreatedAt.Unix() {
+			return nil, nil
+		}
+
+		// delete old relay relations
+		if _, err := tx.Run(ctx, "match (u:User {pubkey: $Pubkey})-[r:USES]->(:Relay) delete r;",
+			map[string]any{
+				"Pubkey": event.PubKey,
+			}); err != nil {
+			return nil, err
+		}
+
+		// create new relay relations, a relay without marker is used for both
+		for _, rTag := range event.Tags.GetAll([]string{"r"}) {
+			url := nostr.NormalizeURL(rTag.Value())
+			if url == "" {
+				continue
+			}
+			marker := ""
+			if len(rTag) > 2 {
+				marker = rTag[2]
+			}
+			if _, err := tx.Run(ctx, "match (u:User {pubkey: $Pubkey}) merge (r:Relay {url: $Url}) merge (u)-[:USES {read: $Read, write: $Write}]->(r);",
+				map[string]any{
+					"Pubkey": event.PubKey,
+					"Url":    url,
+					"Read":   marker != "write",
+					"Write":  marker != "read",
+				}); err != nil {
+				return nil, err
+			}
+		}
+
+		if _, err := tx.Run(ctx, "match (u:User {pubkey: $Pubkey}) set u.relay_list_at = $CreatedAt;",
+			map[string]any{
+				"Pubkey":    event.PubKey,
+				"CreatedAt": event.CreatedAt.Unix(),
+			}); err != nil {
+			return nil, err
+		}
+
+		return nil, nil
+	})
+
+	return err
+}
+
 func (s *Service) saveUserAndPost(ctx context.Context, tx neo4j.ManagedTransaction, event *nostr.Event) error {
 	if _, err := tx.Run(ctx, "merge (u:User {pubkey: $Pubkey});",
 		map[string]any{
@@ -428,7 +654,12 @@ func (s *Service) objPath(id string) (file string, dir string) {
 
 func (s *Service) CreateSubscriber(pubkey, channelSK string, subscribedAt time.Time) error {
 	logger.Debug("Create subscriber", "pubkey", pubkey)
-	_, err := s.neo4j.ExecuteWrite(func(tx neo4j.ManagedTransaction) (any, error) {
+	sealed, err := s.secrets.Seal(pubkey, channelSK)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.neo4j.ExecuteWrite(func(tx neo4j.ManagedTransaction) (any, error) {
 		query := `
 			MERGE (s:Subscriber {pubkey: $Pubkey}) ON CREATE
 			SET
@@ -439,7 +670,7 @@ func (s *Service) CreateSubscriber(pubkey, channelSK string, subscribedAt time.T
 		_, err := tx.Run(context.Background(), query,
 			map[string]any{
 				"Pubkey":        pubkey,
-				"ChannelSecret": channelSK,
+				"ChannelSecret": sealed,
 				"SubscribedAt":  subscribedAt.Unix(),
 			})
 		return nil, err
@@ -479,8 +710,9 @@ func (s *Service) ListSubscribers(ctx context.Context, limit, skip int) ([]types
 			itemNode := rawItemNode.(neo4j.Node)
 			props := itemNode.Props
 
+			pubkey := props["pubkey"].(string)
 			subscriber := types.Subscriber{
-				Pubkey:        props["pubkey"].(string),
+				Pubkey:        pubkey,
 				ChannelSecret: props["channel_secret"].(string),
 				SubscribedAt: func() *time.Time {
 					t := time.Unix(props["subscribed_at"].(int64), 0)
@@ -494,6 +726,15 @@ func (s *Service) ListSubscribers(ctx context.Context, limit, skip int) ([]types
 
 					return nil
 				}(),
+				LastPushedAt: func() *time.Time {
+					if v, ok := props["last_pushed_at"].(int64); ok {
+						t := time.Unix(v, 0)
+						return &t
+					}
+
+					return nil
+				}(),
+				Preferences: preferencesFromProps(props),
 			}
 
 			subscribers = append(subscribers, subscriber)
@@ -538,7 +779,7 @@ func (s *Service) GetSubscriber(pubkey string) *types.Subscriber {
 		props := itemNode.Props
 
 		subscriber := types.Subscriber{
-			Pubkey:        props["pubkey"].(string),
+			Pubkey:        pubkey,
 			ChannelSecret: props["channel_secret"].(string),
 			SubscribedAt: func() *time.Time {
 				t := time.Unix(props["subscribed_at"].(int64), 0)
@@ -552,6 +793,15 @@ func (s *Service) GetSubscriber(pubkey string) *types.Subscriber {
 
 				return nil
 			}(),
+			LastPushedAt: func() *time.Time {
+				if v, ok := props["last_pushed_at"].(int64); ok {
+					t := time.Unix(v, 0)
+					return &t
+				}
+
+				return nil
+			}(),
+			Preferences: preferencesFromProps(props),
 		}
 
 		return subscriber, nil
@@ -569,6 +819,177 @@ func (s *Service) GetSubscriber(pubkey string) *types.Subscriber {
 	return nil
 }
 
+// RotateChannelSecret replaces the channel secret of a subscriber and
+// returns the one replaced, as stored. The public key of the replaced
+// channel is kept in the retired channels of the subscriber, unless its
+// secret cannot be decrypted: rotating is the way to recover from that.
+func (s *Service) RotateChannelSecret(pubkey, channelSK string, rotatedAt time.Time) (string, error) {
+	logger.Debug("Rotate channel secret", "pubkey", pubkey)
+	sealed, err := s.secrets.Seal(pubkey, channelSK)
+	if err != nil {
+		return "", err
+	}
+
+	old, err := s.neo4j.ExecuteWrite(func(tx neo4j.ManagedTransaction) (any, error) {
+		ctx := context.Background()
+
+		result, err := tx.Run(ctx, "MATCH (s:Subscriber {pubkey: $Pubkey}) RETURN s.channel_secret;",
+			map[string]any{
+				"Pubkey": pubkey,
+			})
+		if err != nil {
+			return nil, err
+		}
+		if !result.Next(ctx) {
+			if err := result.Err(); err != nil {
+				return nil, err
+			}
+			return nil, ErrSubscriberNotFound
+		}
+		stored, _ := result.Record().Values[0].(string)
+
+		retired := []string{}
+		if old, err := s.secrets.Open(pubkey, stored); err != nil {
+			logger.Warn("Replacing channel secret that cannot be decrypted", "pubkey", pubkey, "err", err)
+		} else if pub, err := nostr.GetPublicKey(old); err == nil {
+			retired = append(retired, pub)
+		}
+
+		// the secret must not have changed since it was read
+		query := `
+			MATCH (s:Subscriber {pubkey: $Pubkey})
+			WHERE s.channel_secret = $Stored
+			SET
+				s.channel_secret = $ChannelSecret,
+				s.channel_rotated_at = $RotatedAt,
+				s.retired_channels = coalesce(s.retired_channels, []) + $Retired
+			RETURN count(s);
+		`
+		result, err = tx.Run(ctx, query,
+			map[string]any{
+				"Pubkey":        pubkey,
+				"Stored":        stored,
+				"ChannelSecret": sealed,
+				"RotatedAt":     rotatedAt.Unix(),
+				"Retired":       retired,
+			})
+		if err != nil {
+			return nil, err
+		}
+		record, err := result.Single(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if count, _ := record.Values[0].(int64); count != 1 {
+			return nil, fmt.Errorf("channel secret of %s changed while rotating it", pubkey)
+		}
+		return stored, nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+	return old.(string), nil
+}
+
+// OpenChannelSecret decrypts the channel secret of a subscriber as stored
+// in Subscriber.ChannelSecret. It is meant to be called right before
+// signing, so that the secret is not carried around in plain text.
+func (s *Service) OpenChannelSecret(pubkey, stored string) (string, error) {
+	return s.secrets.Open(pubkey, stored)
+}
+
+// sealSecrets encrypts the channel secrets stored in plain text or under an
+// old master key with the current master key. Without a master key it warns
+// about the secrets stored in plain text or that cannot be decrypted.
+func (s *Service) sealSecrets() error {
+	stored, err := s.neo4j.ExecuteRead(func(tx neo4j.ManagedTransaction) (any, error) {
+		ctx := context.Background()
+
+		result, err := tx.Run(ctx, "MATCH (s:Subscriber) RETURN s.pubkey, s.channel_secret;", nil)
+		if err != nil {
+			return nil, err
+		}
+
+		stored := make(map[string]string)
+		for result.Next(ctx) {
+			values := result.Record().Values
+			pubkey, _ := values[0].(string)
+			secret, _ := values[1].(string)
+			stored[pubkey] = secret
+		}
+		return stored, result.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	if !s.secrets.Enabled() {
+		plain, sealed := 0, 0
+		for _, secret := range stored.(map[string]string) {
+			switch {
+			case secret == "":
+			case s.secrets.Sealed(secret):
+				sealed++
+			default:
+				plain++
+			}
+		}
+		if plain > 0 {
+			logger.Warn("Channel secrets are stored in plain text, set secrets.masterKey to encrypt them", "count", plain)
+		}
+		if sealed > 0 {
+			logger.Error("Channel secrets are encrypted but no master key is configured", "count", sealed)
+		}
+		return nil
+	}
+
+	var rows []map[string]any
+	for pubkey, old := range stored.(map[string]string) {
+		if !s.secrets.Stale(old) {
+			continue
+		}
+		secret, err := s.secrets.Open(pubkey, old)
+		if err != nil {
+			logger.Error("Failed to decrypt channel secret", "pubkey", pubkey, "err", err)
+			continue
+		}
+		sealed, err := s.secrets.Seal(pubkey, secret)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, map[string]any{
+			"Pubkey": pubkey,
+			"Old":    old,
+			"New":    sealed,
+		})
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	_, err = s.neo4j.ExecuteWrite(func(tx neo4j.ManagedTransaction) (any, error) {
+		// a secret changed in the meantime is left alone
+		query := `
+			UNWIND $Rows AS row
+			MATCH (s:Subscriber {pubkey: row.Pubkey})
+			WHERE s.channel_secret = row.Old
+			SET s.channel_secret = row.New;
+		`
+		_, err := tx.Run(context.Background(), query,
+			map[string]any{
+				"Rows": rows,
+			})
+		return nil, err
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Encrypted channel secrets under the current master key", "count", len(rows))
+	return nil
+}
+
 func (s *Service) DeleteSubscriber(pubkey string, unsubscribedAt time.Time) error {
 	logger.Debug("Deleting subscriber", "pubkey", pubkey)
 	_, err := s.neo4j.ExecuteWrite(func(tx neo4j.ManagedTransaction) (any, error) {
@@ -620,3 +1041,309 @@ func (s *Service) RestoreSubscriber(pubkey string, subscribedAt time.Time) (bool
 	// if the restoring succeeded, return true
 	return true, err
 }
+
+// GetEventRefs returns the ids of the stored events of the given kinds and
+// authors, if any, that were created between since and until. Only events
+// stored as posts are known, i.e. contact and relay lists are never part of
+// the result.
+func (s *Service) GetEventRefs(kinds []int, authors []string, since, until time.Time) ([]types.EventRef, error) {
+	if authors == nil {
+		authors = []string{}
+	}
+
+	refs, err := s.neo4j.ExecuteRead(func(tx neo4j.ManagedTransaction) (any, error) {
+		ctx := context.Background()
+
+		query := `
+			MATCH (p:Post)
+			WHERE p.created_at >= $Since AND p.created_at <= $Until AND p.kind IN $Kinds
+				AND (size($Authors) = 0 OR p.author IN $Authors)
+			RETURN p.id, p.created_at;
+		`
+		result, err := tx.Run(ctx, query,
+			map[string]any{
+				"Kinds":   kinds,
+				"Authors": authors,
+				"Since":   since.Unix(),
+				"Until":   until.Unix(),
+			})
+		if err != nil {
+			return nil, err
+		}
+
+		var refs []types.EventRef
+		for result.Next(ctx) {
+			values := result.Record().Values
+			id, _ := values[0].(string)
+			createdAt, _ := values[1].(int64)
+			refs = append(refs, types.EventRef{
+				ID:        id,
+				CreatedAt: time.Unix(createdAt, 0),
+			})
+		}
+		return refs, result.Err()
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return refs.([]types.EventRef), nil
+}
+
+// SaveSeenOn records the relays events were seen on as SEEN_ON relations,
+// keeping the time an event was first seen on a relay. It returns the ids of
+// the events recorded, events not stored as posts (yet) are skipped.
+func (s *Service) SaveSeenOn(seen []types.EventSeenOn) ([]string, error) {
+	rows := make([]map[string]any, len(seen))
+	for i, e := range seen {
+		rows[i] = map[string]any{
+			"Id":     e.ID,
+			"Url":    e.URL,
+			"SeenAt": e.FirstSeenAt.Unix(),
+		}
+	}
+
+	ids, err := s.neo4j.ExecuteWrite(func(tx neo4j.ManagedTransaction) (any, error) {
+		ctx := context.Background()
+
+		query := `
+			UNWIND $Seen AS seen
+			MATCH (p:Post {id: seen.Id})
+			MERGE (r:Relay {url: seen.Url})
+			MERGE (p)-[o:SEEN_ON]->(r)
+			ON CREATE SET o.first_seen_at = seen.SeenAt
+			ON MATCH SET o.first_seen_at = CASE WHEN seen.SeenAt < o.first_seen_at THEN seen.SeenAt ELSE o.first_seen_at END
+			RETURN DISTINCT p.id;
+		`
+		result, err := tx.Run(ctx, query,
+			map[string]any{
+				"Seen": rows,
+			})
+		if err != nil {
+			return nil, err
+		}
+
+		var ids []string
+		for result.Next(ctx) {
+			id, _ := result.Record().Values[0].(string)
+			ids = append(ids, id)
+		}
+		return ids, result.Err()
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return ids.([]string), nil
+}
+
+// GetSeenOn returns the relays each of the events was seen on, the relay it
+// was first seen on first.
+func (s *Service) GetSeenOn(ids []string) (map[string][]types.SeenOn, error) {
+	seenOn, err := s.neo4j.ExecuteRead(func(tx neo4j.ManagedTransaction) (any, error) {
+		ctx := context.Background()
+
+		query := `
+			MATCH (p:Post)-[o:SEEN_ON]->(r:Relay)
+			WHERE p.id IN $Ids
+			RETURN p.id, r.url, o.first_seen_at
+			ORDER BY o.first_seen_at;
+		`
+		result, err := tx.Run(ctx, query,
+			map[string]any{
+				"Ids": ids,
+			})
+		if err != nil {
+			return nil, err
+		}
+
+		seenOn := make(map[string][]types.SeenOn)
+		for result.Next(ctx) {
+			values := result.Record().Values
+			id, _ := values[0].(string)
+			url, _ := values[1].(string)
+			seenAt, _ := values[2].(int64)
+			seenOn[id] = append(seenOn[id], types.SeenOn{
+				URL:         url,
+				FirstSeenAt: time.Unix(seenAt, 0),
+			})
+		}
+		return seenOn, result.Err()
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return seenOn.(map[string][]types.SeenOn), nil
+}
+
+// GetEvent returns a stored event along with the relays it was seen on, or
+// nil if the event is not stored.
+func (s *Service) GetEvent(id string) (*types.StoredEvent, error) {
+	// the id names a file, anything but a hex id is not stored
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 64 {
+		return nil, nil
+	}
+
+	raw, err := s.readObject(id)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seenOn, err := s.GetSeenOn([]string{id})
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.StoredEvent{
+		Event:  json.RawMessage(raw),
+		SeenOn: seenOn[id],
+	}, nil
+}
+
+// GetOutbox returns the follows of all active subscribers along with the
+// relays they write to according to their NIP-65 relay lists.
+func (s *Service) GetOutbox() (*types.Outbox, error) {
+	outbox, err := s.neo4j.ExecuteRead(func(tx neo4j.ManagedTransaction) (any, error) {
+		ctx := context.Background()
+
+		outbox := &types.Outbox{
+			Relays: make(map[string][]string),
+		}
+
+		query := `
+			MATCH (s:Subscriber)
+			WHERE s.unsubscribed_at IS NULL
+			RETURN s.pubkey;
+		`
+		result, err := tx.Run(ctx, query, nil)
+		if err != nil {
+			return nil, err
+		}
+		for result.Next(ctx) {
+			if pubkey, ok := result.Record().Values[0].(string); ok {
+				outbox.Subscribers = append(outbox.Subscribers, pubkey)
+			}
+		}
+		if err := result.Err(); err != nil {
+			return nil, err
+		}
+		if len(outbox.Subscribers) == 0 {
+			return outbox, nil
+		}
+
+		query = `
+			MATCH (u:User)-[:FOLLOW]->(f:User)
+			WHERE u.pubkey IN $Subscribers
+			OPTIONAL MATCH (f)-[w:USES {write: true}]->(r:Relay)
+			RETURN f.pubkey, collect(DISTINCT r.url);
+		`
+		result, err = tx.Run(ctx, query,
+			map[string]any{
+				"Subscribers": outbox.Subscribers,
+			})
+		if err != nil {
+			return nil, err
+		}
+		for result.Next(ctx) {
+			values := result.Record().Values
+			pubkey, _ := values[0].(string)
+			var relays []string
+			for _, url := range values[1].([]any) {
+				if url, ok := url.(string); ok {
+					relays = append(relays, url)
+				}
+			}
+			outbox.Relays[pubkey] = relays
+		}
+		return outbox, result.Err()
+	})
+
+	if err != nil {
+		return nil, err
+	}
+	return outbox.(*types.Outbox), nil
+}
+
+// GetRelayCheckpoint returns the newest created_at persisted for a relay,
+// or nil if the relay has never been checkpointed.
+func (s *Service) GetRelayCheckpoint(url string) (*time.Time, error) {
+	return s.getRelayTime(url, "checkpoint")
+}
+
+func (s *Service) SaveRelayCheckpoint(url string, checkpoint time.Time) error {
+	logger.Debug("Save relay checkpoint", "url", url, "checkpoint", checkpoint)
+	return s.setRelayTime(url, "checkpoint", checkpoint)
+}
+
+// GetBackfillCursor returns the end of the last window backfilled from a relay,
+// or nil if no backfill has been run against it.
+func (s *Service) GetBackfillCursor(url string) (*time.Time, error) {
+	return s.getRelayTime(url, "backfill_cursor")
+}
+
+func (s *Service) SaveBackfillCursor(url string, cursor time.Time) error {
+	logger.Debug("Save backfill cursor", "url", url, "cursor", cursor)
+	return s.setRelayTime(url, "backfill_cursor", cursor)
+}
+
+func (s *Service) getRelayTime(url, property string) (*time.Time, error) {
+	value, err := s.neo4j.ExecuteRead(func(tx neo4j.ManagedTransaction) (any, error) {
+		ctx := context.Background()
+
+		query := `
+			MATCH (r:Relay {url: $Url})
+			RETURN r[$Property];
+		`
+		result, err := tx.Run(ctx, query,
+			map[string]any{
+				"Url":      url,
+				"Property": property,
+			})
+		if err != nil {
+			return nil, err
+		}
+
+		if !result.Next(ctx) {
+			return nil, result.Err()
+		}
+
+		if v, ok := result.Record().Values[0].(int64); ok {
+			t := time.Unix(v, 0)
+			return &t, nil
+		}
+
+		return nil, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if t, ok := value.(*time.Time); ok {
+		return t, nil
+	}
+
+	return nil, nil
+}
+
+func (s *Service) setRelayTime(url, property string, value time.Time) error {
+	_, err := s.neo4j.ExecuteWrite(func(tx neo4j.ManagedTransaction) (any, error) {
+		query := `
+			MERGE (r:Relay {url: $Url})
+			SET r += $Props;
+		`
+		_, err := tx.Run(context.Background(), query,
+			map[string]any{
+				"Url": url,
+				"Props": map[string]any{
+					property: value.Unix(),
+				},
+			})
+		return nil, err
+	})
+	return err
+}
@@ -1,10 +1,73 @@
 package types
 
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// BotConfig configures the bot account. An event is published successfully
+// once PublishQuorum of Relays accepted it. An event delivered to a channel
+// is not delivered to it again for Redeliver.
 type BotConfig struct {
-	SK       string
-	Relays   []string
-	ListenTo []string
-	Metadata MetadataConfig
+	SK            string
+	Bunker        BunkerConfig
+	Relays        []string
+	ListenTo      []string
+	PublishQuorum int    `default:"1"`
+	Redeliver     string `default:"7d"`
+	Publish       PublishConfig
+	Metadata      MetadataConfig
+	Digest        DigestConfig
+}
+
+// DigestConfig controls the digests summing up the top Size posts of a
+// Period in one event, an article of kind 30023 or a note of kind 1.
+// Subscribers choose digests in their preferences, the main channel
+// publishes one on Schedule, a cron expression, if Main is set.
+type DigestConfig struct {
+	Kind     int `default:"30023"`
+	Main     bool
+	Schedule string `default:"0 8 * * *"`
+	Period   string `default:"1d"`
+	Size     int    `default:"10"`
+}
+
+// BunkerConfig has a NIP-46 remote signer, a bunker, hold the key of the
+// main bot instead of SK. URI is the bunker://... connection string, SK the
+// session key we identify to the bunker with, random if empty.
+type BunkerConfig struct {
+	URI string
+	SK  string
+}
+
+// PublishConfig controls the outbox of published events. Relays that did not
+// accept an event are retried from BaseDelay up to MaxDelay apart until the
+// event is older than Expiry. Dir defaults to a directory below the objects
+// root.
+type PublishConfig struct {
+	Dir       string
+	Expiry    string `default:"1d"`
+	BaseDelay string `default:"30s"`
+	MaxDelay  string `default:"30m"`
+	RateLimit RateLimitConfig
+}
+
+// RateLimitConfig limits how fast events are published to each relay, i.e.
+// PerMinute events on average in bursts of up to Burst. Zero means no limit.
+// A relay answering "rate-limited:" is not published to for Pause. Relays
+// overrides the limits of single relays.
+type RateLimitConfig struct {
+	PerMinute int    `default:"30"`
+	Burst     int    `default:"10"`
+	Pause     string `default:"1m"`
+	Relays    []RelayRateLimit
+}
+
+type RelayRateLimit struct {
+	URL       string
+	PerMinute int
+	Burst     int
 }
 
 type MetadataConfig struct {
@@ -18,9 +81,93 @@ type MetadataConfig struct {
 }
 
 type CrawlerConfig struct {
+	Relays             []string
+	Since              string `default:"-1h"`
+	Limit              int    `default:"0"`
+	CheckpointInterval string `default:"1m"`
+	ResumeOffset       string `default:"-5m"`
+	Negentropy         bool   `default:"true"`
+	Backfill           BackfillConfig
+	Discovery          DiscoveryConfig
+	Outbox             OutboxConfig
+	Ingest             IngestConfig
+	Profiles           []CrawlProfile
+}
+
+// CrawlProfile describes what to fetch from which relays. A profile without
+// relays applies to every crawled relay, Since is an offset like Since of
+// CrawlerConfig and defaults to it.
+type CrawlProfile struct {
+	Name     string
+	Relays   []string
+	Kinds    []int
+	Authors  []string
+	Hashtags []string
+	Limit    int
+	Since    string
+}
+
+type BackfillConfig struct {
+	Window   string `default:"1h"`
+	PageSize int    `default:"500"`
+	Throttle string `default:"2s"`
+}
+
+// IngestConfig controls the queue between relay readers and storage.
+// Overflow is one of "backpressure", "drop" or "spill".
+type IngestConfig struct {
+	Workers        int    `default:"4"`
+	QueueSize      int    `default:"10000"`
+	Overflow       string `default:"backpressure"`
+	SpillDir       string
+	ReportInterval string `default:"1m"`
+}
+
+type DiscoveryConfig struct {
+	Enabled   bool
+	MaxRelays int    `default:"10"`
+	Interval  string `default:"30m"`
+	MinUnique int    `default:"10"`
+	Allow     []string
+	Deny      []string
+}
+
+// OutboxConfig controls the crawling of the follows of subscribers on the
+// relays they write to according to their NIP-65 relay lists. MaxRelays
+// limits the relays connected to for this purpose only, every author is
+// fetched from at most RelaysPerAuthor relays and at most MaxAuthors
+// authors are put into one filter.
+type OutboxConfig struct {
+	Enabled         bool
+	Kinds           []int
+	Since           string `default:"-1d"`
+	MaxRelays       int    `default:"20"`
+	RelaysPerAuthor int    `default:"2"`
+	MaxAuthors      int    `default:"500"`
+	Interval        string `default:"1h"`
+	Debounce        string `default:"1m"`
+}
+
+type RelayConfig struct {
+	Health HealthConfig
+	Auth   AuthConfig
+}
+
+// AuthConfig opts relays into NIP-42 authentication. SK is the key to
+// authenticate with and defaults to the bot key, so it must be set when a
+// bunker holds the bot key. Relays lists the relays to authenticate to, or
+// "*" for all of them.
+type AuthConfig struct {
+	SK     string
 	Relays []string
-	Since  string `default:"-1h"`
-	Limit  int    `default:"0"`
+}
+
+type HealthConfig struct {
+	BaseDelay        string `default:"1s"`
+	MaxDelay         string `default:"5m"`
+	FailureThreshold int    `default:"10"`
+	ProbeInterval    string `default:"1h"`
+	StableAfter      string `default:"1m"`
 }
 
 type Neo4jConfig struct {
@@ -36,6 +183,22 @@ type LogConfig struct {
 	MaxAge  int    `default:"30"`
 }
 
+// SecretsConfig holds the master key the secret keys of the channels are
+// encrypted with at rest, 32 bytes in hex. It is best set from the
+// environment as SECRETS_MASTERKEY. To rotate it, move the current key to
+// OldKeys and set a new MasterKey; secrets are encrypted under the new key on
+// startup, after which the old key can be dropped. Without a master key the
+// secrets are stored in plain text.
+type SecretsConfig struct {
+	MasterKey string
+	OldKeys   []string
+}
+
+type AdminConfig struct {
+	Token    string
+	Endpoint string `default:"http://localhost:8080"`
+}
+
 type ObjectsConfig struct {
 	Root string `default:"/var/data/nossence"`
 }
@@ -44,6 +207,37 @@ type Config struct {
 	Log     LogConfig
 	Neo4j   Neo4jConfig
 	Crawler CrawlerConfig
+	Relay   RelayConfig
 	Objects ObjectsConfig
 	Bot     BotConfig
+	Secrets SecretsConfig
+	Admin   AdminConfig
+}
+
+// ParseTimeOffset parses an offset of a number and a unit, one of s, m, h
+// or d, e.g. "-1h" or "7d".
+func ParseTimeOffset(offset string) (time.Duration, error) {
+	if len(offset) < 2 {
+		return 0, fmt.Errorf("invalid time offset %q", offset)
+	}
+
+	// split offset into number and unit
+	num, unit := offset[:len(offset)-1], offset[len(offset)-1:]
+	n, err := strconv.Atoi(num)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time offset %q: %w", offset, err)
+	}
+
+	switch unit {
+	case "s":
+		return time.Duration(n) * time.Second, nil
+	case "m":
+		return time.Duration(n) * time.Minute, nil
+	case "h":
+		return time.Duration(n) * time.Hour, nil
+	case "d":
+		return time.Duration(n) * time.Hour * 24, nil
+	default:
+		return 0, fmt.Errorf("invalid time offset %q: unknown unit %q", offset, unit)
+	}
 }
@@ -0,0 +1,34 @@
+package types
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTimeOffset(t *testing.T) {
+	tests := []struct {
+		offset string
+		want   time.Duration
+		err    bool
+	}{
+		{"30s", 30 * time.Second, false},
+		{"-1h", -time.Hour, false},
+		{"7d", 7 * 24 * time.Hour, false},
+		{"", 0, true},
+		{"d", 0, true},
+		{"1w", 0, true},
+		{"1.5h", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseTimeOffset(tt.offset)
+		if tt.err {
+			assert.Error(t, err, tt.offset)
+		} else {
+			assert.NoError(t, err, tt.offset)
+		}
+		assert.Equal(t, tt.want, got, tt.offset)
+	}
+}
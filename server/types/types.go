@@ -1,12 +1,41 @@
 package types
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
+// Subscriber is a subscriber as stored. ChannelSecret is encrypted if a
+// master key is configured, it is only decrypted to sign for the channel.
 type Subscriber struct {
 	Pubkey         string
 	ChannelSecret  string
 	SubscribedAt   *time.Time
 	UnsubscribedAt *time.Time
+	LastPushedAt   *time.Time
+	Preferences    Preferences
+}
+
+// Preferences is how a subscriber wants the feed delivered: Size items every
+// IntervalHours hours, as quotes, reposts or one digest according to Format,
+// and nothing from QuietFrom to QuietTo o'clock in Timezone. There are no
+// quiet hours if QuietFrom equals QuietTo.
+type Preferences struct {
+	IntervalHours int    `json:"interval_hours"`
+	Size          int    `json:"size"`
+	Format        string `json:"format"`
+	QuietFrom     int    `json:"quiet_from"`
+	QuietTo       int    `json:"quiet_to"`
+	Timezone      string `json:"timezone"`
+}
+
+// Engagement counts the reactions to a post known to us.
+type Engagement struct {
+	Replies int   `json:"replies"`
+	Likes   int   `json:"likes"`
+	Reposts int   `json:"reposts"`
+	Zaps    int   `json:"zaps"`
+	ZapSats int64 `json:"zap_sats"`
 }
 
 type FeedEntry struct {
@@ -16,9 +45,43 @@ type FeedEntry struct {
 	CreatedAt time.Time `json:"created_at"`
 	Score     float64   `json:"score"`
 	Raw       string    `json:"raw"`
+	SeenOn    []SeenOn  `json:"seen_on,omitempty"`
+}
+
+// SeenOn is a relay an event was received from, with the time it was first
+// received from it.
+type SeenOn struct {
+	URL         string    `json:"url"`
+	FirstSeenAt time.Time `json:"first_seen_at"`
+}
+
+// EventSeenOn records that an event was seen on a relay.
+type EventSeenOn struct {
+	ID string
+	SeenOn
+}
+
+// StoredEvent is an event along with the relays it was seen on.
+type StoredEvent struct {
+	Event  json.RawMessage `json:"event"`
+	SeenOn []SeenOn        `json:"seen_on"`
 }
 
 type RelayInfo struct {
 	URL     string `json:"url"`
 	Purpose string `json:"purpose"`
 }
+
+// EventRef identifies a stored event, e.g. to reconcile it with a relay.
+type EventRef struct {
+	ID        string
+	CreatedAt time.Time
+}
+
+// Outbox lists the active subscribers and, for every account they follow,
+// the relays that account writes to. Follows without a relay list have no
+// relays.
+type Outbox struct {
+	Subscribers []string
+	Relays      map[string][]string
+}